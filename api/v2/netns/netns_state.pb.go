@@ -0,0 +1,277 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.2
+// 	protoc        v5.28.1
+// source: api/netns/netns_state.proto
+
+package netns
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// NetnsEnrollmentState is the netns enrollment of the pods of a node,
+// it is persisted to recover the enrollment on controller restart.
+type NetnsEnrollmentState struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// schema_version is bumped on every incompatible change of the schema
+	SchemaVersion   uint32                `protobuf:"varint,1,opt,name=schema_version,json=schemaVersion,proto3" json:"schema_version,omitempty"`
+	SavedAtUnixNano int64                 `protobuf:"varint,2,opt,name=saved_at_unix_nano,json=savedAtUnixNano,proto3" json:"saved_at_unix_nano,omitempty"`
+	Pods            []*PodNetnsEnrollment `protobuf:"bytes,3,rep,name=pods,proto3" json:"pods,omitempty"`
+	// bpf_map_ids are the ids of the bpf maps of the enrolled tc programs,
+	// they are reopened by id after restart
+	BpfMapIds []uint32 `protobuf:"varint,4,rep,packed,name=bpf_map_ids,json=bpfMapIds,proto3" json:"bpf_map_ids,omitempty"`
+}
+
+func (x *NetnsEnrollmentState) Reset() {
+	*x = NetnsEnrollmentState{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_netns_netns_state_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *NetnsEnrollmentState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NetnsEnrollmentState) ProtoMessage() {}
+
+func (x *NetnsEnrollmentState) ProtoReflect() protoreflect.Message {
+	mi := &file_api_netns_netns_state_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NetnsEnrollmentState.ProtoReflect.Descriptor instead.
+func (*NetnsEnrollmentState) Descriptor() ([]byte, []int) {
+	return file_api_netns_netns_state_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *NetnsEnrollmentState) GetSchemaVersion() uint32 {
+	if x != nil {
+		return x.SchemaVersion
+	}
+	return 0
+}
+
+func (x *NetnsEnrollmentState) GetSavedAtUnixNano() int64 {
+	if x != nil {
+		return x.SavedAtUnixNano
+	}
+	return 0
+}
+
+func (x *NetnsEnrollmentState) GetPods() []*PodNetnsEnrollment {
+	if x != nil {
+		return x.Pods
+	}
+	return nil
+}
+
+func (x *NetnsEnrollmentState) GetBpfMapIds() []uint32 {
+	if x != nil {
+		return x.BpfMapIds
+	}
+	return nil
+}
+
+type PodNetnsEnrollment struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Uid       string `protobuf:"bytes,1,opt,name=uid,proto3" json:"uid,omitempty"`
+	NetnsPath string `protobuf:"bytes,2,opt,name=netns_path,json=netnsPath,proto3" json:"netns_path,omitempty"`
+	// inode is 0 if the netns could not be resolved on enrollment
+	Inode              uint64 `protobuf:"varint,3,opt,name=inode,proto3" json:"inode,omitempty"`
+	EnrolledAtUnixNano int64  `protobuf:"varint,4,opt,name=enrolled_at_unix_nano,json=enrolledAtUnixNano,proto3" json:"enrolled_at_unix_nano,omitempty"`
+}
+
+func (x *PodNetnsEnrollment) Reset() {
+	*x = PodNetnsEnrollment{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_netns_netns_state_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PodNetnsEnrollment) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PodNetnsEnrollment) ProtoMessage() {}
+
+func (x *PodNetnsEnrollment) ProtoReflect() protoreflect.Message {
+	mi := &file_api_netns_netns_state_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PodNetnsEnrollment.ProtoReflect.Descriptor instead.
+func (*PodNetnsEnrollment) Descriptor() ([]byte, []int) {
+	return file_api_netns_netns_state_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *PodNetnsEnrollment) GetUid() string {
+	if x != nil {
+		return x.Uid
+	}
+	return ""
+}
+
+func (x *PodNetnsEnrollment) GetNetnsPath() string {
+	if x != nil {
+		return x.NetnsPath
+	}
+	return ""
+}
+
+func (x *PodNetnsEnrollment) GetInode() uint64 {
+	if x != nil {
+		return x.Inode
+	}
+	return 0
+}
+
+func (x *PodNetnsEnrollment) GetEnrolledAtUnixNano() int64 {
+	if x != nil {
+		return x.EnrolledAtUnixNano
+	}
+	return 0
+}
+
+var File_api_netns_netns_state_proto protoreflect.FileDescriptor
+
+var file_api_netns_netns_state_proto_rawDesc = []byte{
+	0x0a, 0x1b, 0x61, 0x70, 0x69, 0x2f, 0x6e, 0x65, 0x74, 0x6e, 0x73, 0x2f, 0x6e, 0x65, 0x74, 0x6e,
+	0x73, 0x5f, 0x73, 0x74, 0x61, 0x74, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x05, 0x6e,
+	0x65, 0x74, 0x6e, 0x73, 0x22, 0xb9, 0x01, 0x0a, 0x14, 0x4e, 0x65, 0x74, 0x6e, 0x73, 0x45, 0x6e,
+	0x72, 0x6f, 0x6c, 0x6c, 0x6d, 0x65, 0x6e, 0x74, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x25, 0x0a,
+	0x0e, 0x73, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0d, 0x73, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x56, 0x65, 0x72,
+	0x73, 0x69, 0x6f, 0x6e, 0x12, 0x2b, 0x0a, 0x12, 0x73, 0x61, 0x76, 0x65, 0x64, 0x5f, 0x61, 0x74,
+	0x5f, 0x75, 0x6e, 0x69, 0x78, 0x5f, 0x6e, 0x61, 0x6e, 0x6f, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x0f, 0x73, 0x61, 0x76, 0x65, 0x64, 0x41, 0x74, 0x55, 0x6e, 0x69, 0x78, 0x4e, 0x61, 0x6e,
+	0x6f, 0x12, 0x2d, 0x0a, 0x04, 0x70, 0x6f, 0x64, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32,
+	0x19, 0x2e, 0x6e, 0x65, 0x74, 0x6e, 0x73, 0x2e, 0x50, 0x6f, 0x64, 0x4e, 0x65, 0x74, 0x6e, 0x73,
+	0x45, 0x6e, 0x72, 0x6f, 0x6c, 0x6c, 0x6d, 0x65, 0x6e, 0x74, 0x52, 0x04, 0x70, 0x6f, 0x64, 0x73,
+	0x12, 0x1e, 0x0a, 0x0b, 0x62, 0x70, 0x66, 0x5f, 0x6d, 0x61, 0x70, 0x5f, 0x69, 0x64, 0x73, 0x18,
+	0x04, 0x20, 0x03, 0x28, 0x0d, 0x52, 0x09, 0x62, 0x70, 0x66, 0x4d, 0x61, 0x70, 0x49, 0x64, 0x73,
+	0x22, 0x8e, 0x01, 0x0a, 0x12, 0x50, 0x6f, 0x64, 0x4e, 0x65, 0x74, 0x6e, 0x73, 0x45, 0x6e, 0x72,
+	0x6f, 0x6c, 0x6c, 0x6d, 0x65, 0x6e, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x75, 0x69, 0x64, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x75, 0x69, 0x64, 0x12, 0x1d, 0x0a, 0x0a, 0x6e, 0x65, 0x74,
+	0x6e, 0x73, 0x5f, 0x70, 0x61, 0x74, 0x68, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x6e,
+	0x65, 0x74, 0x6e, 0x73, 0x50, 0x61, 0x74, 0x68, 0x12, 0x14, 0x0a, 0x05, 0x69, 0x6e, 0x6f, 0x64,
+	0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05, 0x69, 0x6e, 0x6f, 0x64, 0x65, 0x12, 0x31,
+	0x0a, 0x15, 0x65, 0x6e, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x64, 0x5f, 0x61, 0x74, 0x5f, 0x75, 0x6e,
+	0x69, 0x78, 0x5f, 0x6e, 0x61, 0x6e, 0x6f, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x12, 0x65,
+	0x6e, 0x72, 0x6f, 0x6c, 0x6c, 0x65, 0x64, 0x41, 0x74, 0x55, 0x6e, 0x69, 0x78, 0x4e, 0x61, 0x6e,
+	0x6f, 0x42, 0x21, 0x5a, 0x1f, 0x6b, 0x6d, 0x65, 0x73, 0x68, 0x2e, 0x6e, 0x65, 0x74, 0x2f, 0x6b,
+	0x6d, 0x65, 0x73, 0x68, 0x2f, 0x61, 0x70, 0x69, 0x2f, 0x6e, 0x65, 0x74, 0x6e, 0x73, 0x3b, 0x6e,
+	0x65, 0x74, 0x6e, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_api_netns_netns_state_proto_rawDescOnce sync.Once
+	file_api_netns_netns_state_proto_rawDescData = file_api_netns_netns_state_proto_rawDesc
+)
+
+func file_api_netns_netns_state_proto_rawDescGZIP() []byte {
+	file_api_netns_netns_state_proto_rawDescOnce.Do(func() {
+		file_api_netns_netns_state_proto_rawDescData = protoimpl.X.CompressGZIP(file_api_netns_netns_state_proto_rawDescData)
+	})
+	return file_api_netns_netns_state_proto_rawDescData
+}
+
+var file_api_netns_netns_state_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_api_netns_netns_state_proto_goTypes = []any{
+	(*NetnsEnrollmentState)(nil), // 0: netns.NetnsEnrollmentState
+	(*PodNetnsEnrollment)(nil),   // 1: netns.PodNetnsEnrollment
+}
+var file_api_netns_netns_state_proto_depIdxs = []int32{
+	1, // 0: netns.NetnsEnrollmentState.pods:type_name -> netns.PodNetnsEnrollment
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_api_netns_netns_state_proto_init() }
+func file_api_netns_netns_state_proto_init() {
+	if File_api_netns_netns_state_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_api_netns_netns_state_proto_msgTypes[0].Exporter = func(v any, i int) any {
+			switch v := v.(*NetnsEnrollmentState); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_api_netns_netns_state_proto_msgTypes[1].Exporter = func(v any, i int) any {
+			switch v := v.(*PodNetnsEnrollment); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_api_netns_netns_state_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_api_netns_netns_state_proto_goTypes,
+		DependencyIndexes: file_api_netns_netns_state_proto_depIdxs,
+		MessageInfos:      file_api_netns_netns_state_proto_msgTypes,
+	}.Build()
+	File_api_netns_netns_state_proto = out.File
+	file_api_netns_netns_state_proto_rawDesc = nil
+	file_api_netns_netns_state_proto_goTypes = nil
+	file_api_netns_netns_state_proto_depIdxs = nil
+}
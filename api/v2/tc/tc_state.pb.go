@@ -0,0 +1,328 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.2
+// 	protoc        v5.28.1
+// source: api/tc/tc_state.proto
+
+package tc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type TCDirection int32
+
+const (
+	TCDirection_INGRESS TCDirection = 0
+	TCDirection_EGRESS  TCDirection = 1
+)
+
+// Enum value maps for TCDirection.
+var (
+	TCDirection_name = map[int32]string{
+		0: "INGRESS",
+		1: "EGRESS",
+	}
+	TCDirection_value = map[string]int32{
+		"INGRESS": 0,
+		"EGRESS":  1,
+	}
+)
+
+func (x TCDirection) Enum() *TCDirection {
+	p := new(TCDirection)
+	*p = x
+	return p
+}
+
+func (x TCDirection) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (TCDirection) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_tc_tc_state_proto_enumTypes[0].Descriptor()
+}
+
+func (TCDirection) Type() protoreflect.EnumType {
+	return &file_api_tc_tc_state_proto_enumTypes[0]
+}
+
+func (x TCDirection) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use TCDirection.Descriptor instead.
+func (TCDirection) EnumDescriptor() ([]byte, []int) {
+	return file_api_tc_tc_state_proto_rawDescGZIP(), []int{0}
+}
+
+// TCAttachment is a bpf program attached to a clsact hook of a link,
+// it carries everything needed to attach the program again.
+type TCAttachment struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	LinkName    string      `protobuf:"bytes,1,opt,name=link_name,json=linkName,proto3" json:"link_name,omitempty"`
+	LinkIndex   int32       `protobuf:"varint,2,opt,name=link_index,json=linkIndex,proto3" json:"link_index,omitempty"`
+	Direction   TCDirection `protobuf:"varint,3,opt,name=direction,proto3,enum=tc.TCDirection" json:"direction,omitempty"`
+	ProgramName string      `protobuf:"bytes,4,opt,name=program_name,json=programName,proto3" json:"program_name,omitempty"`
+	// program_id is the kernel id of the attached program,
+	// unlike the fd it is valid across processes
+	ProgramId uint32 `protobuf:"varint,5,opt,name=program_id,json=programId,proto3" json:"program_id,omitempty"`
+	Handle    uint32 `protobuf:"varint,6,opt,name=handle,proto3" json:"handle,omitempty"`
+	Priority  uint32 `protobuf:"varint,7,opt,name=priority,proto3" json:"priority,omitempty"`
+	Paused    bool   `protobuf:"varint,8,opt,name=paused,proto3" json:"paused,omitempty"`
+}
+
+func (x *TCAttachment) Reset() {
+	*x = TCAttachment{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_tc_tc_state_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *TCAttachment) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TCAttachment) ProtoMessage() {}
+
+func (x *TCAttachment) ProtoReflect() protoreflect.Message {
+	mi := &file_api_tc_tc_state_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TCAttachment.ProtoReflect.Descriptor instead.
+func (*TCAttachment) Descriptor() ([]byte, []int) {
+	return file_api_tc_tc_state_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *TCAttachment) GetLinkName() string {
+	if x != nil {
+		return x.LinkName
+	}
+	return ""
+}
+
+func (x *TCAttachment) GetLinkIndex() int32 {
+	if x != nil {
+		return x.LinkIndex
+	}
+	return 0
+}
+
+func (x *TCAttachment) GetDirection() TCDirection {
+	if x != nil {
+		return x.Direction
+	}
+	return TCDirection_INGRESS
+}
+
+func (x *TCAttachment) GetProgramName() string {
+	if x != nil {
+		return x.ProgramName
+	}
+	return ""
+}
+
+func (x *TCAttachment) GetProgramId() uint32 {
+	if x != nil {
+		return x.ProgramId
+	}
+	return 0
+}
+
+func (x *TCAttachment) GetHandle() uint32 {
+	if x != nil {
+		return x.Handle
+	}
+	return 0
+}
+
+func (x *TCAttachment) GetPriority() uint32 {
+	if x != nil {
+		return x.Priority
+	}
+	return 0
+}
+
+func (x *TCAttachment) GetPaused() bool {
+	if x != nil {
+		return x.Paused
+	}
+	return false
+}
+
+type GetStateRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *GetStateRequest) Reset() {
+	*x = GetStateRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_tc_tc_state_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *GetStateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStateRequest) ProtoMessage() {}
+
+func (x *GetStateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_tc_tc_state_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStateRequest.ProtoReflect.Descriptor instead.
+func (*GetStateRequest) Descriptor() ([]byte, []int) {
+	return file_api_tc_tc_state_proto_rawDescGZIP(), []int{1}
+}
+
+var File_api_tc_tc_state_proto protoreflect.FileDescriptor
+
+var file_api_tc_tc_state_proto_rawDesc = []byte{
+	0x0a, 0x15, 0x61, 0x70, 0x69, 0x2f, 0x74, 0x63, 0x2f, 0x74, 0x63, 0x5f, 0x73, 0x74, 0x61, 0x74,
+	0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x02, 0x74, 0x63, 0x22, 0x87, 0x02, 0x0a, 0x0c,
+	0x54, 0x43, 0x41, 0x74, 0x74, 0x61, 0x63, 0x68, 0x6d, 0x65, 0x6e, 0x74, 0x12, 0x1b, 0x0a, 0x09,
+	0x6c, 0x69, 0x6e, 0x6b, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x08, 0x6c, 0x69, 0x6e, 0x6b, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1d, 0x0a, 0x0a, 0x6c, 0x69, 0x6e,
+	0x6b, 0x5f, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x09, 0x6c,
+	0x69, 0x6e, 0x6b, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x2d, 0x0a, 0x09, 0x64, 0x69, 0x72, 0x65,
+	0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x0f, 0x2e, 0x74, 0x63,
+	0x2e, 0x54, 0x43, 0x44, 0x69, 0x72, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x09, 0x64, 0x69,
+	0x72, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x21, 0x0a, 0x0c, 0x70, 0x72, 0x6f, 0x67, 0x72,
+	0x61, 0x6d, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x70,
+	0x72, 0x6f, 0x67, 0x72, 0x61, 0x6d, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x1d, 0x0a, 0x0a, 0x70, 0x72,
+	0x6f, 0x67, 0x72, 0x61, 0x6d, 0x5f, 0x69, 0x64, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x09,
+	0x70, 0x72, 0x6f, 0x67, 0x72, 0x61, 0x6d, 0x49, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x68, 0x61, 0x6e,
+	0x64, 0x6c, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x68, 0x61, 0x6e, 0x64, 0x6c,
+	0x65, 0x12, 0x1a, 0x0a, 0x08, 0x70, 0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x18, 0x07, 0x20,
+	0x01, 0x28, 0x0d, 0x52, 0x08, 0x70, 0x72, 0x69, 0x6f, 0x72, 0x69, 0x74, 0x79, 0x12, 0x16, 0x0a,
+	0x06, 0x70, 0x61, 0x75, 0x73, 0x65, 0x64, 0x18, 0x08, 0x20, 0x01, 0x28, 0x08, 0x52, 0x06, 0x70,
+	0x61, 0x75, 0x73, 0x65, 0x64, 0x22, 0x11, 0x0a, 0x0f, 0x47, 0x65, 0x74, 0x53, 0x74, 0x61, 0x74,
+	0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x2a, 0x26, 0x0a, 0x0b, 0x54, 0x43, 0x44, 0x69,
+	0x72, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x0b, 0x0a, 0x07, 0x49, 0x4e, 0x47, 0x52, 0x45,
+	0x53, 0x53, 0x10, 0x00, 0x12, 0x0a, 0x0a, 0x06, 0x45, 0x47, 0x52, 0x45, 0x53, 0x53, 0x10, 0x01,
+	0x32, 0x42, 0x0a, 0x0b, 0x54, 0x43, 0x53, 0x74, 0x61, 0x74, 0x65, 0x53, 0x79, 0x6e, 0x63, 0x12,
+	0x33, 0x0a, 0x08, 0x47, 0x65, 0x74, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x13, 0x2e, 0x74, 0x63,
+	0x2e, 0x47, 0x65, 0x74, 0x53, 0x74, 0x61, 0x74, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x1a, 0x10, 0x2e, 0x74, 0x63, 0x2e, 0x54, 0x43, 0x41, 0x74, 0x74, 0x61, 0x63, 0x68, 0x6d, 0x65,
+	0x6e, 0x74, 0x30, 0x01, 0x42, 0x1b, 0x5a, 0x19, 0x6b, 0x6d, 0x65, 0x73, 0x68, 0x2e, 0x6e, 0x65,
+	0x74, 0x2f, 0x6b, 0x6d, 0x65, 0x73, 0x68, 0x2f, 0x61, 0x70, 0x69, 0x2f, 0x74, 0x63, 0x3b, 0x74,
+	0x63, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_api_tc_tc_state_proto_rawDescOnce sync.Once
+	file_api_tc_tc_state_proto_rawDescData = file_api_tc_tc_state_proto_rawDesc
+)
+
+func file_api_tc_tc_state_proto_rawDescGZIP() []byte {
+	file_api_tc_tc_state_proto_rawDescOnce.Do(func() {
+		file_api_tc_tc_state_proto_rawDescData = protoimpl.X.CompressGZIP(file_api_tc_tc_state_proto_rawDescData)
+	})
+	return file_api_tc_tc_state_proto_rawDescData
+}
+
+var file_api_tc_tc_state_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_api_tc_tc_state_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_api_tc_tc_state_proto_goTypes = []any{
+	(TCDirection)(0),        // 0: tc.TCDirection
+	(*TCAttachment)(nil),    // 1: tc.TCAttachment
+	(*GetStateRequest)(nil), // 2: tc.GetStateRequest
+}
+var file_api_tc_tc_state_proto_depIdxs = []int32{
+	0, // 0: tc.TCAttachment.direction:type_name -> tc.TCDirection
+	2, // 1: tc.TCStateSync.GetState:input_type -> tc.GetStateRequest
+	1, // 2: tc.TCStateSync.GetState:output_type -> tc.TCAttachment
+	2, // [2:3] is the sub-list for method output_type
+	1, // [1:2] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_api_tc_tc_state_proto_init() }
+func file_api_tc_tc_state_proto_init() {
+	if File_api_tc_tc_state_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_api_tc_tc_state_proto_msgTypes[0].Exporter = func(v any, i int) any {
+			switch v := v.(*TCAttachment); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_api_tc_tc_state_proto_msgTypes[1].Exporter = func(v any, i int) any {
+			switch v := v.(*GetStateRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_api_tc_tc_state_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_api_tc_tc_state_proto_goTypes,
+		DependencyIndexes: file_api_tc_tc_state_proto_depIdxs,
+		EnumInfos:         file_api_tc_tc_state_proto_enumTypes,
+		MessageInfos:      file_api_tc_tc_state_proto_msgTypes,
+	}.Build()
+	File_api_tc_tc_state_proto = out.File
+	file_api_tc_tc_state_proto_rawDesc = nil
+	file_api_tc_tc_state_proto_goTypes = nil
+	file_api_tc_tc_state_proto_depIdxs = nil
+}
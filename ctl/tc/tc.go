@@ -0,0 +1,192 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tc
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vishvananda/netlink"
+
+	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/logger"
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+var log = logger.NewLoggerScope("kmeshctl/tc")
+
+func NewCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tc",
+		Short: "Manage the tc filters of the interfaces on the node kmeshctl runs on",
+		Example: `# Preview the changes to attach a loaded program to the ingress of eth0:
+kmeshctl tc apply eth0 --program tc_ingress --dry-run`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+
+	applyCmd := &cobra.Command{
+		Use:   "apply <interface>",
+		Short: "Make the tc filters of an interface direction match the given policy",
+		Example: `# Attach a loaded program and drop the packets to port 8080 on the egress of eth0:
+kmeshctl tc apply eth0 --direction egress --program tc_egress --drop-port 8080
+
+# Print the planned changes without applying them:
+kmeshctl tc apply eth0 --program tc_ingress --rate-limit 1048576 --dry-run`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runApply(cmd, args[0]); err != nil {
+				log.Errorf("%v", err)
+				os.Exit(1)
+			}
+		},
+	}
+	applyCmd.Flags().String("direction", "ingress", "Direction of the policy, ingress or egress")
+	applyCmd.Flags().String("program", "", "Name of the loaded bpf program to attach, empty means no program")
+	applyCmd.Flags().Uint64("rate-limit", 0, "Rate limit in bytes per second, 0 means no limit")
+	applyCmd.Flags().UintSlice("drop-port", nil, "Tcp and udp destination ports whose packets are dropped")
+	applyCmd.Flags().Bool("dry-run", false, "Print the planned changes without applying them")
+
+	inspectCmd := &cobra.Command{
+		Use:   "inspect <interface>",
+		Short: "List the bpf programs attached by the tc filters of an interface",
+		Example: `# List the programs attached to the ingress and the egress of eth0:
+kmeshctl tc inspect eth0
+
+# List the programs attached to the egress of eth0 only:
+kmeshctl tc inspect eth0 --direction egress`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runInspect(cmd, args[0]); err != nil {
+				log.Errorf("%v", err)
+				os.Exit(1)
+			}
+		},
+	}
+	inspectCmd.Flags().String("direction", "", "Direction to inspect, ingress or egress, empty means both")
+
+	cmd.AddCommand(applyCmd)
+	cmd.AddCommand(inspectCmd)
+	return cmd
+}
+
+func parseDirection(direction string) (utils.TCDirection, error) {
+	switch direction {
+	case "ingress":
+		return constants.TC_INGRESS, nil
+	case "egress":
+		return constants.TC_EGRESS, nil
+	default:
+		return 0, fmt.Errorf("invalid direction %q, must be ingress or egress", direction)
+	}
+}
+
+func policyFromFlags(cmd *cobra.Command, link netlink.Link) (utils.TCPolicy, error) {
+	policy := utils.TCPolicy{Link: link}
+
+	direction, _ := cmd.Flags().GetString("direction")
+	var err error
+	if policy.Direction, err = parseDirection(direction); err != nil {
+		return policy, err
+	}
+	policy.ProgramName, _ = cmd.Flags().GetString("program")
+	policy.RateLimitBps, _ = cmd.Flags().GetUint64("rate-limit")
+	ports, _ := cmd.Flags().GetUintSlice("drop-port")
+	for _, port := range ports {
+		if port > 0xffff {
+			return policy, fmt.Errorf("invalid drop port %d", port)
+		}
+		policy.DropPorts = append(policy.DropPorts, uint16(port))
+	}
+	return policy, nil
+}
+
+func runApply(cmd *cobra.Command, ifaceName string) error {
+	link, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("failed to get interface %s: %v", ifaceName, err)
+	}
+	policy, err := policyFromFlags(cmd, link)
+	if err != nil {
+		return err
+	}
+
+	m := utils.NewTCManager()
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	if !dryRun {
+		return m.ApplyPolicy(policy)
+	}
+
+	changes, err := m.DryRun(policy)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		cmd.Println("no changes")
+		return nil
+	}
+	for _, change := range changes {
+		cmd.Println(change.String())
+	}
+	return nil
+}
+
+func runInspect(cmd *cobra.Command, ifaceName string) error {
+	link, err := netlink.LinkByName(ifaceName)
+	if err != nil {
+		return fmt.Errorf("failed to get interface %s: %v", ifaceName, err)
+	}
+	directions := []string{"ingress", "egress"}
+	if direction, _ := cmd.Flags().GetString("direction"); direction != "" {
+		directions = []string{direction}
+	}
+
+	summaries := make(map[string][]utils.BPFProgramSummary, len(directions))
+	for _, name := range directions {
+		direction, err := parseDirection(name)
+		if err != nil {
+			return err
+		}
+		if summaries[name], err = utils.GetTCFilterBPFProgramInfo(link, direction); err != nil {
+			return err
+		}
+	}
+	printProgramSummaries(cmd.OutOrStdout(), directions, summaries)
+	return nil
+}
+
+// printProgramSummaries prints the programs of each direction as a table
+func printProgramSummaries(w io.Writer, directions []string, summaries map[string][]utils.BPFProgramSummary) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DIRECTION\tID\tNAME\tTYPE\tTAG\tLOADED AT")
+	for _, direction := range directions {
+		for _, s := range summaries[direction] {
+			loadTime := "-"
+			if !s.LoadTime.IsZero() {
+				loadTime = s.LoadTime.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", direction, s.ID, s.Name, s.Type, hex.EncodeToString(s.Tag[:]), loadTime)
+		}
+	}
+	tw.Flush()
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tc
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+func TestPrintProgramSummaries(t *testing.T) {
+	loadTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	summaries := map[string][]utils.BPFProgramSummary{
+		"ingress": {
+			{ID: 12, Name: "tc_ingress", Tag: [8]byte{0xde, 0xad, 0xbe, 0xef, 0, 1, 2, 3}, LoadTime: loadTime, Type: "SchedCLS"},
+			{ID: 130, Name: "tc_policy", Type: "SchedCLS"},
+		},
+		"egress": {
+			{ID: 13, Name: "tc_egress", LoadTime: loadTime, Type: "SchedCLS"},
+		},
+	}
+
+	var buf bytes.Buffer
+	printProgramSummaries(&buf, []string{"ingress", "egress"}, summaries)
+	assert.Equal(t, `DIRECTION  ID   NAME        TYPE      TAG               LOADED AT
+ingress    12   tc_ingress  SchedCLS  deadbeef00010203  2024-05-01T10:00:00Z
+ingress    130  tc_policy   SchedCLS  0000000000000000  -
+egress     13   tc_egress   SchedCLS  0000000000000000  2024-05-01T10:00:00Z
+`, buf.String())
+
+	// only the header without programs
+	buf.Reset()
+	printProgramSummaries(&buf, []string{"egress"}, nil)
+	assert.Equal(t, "DIRECTION  ID  NAME  TYPE  TAG  LOADED AT\n", buf.String())
+}
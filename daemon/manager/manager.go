@@ -36,6 +36,7 @@ import (
 	"kmesh.net/kmesh/pkg/controller"
 	"kmesh.net/kmesh/pkg/logger"
 	"kmesh.net/kmesh/pkg/status"
+	"kmesh.net/kmesh/pkg/utils"
 )
 
 const (
@@ -80,6 +81,7 @@ func Execute(configs *options.BootstrapConfigs) error {
 	if err != nil {
 		log.Warn("rlimit.RemoveMemlock failed")
 	}
+	log.Infof("kernel bpf features: %s", utils.VerifyKernelBPFFeatures())
 
 	bpfLoader := bpf.NewBpfLoader(configs.BpfConfig)
 	// there could be a case that bpf loader partially start failed, we still need to stop it, otherwise it cannot recover
@@ -40,6 +40,13 @@ const (
 	TC_ATTACH = 0
 	TC_DETACH = 1
 
+	XDP_ATTACH  = 0
+	XDP_DETACH  = 1
+	XDP_REPLACE = 2
+
+	TC_INGRESS = 0
+	TC_EGRESS  = 1
+
 	RootCertPath = "/var/run/secrets/istio/root-cert.pem"
 	TrustDomain  = "cluster.local"
 
@@ -34,6 +34,7 @@ import (
 	"kmesh.net/kmesh/pkg/controller/bypass"
 	"kmesh.net/kmesh/pkg/controller/encryption/ipsec"
 	manage "kmesh.net/kmesh/pkg/controller/manage"
+	"kmesh.net/kmesh/pkg/controller/netns"
 	"kmesh.net/kmesh/pkg/controller/security"
 	"kmesh.net/kmesh/pkg/controller/workload"
 	"kmesh.net/kmesh/pkg/dns"
@@ -112,6 +113,21 @@ func (c *Controller) Start(stopCh <-chan struct{}) error {
 		tcFd = -1
 	}
 
+	// cache the netns of the running pods before the manage controller enrolls them
+	go func() {
+		if err := netns.PodNetnsWarmup(context.Background()); err != nil {
+			log.Warnf("netns warmup failed: %v", err)
+		}
+	}()
+	go netns.RunPodNetnsCacheEviction(ctx)
+	go netns.RunDiscoveryProfilerMetrics(ctx)
+	// the index of a deleted interface may be reused, its annotations must not outlive it
+	go func() {
+		if err := helper.ClearInterfaceAnnotationsOnDelete(ctx, helper.WatchInterfaceEvents); err != nil {
+			log.Warnf("failed to watch the deleted interfaces: %v", err)
+		}
+	}()
+
 	if c.mode == constants.DualEngineMode {
 		var secertManager *security.SecretManager
 		if c.enableSecretManager {
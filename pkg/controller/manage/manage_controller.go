@@ -201,6 +201,9 @@ func (c *KmeshManageController) handlePodDelete(obj interface{}) {
 		}
 	}
 
+	// the netns of every pod may have been discovered
+	kmesh_netns.DefaultDiscoveryProfiler.Forget(pod.UID)
+
 	if utils.AnnotationEnabled(pod.Annotations[constants.KmeshRedirectionAnnotation]) {
 		log.Infof("%s/%s: Pod managed by Kmesh is deleted", pod.GetNamespace(), pod.GetName())
 		sendCertRequest(c.sm, pod, kmeshsecurity.DELETE)
@@ -491,7 +494,7 @@ func managleVethTc(ifIndex uint64, tcProgFd int, mode int) error {
 		return fmt.Errorf("failed to link valid interface, %v", err)
 	}
 
-	return utils.ManageTCProgramByFd(link, tcProgFd, mode)
+	return utils.ManageTCProgramByFd(link, tcProgFd, mode, 0)
 }
 
 func linkTc(netNsPath string, tcProgFd int) error {
@@ -893,7 +893,7 @@ func Test_TC(t *testing.T) {
 		}
 		return nil
 	})
-	patches.ApplyFunc(utils.ManageTCProgramByFd, func(link netlink.Link, tcFd int, mode int) error {
+	patches.ApplyFunc(utils.ManageTCProgramByFd, func(link netlink.Link, tcFd int, mode int, priority uint16) error {
 		return nil
 	})
 	type args struct {
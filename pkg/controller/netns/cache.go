@@ -0,0 +1,165 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/clock"
+)
+
+// DefaultNetnsCacheTTL is how long the netns of a pod is kept in the cache before it is
+// resolved again
+const DefaultNetnsCacheTTL = 10 * time.Minute
+
+type netnsCacheEntry struct {
+	path string
+	// inode is 0 if the netns could not be resolved when the entry was added
+	inode   uint64
+	addedAt time.Time
+}
+
+// NetnsCache records the last known netns path of pods
+type NetnsCache struct {
+	mu      sync.RWMutex
+	entries map[types.UID]netnsCacheEntry
+
+	now func() time.Time
+}
+
+func NewNetnsCache() *NetnsCache {
+	return &NetnsCache{
+		entries: make(map[types.UID]netnsCacheEntry),
+		now:     time.Now,
+	}
+}
+
+// podNetnsCache holds the netns paths resolved by GetPodNSpath. Only the netns resolution of
+// this package writes it, the callers drop the paths of the deleted pods with ForgetPodNetns.
+var podNetnsCache = NewNetnsCache()
+
+func (c *NetnsCache) Add(uid types.UID, path string) {
+	inode, _ := getNetnsInode(path)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[uid] = netnsCacheEntry{path: path, inode: inode, addedAt: c.now()}
+}
+
+func (c *NetnsCache) Get(uid types.UID) (string, bool) {
+	entry, ok := c.entry(uid)
+	return entry.path, ok
+}
+
+func (c *NetnsCache) entry(uid types.UID) (netnsCacheEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[uid]
+	return entry, ok
+}
+
+// lookup returns the path of the pod uid if its netns is still the one cached. A netns gone is a
+// miss, but the entry is kept as the last known path of the pod, e.g. for GetNetnsForTerminatingPod,
+// until the netns of the pod is resolved again or the entry is evicted.
+func (c *NetnsCache) lookup(uid types.UID) (string, bool) {
+	entry, ok := c.entry(uid)
+	if !ok || entry.inode == 0 {
+		return "", false
+	}
+	if inode, err := getNetnsInode(entry.path); err != nil || inode != entry.inode {
+		return "", false
+	}
+	return entry.path, true
+}
+
+func (c *NetnsCache) Delete(uid types.UID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, uid)
+}
+
+// deletePath deletes the entries of path
+func (c *NetnsCache) deletePath(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for uid, entry := range c.entries {
+		if entry.path == path {
+			delete(c.entries, uid)
+		}
+	}
+}
+
+func (c *NetnsCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
+
+// Evict deletes the entries added more than ttl ago and returns the number of entries deleted
+func (c *NetnsCache) Evict(ttl time.Duration) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	evicted := 0
+	for uid, entry := range c.entries {
+		if now.Sub(entry.addedAt) > ttl {
+			delete(c.entries, uid)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// RunEviction evicts the entries older than ttl every interval until ctx is done
+func (c *NetnsCache) RunEviction(ctx context.Context, ttl, interval time.Duration) {
+	c.runEviction(ctx, clock.RealClock{}, ttl, interval)
+}
+
+func (c *NetnsCache) runEviction(ctx context.Context, clock clock.WithTicker, ttl, interval time.Duration) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			if n := c.Evict(ttl); n > 0 {
+				log.Debugf("evicted %d netns cache entries older than %s", n, ttl)
+			}
+		}
+	}
+}
+
+// podNetnsCacheEvictionInterval is how often RunPodNetnsCacheEviction evicts the entries
+const podNetnsCacheEvictionInterval = time.Minute
+
+// RunPodNetnsCacheEviction evicts the netns paths cached by GetPodNSpath older than
+// DefaultNetnsCacheTTL until ctx is done, so that the pods deleted are not kept forever
+func RunPodNetnsCacheEviction(ctx context.Context) {
+	podNetnsCache.RunEviction(ctx, DefaultNetnsCacheTTL, podNetnsCacheEvictionInterval)
+}
+
+// reset deletes all the entries
+func (c *NetnsCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[types.UID]netnsCacheEntry)
+}
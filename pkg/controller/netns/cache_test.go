@@ -0,0 +1,132 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestNetnsCache(t *testing.T) {
+	nsPath := filepath.Join(t.TempDir(), "net")
+	require.NoError(t, os.WriteFile(nsPath, nil, 0644))
+	inode, err := getNetnsInode(nsPath)
+	require.NoError(t, err)
+
+	c := NewNetnsCache()
+	_, ok := c.Get("uid-1")
+	assert.False(t, ok)
+
+	c.Add("uid-1", nsPath)
+	c.Add("uid-2", "/not/exist")
+	assert.Equal(t, 2, c.Len())
+
+	got, ok := c.Get("uid-1")
+	assert.True(t, ok)
+	assert.Equal(t, nsPath, got)
+	entry, _ := c.entry("uid-1")
+	assert.Equal(t, inode, entry.inode)
+	entry, _ = c.entry("uid-2")
+	assert.Equal(t, uint64(0), entry.inode)
+
+	c.Delete("uid-1")
+	_, ok = c.Get("uid-1")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestNetnsCacheEvict(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Unix(1700000000, 0))
+	c := NewNetnsCache()
+	c.now = fakeClock.Now
+
+	c.Add("uid-1", "/host/proc/1/ns/net")
+	fakeClock.Step(time.Minute)
+	c.Add("uid-2", "/host/proc/2/ns/net")
+
+	assert.Zero(t, c.Evict(time.Minute))
+	fakeClock.Step(time.Second)
+	assert.Equal(t, 1, c.Evict(time.Minute))
+	_, ok := c.Get("uid-1")
+	assert.False(t, ok)
+	_, ok = c.Get("uid-2")
+	assert.True(t, ok)
+
+	// the eviction loop
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan struct{})
+	go func() {
+		c.runEviction(ctx, fakeClock, time.Minute, 10*time.Second)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	require.Eventually(t, fakeClock.HasWaiters, 5*time.Second, time.Millisecond)
+	fakeClock.Step(50 * time.Second)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, c.Len())
+	fakeClock.Step(10 * time.Second)
+	require.Eventually(t, func() bool { return c.Len() == 0 }, 5*time.Second, time.Millisecond)
+}
+
+func TestFindNetnsForPodCached(t *testing.T) {
+	procRoot, pidA, _ := newWarmupProcRoot(t)
+	c := NewNetnsCache()
+
+	// miss, procRoot is scanned
+	res, err := findNetnsForPodCached(c, procRoot, warmupPodA)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(strconv.Itoa(pidA), "ns", "net"), res)
+	nsPath, ok := c.Get(warmupPodA)
+	require.True(t, ok)
+	assert.Equal(t, filepath.Join(procRoot, res), nsPath)
+
+	// hit, procRoot is not scanned anymore
+	require.NoError(t, os.Remove(filepath.Join(procRoot, strconv.Itoa(pidA), "cgroup")))
+	res, err = findNetnsForPodCached(c, procRoot, warmupPodA)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(strconv.Itoa(pidA), "ns", "net"), res)
+
+	// the netns cached is gone
+	c.Add("uid-gone", filepath.Join(procRoot, "4321", "ns", "net"))
+	_, err = findNetnsForPodCached(c, procRoot, "uid-gone")
+	assert.ErrorContains(t, err, "No matching network namespace found")
+
+	// the netns of the path cached is another one
+	stale := filepath.Join(t.TempDir(), "net")
+	require.NoError(t, os.WriteFile(stale, nil, 0644))
+	c.Add("uid-stale", stale)
+	other := filepath.Join(filepath.Dir(stale), "other")
+	require.NoError(t, os.WriteFile(other, nil, 0644))
+	require.NoError(t, os.Rename(other, stale))
+	_, ok = c.lookup("uid-stale")
+	assert.False(t, ok)
+	// the last known path is kept
+	nsPath, ok = c.Get("uid-stale")
+	assert.True(t, ok)
+	assert.Equal(t, stale, nsPath)
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// QoSClass is the qos class of a pod, as encoded in its cgroup path
+type QoSClass = corev1.PodQOSClass
+
+// ErrNotPodCgroup is returned by CompactCgroupPath for the cgroups not owned by a pod
+var ErrNotPodCgroup = errors.New("not a pod cgroup")
+
+const podUIDLen = len("2c48913c-b29f-11e7-9350-020968147796")
+
+// staticPodUIDLen is the length of the uid of a static pod, the hash of its manifest without dashes
+const staticPodUIDLen = len("9c7f3ef4b2e12a6b1a4e5ed1d2f5e3a8")
+
+// cgroupState is the state of CompactCgroupPath after a path segment
+type cgroupState int
+
+const (
+	// stateOutside is before the kubepods segment
+	stateOutside cgroupState = iota
+	// stateKubepods is after the kubepods segment, the qos or pod segment follows
+	stateKubepods
+	// stateQoS is after the qos segment, the pod segment follows
+	stateQoS
+)
+
+// CompactCgroupPath returns the uid and qos class of the pod owning cgroupPath, a line of
+// /proc/<pid>/cgroup of cgroup v1 or v2 or a bare cgroup path, in one pass over its segments.
+// Both the layouts of the systemd driver,
+// kubepods.slice/kubepods-<qos>.slice/kubepods-<qos>-pod<uid>.slice/cri-containerd-<id>.scope,
+// and of the cgroupfs driver, kubepods/<qos>/pod<uid>/<id>, are parsed. The qos level is
+// omitted for guaranteed pods and systemd escapes the dashes of the uid with underscores,
+// the uid is returned lower case with dashes.
+func CompactCgroupPath(cgroupPath string) (types.UID, QoSClass, error) {
+	cgroupPath = strings.TrimSpace(cgroupPath)
+	// hierarchy-ID:controller-list:cgroup-path
+	if i := strings.IndexByte(cgroupPath, ':'); i >= 0 {
+		if j := strings.IndexByte(cgroupPath[i+1:], ':'); j >= 0 {
+			cgroupPath = cgroupPath[i+1+j+1:]
+		}
+	}
+
+	state := stateOutside
+	qos := corev1.PodQOSGuaranteed
+	for len(cgroupPath) > 0 {
+		var segment string
+		if i := strings.IndexByte(cgroupPath, '/'); i >= 0 {
+			segment, cgroupPath = cgroupPath[:i], cgroupPath[i+1:]
+		} else {
+			segment, cgroupPath = cgroupPath, ""
+		}
+		if segment == "" {
+			continue
+		}
+
+		switch state {
+		case stateOutside:
+			if segment == "kubepods.slice" || segment == "kubepods" {
+				state = stateKubepods
+			}
+		case stateKubepods, stateQoS:
+			// systemd: kubepods-pod<uid>.slice, kubepods-<qos>-pod<uid>.slice or kubepods-<qos>.slice
+			if rest, ok := strings.CutSuffix(segment, ".slice"); ok {
+				if rest, ok = strings.CutPrefix(rest, "kubepods-"); !ok {
+					return "", "", ErrNotPodCgroup
+				}
+				if uid, ok := strings.CutPrefix(rest, "pod"); ok {
+					return podCgroupResult(uid, qos)
+				}
+				class, rest, ok := cutQoS(rest)
+				if !ok {
+					return "", "", ErrNotPodCgroup
+				}
+				if uid, ok := strings.CutPrefix(rest, "-pod"); ok {
+					return podCgroupResult(uid, class)
+				}
+				if rest != "" || state == stateQoS {
+					return "", "", ErrNotPodCgroup
+				}
+				qos, state = class, stateQoS
+				continue
+			}
+
+			// cgroupfs: pod<uid> or <qos>
+			if uid, ok := strings.CutPrefix(segment, "pod"); ok {
+				return podCgroupResult(uid, qos)
+			}
+			class, rest, ok := cutQoS(segment)
+			if !ok || rest != "" || state == stateQoS {
+				return "", "", ErrNotPodCgroup
+			}
+			qos, state = class, stateQoS
+		}
+	}
+	return "", "", ErrNotPodCgroup
+}
+
+// cutQoS cuts the qos level at the start of s
+func cutQoS(s string) (QoSClass, string, bool) {
+	for _, level := range []struct {
+		name  string
+		class QoSClass
+	}{
+		{"besteffort", corev1.PodQOSBestEffort},
+		{"burstable", corev1.PodQOSBurstable},
+		{"guaranteed", corev1.PodQOSGuaranteed},
+	} {
+		if rest, ok := strings.CutPrefix(s, level.name); ok {
+			return level.class, rest, true
+		}
+	}
+	return "", s, false
+}
+
+func podCgroupResult(encoded string, qos QoSClass) (types.UID, QoSClass, error) {
+	uid, ok := normalizePodUID(encoded)
+	if !ok {
+		return "", "", ErrNotPodCgroup
+	}
+	return uid, qos, nil
+}
+
+// CgroupV2PodMatcher finds the pod owning a cgroup with CompactCgroupPath
+type CgroupV2PodMatcher struct{}
+
+// Match returns the pod uid of cgroupLine, a line of /proc/<pid>/cgroup such as
+// "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid>.slice/cri-containerd-<id>.scope".
+// A bare cgroup path is accepted too.
+func (CgroupV2PodMatcher) Match(cgroupLine string) (types.UID, bool) {
+	uid, _, err := CompactCgroupPath(cgroupLine)
+	return uid, err == nil
+}
+
+// ParsePodUIDFromCgroup returns the uid of the pod owning cgroupLine, a line of /proc/<pid>/cgroup
+// of cgroup v1 or v2 created by the cgroupfs or the systemd driver. The whole content of the
+// file is accepted too, the first line of a pod cgroup is used, as cgroup v1 lists a line per
+// hierarchy and some of them, e.g. the named ones, may not be owned by the pod.
+func ParsePodUIDFromCgroup(cgroupLine string) (types.UID, error) {
+	for _, line := range strings.Split(cgroupLine, "\n") {
+		if uid, _, err := CompactCgroupPath(line); err == nil {
+			return uid, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrNotPodCgroup, strings.TrimSpace(cgroupLine))
+}
+
+// normalizePodUID validates the uid encoded in a cgroup path, the dashes may be escaped
+// with underscores, and returns it lower case with dashes. The uid of a static pod has no
+// dashes, it is returned lower case only.
+func normalizePodUID(encoded string) (types.UID, bool) {
+	dashed := len(encoded) == podUIDLen
+	if !dashed && len(encoded) != staticPodUIDLen {
+		return "", false
+	}
+	uid := make([]byte, len(encoded))
+	for i := range encoded {
+		c := encoded[i]
+		switch {
+		case dashed && (i == 8 || i == 13 || i == 18 || i == 23):
+			if c != '-' && c != '_' {
+				return "", false
+			}
+			c = '-'
+		case c >= '0' && c <= '9' || c >= 'a' && c <= 'f':
+		case c >= 'A' && c <= 'F':
+			c += 'a' - 'A'
+		default:
+			return "", false
+		}
+		uid[i] = c
+	}
+	return types.UID(uid), true
+}
+
+// matchPodCgroup returns the pod uid of the first line of the /proc/<pid>/cgroup data matched by CgroupV2PodMatcher
+func matchPodCgroup(data string) (types.UID, bool) {
+	for _, line := range strings.Split(data, "\n") {
+		if uid, ok := (CgroupV2PodMatcher{}).Match(line); ok {
+			return uid, true
+		}
+	}
+	return "", false
+}
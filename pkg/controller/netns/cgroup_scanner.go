@@ -0,0 +1,270 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/types"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// cgroupEventsFile is the file of a cgroupv2 directory reporting whether it holds processes,
+// the kernel generates a modification event on it when its populated field changes.
+const cgroupEventsFile = "cgroup.events"
+
+// CgroupEmptyEvent is emitted by CgroupScanner when the last process of the cgroup of a pod exits
+type CgroupEmptyEvent struct {
+	UID        types.UID
+	CgroupPath string
+}
+
+type cgroupWatch struct {
+	uid       types.UID
+	path      string
+	populated bool
+}
+
+// CgroupScanner watches the cgroup.events of the cgroups of pods with inotify and reports the
+// pods whose cgroup becomes empty, usually before the kubelet reports their containers exited.
+type CgroupScanner struct {
+	fd     int
+	events chan CgroupEmptyEvent
+
+	mu      sync.Mutex
+	watches map[int32]*cgroupWatch
+	pods    map[types.UID]int32
+}
+
+// NewCgroupScanner creates a scanner, it must be closed by Close once Run returns
+func NewCgroupScanner() (*CgroupScanner, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init inotify: %v", err)
+	}
+	return &CgroupScanner{
+		fd:      fd,
+		events:  make(chan CgroupEmptyEvent, 64),
+		watches: make(map[int32]*cgroupWatch),
+		pods:    make(map[types.UID]int32),
+	}, nil
+}
+
+// Close releases the inotify of s
+func (s *CgroupScanner) Close() error {
+	return unix.Close(s.fd)
+}
+
+// Events returns the channel receiving the cgroups found empty by Run, it is closed once Run returns
+func (s *CgroupScanner) Events() <-chan CgroupEmptyEvent {
+	return s.events
+}
+
+// Watch starts watching cgroupPath, the cgroup directory of the pod uid, and returns whether it
+// holds processes. The empty event is only emitted once a populated cgroup becomes empty.
+func (s *CgroupScanner) Watch(uid types.UID, cgroupPath string) (bool, error) {
+	s.Unwatch(uid)
+
+	eventsPath := filepath.Join(cgroupPath, cgroupEventsFile)
+	wd, err := unix.InotifyAddWatch(s.fd, eventsPath, unix.IN_MODIFY)
+	if err != nil {
+		return false, fmt.Errorf("failed to watch %s: %v", eventsPath, err)
+	}
+	// read after the watch is added not to miss a change
+	populated, err := readCgroupPopulated(eventsPath)
+	if err != nil {
+		_, _ = unix.InotifyRmWatch(s.fd, uint32(wd))
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watches[int32(wd)] = &cgroupWatch{uid: uid, path: cgroupPath, populated: populated}
+	s.pods[uid] = int32(wd)
+	return populated, nil
+}
+
+// Unwatch stops watching the cgroup of the pod uid
+func (s *CgroupScanner) Unwatch(uid types.UID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wd, ok := s.pods[uid]
+	if !ok {
+		return
+	}
+	delete(s.pods, uid)
+	delete(s.watches, wd)
+	// the watch is already removed if the cgroup is
+	_, _ = unix.InotifyRmWatch(s.fd, uint32(wd))
+}
+
+// Run reports the cgroups becoming empty until ctx is done
+func (s *CgroupScanner) Run(ctx context.Context) error {
+	defer close(s.events)
+
+	buf := make([]byte, 64*unix.SizeofInotifyEvent)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil
+		}
+		// wake up regularly to check ctx
+		fds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, 100)
+		if errors.Is(err, unix.EINTR) || n == 0 {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to poll inotify of cgroups: %v", err)
+		}
+		n, err = unix.Read(s.fd, buf)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read inotify of cgroups: %v", err)
+		}
+		s.handleEvents(ctx, buf[:n])
+	}
+}
+
+func (s *CgroupScanner) handleEvents(ctx context.Context, buf []byte) {
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		offset += unix.SizeofInotifyEvent + int(event.Len)
+
+		if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+			s.recheckAll(ctx)
+			continue
+		}
+		s.mu.Lock()
+		w, ok := s.watches[event.Wd]
+		if ok && event.Mask&unix.IN_IGNORED != 0 {
+			// the cgroup is removed, it has no process left
+			delete(s.watches, event.Wd)
+			delete(s.pods, w.uid)
+		}
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		s.check(ctx, w, event.Mask&unix.IN_IGNORED != 0)
+	}
+}
+
+// recheckAll checks all the cgroups after events are lost
+func (s *CgroupScanner) recheckAll(ctx context.Context) {
+	s.mu.Lock()
+	watches := make([]*cgroupWatch, 0, len(s.watches))
+	for _, w := range s.watches {
+		watches = append(watches, w)
+	}
+	s.mu.Unlock()
+	for _, w := range watches {
+		s.check(ctx, w, false)
+	}
+}
+
+// check reads the populated field of w, removed means the cgroup no longer exists
+func (s *CgroupScanner) check(ctx context.Context, w *cgroupWatch, removed bool) {
+	populated := false
+	if !removed {
+		var err error
+		if populated, err = readCgroupPopulated(filepath.Join(w.path, cgroupEventsFile)); err != nil {
+			log.Debugf("%v", err)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	emptied := w.populated && !populated
+	w.populated = populated
+	s.mu.Unlock()
+	if !emptied {
+		return
+	}
+	select {
+	case s.events <- CgroupEmptyEvent{UID: w.uid, CgroupPath: w.path}:
+	case <-ctx.Done():
+	}
+}
+
+func readCgroupPopulated(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	populated, err := parseCgroupPopulated(data)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return populated, nil
+}
+
+// parseCgroupPopulated returns the populated field of the content of a cgroup.events,
+// e.g. "populated 1\nfrozen 0\n"
+func parseCgroupPopulated(data []byte) (bool, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		if key != "populated" {
+			continue
+		}
+		switch value {
+		case "0":
+			return false, nil
+		case "1":
+			return true, nil
+		default:
+			return false, fmt.Errorf("invalid populated %q", value)
+		}
+	}
+	return false, errors.New("no populated field")
+}
+
+// DetachTCOnCgroupEmpty detaches the tc programs of the pods reported by s, until ctx is done
+// or s stops. The interfaces of a pod are the ones annotated with its uid under their current
+// name and index, their annotations are cleared once detached.
+func DetachTCOnCgroupEmpty(ctx context.Context, s *CgroupScanner) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-s.Events():
+			if !ok {
+				return
+			}
+			n, err := utils.DetachTCProgramsByPodUID(event.UID)
+			if err != nil {
+				log.Errorf("failed to detach tc programs of pod %s whose cgroup is empty: %v", event.UID, err)
+				continue
+			}
+			log.Debugf("detached %d tc programs of pod %s whose cgroup is empty", n, event.UID)
+		}
+	}
+}
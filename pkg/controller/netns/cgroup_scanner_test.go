@@ -0,0 +1,205 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// newTestCgroup creates a mock pod cgroup directory with its cgroup.events
+func newTestCgroup(t *testing.T, populated bool) string {
+	dir := filepath.Join(t.TempDir(), "kubepods-pod"+string(warmupPodA)+".slice")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	writeTestCgroupEvents(t, dir, populated)
+	return dir
+}
+
+func writeTestCgroupEvents(t *testing.T, dir string, populated bool) {
+	content := "populated 0\nfrozen 0\n"
+	if populated {
+		content = "populated 1\nfrozen 0\n"
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, cgroupEventsFile), []byte(content), 0644))
+}
+
+func startTestCgroupScanner(t *testing.T) *CgroupScanner {
+	s, err := NewCgroupScanner()
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, <-done)
+		assert.NoError(t, s.Close())
+	})
+	return s
+}
+
+func nextCgroupEmptyEvent(t *testing.T, s *CgroupScanner) CgroupEmptyEvent {
+	select {
+	case event := <-s.Events():
+		return event
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no cgroup empty event")
+		return CgroupEmptyEvent{}
+	}
+}
+
+func assertNoCgroupEmptyEvent(t *testing.T, s *CgroupScanner) {
+	select {
+	case event := <-s.Events():
+		assert.Fail(t, "unexpected cgroup empty event", "%+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCgroupScanner(t *testing.T) {
+	s := startTestCgroupScanner(t)
+	dir := newTestCgroup(t, true)
+	populated, err := s.Watch(warmupPodA, dir)
+	require.NoError(t, err)
+	assert.True(t, populated)
+
+	// still populated
+	writeTestCgroupEvents(t, dir, true)
+	assertNoCgroupEmptyEvent(t, s)
+
+	writeTestCgroupEvents(t, dir, false)
+	assert.Equal(t, CgroupEmptyEvent{UID: warmupPodA, CgroupPath: dir}, nextCgroupEmptyEvent(t, s))
+	// reported once
+	writeTestCgroupEvents(t, dir, false)
+	assertNoCgroupEmptyEvent(t, s)
+
+	// reported again once populated again
+	writeTestCgroupEvents(t, dir, true)
+	assertNoCgroupEmptyEvent(t, s)
+	writeTestCgroupEvents(t, dir, false)
+	assert.Equal(t, warmupPodA, nextCgroupEmptyEvent(t, s).UID)
+
+	// not reported once unwatched
+	writeTestCgroupEvents(t, dir, true)
+	assertNoCgroupEmptyEvent(t, s)
+	s.Unwatch(warmupPodA)
+	writeTestCgroupEvents(t, dir, false)
+	assertNoCgroupEmptyEvent(t, s)
+}
+
+func TestCgroupScannerRemoved(t *testing.T) {
+	s := startTestCgroupScanner(t)
+	dir := newTestCgroup(t, true)
+	_, err := s.Watch(warmupPodB, dir)
+	require.NoError(t, err)
+
+	// a cgroup is removed once its processes exited
+	require.NoError(t, os.RemoveAll(dir))
+	assert.Equal(t, CgroupEmptyEvent{UID: warmupPodB, CgroupPath: dir}, nextCgroupEmptyEvent(t, s))
+	s.mu.Lock()
+	assert.Empty(t, s.watches)
+	assert.Empty(t, s.pods)
+	s.mu.Unlock()
+}
+
+func TestCgroupScannerWatchErrors(t *testing.T) {
+	s, err := NewCgroupScanner()
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.Watch(warmupPodA, filepath.Join(t.TempDir(), "not-exist"))
+	assert.ErrorContains(t, err, "failed to watch")
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, cgroupEventsFile), []byte("frozen 0\n"), 0644))
+	_, err = s.Watch(warmupPodA, dir)
+	assert.ErrorContains(t, err, "no populated field")
+	assert.Empty(t, s.pods)
+
+	// an empty cgroup is not reported
+	populated, err := s.Watch(warmupPodA, newTestCgroup(t, false))
+	require.NoError(t, err)
+	assert.False(t, populated)
+}
+
+func TestParseCgroupPopulated(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    bool
+		wantErr bool
+	}{
+		{data: "populated 1\nfrozen 0\n", want: true},
+		{data: "frozen 1\npopulated 0\n"},
+		{data: "populated 1", want: true},
+		{data: "populated 2\n", wantErr: true},
+		{data: "populated\n", wantErr: true},
+		{data: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCgroupPopulated([]byte(tt.data))
+		if tt.wantErr {
+			assert.Error(t, err, tt.data)
+			continue
+		}
+		assert.NoError(t, err, tt.data)
+		assert.Equal(t, tt.want, got, tt.data)
+	}
+}
+
+func TestDetachTCOnCgroupEmpty(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	detached := make(chan types.UID, 1)
+	patches.ApplyFunc(utils.DetachTCProgramsByPodUID, func(podUID types.UID) (int, error) {
+		detached <- podUID
+		return 2, nil
+	})
+
+	s := startTestCgroupScanner(t)
+	dir := newTestCgroup(t, true)
+	_, err := s.Watch(warmupPodA, dir)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan struct{})
+	go func() {
+		DetachTCOnCgroupEmpty(ctx, s)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	writeTestCgroupEvents(t, dir, false)
+	select {
+	case uid := <-detached:
+		assert.Equal(t, warmupPodA, uid)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "tc programs not detached")
+	}
+}
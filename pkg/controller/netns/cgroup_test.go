@@ -0,0 +1,362 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestCgroupV2PodMatcher(t *testing.T) {
+	const (
+		uid        = types.UID("2c48913c-b29f-11e7-9350-020968147796")
+		escapedUID = "2c48913c_b29f_11e7_9350_020968147796"
+		staticUID  = types.UID("9c7f3ef4b2e12a6b1a4e5ed1d2f5e3a8")
+		cid        = "9bca8d63d5fa610783847915bcff0ecac1273e5b4bed3f6fa1b07350e0135961"
+	)
+
+	tests := []struct {
+		name string
+		line string
+		want types.UID
+	}{
+		{
+			name: "systemd besteffort",
+			line: "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod" + escapedUID + ".slice/cri-containerd-" + cid + ".scope",
+			want: uid,
+		},
+		{
+			name: "systemd burstable",
+			line: "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + escapedUID + ".slice/cri-containerd-" + cid + ".scope",
+			want: uid,
+		},
+		{
+			name: "systemd guaranteed without qos slice",
+			line: "0::/kubepods.slice/kubepods-pod" + escapedUID + ".slice/cri-containerd-" + cid + ".scope",
+			want: uid,
+		},
+		{
+			name: "systemd guaranteed with qos slice",
+			line: "0::/kubepods.slice/kubepods-guaranteed.slice/kubepods-guaranteed-pod" + escapedUID + ".slice",
+			want: uid,
+		},
+		{
+			name: "systemd pod slice without container",
+			line: "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + escapedUID + ".slice",
+			want: uid,
+		},
+		{
+			name: "systemd uid with dashes",
+			line: "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod" + string(uid) + ".slice",
+			want: uid,
+		},
+		{
+			name: "systemd upper case uid",
+			line: "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod2C48913C_B29F_11E7_9350_020968147796.slice",
+			want: uid,
+		},
+		{
+			name: "systemd nested in a system slice",
+			line: "0::/system.slice/containerd.service/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + escapedUID + ".slice/" + cid,
+			want: uid,
+		},
+		{
+			name: "cgroupfs besteffort",
+			line: "0::/kubepods/besteffort/pod" + string(uid) + "/" + cid,
+			want: uid,
+		},
+		{
+			name: "cgroupfs burstable",
+			line: "0::/kubepods/burstable/pod" + string(uid) + "/" + cid,
+			want: uid,
+		},
+		{
+			name: "cgroupfs guaranteed",
+			line: "0::/kubepods/pod" + string(uid) + "/" + cid,
+			want: uid,
+		},
+		{
+			name: "cgroupfs escaped uid",
+			line: "0::/kubepods/pod" + escapedUID + "/" + cid,
+			want: uid,
+		},
+		{
+			name: "cgroup v1 line",
+			line: "12:memory:/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + escapedUID + ".slice/cri-containerd-" + cid + ".scope",
+			want: uid,
+		},
+		{
+			name: "bare path",
+			line: "/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod" + escapedUID + ".slice",
+			want: uid,
+		},
+		{
+			name: "systemd static pod",
+			line: "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod9C7F3EF4B2E12A6B1A4E5ED1D2F5E3A8.slice/cri-containerd-" + cid + ".scope",
+			want: staticUID,
+		},
+		{
+			name: "cgroupfs static pod",
+			line: "0::/kubepods/burstable/pod" + string(staticUID) + "/" + cid,
+			want: staticUID,
+		},
+		{name: "host process", line: "0::/system.slice/containerd.service"},
+		{name: "init", line: "0::/init.scope"},
+		{name: "empty", line: ""},
+		{name: "kubepods only", line: "0::/kubepods.slice"},
+		{name: "qos slice only", line: "0::/kubepods.slice/kubepods-burstable.slice"},
+		{
+			name: "unknown qos",
+			line: "0::/kubepods.slice/kubepods-premium.slice/kubepods-premium-pod" + escapedUID + ".slice",
+		},
+		{
+			name: "pod slice outside kubepods",
+			line: "0::/user.slice/kubepods-besteffort-pod" + escapedUID + ".slice",
+		},
+		{
+			name: "invalid uid",
+			line: "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1234.slice",
+		},
+		{
+			name: "uid with invalid characters",
+			line: "0::/kubepods/besteffort/pod2c48913c-b29f-11e7-9350-02096814779z/" + cid,
+		},
+		{
+			name: "static pod uid with invalid characters",
+			line: "0::/kubepods/burstable/pod9c7f3ef4b2e12a6b1a4e5ed1d2f5e3az/" + cid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := CgroupV2PodMatcher{}.Match(tt.line)
+			assert.Equal(t, tt.want != "", ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMatchPodCgroup(t *testing.T) {
+	uid, ok := matchPodCgroup("1:name=systemd:/init.scope\n0::/kubepods.slice/kubepods-pod2c48913c_b29f_11e7_9350_020968147796.slice\n")
+	assert.True(t, ok)
+	assert.Equal(t, types.UID("2c48913c-b29f-11e7-9350-020968147796"), uid)
+
+	_, ok = matchPodCgroup("0::/init.scope\n")
+	assert.False(t, ok)
+}
+
+func TestCompactCgroupPath(t *testing.T) {
+	const (
+		uid        = types.UID("2c48913c-b29f-11e7-9350-020968147796")
+		escapedUID = "2c48913c_b29f_11e7_9350_020968147796"
+		cid        = "9bca8d63d5fa610783847915bcff0ecac1273e5b4bed3f6fa1b07350e0135961"
+	)
+
+	tests := []struct {
+		name    string
+		path    string
+		wantQoS QoSClass
+	}{
+		{
+			name:    "systemd besteffort",
+			path:    "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod" + escapedUID + ".slice/cri-containerd-" + cid + ".scope",
+			wantQoS: corev1.PodQOSBestEffort,
+		},
+		{
+			name:    "systemd burstable",
+			path:    "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + escapedUID + ".slice",
+			wantQoS: corev1.PodQOSBurstable,
+		},
+		{
+			name:    "systemd guaranteed",
+			path:    "0::/kubepods.slice/kubepods-pod" + escapedUID + ".slice/cri-containerd-" + cid + ".scope",
+			wantQoS: corev1.PodQOSGuaranteed,
+		},
+		{
+			name:    "cgroup v1 systemd",
+			path:    "4:cpu,cpuacct:/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + escapedUID + ".slice/docker-" + cid + ".scope",
+			wantQoS: corev1.PodQOSBurstable,
+		},
+		{
+			name:    "cgroupfs besteffort",
+			path:    "0::/kubepods/besteffort/pod" + string(uid) + "/" + cid,
+			wantQoS: corev1.PodQOSBestEffort,
+		},
+		{
+			name:    "cgroupfs guaranteed",
+			path:    "/kubepods/pod" + string(uid),
+			wantQoS: corev1.PodQOSGuaranteed,
+		},
+		{
+			name:    "cgroup v1 cgroupfs",
+			path:    "11:memory:/kubepods/burstable/pod" + string(uid) + "/" + cid,
+			wantQoS: corev1.PodQOSBurstable,
+		},
+		{
+			name:    "duplicate slashes and trailing newline",
+			path:    "0:://kubepods//burstable/pod" + string(uid) + "/\n",
+			wantQoS: corev1.PodQOSBurstable,
+		},
+		{name: "host process", path: "0::/system.slice/containerd.service"},
+		{name: "empty", path: ""},
+		{name: "qos only", path: "0::/kubepods/burstable"},
+		{name: "two qos levels", path: "0::/kubepods/burstable/besteffort/pod" + string(uid)},
+		{name: "unknown slice", path: "0::/kubepods.slice/system-pod" + escapedUID + ".slice"},
+		{name: "qos slice with suffix", path: "0::/kubepods.slice/kubepods-burstablex.slice/kubepods-pod" + escapedUID + ".slice"},
+		{name: "short uid", path: "0::/kubepods/pod" + string(uid[1:])},
+		{name: "misplaced dash", path: "0::/kubepods/pod2c48913cb-29f-11e7-9350-020968147796"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotUID, gotQoS, err := CompactCgroupPath(tt.path)
+			if tt.wantQoS == "" {
+				assert.ErrorIs(t, err, ErrNotPodCgroup)
+				assert.Empty(t, gotUID)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, uid, gotUID)
+			assert.Equal(t, tt.wantQoS, gotQoS)
+		})
+	}
+}
+
+var (
+	systemdPodSlice = regexp.MustCompile(`^kubepods(?:-(besteffort|burstable|guaranteed))?-pod([0-9a-fA-F_-]+)\.slice$`)
+	cgroupfsPodDir  = regexp.MustCompile(`^pod([0-9a-fA-F_-]+)$`)
+	podUIDFormat    = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+)
+
+// regexpPodCgroupUID is the regexp based parsing replaced by CompactCgroupPath, for the benchmarks
+func regexpPodCgroupUID(cgroupLine string) (types.UID, bool) {
+	normalize := func(encoded string) (types.UID, bool) {
+		uid := strings.ToLower(strings.ReplaceAll(encoded, "_", "-"))
+		return types.UID(uid), podUIDFormat.MatchString(uid)
+	}
+
+	cgroupPath := strings.TrimSpace(cgroupLine)
+	if parts := strings.SplitN(cgroupPath, ":", 3); len(parts) == 3 {
+		cgroupPath = parts[2]
+	}
+	var inKubepods bool
+	for _, segment := range strings.Split(cgroupPath, "/") {
+		if segment == "kubepods.slice" || segment == "kubepods" {
+			inKubepods = true
+			continue
+		}
+		if !inKubepods {
+			continue
+		}
+		if m := systemdPodSlice.FindStringSubmatch(segment); m != nil {
+			return normalize(m[2])
+		}
+		if m := cgroupfsPodDir.FindStringSubmatch(segment); m != nil {
+			return normalize(m[1])
+		}
+	}
+	return "", false
+}
+
+var benchmarkCgroupLines = []string{
+	"0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod2c48913c_b29f_11e7_9350_020968147796.slice/cri-containerd-9bca8d63d5fa610783847915bcff0ecac1273e5b4bed3f6fa1b07350e0135961.scope",
+	"0::/kubepods/besteffort/pod2c48913c-b29f-11e7-9350-020968147796/9bca8d63d5fa610783847915bcff0ecac1273e5b4bed3f6fa1b07350e0135961",
+	"0::/system.slice/containerd.service",
+}
+
+func BenchmarkCompactCgroupPath(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, line := range benchmarkCgroupLines {
+			_, _, _ = CompactCgroupPath(line)
+		}
+	}
+}
+
+func BenchmarkRegexpCgroupPath(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, line := range benchmarkCgroupLines {
+			_, _ = regexpPodCgroupUID(line)
+		}
+	}
+}
+
+func TestParsePodUIDFromCgroup(t *testing.T) {
+	const (
+		uid        = types.UID("2c48913c-b29f-11e7-9350-020968147796")
+		escapedUID = "2c48913c_b29f_11e7_9350_020968147796"
+		cid        = "9bca8d63d5fa610783847915bcff0ecac1273e5b4bed3f6fa1b07350e0135961"
+	)
+
+	tests := []struct {
+		name    string
+		cgroup  string
+		wantErr bool
+	}{
+		{
+			name: "cgroupfs cgroup v1",
+			cgroup: "12:pids:/kubepods/besteffort/pod" + string(uid) + "/" + cid + "\n" +
+				"11:memory:/kubepods/besteffort/pod" + string(uid) + "/" + cid + "\n" +
+				"4:cpu,cpuacct:/kubepods/besteffort/pod" + string(uid) + "/" + cid + "\n" +
+				"1:name=systemd:/kubepods/besteffort/pod" + string(uid) + "/" + cid + "\n",
+		},
+		{
+			name:   "cgroupfs cgroup v2",
+			cgroup: "0::/kubepods/pod" + string(uid) + "/" + cid + "\n",
+		},
+		{
+			name: "systemd cgroup v1",
+			cgroup: "12:pids:/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + escapedUID + ".slice/cri-containerd-" + cid + ".scope\n" +
+				"11:memory:/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + escapedUID + ".slice/cri-containerd-" + cid + ".scope\n" +
+				"1:name=systemd:/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + escapedUID + ".slice/cri-containerd-" + cid + ".scope\n",
+		},
+		{
+			name:   "systemd cgroup v2",
+			cgroup: "0::/kubepods.slice/kubepods-pod" + escapedUID + ".slice/cri-containerd-" + cid + ".scope\n",
+		},
+		{
+			name:   "single line",
+			cgroup: "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod" + escapedUID + ".slice",
+		},
+		{
+			name:   "pod line after host lines",
+			cgroup: "13:misc:/\n12:pids:/kubepods/burstable/pod" + string(uid) + "/" + cid + "\n",
+		},
+		{name: "host process cgroup v1", cgroup: "12:pids:/system.slice/containerd.service\n1:name=systemd:/system.slice/containerd.service\n", wantErr: true},
+		{name: "host process cgroup v2", cgroup: "0::/init.scope\n", wantErr: true},
+		{name: "empty", cgroup: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePodUIDFromCgroup(tt.cgroup)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrNotPodCgroup)
+				assert.Empty(t, got)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, uid, got)
+		})
+	}
+
+	// the uid of a static pod has no dashes
+	got, err := ParsePodUIDFromCgroup("0::/kubepods/burstable/pod9c7f3ef4b2e12a6b1a4e5ed1d2f5e3a8/" + cid + "\n")
+	assert.NoError(t, err)
+	assert.Equal(t, types.UID("9c7f3ef4b2e12a6b1a4e5ed1d2f5e3a8"), got)
+}
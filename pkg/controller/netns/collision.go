@@ -0,0 +1,76 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// NetnsCollisionTotal counts the pods found sharing the netns of another pod
+var NetnsCollisionTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "kmesh_netns_collision_total",
+		Help: "The total number of pods found sharing the netns of another pod.",
+	},
+)
+
+// NetnsCollision is a pod UID2 whose netns at Path is the netns of the pod UID1
+type NetnsCollision struct {
+	UID1  types.UID
+	UID2  types.UID
+	Path  string
+	Inode uint64
+}
+
+// ValidatePodNetnsAssignment returns the pods of assignments, which maps pod uids to netns paths,
+// sharing the netns inode of another pod. Each pod sharing a netns collides with the pod of
+// the smallest uid in the netns. Paths that cannot be resolved are ignored.
+func ValidatePodNetnsAssignment(assignments map[types.UID]string) []NetnsCollision {
+	uids := make(map[uint64][]types.UID)
+	for uid, nsPath := range assignments {
+		inode, err := getNetnsInode(nsPath)
+		if err != nil {
+			log.Debugf("skip validating netns of pod %s: %v", uid, err)
+			continue
+		}
+		uids[inode] = append(uids[inode], uid)
+	}
+
+	var collisions []NetnsCollision
+	for inode, shared := range uids {
+		if len(shared) < 2 {
+			continue
+		}
+		slices.Sort(shared)
+		for _, uid := range shared[1:] {
+			c := NetnsCollision{UID1: shared[0], UID2: uid, Path: assignments[uid], Inode: inode}
+			log.Errorf("pod %s shares netns %s (inode %d) with pod %s", c.UID2, c.Path, c.Inode, c.UID1)
+			NetnsCollisionTotal.Inc()
+			collisions = append(collisions, c)
+		}
+	}
+
+	slices.SortFunc(collisions, func(a, b NetnsCollision) int {
+		return cmp.Or(cmp.Compare(a.UID1, b.UID1), cmp.Compare(a.UID2, b.UID2))
+	})
+	return collisions
+}
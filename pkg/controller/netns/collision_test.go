@@ -0,0 +1,81 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestValidatePodNetnsAssignment(t *testing.T) {
+	dir := t.TempDir()
+	newNetnsFile := func(name string) string {
+		nsPath := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(nsPath, nil, 0644))
+		return nsPath
+	}
+	ns1, ns2 := newNetnsFile("ns1"), newNetnsFile("ns2")
+	// a bind mount of the same netns has the same inode
+	ns1Link := filepath.Join(dir, "ns1-link")
+	require.NoError(t, os.Link(ns1, ns1Link))
+	inode1, err := getNetnsInode(ns1)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		assignments map[types.UID]string
+		want        []NetnsCollision
+	}{
+		{
+			name:        "no collision",
+			assignments: map[types.UID]string{"uid-1": ns1, "uid-2": ns2},
+		},
+		{
+			name:        "same path",
+			assignments: map[types.UID]string{"uid-1": ns1, "uid-2": ns2, "uid-3": ns1},
+			want: []NetnsCollision{
+				{UID1: "uid-1", UID2: "uid-3", Path: ns1, Inode: inode1},
+			},
+		},
+		{
+			name:        "same inode",
+			assignments: map[types.UID]string{"uid-3": ns1Link, "uid-2": ns1, "uid-1": ns1},
+			want: []NetnsCollision{
+				{UID1: "uid-1", UID2: "uid-2", Path: ns1, Inode: inode1},
+				{UID1: "uid-1", UID2: "uid-3", Path: ns1Link, Inode: inode1},
+			},
+		},
+		{
+			name:        "unresolved path",
+			assignments: map[types.UID]string{"uid-1": "/not/exist", "uid-2": "/not/exist"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(NetnsCollisionTotal)
+			got := ValidatePodNetnsAssignment(tt.assignments)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, float64(len(tt.want)), testutil.ToFloat64(NetnsCollisionTotal)-before)
+		})
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	tasks "github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/apimachinery/pkg/types"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+const (
+	// DefaultContainerdSocket is the address of the containerd grpc api on the node
+	DefaultContainerdSocket = "/run/containerd/containerd.sock"
+	// ContainerdK8sNamespace is the containerd namespace of the containers created by the cri plugin
+	ContainerdK8sNamespace = "k8s.io"
+
+	// containerdNamespaceKey is the grpc metadata key containerd reads the namespace from
+	containerdNamespaceKey = "containerd-namespace"
+	// podUIDLabel is the label of the sandboxes created by the kubelet holding the uid of the pod
+	podUIDLabel = "io.kubernetes.pod.uid"
+	// sandboxInfoKey is the key of the verbose status of a sandbox holding its info
+	sandboxInfoKey = "info"
+)
+
+// criSandboxInfo is the part used of the verbose info of a sandbox returned by the cri plugin
+// of containerd
+type criSandboxInfo struct {
+	// Pid is the process of the sandbox task on the host, the shim or the hypervisor of a VM
+	Pid                int  `json:"pid"`
+	NetNamespaceClosed bool `json:"netNamespaceClosed"`
+	// RuntimeType is the containerd runtime of the sandbox, e.g. io.containerd.kata.v2
+	RuntimeType string `json:"runtimeType"`
+	RuntimeSpec struct {
+		Annotations map[string]string `json:"annotations"`
+	} `json:"runtimeSpec"`
+}
+
+// ContainerdClientConfig configures how the containerd api is accessed
+type ContainerdClientConfig struct {
+	// Namespace is the containerd namespace of the containers
+	Namespace string
+	// ProcRoot is where the proc of the host is mounted
+	ProcRoot string
+	Timeout  time.Duration
+}
+
+// DefaultContainerdClientConfig is used by GetNetnsFromContainerdTaskAPI
+var DefaultContainerdClientConfig = ContainerdClientConfig{
+	Namespace: ContainerdK8sNamespace,
+	ProcRoot:  utils.GetProcRootFromEnv(),
+	Timeout:   5 * time.Second,
+}
+
+// GetNetnsFromContainerdTaskAPI asks containerd listening on containerdSocket, DefaultContainerdSocket
+// if empty, for the task of containerID and returns the netns path of its process. The path is
+// cached for GetNetnsForSandboxFromCache, containerID being the sandbox id for the sandboxes.
+func GetNetnsFromContainerdTaskAPI(containerdSocket, containerID string) (string, error) {
+	nsPath, err := DefaultContainerdClientConfig.GetNetns(containerdSocket, containerID)
+	if err != nil {
+		return "", err
+	}
+	CacheSandboxNetns(containerID, nsPath)
+	return nsPath, nil
+}
+
+func dialContainerd(containerdSocket string) (*grpc.ClientConn, error) {
+	if containerdSocket == "" {
+		containerdSocket = DefaultContainerdSocket
+	}
+	conn, err := grpc.NewClient("unix://"+containerdSocket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to containerd %s: %v", containerdSocket, err)
+	}
+	return conn, nil
+}
+
+func (c ContainerdClientConfig) GetNetns(containerdSocket, containerID string) (string, error) {
+	conn, err := dialContainerd(containerdSocket)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, containerdNamespaceKey, c.Namespace)
+
+	resp, err := tasks.NewTasksClient(conn).Get(ctx, &tasks.GetRequest{ContainerID: containerID})
+	if err != nil {
+		return "", fmt.Errorf("failed to get task of container %s from containerd: %v", containerID, err)
+	}
+	process := resp.GetProcess()
+	if process.GetPid() == 0 || process.GetStatus() == task.Status_STOPPED {
+		return "", fmt.Errorf("task of container %s is not running, status %s", containerID, process.GetStatus())
+	}
+	return path.Join(c.ProcRoot, strconv.FormatUint(uint64(process.GetPid()), 10), "ns", "net"), nil
+}
+
+// GetSandboxID asks the cri plugin of containerd listening on containerdSocket,
+// DefaultContainerdSocket if empty, for the ready sandbox of the pod podUID. The newest one is
+// returned if a restarted pod has several.
+func (c ContainerdClientConfig) GetSandboxID(containerdSocket string, podUID types.UID) (string, error) {
+	conn, err := dialContainerd(containerdSocket)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	resp, err := runtimeapi.NewRuntimeServiceClient(conn).ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{
+		Filter: &runtimeapi.PodSandboxFilter{
+			State:         &runtimeapi.PodSandboxStateValue{State: runtimeapi.PodSandboxState_SANDBOX_READY},
+			LabelSelector: map[string]string{podUIDLabel: string(podUID)},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list sandboxes of pod %s from containerd: %v", podUID, err)
+	}
+	var newest *runtimeapi.PodSandbox
+	for _, sandbox := range resp.GetItems() {
+		if newest == nil || sandbox.GetCreatedAt() > newest.GetCreatedAt() {
+			newest = sandbox
+		}
+	}
+	if newest == nil {
+		return "", fmt.Errorf("no ready sandbox of pod %s", podUID)
+	}
+	return newest.GetId(), nil
+}
+
+// getSandboxInfo asks the cri plugin of containerd listening on containerdSocket for the
+// verbose status of the sandbox sandboxID
+func (c ContainerdClientConfig) getSandboxInfo(containerdSocket, sandboxID string) (*criSandboxInfo, error) {
+	conn, err := dialContainerd(containerdSocket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	resp, err := runtimeapi.NewRuntimeServiceClient(conn).PodSandboxStatus(ctx, &runtimeapi.PodSandboxStatusRequest{
+		PodSandboxId: sandboxID,
+		Verbose:      true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status of sandbox %s from containerd: %v", sandboxID, err)
+	}
+	data, ok := resp.GetInfo()[sandboxInfoKey]
+	if !ok {
+		return nil, fmt.Errorf("status of sandbox %s has no info", sandboxID)
+	}
+	info := &criSandboxInfo{}
+	if err := json.Unmarshal([]byte(data), info); err != nil {
+		return nil, fmt.Errorf("invalid info of sandbox %s: %v", sandboxID, err)
+	}
+	return info, nil
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tasks "github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/types"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+type mockTasksServer struct {
+	tasks.UnimplementedTasksServer
+	processes map[string]*task.Process
+	namespace string
+}
+
+func (s *mockTasksServer) Get(ctx context.Context, req *tasks.GetRequest) (*tasks.GetResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ns := md.Get(containerdNamespaceKey); len(ns) != 1 || ns[0] != s.namespace {
+		return nil, status.Errorf(codes.NotFound, "container %s not found in namespace %v", req.ContainerID, ns)
+	}
+	process, ok := s.processes[req.ContainerID]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no running task found: task %s not found", req.ContainerID)
+	}
+	return &tasks.GetResponse{Process: process}, nil
+}
+
+func TestGetNetnsFromContainerdTaskAPI(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "containerd.sock")
+	lis, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	tasks.RegisterTasksServer(server, &mockTasksServer{
+		namespace: ContainerdK8sNamespace,
+		processes: map[string]*task.Process{
+			"running": {ID: "running", Pid: 1234, Status: task.Status_RUNNING},
+			"stopped": {ID: "stopped", Pid: 1235, Status: task.Status_STOPPED},
+			"created": {ID: "created", Status: task.Status_CREATED},
+		},
+	})
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	defer server.Stop()
+
+	nsPath, err := GetNetnsFromContainerdTaskAPI(socket, "running")
+	require.NoError(t, err)
+	assert.Equal(t, "/host/proc/1234/ns/net", nsPath)
+
+	_, err = GetNetnsFromContainerdTaskAPI(socket, "stopped")
+	assert.ErrorContains(t, err, "is not running, status STOPPED")
+	_, err = GetNetnsFromContainerdTaskAPI(socket, "created")
+	assert.ErrorContains(t, err, "is not running")
+	_, err = GetNetnsFromContainerdTaskAPI(socket, "unknown")
+	assert.ErrorContains(t, err, "not found")
+
+	// the containers of other namespaces are not visible
+	c := DefaultContainerdClientConfig
+	c.Namespace = "moby"
+	_, err = c.GetNetns(socket, "running")
+	assert.Error(t, err)
+
+	c = DefaultContainerdClientConfig
+	c.Timeout = time.Second
+	_, err = c.GetNetns(filepath.Join(t.TempDir(), "not-exist.sock"), "running")
+	assert.Error(t, err)
+}
+
+type mockRuntimeServer struct {
+	runtimeapi.UnimplementedRuntimeServiceServer
+	sandboxes []*runtimeapi.PodSandbox
+	// infos are the verbose infos of the sandboxes by id
+	infos map[string]string
+}
+
+func (s *mockRuntimeServer) ListPodSandbox(_ context.Context, req *runtimeapi.ListPodSandboxRequest) (*runtimeapi.ListPodSandboxResponse, error) {
+	filter := req.GetFilter()
+	resp := &runtimeapi.ListPodSandboxResponse{}
+	for _, sandbox := range s.sandboxes {
+		if filter.GetState() != nil && sandbox.GetState() != filter.GetState().GetState() {
+			continue
+		}
+		matches := true
+		for k, v := range filter.GetLabelSelector() {
+			matches = matches && sandbox.GetLabels()[k] == v
+		}
+		if matches {
+			resp.Items = append(resp.Items, sandbox)
+		}
+	}
+	return resp, nil
+}
+
+func (s *mockRuntimeServer) PodSandboxStatus(_ context.Context, req *runtimeapi.PodSandboxStatusRequest) (*runtimeapi.PodSandboxStatusResponse, error) {
+	for _, sandbox := range s.sandboxes {
+		if sandbox.GetId() != req.GetPodSandboxId() {
+			continue
+		}
+		resp := &runtimeapi.PodSandboxStatusResponse{
+			Status: &runtimeapi.PodSandboxStatus{Id: sandbox.GetId(), State: sandbox.GetState(), CreatedAt: sandbox.GetCreatedAt()},
+		}
+		if info, ok := s.infos[sandbox.GetId()]; ok && req.GetVerbose() {
+			resp.Info = map[string]string{sandboxInfoKey: info}
+		}
+		return resp, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "an error occurred when try to find sandbox: not found")
+}
+
+func newMockSandbox(id string, podUID types.UID, state runtimeapi.PodSandboxState, createdAt int64) *runtimeapi.PodSandbox {
+	return &runtimeapi.PodSandbox{
+		Id:        id,
+		State:     state,
+		CreatedAt: createdAt,
+		Labels:    map[string]string{podUIDLabel: string(podUID)},
+	}
+}
+
+// serveMockContainerd serves the task api of processes and the cri api listing sandboxes, it
+// returns their socket
+func serveMockContainerd(t *testing.T, processes map[string]*task.Process, sandboxes ...*runtimeapi.PodSandbox) string {
+	return serveMockContainerdInfos(t, processes, nil, sandboxes...)
+}
+
+// serveMockContainerdInfos is serveMockContainerd with the verbose infos of the sandboxes by id
+func serveMockContainerdInfos(t *testing.T, processes map[string]*task.Process, infos map[string]string, sandboxes ...*runtimeapi.PodSandbox) string {
+	socket := filepath.Join(t.TempDir(), "containerd.sock")
+	lis, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	tasks.RegisterTasksServer(server, &mockTasksServer{namespace: ContainerdK8sNamespace, processes: processes})
+	runtimeapi.RegisterRuntimeServiceServer(server, &mockRuntimeServer{sandboxes: sandboxes, infos: infos})
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+	return socket
+}
+
+func TestGetSandboxID(t *testing.T) {
+	socket := serveMockContainerd(t, nil,
+		newMockSandbox("sb-old", "uid-1", runtimeapi.PodSandboxState_SANDBOX_READY, 1),
+		newMockSandbox("sb-new", "uid-1", runtimeapi.PodSandboxState_SANDBOX_READY, 2),
+		newMockSandbox("sb-stopped", "uid-1", runtimeapi.PodSandboxState_SANDBOX_NOTREADY, 3),
+		newMockSandbox("sb-other", "uid-2", runtimeapi.PodSandboxState_SANDBOX_READY, 1),
+		newMockSandbox("sb-gone", "uid-3", runtimeapi.PodSandboxState_SANDBOX_NOTREADY, 1),
+	)
+
+	c := DefaultContainerdClientConfig
+	sandboxID, err := c.GetSandboxID(socket, "uid-1")
+	require.NoError(t, err)
+	assert.Equal(t, "sb-new", sandboxID)
+	sandboxID, err = c.GetSandboxID(socket, "uid-2")
+	require.NoError(t, err)
+	assert.Equal(t, "sb-other", sandboxID)
+
+	_, err = c.GetSandboxID(socket, "uid-3")
+	assert.ErrorContains(t, err, "no ready sandbox")
+	_, err = c.GetSandboxID(socket, "uid-unknown")
+	assert.ErrorContains(t, err, "no ready sandbox")
+
+	c.Timeout = time.Second
+	_, err = c.GetSandboxID(filepath.Join(t.TempDir(), "not-exist.sock"), "uid-1")
+	assert.Error(t, err)
+}
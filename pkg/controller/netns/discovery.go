@@ -0,0 +1,136 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"istio.io/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// NetnsDiscoveryStrategy is a way of finding the netns path of a pod,
+// e.g. scanning /proc or asking the container runtime
+type NetnsDiscoveryStrategy interface {
+	Name() string
+	Discover(ctx context.Context, pod *corev1.Pod) (string, error)
+}
+
+// ProcScanStrategy discovers the netns by scanning the cgroups of the host processes
+type ProcScanStrategy struct{}
+
+func (ProcScanStrategy) Name() string {
+	return ProcScanStrategyName
+}
+
+func (ProcScanStrategy) Discover(_ context.Context, pod *corev1.Pod) (string, error) {
+	return GetPodNSpath(pod)
+}
+
+// StrategyError is the failure of one strategy
+type StrategyError struct {
+	Strategy string
+	Err      error
+}
+
+// NetnsDiscoveryError is returned when all the strategies failed
+type NetnsDiscoveryError struct {
+	UID    types.UID
+	Errors []StrategyError
+}
+
+func (e *NetnsDiscoveryError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("no netns discovery strategy registered for pod %s", e.UID)
+	}
+	msgs := make([]string, 0, len(e.Errors))
+	for _, se := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", se.Strategy, se.Err))
+	}
+	return fmt.Sprintf("failed to discover netns for pod %s, tried [%s]", e.UID, strings.Join(msgs, "; "))
+}
+
+// MultiRuntimeNetnsDiscovery tries the registered strategies in order and stops
+// at the first success. It supports nodes running several container runtimes.
+type MultiRuntimeNetnsDiscovery struct {
+	mu         sync.RWMutex
+	strategies []NetnsDiscoveryStrategy
+	// succeeded records the strategy that found the netns of each pod
+	succeeded map[types.UID]string
+}
+
+func NewMultiRuntimeNetnsDiscovery(strategies ...NetnsDiscoveryStrategy) *MultiRuntimeNetnsDiscovery {
+	return &MultiRuntimeNetnsDiscovery{
+		strategies: strategies,
+		succeeded:  make(map[types.UID]string),
+	}
+}
+
+// Register appends a strategy, it is tried after the existing ones
+func (d *MultiRuntimeNetnsDiscovery) Register(strategy NetnsDiscoveryStrategy) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.strategies = append(d.strategies, strategy)
+}
+
+// Discover returns the netns path found by the first successful strategy,
+// a *NetnsDiscoveryError with the error of every tried strategy is returned otherwise.
+func (d *MultiRuntimeNetnsDiscovery) Discover(ctx context.Context, pod *corev1.Pod) (string, error) {
+	d.mu.RLock()
+	strategies := d.strategies
+	d.mu.RUnlock()
+
+	discoveryErr := &NetnsDiscoveryError{UID: pod.UID}
+	for _, strategy := range strategies {
+		if err := ctx.Err(); err != nil {
+			discoveryErr.Errors = append(discoveryErr.Errors, StrategyError{Strategy: strategy.Name(), Err: err})
+			break
+		}
+
+		nsPath, err := strategy.Discover(ctx, pod)
+		if err != nil {
+			log.Debugf("strategy %s failed to discover netns for pod %s/%s: %v", strategy.Name(), pod.Namespace, pod.Name, err)
+			discoveryErr.Errors = append(discoveryErr.Errors, StrategyError{Strategy: strategy.Name(), Err: err})
+			continue
+		}
+
+		d.mu.Lock()
+		d.succeeded[pod.UID] = strategy.Name()
+		d.mu.Unlock()
+		return nsPath, nil
+	}
+	return "", discoveryErr
+}
+
+// SucceededStrategy returns the name of the strategy that found the netns of the pod
+func (d *MultiRuntimeNetnsDiscovery) SucceededStrategy(uid types.UID) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	name, ok := d.succeeded[uid]
+	return name, ok
+}
+
+// Forget removes the record of the pod, it should be called on pod deletion
+func (d *MultiRuntimeNetnsDiscovery) Forget(uid types.UID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.succeeded, uid)
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type mockStrategy struct {
+	name   string
+	nsPath string
+	err    error
+	calls  int
+}
+
+func (s *mockStrategy) Name() string {
+	return s.name
+}
+
+func (s *mockStrategy) Discover(_ context.Context, _ *corev1.Pod) (string, error) {
+	s.calls++
+	return s.nsPath, s.err
+}
+
+func TestMultiRuntimeNetnsDiscovery(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "ut-pod", UID: "ut-uid"}}
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name         string
+		strategies   []*mockStrategy
+		wantPath     string
+		wantStrategy string
+		wantErrs     []string
+		wantCalls    []int
+	}{
+		{
+			name: "first succeeds",
+			strategies: []*mockStrategy{
+				{name: "containerd", nsPath: "/ns/containerd"},
+				{name: "crio", nsPath: "/ns/crio"},
+			},
+			wantPath:     "/ns/containerd",
+			wantStrategy: "containerd",
+			wantCalls:    []int{1, 0},
+		},
+		{
+			name: "fallback to second",
+			strategies: []*mockStrategy{
+				{name: "containerd", err: errFailed},
+				{name: "crio", nsPath: "/ns/crio"},
+			},
+			wantPath:     "/ns/crio",
+			wantStrategy: "crio",
+			wantCalls:    []int{1, 1},
+		},
+		{
+			name: "all fail",
+			strategies: []*mockStrategy{
+				{name: "containerd", err: errFailed},
+				{name: "crio", err: errFailed},
+			},
+			wantErrs:  []string{"containerd", "crio"},
+			wantCalls: []int{1, 1},
+		},
+		{
+			name: "no strategy",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewMultiRuntimeNetnsDiscovery()
+			for _, s := range tt.strategies {
+				d.Register(s)
+			}
+
+			nsPath, err := d.Discover(context.Background(), pod)
+			for i, s := range tt.strategies {
+				assert.Equal(t, tt.wantCalls[i], s.calls)
+			}
+			if tt.wantPath == "" {
+				var discoveryErr *NetnsDiscoveryError
+				assert.True(t, errors.As(err, &discoveryErr))
+				var tried []string
+				for _, se := range discoveryErr.Errors {
+					tried = append(tried, se.Strategy)
+				}
+				assert.Equal(t, tt.wantErrs, tried)
+				_, ok := d.SucceededStrategy(pod.UID)
+				assert.False(t, ok)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantPath, nsPath)
+			name, ok := d.SucceededStrategy(pod.UID)
+			assert.True(t, ok)
+			assert.Equal(t, tt.wantStrategy, name)
+
+			d.Forget(pod.UID)
+			_, ok = d.SucceededStrategy(pod.UID)
+			assert.False(t, ok)
+		})
+	}
+}
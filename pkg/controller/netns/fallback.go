@@ -0,0 +1,176 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ProcScanStrategyName is the name of ProcScanStrategy
+	ProcScanStrategyName = "proc-scan"
+	// CRIStrategyName is the name of CRIStrategy
+	CRIStrategyName = "cri"
+	// KataStrategyName is the name of KataStrategy
+	KataStrategyName = "kata"
+	// KubeletStrategyName is the name of KubeletStrategy
+	KubeletStrategyName = "kubelet"
+
+	// DefaultStrategyTimeout is how long a strategy of NetnsDiscoveryFallbackChain is waited for
+	DefaultStrategyTimeout = 2 * time.Second
+)
+
+// DefaultNetnsDiscoveryStrategies is the order of the strategies tried if none is configured
+var DefaultNetnsDiscoveryStrategies = []string{KataStrategyName, CRIStrategyName, ProcScanStrategyName}
+
+// CRIStrategy discovers the netns of the sandbox of a pod, found by the cri api, from the
+// containerd task api
+type CRIStrategy struct {
+	// Socket is the containerd socket, DefaultContainerdSocket if empty
+	Socket string
+	Config ContainerdClientConfig
+}
+
+func (CRIStrategy) Name() string {
+	return CRIStrategyName
+}
+
+func (s CRIStrategy) Discover(_ context.Context, pod *corev1.Pod) (string, error) {
+	sandboxID, err := s.Config.GetSandboxID(s.Socket, pod.UID)
+	if err != nil {
+		return "", fmt.Errorf("sandbox of pod %s/%s is unknown: %v", pod.Namespace, pod.Name, err)
+	}
+	return s.Config.GetNetns(s.Socket, sandboxID)
+}
+
+// KataStrategy discovers the netns of a pod run by kata from its agent
+type KataStrategy struct {
+	Config KataClientConfig
+}
+
+func (KataStrategy) Name() string {
+	return KataStrategyName
+}
+
+func (s KataStrategy) Discover(_ context.Context, pod *corev1.Pod) (string, error) {
+	return s.Config.GetNetns(pod)
+}
+
+// KubeletStrategy discovers the netns annotated on a pod from the kubelet api
+type KubeletStrategy struct {
+	// Address is the kubelet api, e.g. DefaultKubeletAddress
+	Address string
+	Config  KubeletClientConfig
+}
+
+func (KubeletStrategy) Name() string {
+	return KubeletStrategyName
+}
+
+func (s KubeletStrategy) Discover(_ context.Context, pod *corev1.Pod) (string, error) {
+	return s.Config.GetSandboxNetns(s.Address, string(pod.UID))
+}
+
+// netnsDiscoveryStrategies creates the strategies that can be configured by name
+var netnsDiscoveryStrategies = map[string]func() NetnsDiscoveryStrategy{
+	ProcScanStrategyName: func() NetnsDiscoveryStrategy { return ProcScanStrategy{} },
+	CRIStrategyName: func() NetnsDiscoveryStrategy {
+		return CRIStrategy{Socket: DefaultContainerdSocket, Config: DefaultContainerdClientConfig}
+	},
+	KataStrategyName: func() NetnsDiscoveryStrategy { return KataStrategy{Config: DefaultKataClientConfig} },
+	KubeletStrategyName: func() NetnsDiscoveryStrategy {
+		return KubeletStrategy{Address: DefaultKubeletAddress, Config: DefaultKubeletClientConfig}
+	},
+}
+
+// NetnsDiscoveryConfig selects the netns discovery strategies of a node
+type NetnsDiscoveryConfig struct {
+	// Strategies are the names of the strategies in the order they are tried,
+	// DefaultNetnsDiscoveryStrategies if empty
+	Strategies []string `json:"strategies,omitempty"`
+	// StrategyTimeout bounds each strategy, DefaultStrategyTimeout if 0
+	StrategyTimeout time.Duration `json:"strategyTimeout,omitempty"`
+}
+
+// NetnsDiscoveryFallbackChain tries the strategies of a NetnsDiscoveryConfig in order, a
+// strategy not answering within the timeout is given up for the next one.
+type NetnsDiscoveryFallbackChain struct {
+	*MultiRuntimeNetnsDiscovery
+}
+
+// NewNetnsDiscoveryFallbackChain creates the strategies named by config, an unknown or
+// repeated name is an error.
+func NewNetnsDiscoveryFallbackChain(config NetnsDiscoveryConfig) (*NetnsDiscoveryFallbackChain, error) {
+	names := config.Strategies
+	if len(names) == 0 {
+		names = DefaultNetnsDiscoveryStrategies
+	}
+	timeout := config.StrategyTimeout
+	if timeout < 0 {
+		return nil, fmt.Errorf("invalid strategy timeout %s", timeout)
+	} else if timeout == 0 {
+		timeout = DefaultStrategyTimeout
+	}
+
+	strategies := make([]NetnsDiscoveryStrategy, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		newStrategy, ok := netnsDiscoveryStrategies[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown netns discovery strategy %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("netns discovery strategy %q is configured more than once", name)
+		}
+		seen[name] = true
+		strategies = append(strategies, timeoutStrategy{NetnsDiscoveryStrategy: newStrategy(), timeout: timeout})
+	}
+	return &NetnsDiscoveryFallbackChain{NewMultiRuntimeNetnsDiscovery(strategies...)}, nil
+}
+
+// timeoutStrategy stops waiting for a strategy after timeout, even if it ignores its context
+type timeoutStrategy struct {
+	NetnsDiscoveryStrategy
+	timeout time.Duration
+}
+
+type discoveryResult struct {
+	nsPath string
+	err    error
+}
+
+func (s timeoutStrategy) Discover(ctx context.Context, pod *corev1.Pod) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	// buffered so that a strategy returning late does not leak
+	done := make(chan discoveryResult, 1)
+	go func() {
+		nsPath, err := s.NetnsDiscoveryStrategy.Discover(ctx, pod)
+		done <- discoveryResult{nsPath: nsPath, err: err}
+	}()
+	select {
+	case res := <-done:
+		return res.nsPath, res.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("no answer in %s: %w", s.timeout, ctx.Err())
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// blockingStrategy ignores its context and answers once released
+type blockingStrategy struct {
+	name    string
+	release chan struct{}
+}
+
+func (s *blockingStrategy) Name() string {
+	return s.name
+}
+
+func (s *blockingStrategy) Discover(_ context.Context, _ *corev1.Pod) (string, error) {
+	<-s.release
+	return "/ns/" + s.name, nil
+}
+
+func useTestStrategies(t *testing.T, strategies ...NetnsDiscoveryStrategy) {
+	old := maps.Clone(netnsDiscoveryStrategies)
+	for _, strategy := range strategies {
+		netnsDiscoveryStrategies[strategy.Name()] = func() NetnsDiscoveryStrategy { return strategy }
+	}
+	t.Cleanup(func() {
+		netnsDiscoveryStrategies = old
+	})
+}
+
+func TestNewNetnsDiscoveryFallbackChain(t *testing.T) {
+	names := func(chain *NetnsDiscoveryFallbackChain) []string {
+		var res []string
+		for _, strategy := range chain.strategies {
+			res = append(res, strategy.Name())
+			assert.Equal(t, DefaultStrategyTimeout, strategy.(timeoutStrategy).timeout)
+		}
+		return res
+	}
+
+	chain, err := NewNetnsDiscoveryFallbackChain(NetnsDiscoveryConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"kata", "cri", "proc-scan"}, names(chain))
+
+	chain, err = NewNetnsDiscoveryFallbackChain(NetnsDiscoveryConfig{Strategies: []string{"proc-scan", "kubelet"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"proc-scan", "kubelet"}, names(chain))
+	assert.IsType(t, KubeletStrategy{}, chain.strategies[1].(timeoutStrategy).NetnsDiscoveryStrategy)
+
+	_, err = NewNetnsDiscoveryFallbackChain(NetnsDiscoveryConfig{Strategies: []string{"proc-scan", "crio"}})
+	assert.EqualError(t, err, `unknown netns discovery strategy "crio"`)
+	_, err = NewNetnsDiscoveryFallbackChain(NetnsDiscoveryConfig{Strategies: []string{"cri", "proc-scan", "cri"}})
+	assert.EqualError(t, err, `netns discovery strategy "cri" is configured more than once`)
+	_, err = NewNetnsDiscoveryFallbackChain(NetnsDiscoveryConfig{StrategyTimeout: -time.Second})
+	assert.Error(t, err)
+}
+
+func TestNetnsDiscoveryFallbackChain(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "ut-pod", UID: "ut-uid"}}
+	slow := &blockingStrategy{name: "cri", release: make(chan struct{})}
+	t.Cleanup(func() {
+		close(slow.release)
+	})
+	failing := &mockStrategy{name: "kata", err: errors.New("not a kata pod")}
+	procScan := &mockStrategy{name: "proc-scan", nsPath: "/ns/proc-scan"}
+	useTestStrategies(t, slow, failing, procScan)
+
+	chain, err := NewNetnsDiscoveryFallbackChain(NetnsDiscoveryConfig{
+		Strategies:      []string{"kata", "cri", "proc-scan"},
+		StrategyTimeout: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	// the slow cri api does not block the proc scan
+	start := time.Now()
+	nsPath, err := chain.Discover(context.TODO(), pod)
+	require.NoError(t, err)
+	assert.Equal(t, "/ns/proc-scan", nsPath)
+	assert.Less(t, time.Since(start), time.Second)
+	strategy, ok := chain.SucceededStrategy(pod.UID)
+	require.True(t, ok)
+	assert.Equal(t, "proc-scan", strategy)
+	assert.Equal(t, 1, failing.calls)
+	assert.Equal(t, 1, procScan.calls)
+
+	// the timeout is reported with the other errors
+	procScan.err = errors.New("no process")
+	_, err = chain.Discover(context.TODO(), pod)
+	var discoveryErr *NetnsDiscoveryError
+	require.ErrorAs(t, err, &discoveryErr)
+	require.Len(t, discoveryErr.Errors, 3)
+	assert.Equal(t, "cri", discoveryErr.Errors[1].Strategy)
+	assert.ErrorIs(t, discoveryErr.Errors[1].Err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "cri: no answer in 50ms")
+
+	// nothing is tried once ctx is done
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	_, err = chain.Discover(ctx, pod)
+	require.ErrorAs(t, err, &discoveryErr)
+	require.Len(t, discoveryErr.Errors, 1)
+	assert.ErrorIs(t, discoveryErr.Errors[0].Err, context.Canceled)
+	assert.Equal(t, 2, failing.calls)
+}
+
+func TestCRIStrategy(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "ut-pod", Namespace: "ut-ns", UID: "uid-1"}}
+	s := CRIStrategy{
+		Socket: serveMockContainerd(t,
+			map[string]*task.Process{"sb-1": {ID: "sb-1", Pid: 1234, Status: task.Status_RUNNING}},
+			newMockSandbox("sb-1", pod.UID, runtimeapi.PodSandboxState_SANDBOX_READY, 1),
+		),
+		Config: DefaultContainerdClientConfig,
+	}
+
+	nsPath, err := s.Discover(context.TODO(), pod)
+	require.NoError(t, err)
+	assert.Equal(t, "/host/proc/1234/ns/net", nsPath)
+
+	// the sandbox id annotation is not trusted
+	other := pod.DeepCopy()
+	other.UID = "uid-2"
+	other.Annotations = map[string]string{"io.kubernetes.cri.sandbox-id": "sb-1"}
+	_, err = s.Discover(context.TODO(), other)
+	assert.ErrorContains(t, err, "no ready sandbox")
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// EnrollmentState is a state of the enrollment of a pod
+type EnrollmentState int
+
+const (
+	// EnrollmentPending is the state of a pod whose netns is not searched yet
+	EnrollmentPending EnrollmentState = iota
+	// EnrollmentDiscovering is the state of a pod whose netns is found but not enrolled yet
+	EnrollmentDiscovering
+	// EnrollmentEnrolling is the state of a pod whose netns is being enrolled
+	EnrollmentEnrolling
+	EnrollmentEnrolled
+	// EnrollmentTerminating is the state of a pod being deleted
+	EnrollmentTerminating
+	// EnrollmentDetached is the final state of a deleted pod, nothing is attached anymore
+	EnrollmentDetached
+)
+
+var enrollmentStateNames = [...]string{"pending", "discovering", "enrolling", "enrolled", "terminating", "detached"}
+
+func (s EnrollmentState) String() string {
+	if s < 0 || int(s) >= len(enrollmentStateNames) {
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+	return enrollmentStateNames[s]
+}
+
+// NetnsEnrollmentFSMState is 1 for the current enrollment state of each pod with a PodNetnsEnrollmentFSM
+var NetnsEnrollmentFSMState = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "kmesh_netns_enrollment_state",
+		Help: "The current netns enrollment state of the pods, 1 for the state of each pod.",
+	},
+	[]string{"pod_uid", "state"},
+)
+
+// ErrInvalidTransition is returned by PodNetnsEnrollmentFSM.Transition for a transition not allowed
+// or whose preconditions are not met
+type ErrInvalidTransition struct {
+	From   EnrollmentState
+	To     EnrollmentState
+	Reason string
+}
+
+func (e *ErrInvalidTransition) Error() string {
+	return fmt.Sprintf("invalid enrollment transition from %s to %s: %s", e.From, e.To, e.Reason)
+}
+
+// PodNetnsEnrollmentActions are run by the transitions of PodNetnsEnrollmentFSM, nil actions succeed
+type PodNetnsEnrollmentActions struct {
+	// Discover returns the netns path of pod, run from pending to discovering
+	Discover func(pod *corev1.Pod) (string, error)
+	// Enroll attaches the netns of pod, run from enrolling to enrolled
+	Enroll func(pod *corev1.Pod, nsPath string) error
+	// Detach detaches the netns of pod, run from terminating to detached if the pod was enrolled
+	Detach func(pod *corev1.Pod, nsPath string) error
+}
+
+// enrollmentTransitions are the states each state can go to
+var enrollmentTransitions = map[EnrollmentState][]EnrollmentState{
+	EnrollmentPending:     {EnrollmentDiscovering, EnrollmentTerminating},
+	EnrollmentDiscovering: {EnrollmentEnrolling, EnrollmentPending, EnrollmentTerminating},
+	EnrollmentEnrolling:   {EnrollmentEnrolled, EnrollmentTerminating},
+	EnrollmentEnrolled:    {EnrollmentTerminating},
+	EnrollmentTerminating: {EnrollmentDetached},
+}
+
+// PodNetnsEnrollmentFSM is the enrollment lifecycle of a pod: pending, discovering, enrolling,
+// enrolled, terminating then detached. A pod may terminate from any state before enrolled,
+// and goes back to pending when its netns must be discovered again. A transition whose action
+// fails leaves the state unchanged.
+type PodNetnsEnrollmentFSM struct {
+	actions PodNetnsEnrollmentActions
+
+	mu    sync.Mutex
+	pod   *corev1.Pod
+	state EnrollmentState
+	// nsPath is the netns found by the discovery, empty if not discovered
+	nsPath   string
+	enrolled bool
+}
+
+// NewPodNetnsEnrollmentFSM creates the pending enrollment of pod
+func NewPodNetnsEnrollmentFSM(pod *corev1.Pod, actions PodNetnsEnrollmentActions) *PodNetnsEnrollmentFSM {
+	f := &PodNetnsEnrollmentFSM{actions: actions, pod: pod, state: EnrollmentPending}
+	NetnsEnrollmentFSMState.WithLabelValues(string(pod.UID), f.state.String()).Set(1)
+	return f
+}
+
+func (f *PodNetnsEnrollmentFSM) State() EnrollmentState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+// NetnsPath returns the netns path discovered, empty if not discovered
+func (f *PodNetnsEnrollmentFSM) NetnsPath() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nsPath
+}
+
+// Transition moves the enrollment to the state to, running the action of the transition.
+// An *ErrInvalidTransition is returned if the transition is not allowed, the error of the
+// action if it fails.
+func (f *PodNetnsEnrollmentFSM) Transition(to EnrollmentState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	from := f.state
+	if !slices.Contains(enrollmentTransitions[from], to) {
+		return &ErrInvalidTransition{From: from, To: to, Reason: "transition not allowed"}
+	}
+	if err := f.runTransition(to); err != nil {
+		return err
+	}
+
+	f.state = to
+	NetnsEnrollmentFSMState.DeleteLabelValues(string(f.pod.UID), from.String())
+	if to != EnrollmentDetached {
+		NetnsEnrollmentFSMState.WithLabelValues(string(f.pod.UID), to.String()).Set(1)
+	}
+	return nil
+}
+
+// runTransition checks the preconditions of the transition from the current state to the
+// state to and runs its action
+func (f *PodNetnsEnrollmentFSM) runTransition(to EnrollmentState) error {
+	switch to {
+	case EnrollmentDiscovering:
+		if f.actions.Discover == nil {
+			return nil
+		}
+		nsPath, err := f.actions.Discover(f.pod)
+		if err != nil {
+			return fmt.Errorf("failed to discover netns of pod %s/%s: %v", f.pod.Namespace, f.pod.Name, err)
+		}
+		f.nsPath = nsPath
+	case EnrollmentPending:
+		f.nsPath = ""
+	case EnrollmentEnrolling:
+		if f.nsPath == "" {
+			return &ErrInvalidTransition{From: f.state, To: to, Reason: "netns not discovered"}
+		}
+	case EnrollmentEnrolled:
+		if f.actions.Enroll != nil {
+			if err := f.actions.Enroll(f.pod, f.nsPath); err != nil {
+				return fmt.Errorf("failed to enroll netns %s of pod %s/%s: %v", f.nsPath, f.pod.Namespace, f.pod.Name, err)
+			}
+		}
+		f.enrolled = true
+	case EnrollmentTerminating:
+		if f.pod.DeletionTimestamp == nil {
+			return &ErrInvalidTransition{From: f.state, To: to, Reason: "pod is not being deleted"}
+		}
+	case EnrollmentDetached:
+		if f.enrolled && f.actions.Detach != nil {
+			if err := f.actions.Detach(f.pod, f.nsPath); err != nil {
+				return fmt.Errorf("failed to detach netns %s of pod %s/%s: %v", f.nsPath, f.pod.Namespace, f.pod.Name, err)
+			}
+		}
+		f.enrolled = false
+	}
+	return nil
+}
+
+// UpdatePod replaces the pod of the enrollment, e.g. once its deletion timestamp is set
+func (f *PodNetnsEnrollmentFSM) UpdatePod(pod *corev1.Pod) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pod = pod
+}
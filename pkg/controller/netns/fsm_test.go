@@ -0,0 +1,202 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type fsmRecorder struct {
+	calls                             []string
+	discoverErr, enrollErr, detachErr error
+}
+
+func (r *fsmRecorder) actions() PodNetnsEnrollmentActions {
+	return PodNetnsEnrollmentActions{
+		Discover: func(pod *corev1.Pod) (string, error) {
+			r.calls = append(r.calls, "discover")
+			return "/host/proc/1234/ns/net", r.discoverErr
+		},
+		Enroll: func(pod *corev1.Pod, nsPath string) error {
+			r.calls = append(r.calls, "enroll "+nsPath)
+			return r.enrollErr
+		},
+		Detach: func(pod *corev1.Pod, nsPath string) error {
+			r.calls = append(r.calls, "detach "+nsPath)
+			return r.detachErr
+		},
+	}
+}
+
+func newFSMTestPod(uid string, deleting bool) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: types.UID("fsm-" + uid), Namespace: "ns", Name: "pod"}}
+	if deleting {
+		now := metav1.Now()
+		pod.DeletionTimestamp = &now
+	}
+	return pod
+}
+
+// fsmStates returns the states of the pod uid exported by NetnsEnrollmentFSMState
+func fsmStates(t *testing.T, uid types.UID) map[string]float64 {
+	ch := make(chan prometheus.Metric, 100)
+	NetnsEnrollmentFSMState.Collect(ch)
+	close(ch)
+	states := map[string]float64{}
+	for metric := range ch {
+		m := &dto.Metric{}
+		require.NoError(t, metric.Write(m))
+		labels := map[string]string{}
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if labels["pod_uid"] == string(uid) {
+			states[labels["state"]] = m.GetGauge().GetValue()
+		}
+	}
+	return states
+}
+
+func TestPodNetnsEnrollmentFSMLifecycle(t *testing.T) {
+	r := &fsmRecorder{}
+	pod := newFSMTestPod("lifecycle", false)
+	f := NewPodNetnsEnrollmentFSM(pod, r.actions())
+	assert.Equal(t, EnrollmentPending, f.State())
+	assert.Equal(t, map[string]float64{"pending": 1}, fsmStates(t, pod.UID))
+
+	for _, to := range []EnrollmentState{EnrollmentDiscovering, EnrollmentEnrolling, EnrollmentEnrolled} {
+		require.NoError(t, f.Transition(to))
+		assert.Equal(t, to, f.State())
+	}
+	assert.Equal(t, "/host/proc/1234/ns/net", f.NetnsPath())
+	assert.Equal(t, []string{"discover", "enroll /host/proc/1234/ns/net"}, r.calls)
+
+	// the pod must be deleted before terminating
+	var invalid *ErrInvalidTransition
+	require.ErrorAs(t, f.Transition(EnrollmentTerminating), &invalid)
+	assert.Equal(t, ErrInvalidTransition{From: EnrollmentEnrolled, To: EnrollmentTerminating, Reason: "pod is not being deleted"}, *invalid)
+
+	f.UpdatePod(newFSMTestPod("lifecycle", true))
+	require.NoError(t, f.Transition(EnrollmentTerminating))
+	assert.Equal(t, map[string]float64{"terminating": 1}, fsmStates(t, pod.UID))
+
+	// the detach is retried until it succeeds
+	r.detachErr = errors.New("device busy")
+	assert.ErrorContains(t, f.Transition(EnrollmentDetached), "device busy")
+	assert.Equal(t, EnrollmentTerminating, f.State())
+	r.detachErr = nil
+	require.NoError(t, f.Transition(EnrollmentDetached))
+	assert.Equal(t, EnrollmentDetached, f.State())
+	assert.Equal(t, []string{"discover", "enroll /host/proc/1234/ns/net", "detach /host/proc/1234/ns/net", "detach /host/proc/1234/ns/net"}, r.calls)
+	// a detached pod has no state
+	assert.Empty(t, fsmStates(t, pod.UID))
+}
+
+func TestPodNetnsEnrollmentFSMFailedActions(t *testing.T) {
+	r := &fsmRecorder{discoverErr: errors.New("No matching network namespace found")}
+	f := NewPodNetnsEnrollmentFSM(newFSMTestPod("failed", false), r.actions())
+	assert.ErrorContains(t, f.Transition(EnrollmentDiscovering), "No matching network namespace found")
+	assert.Equal(t, EnrollmentPending, f.State())
+
+	r.discoverErr = nil
+	require.NoError(t, f.Transition(EnrollmentDiscovering))
+	// discovered again
+	require.NoError(t, f.Transition(EnrollmentPending))
+	assert.Empty(t, f.NetnsPath())
+	var invalid *ErrInvalidTransition
+	require.NoError(t, f.Transition(EnrollmentDiscovering))
+	require.NoError(t, f.Transition(EnrollmentEnrolling))
+
+	r.enrollErr = errors.New("attach failed")
+	assert.ErrorContains(t, f.Transition(EnrollmentEnrolled), "attach failed")
+	assert.False(t, errors.As(f.Transition(EnrollmentEnrolled), &invalid))
+	assert.Equal(t, EnrollmentEnrolling, f.State())
+
+	// a pod deleted before enrolled is not detached
+	f.UpdatePod(newFSMTestPod("failed", true))
+	require.NoError(t, f.Transition(EnrollmentTerminating))
+	require.NoError(t, f.Transition(EnrollmentDetached))
+	assert.NotContains(t, r.calls, "detach /host/proc/1234/ns/net")
+}
+
+func TestPodNetnsEnrollmentFSMTransitions(t *testing.T) {
+	// the states reachable from each state with the shortest path
+	paths := map[EnrollmentState][]EnrollmentState{
+		EnrollmentPending:     nil,
+		EnrollmentDiscovering: {EnrollmentDiscovering},
+		EnrollmentEnrolling:   {EnrollmentDiscovering, EnrollmentEnrolling},
+		EnrollmentEnrolled:    {EnrollmentDiscovering, EnrollmentEnrolling, EnrollmentEnrolled},
+		EnrollmentTerminating: {EnrollmentTerminating},
+		EnrollmentDetached:    {EnrollmentTerminating, EnrollmentDetached},
+	}
+	valid := map[[2]EnrollmentState]bool{
+		{EnrollmentPending, EnrollmentDiscovering}:     true,
+		{EnrollmentPending, EnrollmentTerminating}:     true,
+		{EnrollmentDiscovering, EnrollmentEnrolling}:   true,
+		{EnrollmentDiscovering, EnrollmentPending}:     true,
+		{EnrollmentDiscovering, EnrollmentTerminating}: true,
+		{EnrollmentEnrolling, EnrollmentEnrolled}:      true,
+		{EnrollmentEnrolling, EnrollmentTerminating}:   true,
+		{EnrollmentEnrolled, EnrollmentTerminating}:    true,
+		{EnrollmentTerminating, EnrollmentDetached}:    true,
+	}
+
+	for from, path := range paths {
+		for to := EnrollmentPending; to <= EnrollmentDetached; to++ {
+			t.Run(fmt.Sprintf("%s to %s", from, to), func(t *testing.T) {
+				r := &fsmRecorder{}
+				f := NewPodNetnsEnrollmentFSM(newFSMTestPod(fmt.Sprintf("%s-%s", from, to), true), r.actions())
+				for _, state := range path {
+					require.NoError(t, f.Transition(state))
+				}
+				require.Equal(t, from, f.State())
+
+				err := f.Transition(to)
+				if valid[[2]EnrollmentState{from, to}] {
+					assert.NoError(t, err)
+					assert.Equal(t, to, f.State())
+					return
+				}
+				var invalid *ErrInvalidTransition
+				require.ErrorAs(t, err, &invalid)
+				assert.Equal(t, ErrInvalidTransition{From: from, To: to, Reason: "transition not allowed"}, *invalid)
+				assert.Equal(t, from, f.State())
+			})
+		}
+	}
+}
+
+func TestPodNetnsEnrollmentFSMNotDiscovered(t *testing.T) {
+	f := NewPodNetnsEnrollmentFSM(newFSMTestPod("not-discovered", false), PodNetnsEnrollmentActions{
+		Discover: func(pod *corev1.Pod) (string, error) { return "", nil },
+	})
+	require.NoError(t, f.Transition(EnrollmentDiscovering))
+	var invalid *ErrInvalidTransition
+	require.ErrorAs(t, f.Transition(EnrollmentEnrolling), &invalid)
+	assert.Equal(t, "invalid enrollment transition from discovering to enrolling: netns not discovered", invalid.Error())
+	assert.Equal(t, "unknown(9)", EnrollmentState(9).String())
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+const (
+	patternHealthz = "/healthz/netns"
+	patternReadyz  = "/readyz/netns"
+)
+
+// CgroupProber checks that the cgroup information used to match processes to pods is readable
+type CgroupProber interface {
+	Probe() error
+}
+
+// ProcCgroupProber reads the cgroup of the init process under ProcRoot
+type ProcCgroupProber struct {
+	ProcRoot string
+}
+
+func (p ProcCgroupProber) Probe() error {
+	data, err := os.ReadFile(path.Join(p.ProcRoot, "1", "cgroup"))
+	if err != nil {
+		return fmt.Errorf("failed to read cgroup: %v", err)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("empty cgroup in %s", p.ProcRoot)
+	}
+	return nil
+}
+
+var (
+	// HealthTimeout is the window in which the last FindNetnsForPod call must have succeeded
+	HealthTimeout = 5 * time.Minute
+	// DefaultCgroupProber is checked by /readyz/netns
+	DefaultCgroupProber CgroupProber = ProcCgroupProber{ProcRoot: utils.GetProcRootFromEnv()}
+)
+
+type netnsHealth struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	lastErr error
+	now     func() time.Time
+}
+
+var health = &netnsHealth{now: time.Now}
+
+func (h *netnsHealth) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastRun = h.now()
+	h.lastErr = err
+}
+
+func (h *netnsHealth) check(timeout time.Duration) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastRun.IsZero() {
+		return fmt.Errorf("no netns lookup yet")
+	}
+	if h.lastErr != nil {
+		return fmt.Errorf("last netns lookup failed: %v", h.lastErr)
+	}
+	if since := h.now().Sub(h.lastRun); since > timeout {
+		return fmt.Errorf("last netns lookup succeeded %v ago", since.Round(time.Second))
+	}
+	return nil
+}
+
+func writeProbeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("OK"))
+}
+
+// HealthzHandler serves /healthz/netns, which succeeds if the last FindNetnsForPod
+// call succeeded within HealthTimeout, and /readyz/netns, which also requires
+// DefaultCgroupProber to succeed.
+func HealthzHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(patternHealthz, func(w http.ResponseWriter, r *http.Request) {
+		writeProbeResult(w, health.check(HealthTimeout))
+	})
+	mux.HandleFunc(patternReadyz, func(w http.ResponseWriter, r *http.Request) {
+		err := health.check(HealthTimeout)
+		if err == nil {
+			err = DefaultCgroupProber.Probe()
+		}
+		writeProbeResult(w, err)
+	})
+	return mux
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockCgroupProber struct {
+	err error
+}
+
+func (p mockCgroupProber) Probe() error {
+	return p.err
+}
+
+func TestHealthzHandler(t *testing.T) {
+	now := time.Now()
+	oldHealth, oldProber := health, DefaultCgroupProber
+	defer func() {
+		health, DefaultCgroupProber = oldHealth, oldProber
+	}()
+	health = &netnsHealth{now: func() time.Time { return now }}
+	DefaultCgroupProber = mockCgroupProber{}
+
+	server := httptest.NewServer(HealthzHandler())
+	defer server.Close()
+	status := func(pattern string) int {
+		resp, err := http.Get(server.URL + pattern)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		name       string
+		setup      func()
+		wantHealth int
+		wantReady  int
+	}{
+		{
+			name:       "no lookup yet",
+			setup:      func() {},
+			wantHealth: http.StatusServiceUnavailable,
+			wantReady:  http.StatusServiceUnavailable,
+		},
+		{
+			name: "last lookup succeeded",
+			setup: func() {
+				health.record(nil)
+			},
+			wantHealth: http.StatusOK,
+			wantReady:  http.StatusOK,
+		},
+		{
+			name: "cgroup probe failed",
+			setup: func() {
+				DefaultCgroupProber = mockCgroupProber{err: errors.New("no cgroup")}
+			},
+			wantHealth: http.StatusOK,
+			wantReady:  http.StatusServiceUnavailable,
+		},
+		{
+			name: "last lookup failed",
+			setup: func() {
+				DefaultCgroupProber = mockCgroupProber{}
+				health.record(errors.New("not found"))
+			},
+			wantHealth: http.StatusServiceUnavailable,
+			wantReady:  http.StatusServiceUnavailable,
+		},
+		{
+			name: "last lookup too old",
+			setup: func() {
+				health.record(nil)
+				now = now.Add(HealthTimeout + time.Second)
+			},
+			wantHealth: http.StatusServiceUnavailable,
+			wantReady:  http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			assert.Equal(t, tt.wantHealth, status(patternHealthz))
+			assert.Equal(t, tt.wantReady, status(patternReadyz))
+		})
+	}
+}
+
+func TestProcCgroupProber(t *testing.T) {
+	procRoot := t.TempDir()
+	prober := ProcCgroupProber{ProcRoot: procRoot}
+	assert.Error(t, prober.Probe())
+
+	require.NoError(t, os.Mkdir(filepath.Join(procRoot, "1"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(procRoot, "1", "cgroup"), []byte("0::/init.scope\n"), 0644))
+	assert.NoError(t, prober.Probe())
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// TerseNetnsInfo returns the cached netns state of the pod for logging,
+// e.g. "uid=abc123 inode=456789 path=/host/proc/1234/ns/net age=3.2s".
+// It never looks up the netns.
+func TerseNetnsInfo(uid types.UID) string {
+	return podNetnsCache.terseInfo(uid)
+}
+
+// FullNetnsInfo is TerseNetnsInfo followed by the process count and interfaces of the netns
+func FullNetnsInfo(uid types.UID) string {
+	return podNetnsCache.fullInfo(uid, utils.GetProcRootFromEnv())
+}
+
+func (c *NetnsCache) terseInfo(uid types.UID) string {
+	entry, ok := c.entry(uid)
+	if !ok {
+		return fmt.Sprintf("uid=%s not-cached", uid)
+	}
+	return fmt.Sprintf("uid=%s inode=%d path=%s age=%.1fs", uid, entry.inode, entry.path, c.now().Sub(entry.addedAt).Seconds())
+}
+
+func (c *NetnsCache) fullInfo(uid types.UID, procRoot string) string {
+	info := c.terseInfo(uid)
+	entry, ok := c.entry(uid)
+	if !ok {
+		return info
+	}
+
+	res, err := probeNetns(entry.path, procRoot)
+	if err != nil {
+		return fmt.Sprintf("%s probe-error=%q", info, err.Error())
+	}
+	names := make([]string, 0, len(res.Interfaces))
+	for _, iface := range res.Interfaces {
+		names = append(names, iface.Name)
+	}
+	return fmt.Sprintf("%s processes=%d interfaces=%s", info, res.ProcessCount, strings.Join(names, ","))
+}
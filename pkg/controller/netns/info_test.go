@@ -0,0 +1,56 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetnsInfo(t *testing.T) {
+	namedNetnsDir = t.TempDir()
+	defer func() {
+		_ = DeleteNamedNetns("ut-info")
+		namedNetnsDir = NamedNetnsDir
+	}()
+	nsPath, err := CreateNamedNetns("ut-info")
+	require.NoError(t, err)
+	inode, err := getNetnsInode(nsPath)
+	require.NoError(t, err)
+
+	now := time.Now()
+	c := NewNetnsCache()
+	c.now = func() time.Time { return now }
+	c.Add("abc123", nsPath)
+	c.Add("gone", "/not/exist")
+	now = now.Add(3200 * time.Millisecond)
+
+	assert.Equal(t, fmt.Sprintf("uid=abc123 inode=%d path=%s age=3.2s", inode, nsPath), c.terseInfo("abc123"))
+	assert.Equal(t, "uid=unknown not-cached", c.terseInfo("unknown"))
+	assert.Equal(t, "uid=unknown not-cached", c.fullInfo("unknown", t.TempDir()))
+
+	full := c.fullInfo("abc123", t.TempDir())
+	assert.Regexp(t, "^"+regexp.QuoteMeta(c.terseInfo("abc123"))+" processes=0 interfaces=.*lo", full)
+
+	full = c.fullInfo("gone", t.TempDir())
+	assert.Regexp(t, `^uid=gone inode=0 path=/not/exist age=3.2s probe-error=".+"$`, full)
+}
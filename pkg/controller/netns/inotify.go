@@ -0,0 +1,372 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/types"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// DefaultInotifyResyncInterval is how often NetnsInotifyWatcher rescans the proc for the
+// processes whose events are missed
+const DefaultInotifyResyncInterval = 10 * time.Second
+
+// DefaultCgroupRoot is the mount of the cgroup v2 hierarchy holding the kubepods cgroups
+const DefaultCgroupRoot = "/sys/fs/cgroup"
+
+const (
+	// podRescanInterval is how often the proc is rescanned for the first process of a
+	// container whose cgroup is created, the runtime moves it to the cgroup afterwards
+	podRescanInterval = 50 * time.Millisecond
+	// podRescanTimeout is how long the first process of a container is looked for
+	podRescanTimeout = 5 * time.Second
+)
+
+// PodNetnsReady is emitted by NetnsInotifyWatcher when the first process of a pod is found,
+// NetnsPath is the netns of the process PID.
+type PodNetnsReady struct {
+	UID       types.UID
+	PID       int
+	NetnsPath string
+}
+
+// cgroupDirLevel is the level of a cgroup directory watched by NetnsInotifyWatcher
+type cgroupDirLevel int
+
+const (
+	// levelRoot is the cgroup root, the kubepods directory is created in it
+	levelRoot cgroupDirLevel = iota
+	// levelKubepods is kubepods or kubepods.slice, the qos and guaranteed pod directories are created in it
+	levelKubepods
+	// levelQoS is the directory of a qos class, the pod directories are created in it
+	levelQoS
+	// levelPod is the directory of a pod, the container directories are created in it
+	levelPod
+)
+
+type cgroupDir struct {
+	path  string
+	level cgroupDirLevel
+}
+
+// NetnsInotifyWatcher watches with inotify the cgroup directories of the pods created under
+// the cgroup root, and rescans the proc for the first process of each container created to
+// find the pods whose netns is ready. A pod is reported again once all its processes found
+// have exited and a new one is found.
+//
+// procfs does not generate inotify events for its process directories, the cgroup directories
+// of the kubepods hierarchy do when the runtime creates them. The exited processes are found
+// by the rescans, the resyncs find the processes missed.
+type NetnsInotifyWatcher struct {
+	procRoot       string
+	cgroupRoot     string
+	resyncInterval time.Duration
+	// inotify is false to find the processes by the resyncs only
+	inotify bool
+	events  chan PodNetnsReady
+
+	// watches maps the inotify watches to the cgroup directories watched
+	watches map[int32]cgroupDir
+	// pending maps the pods whose container cgroup is created and no process is found yet
+	// to the time they are no longer looked for
+	pending       map[types.UID]time.Time
+	nextPodRescan time.Time
+
+	// pids maps the pod processes found to their pod
+	pids map[int]types.UID
+	// pods counts the processes found of each pod
+	pods map[types.UID]int
+}
+
+// NewNetnsInotifyWatcher creates a watcher of the proc mounted at procRoot and of the pod
+// cgroups under cgroupRoot, the cgroup v2 mount or a cgroup v1 hierarchy such as
+// /sys/fs/cgroup/systemd
+func NewNetnsInotifyWatcher(procRoot, cgroupRoot string, resyncInterval time.Duration) *NetnsInotifyWatcher {
+	return &NetnsInotifyWatcher{
+		procRoot:       procRoot,
+		cgroupRoot:     cgroupRoot,
+		resyncInterval: resyncInterval,
+		inotify:        true,
+		events:         make(chan PodNetnsReady, 64),
+		watches:        make(map[int32]cgroupDir),
+		pending:        make(map[types.UID]time.Time),
+		pids:           make(map[int]types.UID),
+		pods:           make(map[types.UID]int),
+	}
+}
+
+// Events returns the channel receiving the pods found by Run, it is closed once Run returns
+func (w *NetnsInotifyWatcher) Events() <-chan PodNetnsReady {
+	return w.events
+}
+
+// Run reports the pods of the processes running and then of the containers created until ctx is done
+func (w *NetnsInotifyWatcher) Run(ctx context.Context) error {
+	defer close(w.events)
+
+	fd := -1
+	if w.inotify {
+		var err error
+		if fd, err = w.addWatch(); err != nil {
+			return err
+		}
+		defer unix.Close(fd)
+	}
+
+	nextResync := time.Now()
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil
+		}
+		now := time.Now()
+		if !now.Before(nextResync) || (len(w.pending) > 0 && !now.Before(w.nextPodRescan)) {
+			if err := w.resync(ctx); err != nil {
+				return err
+			}
+			nextResync = now.Add(w.resyncInterval)
+			w.nextPodRescan = now.Add(podRescanInterval)
+		}
+		// wake up regularly to check ctx
+		wakeup := nextResync
+		if len(w.pending) > 0 && w.nextPodRescan.Before(wakeup) {
+			wakeup = w.nextPodRescan
+		}
+		timeout := max(min(time.Until(wakeup), 100*time.Millisecond), 0)
+		if fd < 0 {
+			time.Sleep(timeout)
+			continue
+		}
+
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(timeout.Milliseconds())+1)
+		if errors.Is(err, unix.EINTR) || n == 0 {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to poll inotify of %s: %v", w.cgroupRoot, err)
+		}
+		n, err = unix.Read(fd, buf)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read inotify of %s: %v", w.cgroupRoot, err)
+		}
+		if err := w.handleEvents(fd, buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *NetnsInotifyWatcher) addWatch() (int, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return -1, fmt.Errorf("failed to init inotify: %v", err)
+	}
+	if err := w.watchDir(fd, cgroupDir{path: w.cgroupRoot, level: levelRoot}); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// watchDir watches the directories created in dir and handles the ones created already
+func (w *NetnsInotifyWatcher) watchDir(fd int, dir cgroupDir) error {
+	wd, err := unix.InotifyAddWatch(fd, dir.path, unix.IN_CREATE)
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %v", dir.path, err)
+	}
+	w.watches[int32(wd)] = dir
+	// read after the watch is added not to miss a directory
+	w.listDir(fd, dir)
+	return nil
+}
+
+func (w *NetnsInotifyWatcher) listDir(fd int, dir cgroupDir) {
+	entries, err := os.ReadDir(dir.path)
+	if err != nil {
+		// the directory is removed already
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			w.dirCreated(fd, dir, entry.Name())
+		}
+	}
+}
+
+// dirCreated watches the kubepods, qos and pod directories created in parent, and looks for the
+// first process of the containers created
+func (w *NetnsInotifyWatcher) dirCreated(fd int, parent cgroupDir, name string) {
+	child := cgroupDir{path: filepath.Join(parent.path, name)}
+	switch parent.level {
+	case levelRoot:
+		if name != "kubepods" && name != "kubepods.slice" {
+			return
+		}
+		child.level = levelKubepods
+	case levelKubepods, levelQoS:
+		if _, ok := w.podUID(child.path); ok {
+			child.level = levelPod
+		} else if parent.level == levelKubepods {
+			child.level = levelQoS
+		} else {
+			return
+		}
+	case levelPod:
+		if uid, ok := w.podUID(child.path); ok {
+			w.pending[uid] = time.Now().Add(podRescanTimeout)
+			w.nextPodRescan = time.Now()
+		}
+		return
+	}
+	if err := w.watchDir(fd, child); err != nil {
+		log.Debugf("%v", err)
+	}
+}
+
+// podUID returns the uid of the pod owning the cgroup directory dirPath
+func (w *NetnsInotifyWatcher) podUID(dirPath string) (types.UID, bool) {
+	rel, err := filepath.Rel(w.cgroupRoot, dirPath)
+	if err != nil {
+		return "", false
+	}
+	uid, _, err := CompactCgroupPath(rel)
+	return uid, err == nil
+}
+
+// handleEvents handles the inotify events read in buf
+func (w *NetnsInotifyWatcher) handleEvents(fd int, buf []byte) error {
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + unix.SizeofInotifyEvent
+		offset = nameStart + int(event.Len)
+		if offset > len(buf) {
+			return fmt.Errorf("truncated inotify event of %s", w.cgroupRoot)
+		}
+
+		if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+			// list the directories watched again for the ones created whose events are lost
+			for _, dir := range maps.Clone(w.watches) {
+				w.listDir(fd, dir)
+			}
+			continue
+		}
+		if event.Mask&unix.IN_IGNORED != 0 {
+			// the directory is removed
+			delete(w.watches, event.Wd)
+			continue
+		}
+		dir, ok := w.watches[event.Wd]
+		if !ok || event.Mask&unix.IN_CREATE == 0 || event.Mask&unix.IN_ISDIR == 0 {
+			continue
+		}
+		// the name is padded with NULs
+		w.dirCreated(fd, dir, string(bytes.TrimRight(buf[nameStart:offset], "\x00")))
+	}
+	return nil
+}
+
+// resync removes the processes exited, adds the processes not found yet and stops looking for
+// the pods pending found or timed out
+func (w *NetnsInotifyWatcher) resync(ctx context.Context) error {
+	entries, err := os.ReadDir(w.procRoot)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", w.procRoot, err)
+	}
+
+	running := make(map[int]fs.DirEntry, len(entries))
+	for _, entry := range entries {
+		if !utils.IsProcEntry(entry) {
+			continue
+		}
+		if pid, err := strconv.Atoi(entry.Name()); err == nil {
+			running[pid] = entry
+		}
+	}
+	// the exits are handled first for a pod whose processes are all replaced to be reported again
+	for pid := range w.pids {
+		if _, ok := running[pid]; !ok {
+			w.removeProcess(pid)
+		}
+	}
+	for pid, entry := range running {
+		if _, ok := w.pids[pid]; ok {
+			continue
+		}
+		w.addProcess(ctx, pid, entry)
+	}
+
+	now := time.Now()
+	for uid, deadline := range w.pending {
+		if w.pods[uid] > 0 || now.After(deadline) {
+			delete(w.pending, uid)
+		}
+	}
+	return nil
+}
+
+// addProcess emits PodNetnsReady if pid is the first process found of its pod
+func (w *NetnsInotifyWatcher) addProcess(ctx context.Context, pid int, entry fs.DirEntry) {
+	var uid types.UID
+	var netnsName string
+	_ = walkProcForPodNetns(ctx, os.DirFS(w.procRoot), []fs.DirEntry{entry}, podNetnsFilter{}, func(_ string, podUID types.UID, nsPath string) error {
+		uid, netnsName = podUID, nsPath
+		return nil
+	})
+	if uid == "" {
+		return
+	}
+
+	w.pids[pid] = uid
+	w.pods[uid]++
+	if w.pods[uid] > 1 {
+		return
+	}
+	select {
+	case w.events <- PodNetnsReady{UID: uid, PID: pid, NetnsPath: path.Join(w.procRoot, netnsName)}:
+	case <-ctx.Done():
+	}
+}
+
+func (w *NetnsInotifyWatcher) removeProcess(pid int) {
+	uid, ok := w.pids[pid]
+	if !ok {
+		return
+	}
+	delete(w.pids, pid)
+	if w.pods[uid]--; w.pods[uid] == 0 {
+		delete(w.pods, uid)
+	}
+}
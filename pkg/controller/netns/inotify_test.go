@@ -0,0 +1,186 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const inotifyPodCgroup = "0::/kubepods/besteffort/pod" + string(warmupPodA) + "/9bca8d63d5fa610783847915bcff0ecac1273e5b4bed3f6fa1b07350e0135961\n"
+
+// addTestProcess populates the directory of pid before moving it to procRoot, as the
+// directories of procfs appear populated
+func addTestProcess(t testing.TB, procRoot string, pid int, cgroup string) {
+	dir := filepath.Join(t.TempDir(), strconv.Itoa(pid))
+	require.NoError(t, os.Mkdir(dir, 0755))
+	require.NoError(t, os.Symlink("/proc/"+strconv.Itoa(os.Getpid())+"/ns", filepath.Join(dir, "ns")))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cgroup"), []byte(cgroup), 0644))
+	require.NoError(t, os.Rename(dir, filepath.Join(procRoot, strconv.Itoa(pid))))
+}
+
+func startTestWatcher(t testing.TB, w *NetnsInotifyWatcher) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan error)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, <-done)
+	})
+}
+
+func nextPodNetnsReady(t testing.TB, w *NetnsInotifyWatcher) PodNetnsReady {
+	select {
+	case event := <-w.Events():
+		return event
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no pod netns ready")
+		return PodNetnsReady{}
+	}
+}
+
+func assertNoPodNetnsReady(t *testing.T, w *NetnsInotifyWatcher) {
+	select {
+	case event := <-w.Events():
+		assert.Fail(t, "unexpected pod netns ready", "%+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// addTestContainerCgroup creates the cgroup directory of a container under cgroupRoot, before
+// its process is added as a runtime does
+func addTestContainerCgroup(t testing.TB, cgroupRoot, cgroupPath string) {
+	require.NoError(t, os.MkdirAll(filepath.Join(cgroupRoot, cgroupPath), 0755))
+}
+
+func TestNetnsInotifyWatcher(t *testing.T) {
+	procRoot, pidA, pidB := newWarmupProcRoot(t)
+	cgroupRoot := t.TempDir()
+	podA := "kubepods/besteffort/pod" + string(warmupPodA)
+	addTestContainerCgroup(t, cgroupRoot, podA+"/9bca8d63d5fa")
+	w := NewNetnsInotifyWatcher(procRoot, cgroupRoot, time.Hour)
+	startTestWatcher(t, w)
+
+	// the running processes are found first
+	found := map[int]PodNetnsReady{}
+	for range 2 {
+		event := nextPodNetnsReady(t, w)
+		found[event.PID] = event
+	}
+	assert.Equal(t, PodNetnsReady{UID: warmupPodA, PID: pidA, NetnsPath: filepath.Join(procRoot, strconv.Itoa(pidA), "ns", "net")}, found[pidA])
+	assert.Equal(t, warmupPodB, found[pidB].UID)
+
+	// a new pod in the kubepods directory created after the watcher
+	const podC = 100001
+	addTestContainerCgroup(t, cgroupRoot, "kubepods.slice/kubepods-pod0b72f0c8_6fd2_4a1b_9d1e_3f6c2b8a4e5d.slice/cri-containerd-4c1a.scope")
+	time.Sleep(3 * podRescanInterval)
+	addTestProcess(t, procRoot, podC, "0::/kubepods.slice/kubepods-pod0b72f0c8_6fd2_4a1b_9d1e_3f6c2b8a4e5d.slice\n")
+	event := nextPodNetnsReady(t, w)
+	assert.Equal(t, "0b72f0c8-6fd2-4a1b-9d1e-3f6c2b8a4e5d", string(event.UID))
+	assert.Equal(t, podC, event.PID)
+
+	// neither a process of a pod found nor a host process is reported
+	addTestContainerCgroup(t, cgroupRoot, podA+"/5d3e0b7a61c2")
+	addTestProcess(t, procRoot, 100002, inotifyPodCgroup)
+	addTestProcess(t, procRoot, 100003, "0::/system.slice/containerd.service\n")
+	assertNoPodNetnsReady(t, w)
+
+	// the pod is reported again once all its processes are removed
+	require.NoError(t, os.RemoveAll(filepath.Join(procRoot, strconv.Itoa(pidA))))
+	require.NoError(t, os.RemoveAll(filepath.Join(procRoot, "100002")))
+	addTestContainerCgroup(t, cgroupRoot, podA+"/e07f2c94b8d1")
+	addTestProcess(t, procRoot, 100004, inotifyPodCgroup)
+	event = nextPodNetnsReady(t, w)
+	assert.Equal(t, warmupPodA, event.UID)
+	assert.Equal(t, 100004, event.PID)
+}
+
+func TestNetnsInotifyWatcherPendingTimeout(t *testing.T) {
+	procRoot := newTestProcRoot(t)
+	cgroupRoot := t.TempDir()
+	w := NewNetnsInotifyWatcher(procRoot, cgroupRoot, time.Hour)
+	// a pod whose first process is found and one whose process is not found in time
+	w.pending[warmupPodA] = time.Now().Add(time.Hour)
+	w.pending[warmupPodB] = time.Now().Add(-time.Second)
+	addTestProcess(t, procRoot, 100001, inotifyPodCgroup)
+	require.NoError(t, w.resync(context.TODO()))
+	assert.Empty(t, w.pending)
+	assert.Equal(t, warmupPodA, nextPodNetnsReady(t, w).UID)
+}
+
+func TestNetnsInotifyWatcherResync(t *testing.T) {
+	procRoot := newTestProcRoot(t)
+	w := NewNetnsInotifyWatcher(procRoot, t.TempDir(), 10*time.Millisecond)
+	w.inotify = false
+	startTestWatcher(t, w)
+
+	addTestProcess(t, procRoot, 100001, inotifyPodCgroup)
+	assert.Equal(t, warmupPodA, nextPodNetnsReady(t, w).UID)
+
+	// the process replaced is found in a single resync
+	require.NoError(t, os.RemoveAll(filepath.Join(procRoot, "100001")))
+	addTestProcess(t, procRoot, 100002, inotifyPodCgroup)
+	assert.Equal(t, 100002, nextPodNetnsReady(t, w).PID)
+}
+
+func TestNetnsInotifyWatcherErrors(t *testing.T) {
+	w := NewNetnsInotifyWatcher(newTestProcRoot(t), filepath.Join(t.TempDir(), "not-exist"), time.Hour)
+	assert.ErrorContains(t, w.Run(context.TODO()), "failed to watch")
+	_, ok := <-w.Events()
+	assert.False(t, ok)
+
+	w = NewNetnsInotifyWatcher(filepath.Join(t.TempDir(), "not-exist"), t.TempDir(), time.Hour)
+	assert.ErrorContains(t, w.Run(context.TODO()), "failed to read")
+
+	// the events are closed once ctx is done
+	w = NewNetnsInotifyWatcher(newTestProcRoot(t), t.TempDir(), time.Hour)
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	assert.NoError(t, w.Run(ctx))
+	_, ok = <-w.Events()
+	assert.False(t, ok)
+}
+
+// BenchmarkNetnsInotifyWatcherLatency measures the time from the creation of a container cgroup
+// and its process to its event. The cgroup and the proc are directories of a temporary
+// filesystem, the time taken by the runtime and the kernel is not measured.
+func BenchmarkNetnsInotifyWatcherLatency(b *testing.B) {
+	procRoot, cgroupRoot := b.TempDir(), b.TempDir()
+	podCgroup := "kubepods/besteffort/pod" + string(warmupPodA)
+	w := NewNetnsInotifyWatcher(procRoot, cgroupRoot, time.Hour)
+	startTestWatcher(b, w)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pid := 100000 + i
+		addTestContainerCgroup(b, cgroupRoot, filepath.Join(podCgroup, strconv.Itoa(i)))
+		addTestProcess(b, procRoot, pid, inotifyPodCgroup)
+		nextPodNetnsReady(b, w)
+
+		b.StopTimer()
+		require.NoError(b, os.RemoveAll(filepath.Join(procRoot, strconv.Itoa(pid))))
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// TCAttachSucceeded is the TCResult of the journal entries of successful enrollments
+	TCAttachSucceeded = "attached"
+	// TCAttachFailed is the TCResult of the journal entries of failed enrollments
+	TCAttachFailed = "failed"
+
+	// journalFileMode keeps the journal readable by root only, it names the workloads of the node
+	journalFileMode = 0600
+)
+
+// JournalEntry is a line of the enrollment journal
+type JournalEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	PodUID    types.UID `json:"podUID"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	NetnsPath string    `json:"netnsPath"`
+	// Inode is 0 if the netns could not be stat'ed
+	Inode    uint64 `json:"inode"`
+	TCResult string `json:"tcResult"`
+	// Error is the reason of a failed tc attachment
+	Error     string `json:"error,omitempty"`
+	Component string `json:"component"`
+}
+
+// NetnsEnrollmentJournal appends a JournalEntry for each enrollment to a file in
+// newline-delimited JSON, so that it can be audited when and where the pods were enrolled.
+type NetnsEnrollmentJournal struct {
+	mu        sync.Mutex
+	path      string
+	component string
+	file      *os.File
+	size      int64
+	now       func() time.Time
+}
+
+// NewNetnsEnrollmentJournal opens the journal at path, entries are appended to an existing
+// journal. component is the name recorded as the one performing the enrollments.
+func NewNetnsEnrollmentJournal(path, component string) (*NetnsEnrollmentJournal, error) {
+	j := &NetnsEnrollmentJournal{
+		path:      path,
+		component: component,
+		now:       time.Now,
+	}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *NetnsEnrollmentJournal) open() error {
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, journalFileMode)
+	if err != nil {
+		return fmt.Errorf("failed to open enrollment journal %s: %v", j.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat enrollment journal %s: %v", j.path, err)
+	}
+	j.file = f
+	j.size = info.Size()
+	return nil
+}
+
+// RecordEnrollment appends the result of enrolling pod in nsPath, tcErr is the error
+// of the tc attachment or nil if it succeeded.
+func (j *NetnsEnrollmentJournal) RecordEnrollment(pod *corev1.Pod, nsPath string, tcErr error) error {
+	inode, _ := getNetnsInode(nsPath)
+	entry := JournalEntry{
+		PodUID:    pod.UID,
+		Namespace: pod.Namespace,
+		Name:      pod.Name,
+		NetnsPath: nsPath,
+		Inode:     inode,
+		TCResult:  TCAttachSucceeded,
+	}
+	if tcErr != nil {
+		entry.TCResult = TCAttachFailed
+		entry.Error = tcErr.Error()
+	}
+	return j.Append(entry)
+}
+
+// Append writes entry as a line of the journal. The timestamp and the component
+// are filled in if unset.
+func (j *NetnsEnrollmentJournal) Append(entry JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return errors.New("enrollment journal is closed")
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = j.now()
+	}
+	if entry.Component == "" {
+		entry.Component = j.component
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal entry of pod %s: %v", entry.PodUID, err)
+	}
+	// a single write keeps the lines intact with concurrent writers of the file
+	n, err := j.file.Write(append(data, '\n'))
+	j.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write enrollment journal %s: %v", j.path, err)
+	}
+	return nil
+}
+
+// RotateJournal moves the journal to <path>.1, replacing an older rotated journal, and
+// starts a new one if it has grown to maxSizeBytes or more.
+func (j *NetnsEnrollmentJournal) RotateJournal(maxSizeBytes int) error {
+	if maxSizeBytes <= 0 {
+		return fmt.Errorf("invalid max journal size %d", maxSizeBytes)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return errors.New("enrollment journal is closed")
+	}
+	if j.size < int64(maxSizeBytes) {
+		return nil
+	}
+	if err := os.Rename(j.path, j.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate enrollment journal %s: %v", j.path, err)
+	}
+	j.file.Close()
+	j.file = nil
+	return j.open()
+}
+
+// Close closes the journal file
+func (j *NetnsEnrollmentJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func readJournal(t *testing.T, path string) []JournalEntry {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry JournalEntry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	require.NoError(t, scanner.Err())
+	return entries
+}
+
+func TestNetnsEnrollmentJournal(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "enrollment.journal")
+	nsPath := filepath.Join(dir, "netns")
+	require.NoError(t, os.WriteFile(nsPath, nil, 0644))
+	inode, err := getNetnsInode(nsPath)
+	require.NoError(t, err)
+
+	j, err := NewNetnsEnrollmentJournal(path, "kmesh-daemon")
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0).UTC()
+	j.now = func() time.Time { return now }
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "ut-pod", Namespace: "ut-ns", UID: "ut-uid"}}
+	require.NoError(t, j.RecordEnrollment(pod, nsPath, nil))
+	require.NoError(t, j.RecordEnrollment(pod, "/not/exist", errors.New("no veth peer")))
+	require.NoError(t, j.Append(JournalEntry{PodUID: "other", TCResult: TCAttachSucceeded, Component: "kmesh-cni"}))
+	require.NoError(t, j.Close())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(journalFileMode), info.Mode().Perm())
+
+	assert.Equal(t, []JournalEntry{
+		{
+			Timestamp: now,
+			PodUID:    "ut-uid",
+			Namespace: "ut-ns",
+			Name:      "ut-pod",
+			NetnsPath: nsPath,
+			Inode:     inode,
+			TCResult:  TCAttachSucceeded,
+			Component: "kmesh-daemon",
+		},
+		{
+			Timestamp: now,
+			PodUID:    "ut-uid",
+			Namespace: "ut-ns",
+			Name:      "ut-pod",
+			NetnsPath: "/not/exist",
+			TCResult:  TCAttachFailed,
+			Error:     "no veth peer",
+			Component: "kmesh-daemon",
+		},
+		{
+			Timestamp: now,
+			PodUID:    "other",
+			TCResult:  TCAttachSucceeded,
+			Component: "kmesh-cni",
+		},
+	}, readJournal(t, path))
+
+	assert.Error(t, j.Append(JournalEntry{PodUID: "closed"}))
+	assert.NoError(t, j.Close())
+
+	// reopening appends to the existing journal
+	j, err = NewNetnsEnrollmentJournal(path, "kmesh-daemon")
+	require.NoError(t, err)
+	defer j.Close()
+	require.NoError(t, j.Append(JournalEntry{PodUID: "reopened"}))
+	entries := readJournal(t, path)
+	require.Len(t, entries, 4)
+	assert.Equal(t, "reopened", string(entries[3].PodUID))
+}
+
+func TestRotateJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "enrollment.journal")
+	j, err := NewNetnsEnrollmentJournal(path, "kmesh-daemon")
+	require.NoError(t, err)
+	defer j.Close()
+
+	assert.Error(t, j.RotateJournal(0))
+
+	require.NoError(t, j.Append(JournalEntry{PodUID: "first"}))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	// not rotated below the max size
+	require.NoError(t, j.RotateJournal(int(info.Size())+1))
+	assert.NoFileExists(t, path+".1")
+
+	require.NoError(t, j.RotateJournal(int(info.Size())))
+	require.NoError(t, j.Append(JournalEntry{PodUID: "second"}))
+	rotated := readJournal(t, path+".1")
+	require.Len(t, rotated, 1)
+	assert.Equal(t, "first", string(rotated[0].PodUID))
+	current := readJournal(t, path)
+	require.Len(t, current, 1)
+	assert.Equal(t, "second", string(current[0].PodUID))
+
+	// an older rotated journal is replaced
+	require.NoError(t, j.RotateJournal(1))
+	rotated = readJournal(t, path+".1")
+	require.Len(t, rotated, 1)
+	assert.Equal(t, "second", string(rotated[0].PodUID))
+	assert.Empty(t, readJournal(t, path))
+}
+
+func TestReconcilerJournal(t *testing.T) {
+	f := newReconcileFixture(t)
+	path := filepath.Join(t.TempDir(), "enrollment.journal")
+	j, err := NewNetnsEnrollmentJournal(path, "kmesh-daemon")
+	require.NoError(t, err)
+	defer j.Close()
+	f.r.SetJournal(j)
+
+	f.enroller.enrollErr = errors.New("attach failed")
+	assert.Error(t, f.r.Reconcile(context.TODO(), f.pod, EventAdd))
+	f.enroller.enrollErr = nil
+	require.NoError(t, f.r.Reconcile(context.TODO(), f.pod, EventAdd))
+
+	entries := readJournal(t, path)
+	require.Len(t, entries, 2)
+	assert.Equal(t, TCAttachFailed, entries[0].TCResult)
+	assert.Equal(t, "attach failed", entries[0].Error)
+	assert.Equal(t, TCAttachSucceeded, entries[1].TCResult)
+	assert.Equal(t, f.oldNetns, entries[1].NetnsPath)
+	assert.NotZero(t, entries[1].Inode)
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// kataRuntimeClassPrefix starts the names of the RuntimeClasses installed by kata, e.g. kata-qemu
+	kataRuntimeClassPrefix = "kata"
+	// kataRuntimeTypePrefix starts the containerd runtimes of kata, e.g. io.containerd.kata.v2
+	// or io.containerd.kata-qemu.v2
+	kataRuntimeTypePrefix = "io.containerd.kata"
+
+	// criContainerTypeAnnotation is set by the cri plugin on the runtime spec of the sandboxes
+	// and the containers
+	criContainerTypeAnnotation = "io.kubernetes.cri.container-type"
+	criContainerTypeSandbox    = "sandbox"
+)
+
+// KataClientConfig configures how the sandbox of a kata pod is looked up
+type KataClientConfig struct {
+	// RuntimeClasses are the names of the RuntimeClasses whose handler is kata, in addition
+	// to the ones starting with kata
+	RuntimeClasses []string
+	// ContainerdSocket is where the sandbox of a pod is looked up, DefaultContainerdSocket if empty
+	ContainerdSocket string
+	Containerd       ContainerdClientConfig
+}
+
+// DefaultKataClientConfig is used by GetNetnsForKataContainer
+var DefaultKataClientConfig = KataClientConfig{
+	ContainerdSocket: DefaultContainerdSocket,
+	Containerd:       DefaultContainerdClientConfig,
+}
+
+// IsKataPod returns whether pod runs inside a kata VM according to DefaultKataClientConfig
+func IsKataPod(pod *corev1.Pod) bool {
+	return DefaultKataClientConfig.IsKataPod(pod)
+}
+
+// IsKataPod returns whether the RuntimeClass of pod is one of kata, i.e. it starts with kata or
+// is one of c.RuntimeClasses. The runtime of the sandbox is checked by GetNetns.
+func (c KataClientConfig) IsKataPod(pod *corev1.Pod) bool {
+	if pod.Spec.RuntimeClassName == nil {
+		return false
+	}
+	name := *pod.Spec.RuntimeClassName
+	return strings.HasPrefix(name, kataRuntimeClassPrefix) || slices.Contains(c.RuntimeClasses, name)
+}
+
+// GetNetnsForKataContainer returns the netns of the sandbox of the kata pod on the host, the one
+// given by the cni to the VM. The processes of the pod run in the VM and are not in the proc of
+// the host.
+func GetNetnsForKataContainer(pod *corev1.Pod) (string, error) {
+	return DefaultKataClientConfig.GetNetns(pod)
+}
+
+// GetNetns returns the netns of the sandbox task of pod, the shim or the hypervisor of its VM,
+// from the status of its sandbox returned by the cri plugin of containerd
+func (c KataClientConfig) GetNetns(pod *corev1.Pod) (string, error) {
+	if !c.IsKataPod(pod) {
+		return "", fmt.Errorf("pod %s/%s is not a kata pod", pod.Namespace, pod.Name)
+	}
+	sandboxID, err := c.Containerd.GetSandboxID(c.ContainerdSocket, pod.UID)
+	if err != nil {
+		return "", fmt.Errorf("sandbox of kata pod %s/%s is unknown: %v", pod.Namespace, pod.Name, err)
+	}
+	info, err := c.Containerd.getSandboxInfo(c.ContainerdSocket, sandboxID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get netns of kata pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+
+	if containerType := info.RuntimeSpec.Annotations[criContainerTypeAnnotation]; containerType != criContainerTypeSandbox {
+		return "", fmt.Errorf("sandbox %s of pod %s/%s has container type %q", sandboxID, pod.Namespace, pod.Name, containerType)
+	}
+	if !strings.HasPrefix(info.RuntimeType, kataRuntimeTypePrefix) {
+		return "", fmt.Errorf("sandbox %s of pod %s/%s is run by %s, not kata", sandboxID, pod.Namespace, pod.Name, info.RuntimeType)
+	}
+	if info.NetNamespaceClosed || info.Pid <= 0 {
+		return "", fmt.Errorf("sandbox %s of kata pod %s/%s is not running", sandboxID, pod.Namespace, pod.Name)
+	}
+	return path.Join(c.Containerd.ProcRoot, strconv.Itoa(info.Pid), "ns", "net"), nil
+}
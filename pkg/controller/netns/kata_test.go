@@ -0,0 +1,153 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// kataSandboxInfo formats the verbose info of a sandbox as returned by the cri plugin of
+// containerd, with its pid, netNamespaceClosed, runtimeType and container type annotation
+const kataSandboxInfo = `{
+  "pid": %d,
+  "processStatus": "running",
+  "netNamespaceClosed": %t,
+  "image": "registry.k8s.io/pause:3.9",
+  "snapshotKey": "sb",
+  "snapshotter": "overlayfs",
+  "runtimeHandler": "kata-qemu",
+  "runtimeType": %q,
+  "runtimeOptions": {"config_path": "/opt/kata/share/defaults/kata-containers/configuration-qemu.toml"},
+  "config": {
+    "metadata": {"name": "ut-kata", "uid": "uid-sb", "namespace": "ut-ns"},
+    "log_directory": "/var/log/pods/ut-ns_ut-kata_uid-sb",
+    "linux": {"cgroup_parent": "/kubepods/besteffort/poduid-sb"}
+  },
+  "runtimeSpec": {
+    "ociVersion": "1.1.0",
+    "process": {"args": ["/pause"], "cwd": "/"},
+    "annotations": {
+      "io.kubernetes.cri.container-type": %q,
+      "io.kubernetes.cri.sandbox-id": "sb",
+      "io.kubernetes.cri.sandbox-name": "ut-kata",
+      "io.kubernetes.cri.sandbox-namespace": "ut-ns"
+    },
+    "linux": {
+      "namespaces": [
+        {"type": "pid"},
+        {"type": "ipc"},
+        {"type": "uts"},
+        {"type": "mount"},
+        {"type": "network", "path": "/var/run/netns/cni-0f5c2d3e-8b1a-4c6f-9e2d-7a3b5c1d4e6f"}
+      ]
+    }
+  },
+  "cniResult": {"Interfaces": {"eth0": {"IPConfigs": [{"IP": "10.244.0.12", "Gateway": "10.244.0.1"}]}}}
+}`
+
+// newKataPod returns a kata pod whose sandbox is sandboxID for serveMockContainerd
+func newKataPod(sandboxID string) *corev1.Pod {
+	runtimeClass := "kata-qemu"
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ut-kata",
+			Namespace: "ut-ns",
+			UID:       types.UID("uid-" + sandboxID),
+		},
+		Spec: corev1.PodSpec{RuntimeClassName: &runtimeClass},
+	}
+}
+
+func TestIsKataPod(t *testing.T) {
+	assert.True(t, IsKataPod(newKataPod("sb")))
+
+	runc := newKataPod("sb")
+	runc.Spec.RuntimeClassName = nil
+	assert.False(t, IsKataPod(runc))
+
+	gvisor := newKataPod("sb")
+	runtimeClass := "gvisor"
+	gvisor.Spec.RuntimeClassName = &runtimeClass
+	assert.False(t, IsKataPod(gvisor))
+
+	// a RuntimeClass of kata with a custom name is configured
+	custom := newKataPod("sb")
+	runtimeClass = "secure-vm"
+	custom.Spec.RuntimeClassName = &runtimeClass
+	assert.False(t, IsKataPod(custom))
+	assert.True(t, KataClientConfig{RuntimeClasses: []string{"secure-vm"}}.IsKataPod(custom))
+}
+
+func TestGetNetnsForKataContainer(t *testing.T) {
+	infos := map[string]string{
+		"sb-running": fmt.Sprintf(kataSandboxInfo, 4242, false, "io.containerd.kata.v2", "sandbox"),
+		"sb-qemu":    fmt.Sprintf(kataSandboxInfo, 4243, false, "io.containerd.kata-qemu.v2", "sandbox"),
+		"sb-closed":  fmt.Sprintf(kataSandboxInfo, 4244, true, "io.containerd.kata.v2", "sandbox"),
+		"sb-exited":  fmt.Sprintf(kataSandboxInfo, 0, false, "io.containerd.kata.v2", "sandbox"),
+		"sb-runc":    fmt.Sprintf(kataSandboxInfo, 4245, false, "io.containerd.runc.v2", "sandbox"),
+		"sb-type":    fmt.Sprintf(kataSandboxInfo, 4246, false, "io.containerd.kata.v2", "container"),
+		"sb-garbage": "pid",
+	}
+	var sandboxes []*runtimeapi.PodSandbox
+	for _, sandboxID := range []string{"sb-running", "sb-qemu", "sb-closed", "sb-exited", "sb-runc", "sb-type", "sb-garbage", "sb-noinfo"} {
+		pod := newKataPod(sandboxID)
+		sandboxes = append(sandboxes, newMockSandbox(sandboxID, pod.UID, runtimeapi.PodSandboxState_SANDBOX_READY, 1))
+	}
+	c := KataClientConfig{
+		ContainerdSocket: serveMockContainerdInfos(t, nil, infos, sandboxes...),
+		Containerd:       DefaultContainerdClientConfig,
+	}
+
+	nsPath, err := c.GetNetns(newKataPod("sb-running"))
+	require.NoError(t, err)
+	assert.Equal(t, "/host/proc/4242/ns/net", nsPath)
+	nsPath, err = c.GetNetns(newKataPod("sb-qemu"))
+	require.NoError(t, err)
+	assert.Equal(t, "/host/proc/4243/ns/net", nsPath)
+
+	tests := []struct {
+		sandboxID string
+		err       string
+	}{
+		{sandboxID: "sb-closed", err: "is not running"},
+		{sandboxID: "sb-exited", err: "is not running"},
+		{sandboxID: "sb-runc", err: "is run by io.containerd.runc.v2, not kata"},
+		{sandboxID: "sb-type", err: `has container type "container"`},
+		{sandboxID: "sb-garbage", err: "invalid info"},
+		{sandboxID: "sb-noinfo", err: "has no info"},
+		{sandboxID: "sb-not-ready", err: "no ready sandbox"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sandboxID, func(t *testing.T) {
+			_, err := c.GetNetns(newKataPod(tt.sandboxID))
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+
+	runc := newKataPod("sb-running")
+	runc.Spec.RuntimeClassName = nil
+	_, err = c.GetNetns(runc)
+	assert.ErrorContains(t, err, "not a kata pod")
+}
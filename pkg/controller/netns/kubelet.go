@@ -0,0 +1,127 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// DefaultKubeletAddress is the address of the kubelet https api on the node
+	DefaultKubeletAddress = "https://localhost:10250"
+	// NetnsAnnotation is the pod annotation holding the sandbox netns path
+	NetnsAnnotation = "kmesh.net/netns"
+)
+
+// KubeletClientConfig configures how the kubelet api is accessed
+type KubeletClientConfig struct {
+	// CertFile and KeyFile are the client certificate of the node, they can be the same file
+	CertFile string
+	KeyFile  string
+	// CAFile verifies the serving certificate of the kubelet
+	CAFile string
+	// NetnsAnnotationKey is the pod annotation holding the netns path
+	NetnsAnnotationKey string
+	Timeout            time.Duration
+}
+
+// DefaultKubeletClientConfig is used by GetSandboxNetnsFromKubelet
+var DefaultKubeletClientConfig = KubeletClientConfig{
+	CertFile:           "/var/lib/kubelet/pki/kubelet-client-current.pem",
+	KeyFile:            "/var/lib/kubelet/pki/kubelet-client-current.pem",
+	CAFile:             "/etc/kubernetes/pki/ca.crt",
+	NetnsAnnotationKey: NetnsAnnotation,
+	Timeout:            5 * time.Second,
+}
+
+// GetSandboxNetnsFromKubelet lists the pods from the kubelet api at kubeletSocket,
+// e.g. DefaultKubeletAddress, and returns the netns path annotated on the pod with podUID.
+func GetSandboxNetnsFromKubelet(kubeletSocket, podUID string) (string, error) {
+	return DefaultKubeletClientConfig.GetSandboxNetns(kubeletSocket, podUID)
+}
+
+func (c KubeletClientConfig) httpClient() (*http.Client, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubelet client cert: %v", err)
+	}
+	ca, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubelet ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no valid certificate found in %s", c.CAFile)
+	}
+
+	return &http.Client{
+		Timeout: c.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				RootCAs:      pool,
+				MinVersion:   tls.VersionTLS12,
+			},
+		},
+	}, nil
+}
+
+// GetSandboxNetns is GetSandboxNetnsFromKubelet with the config c
+func (c KubeletClientConfig) GetSandboxNetns(kubeletSocket, podUID string) (string, error) {
+	client, err := c.httpClient()
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Get(strings.TrimSuffix(kubeletSocket, "/") + "/pods")
+	if err != nil {
+		return "", fmt.Errorf("failed to list pods from kubelet: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("failed to list pods from kubelet: %s %s", resp.Status, body)
+	}
+
+	var pods corev1.PodList
+	if err = json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return "", fmt.Errorf("failed to decode pod list from kubelet: %v", err)
+	}
+
+	for _, pod := range pods.Items {
+		if pod.UID != types.UID(podUID) {
+			continue
+		}
+		nsPath, ok := pod.Annotations[c.NetnsAnnotationKey]
+		if !ok || nsPath == "" {
+			return "", fmt.Errorf("pod %s/%s has no %s annotation", pod.Namespace, pod.Name, c.NetnsAnnotationKey)
+		}
+		return nsPath, nil
+	}
+	return "", fmt.Errorf("pod %s not found in kubelet", podUID)
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestCert issues a certificate signed by parent, or a self signed ca when parent is nil
+func newTestCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, serial int64) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "kmesh-ut"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestGetSandboxNetnsFromKubelet(t *testing.T) {
+	ca, caKey, caPem, _ := newTestCert(t, nil, nil, 1)
+	_, _, serverPem, serverKeyPem := newTestCert(t, ca, caKey, 2)
+	_, _, clientPem, clientKeyPem := newTestCert(t, ca, caKey, 3)
+
+	dir := t.TempDir()
+	config := KubeletClientConfig{
+		CertFile:           filepath.Join(dir, "client.crt"),
+		KeyFile:            filepath.Join(dir, "client.key"),
+		CAFile:             filepath.Join(dir, "ca.crt"),
+		NetnsAnnotationKey: NetnsAnnotation,
+		Timeout:            5 * time.Second,
+	}
+	require.NoError(t, os.WriteFile(config.CertFile, clientPem, 0600))
+	require.NoError(t, os.WriteFile(config.KeyFile, clientKeyPem, 0600))
+	require.NoError(t, os.WriteFile(config.CAFile, caPem, 0600))
+
+	pods := corev1.PodList{Items: []corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "pod-1", Namespace: "default", UID: "uid-1",
+			Annotations: map[string]string{NetnsAnnotation: "/var/run/netns/cni-1"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "pod-2", Namespace: "default", UID: "uid-2"}},
+	}}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pods" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(pods)
+	}))
+	serverCert, err := tls.X509KeyPair(serverPem, serverKeyPem)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	nsPath, err := config.GetSandboxNetns(server.URL, "uid-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "/var/run/netns/cni-1", nsPath)
+
+	_, err = config.GetSandboxNetns(server.URL, "uid-2")
+	assert.ErrorContains(t, err, "no "+NetnsAnnotation)
+
+	_, err = config.GetSandboxNetns(server.URL, "uid-3")
+	assert.ErrorContains(t, err, "not found")
+
+	_, err = config.GetSandboxNetns(server.URL+"/unknown", "uid-1")
+	assert.ErrorContains(t, err, "404")
+
+	// without a client cert the kubelet rejects the handshake
+	noClientCert := config
+	noClientCert.CertFile = filepath.Join(dir, "missing.crt")
+	_, err = noClientCert.GetSandboxNetns(server.URL, "uid-1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// NetnsGoroutineLeakDetector finds the netns left behind by tests. A netns outlives the
+// goroutine that created it only while it is bind mounted, as done by CreateNamedNetns and
+// ns.TempNetNS, so the netns are tracked by their nsfs mounts.
+type NetnsGoroutineLeakDetector struct {
+	mountInfoPath string
+	before        map[string]bool
+}
+
+// NewNetnsGoroutineLeakDetector creates a detector recording the netns mounted at the time
+func NewNetnsGoroutineLeakDetector() (*NetnsGoroutineLeakDetector, error) {
+	d := &NetnsGoroutineLeakDetector{mountInfoPath: "/proc/self/mountinfo"}
+	if err := d.Snapshot(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Snapshot records the netns mounted now, Leaked reports the netns mounted after
+func (d *NetnsGoroutineLeakDetector) Snapshot() error {
+	mounts, err := d.netnsMounts()
+	if err != nil {
+		return err
+	}
+	d.before = make(map[string]bool, len(mounts))
+	for _, m := range mounts {
+		d.before[m] = true
+	}
+	return nil
+}
+
+// Leaked returns the paths of the netns mounted since the last snapshot
+func (d *NetnsGoroutineLeakDetector) Leaked() ([]string, error) {
+	mounts, err := d.netnsMounts()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(mounts, func(m string) bool {
+		return d.before[m]
+	}), nil
+}
+
+// Run is meant for TestMain, it runs run, usually testing.M.Run, and makes the exit
+// code fail if netns are leaked.
+func (d *NetnsGoroutineLeakDetector) Run(run func() int) int {
+	code := run()
+	leaked, err := d.Leaked()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to check netns leaks: %v\n", err)
+		return max(code, 1)
+	}
+	if len(leaked) > 0 {
+		fmt.Fprintf(os.Stderr, "leaked netns: %s\n", strings.Join(leaked, ", "))
+		return max(code, 1)
+	}
+	return code
+}
+
+// testingT is the part of testing.TB used by Track
+type testingT interface {
+	Helper()
+	Cleanup(func())
+	Errorf(format string, args ...any)
+}
+
+// Track fails t if netns are leaked by the end of t, the leaks of the other tests
+// running in parallel are reported too.
+func (d *NetnsGoroutineLeakDetector) Track(t testingT) {
+	t.Helper()
+	tracker := &NetnsGoroutineLeakDetector{mountInfoPath: d.mountInfoPath}
+	if err := tracker.Snapshot(); err != nil {
+		t.Errorf("failed to snapshot netns: %v", err)
+		return
+	}
+	t.Cleanup(func() {
+		leaked, err := tracker.Leaked()
+		if err != nil {
+			t.Errorf("failed to check netns leaks: %v", err)
+		} else if len(leaked) > 0 {
+			t.Errorf("leaked netns: %s", strings.Join(leaked, ", "))
+		}
+	})
+}
+
+// netnsMounts returns the mount points of the netns listed in the mountinfo
+func (d *NetnsGoroutineLeakDetector) netnsMounts() ([]string, error) {
+	f, err := os.Open(d.mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 2108 29 0:4 net:[4026532712] /run/netns/ns1 rw shared:606 - nsfs nsfs rw
+		fields := strings.Fields(scanner.Text())
+		sep := slices.Index(fields, "-")
+		if sep < 5 || sep+1 >= len(fields) || fields[sep+1] != "nsfs" || !strings.HasPrefix(fields[3], "net:") {
+			continue
+		}
+		mounts = append(mounts, unescapeMountPoint(fields[4]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", d.mountInfoPath, err)
+	}
+	return mounts, nil
+}
+
+// unescapeMountPoint decodes the octal escapes of the mountinfo, e.g. \040 for a space
+func unescapeMountPoint(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMountInfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+2108 29 0:4 net:[4026532712] /run/netns/ns1 rw shared:606 - nsfs nsfs rw
+2109 29 0:4 mnt:[4026532713] /run/mnt-ns rw shared:607 - nsfs nsfs rw
+2110 29 0:4 net:[4026532714] /run/netns/with\040space rw - nsfs nsfs rw
+`
+
+type fakeT struct {
+	cleanups []func()
+	errors   []string
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Cleanup(fn func()) {
+	t.cleanups = append(t.cleanups, fn)
+}
+
+func (t *fakeT) Errorf(format string, args ...any) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *fakeT) finish() {
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+}
+
+func TestNetnsGoroutineLeakDetectorMountInfo(t *testing.T) {
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	require.NoError(t, os.WriteFile(mountInfo, []byte(testMountInfo), 0644))
+
+	d := &NetnsGoroutineLeakDetector{mountInfoPath: mountInfo}
+	mounts, err := d.netnsMounts()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/run/netns/ns1", "/run/netns/with space"}, mounts)
+
+	require.NoError(t, d.Snapshot())
+	leaked, err := d.Leaked()
+	require.NoError(t, err)
+	assert.Empty(t, leaked)
+
+	require.NoError(t, os.WriteFile(mountInfo, []byte(testMountInfo+
+		"2200 29 0:4 net:[4026532800] /tmp/leaked rw - nsfs nsfs rw\n"), 0644))
+	leaked, err = d.Leaked()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/tmp/leaked"}, leaked)
+	assert.Equal(t, 1, d.Run(func() int { return 0 }))
+	assert.Equal(t, 2, d.Run(func() int { return 2 }))
+
+	// a netns deleted since the snapshot is not a leak
+	require.NoError(t, os.WriteFile(mountInfo, []byte("22 1 8:1 / / rw - ext4 /dev/sda1 rw\n"), 0644))
+	leaked, err = d.Leaked()
+	require.NoError(t, err)
+	assert.Empty(t, leaked)
+	assert.Equal(t, 0, d.Run(func() int { return 0 }))
+
+	d.mountInfoPath = filepath.Join(t.TempDir(), "not-exist")
+	_, err = d.Leaked()
+	assert.Error(t, err)
+	assert.Equal(t, 1, d.Run(func() int { return 0 }))
+}
+
+func TestNetnsGoroutineLeakDetectorTrack(t *testing.T) {
+	namedNetnsDir = t.TempDir()
+	defer func() {
+		namedNetnsDir = NamedNetnsDir
+	}()
+
+	d, err := NewNetnsGoroutineLeakDetector()
+	require.NoError(t, err)
+
+	// cleaned up
+	ft := &fakeT{}
+	d.Track(ft)
+	_, err = CreateNamedNetns("ut-leak")
+	require.NoError(t, err)
+	require.NoError(t, DeleteNamedNetns("ut-leak"))
+	ft.finish()
+	assert.Empty(t, ft.errors)
+
+	// leaked
+	ft = &fakeT{}
+	d.Track(ft)
+	nsPath, err := CreateNamedNetns("ut-leak")
+	require.NoError(t, err)
+	ft.finish()
+	require.NoError(t, DeleteNamedNetns("ut-leak"))
+	require.Len(t, ft.errors, 1)
+	assert.Equal(t, "leaked netns: "+nsPath, ft.errors[0])
+
+	assert.Equal(t, `a b\c`, unescapeMountPoint(`a\040b\134c`))
+	assert.Equal(t, `a\04`, unescapeMountPoint(`a\04`))
+}
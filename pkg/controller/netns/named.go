@@ -0,0 +1,142 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// NamedNetnsDir is where `ip netns` keeps the bind mounts of named netns
+const NamedNetnsDir = "/var/run/netns"
+
+// namedNetnsDir can be replaced in tests
+var namedNetnsDir = NamedNetnsDir
+
+func validateNetnsName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid netns name %q", name)
+	}
+	return nil
+}
+
+// GetNamedNetnsPath returns the path of the named netns and checks it is accessible
+func GetNamedNetnsPath(name string) (string, error) {
+	if err := validateNetnsName(name); err != nil {
+		return "", err
+	}
+
+	nsPath := path.Join(namedNetnsDir, name)
+	if err := unix.Access(nsPath, unix.R_OK); err != nil {
+		return "", fmt.Errorf("netns %s is not accessible: %v", nsPath, err)
+	}
+	return nsPath, nil
+}
+
+// FindNetnsInNamedDir returns the path of the netns name in dir, NamedNetnsDir if empty, for the
+// cni plugins creating named netns rather than pod processes. The path must be a netns, not e.g.
+// the file left by a netns deleted halfway.
+func FindNetnsInNamedDir(name string, dir string) (string, error) {
+	if err := validateNetnsName(name); err != nil {
+		return "", err
+	}
+	if dir == "" {
+		dir = NamedNetnsDir
+	}
+
+	nsPath := path.Join(dir, name)
+	fi, err := os.Stat(nsPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to find netns %s: %v", nsPath, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a netns, mode %v", nsPath, fi.Mode())
+	}
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(nsPath, &statfs); err != nil {
+		return "", fmt.Errorf("failed to statfs netns %s: %v", nsPath, err)
+	}
+	if statfs.Type != unix.NSFS_MAGIC {
+		return "", fmt.Errorf("%s is not a netns, not bind mounted from nsfs", nsPath)
+	}
+	return nsPath, nil
+}
+
+// CreateNamedNetns creates a new netns and bind-mounts it to /var/run/netns/<name>,
+// the same way as `ip netns add <name>`.
+func CreateNamedNetns(name string) (string, error) {
+	if err := validateNetnsName(name); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(namedNetnsDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create dir %s: %v", namedNetnsDir, err)
+	}
+
+	nsPath := path.Join(namedNetnsDir, name)
+	f, err := os.OpenFile(nsPath, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return "", fmt.Errorf("failed to create netns file %s: %v", nsPath, err)
+	}
+	f.Close()
+
+	errCh := make(chan error)
+	go func() {
+		// The thread is not unlocked on purpose, it is in the new netns
+		// and is terminated when the goroutine exits.
+		runtime.LockOSThread()
+
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			errCh <- fmt.Errorf("failed to unshare netns: %v", err)
+			return
+		}
+
+		threadNsPath := fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+		if err := unix.Mount(threadNsPath, nsPath, "none", unix.MS_BIND, ""); err != nil {
+			errCh <- fmt.Errorf("failed to bind mount netns %s: %v", nsPath, err)
+			return
+		}
+		errCh <- nil
+	}()
+
+	if err = <-errCh; err != nil {
+		os.Remove(nsPath)
+		return "", err
+	}
+	return nsPath, nil
+}
+
+// DeleteNamedNetns unmounts and removes /var/run/netns/<name>, the same way as `ip netns delete <name>`
+func DeleteNamedNetns(name string) error {
+	if err := validateNetnsName(name); err != nil {
+		return err
+	}
+
+	nsPath := path.Join(namedNetnsDir, name)
+	if err := unix.Unmount(nsPath, unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return fmt.Errorf("failed to unmount netns %s: %v", nsPath, err)
+	}
+	if err := os.Remove(nsPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove netns %s: %v", nsPath, err)
+	}
+	return nil
+}
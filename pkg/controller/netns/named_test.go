@@ -0,0 +1,105 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamedNetns(t *testing.T) {
+	namedNetnsDir = t.TempDir()
+	defer func() {
+		namedNetnsDir = NamedNetnsDir
+	}()
+
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		_, err := CreateNamedNetns(name)
+		assert.Error(t, err)
+	}
+
+	_, err := GetNamedNetnsPath("ut-netns")
+	assert.Error(t, err)
+
+	nsPath, err := CreateNamedNetns("ut-netns")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(namedNetnsDir, "ut-netns"), nsPath)
+
+	_, err = CreateNamedNetns("ut-netns")
+	assert.Error(t, err)
+
+	got, err := GetNamedNetnsPath("ut-netns")
+	assert.NoError(t, err)
+	assert.Equal(t, nsPath, got)
+	// the path must be a netns that can be entered
+	netNS, err := ns.GetNS(got)
+	require.NoError(t, err)
+	netNS.Close()
+
+	assert.NoError(t, DeleteNamedNetns("ut-netns"))
+	_, err = GetNamedNetnsPath("ut-netns")
+	assert.Error(t, err)
+	// delete is idempotent
+	assert.NoError(t, DeleteNamedNetns("ut-netns"))
+}
+
+func TestFindNetnsInNamedDir(t *testing.T) {
+	namedNetnsDir = t.TempDir()
+	defer func() {
+		namedNetnsDir = NamedNetnsDir
+	}()
+	nsPath, err := CreateNamedNetns("ut-netns")
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, DeleteNamedNetns("ut-netns"))
+	}()
+	// the file of a netns not mounted, a dir and a symlink to a file
+	require.NoError(t, os.WriteFile(filepath.Join(namedNetnsDir, "ut-stale"), nil, 0444))
+	require.NoError(t, os.Mkdir(filepath.Join(namedNetnsDir, "ut-dir"), 0755))
+	require.NoError(t, os.Symlink("ut-stale", filepath.Join(namedNetnsDir, "ut-link")))
+
+	got, err := FindNetnsInNamedDir("ut-netns", namedNetnsDir)
+	require.NoError(t, err)
+	assert.Equal(t, nsPath, got)
+	inode, err := getNetnsInode(got)
+	require.NoError(t, err)
+	assert.NotZero(t, inode)
+
+	for _, tt := range []struct {
+		name    string
+		wantErr string
+	}{
+		{name: "ut-missing", wantErr: "failed to find netns"},
+		{name: "ut-stale", wantErr: "not bind mounted from nsfs"},
+		{name: "ut-link", wantErr: "not bind mounted from nsfs"},
+		{name: "ut-dir", wantErr: "is not a netns"},
+		{name: "../ut-netns", wantErr: "invalid netns name"},
+		{name: "", wantErr: "invalid netns name"},
+	} {
+		_, err := FindNetnsInNamedDir(tt.name, namedNetnsDir)
+		assert.ErrorContains(t, err, tt.wantErr, tt.name)
+	}
+
+	// NamedNetnsDir by default
+	_, err = FindNetnsInNamedDir("ut-netns-not-exist", "")
+	assert.ErrorContains(t, err, filepath.Join(NamedNetnsDir, "ut-netns-not-exist"))
+}
@@ -18,19 +18,26 @@ package netns
 
 import (
 	"bytes"
+	"context"
 	"embed"
+	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"os"
 	"path"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 	nd "istio.io/istio/cni/pkg/nodeagent"
-	"istio.io/istio/pkg/util/sets"
 	"istio.io/pkg/log"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
+
+	"kmesh.net/kmesh/pkg/utils"
 )
 
 var (
@@ -38,107 +45,188 @@ var (
 )
 
 func GetNodeNSpath() string {
-	res := path.Join("/host/proc", "1", "ns", "net")
+	res := path.Join(utils.GetProcRootFromEnv(), "1", "ns", "net")
 	return res
 }
 
+// GetPodNSpath returns the netns path of pod and caches it in podNetnsCache
 func GetPodNSpath(pod *corev1.Pod) (string, error) {
+	if res, ok := defaultWarmup.take(pod.UID); ok {
+		podNetnsCache.Add(pod.UID, res)
+		return res, nil
+	}
+
+	start := time.Now()
 	res, err := FindNetnsForPod(pod)
 	if err != nil {
 		return "", err
 	}
-	res = path.Join("/host/proc", res)
+	DefaultDiscoveryProfiler.Record(pod.UID, time.Since(start))
+	res = path.Join(utils.GetProcRootFromEnv(), res)
+	podNetnsCache.Add(pod.UID, res)
 	return res, nil
 }
 
-func builtinOrDir(dir string) fs.FS {
-	if dir == "" {
-		return FS
-	}
-	return os.DirFS(dir)
+// ForgetPodNetns drops the netns path cached for the pod uid, once the pod is deleted
+func ForgetPodNetns(uid types.UID) {
+	podNetnsCache.Delete(uid)
 }
 
-func FindNetnsForPod(pod *corev1.Pod) (string, error) {
-	netnsObserved := sets.New[uint64]()
-	fd := builtinOrDir("/host/proc")
+// GetNetnsForHostProcess returns the netns path of a process running directly on the host,
+// an error is returned if the process is not in the host netns.
+func GetNetnsForHostProcess(pid int) (string, error) {
+	return getNetnsForHostProcess(utils.GetProcRootFromEnv(), pid)
+}
 
-	entries, err := fs.ReadDir(fd, ".")
+func getNetnsForHostProcess(procRoot string, pid int) (string, error) {
+	if pid <= 0 {
+		return "", fmt.Errorf("invalid pid %d", pid)
+	}
+
+	nsPath := path.Join(procRoot, strconv.Itoa(pid), "ns", "net")
+	inode, err := getNetnsInode(nsPath)
+	if err != nil {
+		return "", err
+	}
+	hostInode, err := getNetnsInode(path.Join(procRoot, "1", "ns", "net"))
 	if err != nil {
 		return "", err
 	}
+	if inode != hostInode {
+		return "", fmt.Errorf("process %d is not in the host netns, netns inode %d, host netns inode %d", pid, inode, hostInode)
+	}
+	return nsPath, nil
+}
 
-	desiredUID := pod.UID
-	for _, entry := range entries {
-		res, err := processEntry(fd, netnsObserved, desiredUID, entry)
-		if err != nil {
-			log.Debugf("error processing entry: %s %v", entry.Name(), err)
-			continue
-		}
-		if res != "" {
-			return res, nil
-		}
+// NetnsHandleFromPath opens the netns of nsPath, e.g. for netlink.NewHandleAt to run several
+// netlink operations in the netns with one open. The caller closes the file.
+func NetnsHandleFromPath(nsPath string) (*os.File, error) {
+	f, err := os.OpenFile(nsPath, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netns %s: %w", nsPath, err)
 	}
-	return "", fmt.Errorf("No matching network namespace found")
+	return f, nil
+}
+
+// GetNodeNetns opens the netns of the host, at GetNodeNSpath, see NetnsHandleFromPath
+func GetNodeNetns() (*os.File, error) {
+	return NetnsHandleFromPath(GetNodeNSpath())
 }
 
-func isNotNumber(r rune) bool {
-	return r < '0' || r > '9'
+// WithHostNetns runs fn in the netns of the host and switches back to the current netns
+func WithHostNetns(fn func() error) error {
+	return withNetns(GetNodeNSpath(), fn)
 }
 
-func isProcess(entry fs.DirEntry) bool {
-	if !entry.IsDir() {
-		return false
+// withNetns runs fn in the netns of nsPath on the locked os thread of the goroutine. If the
+// thread cannot be switched back, it stays locked so that it exits with the goroutine instead
+// of running other goroutines in the netns of nsPath.
+func withNetns(nsPath string, fn func() error) error {
+	target, err := NetnsHandleFromPath(nsPath)
+	if err != nil {
+		return err
 	}
+	defer target.Close()
 
-	if strings.IndexFunc(entry.Name(), isNotNumber) != -1 {
-		return false
+	runtime.LockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to get current netns: %v", err)
+	}
+	defer orig.Close()
+	if err := netns.Set(netns.NsHandle(target.Fd())); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to switch to netns %s: %v", nsPath, err)
 	}
-	return true
-}
 
-// copied from https://github.com/istio/istio/blob/master/cni/pkg/nodeagent/podcgroupns.go
-func processEntry(proc fs.FS, netnsObserved sets.Set[uint64], filter types.UID, entry fs.DirEntry) (string, error) {
-	if !isProcess(entry) {
-		return "", nil
+	fnErr := fn()
+	if err := netns.Set(orig); err != nil {
+		return errors.Join(fnErr, fmt.Errorf("failed to switch back from netns %s: %v", nsPath, err))
 	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
 
-	netnsName := path.Join(entry.Name(), "ns", "net")
-	fi, err := fs.Stat(proc, netnsName)
-	if err != nil {
-		return "", err
+func builtinOrDir(dir string) fs.FS {
+	if dir == "" {
+		return FS
 	}
+	return os.DirFS(dir)
+}
+
+func FindNetnsForPod(pod *corev1.Pod) (string, error) {
+	res, err := findNetnsForPod(pod)
+	health.record(err)
+	return res, err
+}
 
-	inode, err := nd.GetInode(fi)
+func findNetnsForPod(pod *corev1.Pod) (string, error) {
+	return findNetnsForPodCached(podNetnsCache, utils.GetProcRootFromEnv(), pod.UID)
+}
+
+// findNetnsForPodCached returns the netns path relative to procRoot of the pod uid, from c if
+// the netns cached is still there, otherwise procRoot is scanned and the netns found is cached
+func findNetnsForPodCached(c *NetnsCache, procRoot string, uid types.UID) (string, error) {
+	if nsPath, ok := c.lookup(uid); ok {
+		if res, ok := strings.CutPrefix(nsPath, procRoot+"/"); ok {
+			return res, nil
+		}
+	}
+	res, err := findNetnsForUID(builtinOrDir(procRoot), uid)
 	if err != nil {
 		return "", err
 	}
-	if _, ok := netnsObserved[inode]; ok {
-		log.Debugf("netns: %d already processed. skipping", inode)
-		return "", nil
-	}
+	c.Add(uid, path.Join(procRoot, res))
+	return res, nil
+}
 
-	cgroup, err := proc.Open(path.Join(entry.Name(), "cgroup"))
+// FindNetnsForUID returns the netns path of the pod uid found in procRoot, GetProcRootFromEnv if empty,
+// for the callers knowing only the uid of the pod, e.g. from the cgroup of the pod
+func FindNetnsForUID(uid types.UID, procRoot string) (string, error) {
+	if procRoot == "" {
+		procRoot = utils.GetProcRootFromEnv()
+	}
+	res, err := findNetnsForUID(os.DirFS(procRoot), uid)
+	health.record(err)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
-	defer cgroup.Close()
+	return path.Join(procRoot, res), nil
+}
 
-	var cgroupData bytes.Buffer
-	_, err = io.Copy(&cgroupData, cgroup)
+// findNetnsForUID returns the netns path relative to proc of a process of the pod desiredUID
+func findNetnsForUID(fd fs.FS, desiredUID types.UID) (string, error) {
+	entries, err := fs.ReadDir(fd, ".")
 	if err != nil {
-		return "", nil
+		return "", err
 	}
-
-	uid, _, err := nd.GetPodUIDAndContainerID(cgroupData)
+	var res string
+	err = walkProcForPodNetns(context.Background(), fd, entries, UIDNetnsFilter(desiredUID), func(_ string, _ types.UID, nsPath string) error {
+		log.Debugf("found pod to netns: %s %s", desiredUID, nsPath)
+		res = nsPath
+		return fs.SkipAll
+	})
 	if err != nil {
 		return "", err
 	}
-
-	if filter != uid {
-		return "", nil
+	if res == "" {
+		return "", fmt.Errorf("No matching network namespace found")
 	}
+	return res, nil
+}
 
-	log.Debugf("found pod to netns: %s %d", uid, inode)
-
-	return netnsName, nil
+// podUIDOfCgroup returns the pod uid of the /proc/<pid>/cgroup data, empty if the cgroup is not
+// owned by a pod
+func podUIDOfCgroup(cgroupData bytes.Buffer) (types.UID, error) {
+	data := cgroupData.String()
+	uid, _, err := nd.GetPodUIDAndContainerID(cgroupData)
+	if err != nil || uid == "" {
+		// e.g. the systemd slice of the pod without a container scope
+		var ok bool
+		if uid, ok = matchPodCgroup(data); !ok {
+			return "", err
+		}
+	}
+	return uid, nil
 }
@@ -0,0 +1,221 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	vnetns "github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// newTestProcRoot creates a fake proc root whose entries link the ns dir of real processes,
+// pid 1 of the fake proc root is the current process
+func newTestProcRoot(t *testing.T, pids ...int) string {
+	root := t.TempDir()
+	for _, pid := range append([]int{1}, pids...) {
+		target := pid
+		if pid == 1 {
+			target = os.Getpid()
+		}
+		dir := filepath.Join(root, strconv.Itoa(pid))
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, os.Symlink("/proc/"+strconv.Itoa(target)+"/ns", filepath.Join(dir, "ns")))
+	}
+	return root
+}
+
+func TestGetNetnsForHostProcess(t *testing.T) {
+	cmd := exec.Command("unshare", "--net", "sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("unshare is not available: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	hostPid := os.Getpid()
+	podPid := cmd.Process.Pid
+	procRoot := newTestProcRoot(t, hostPid, podPid)
+
+	nsPath, err := getNetnsForHostProcess(procRoot, hostPid)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(procRoot, strconv.Itoa(hostPid), "ns", "net"), nsPath)
+
+	assert.Eventually(t, func() bool {
+		_, err = getNetnsForHostProcess(procRoot, podPid)
+		return err != nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err = getNetnsForHostProcess(procRoot, 0)
+	assert.Error(t, err)
+	_, err = getNetnsForHostProcess(procRoot, 99999999)
+	assert.Error(t, err)
+}
+
+func TestProcRootFromEnv(t *testing.T) {
+	t.Setenv(utils.HostProcRootEnv, "")
+	assert.Equal(t, "/host/proc/1/ns/net", GetNodeNSpath())
+
+	procRoot, pidA, _ := newWarmupProcRoot(t)
+	t.Setenv(utils.HostProcRootEnv, procRoot)
+	assert.Equal(t, filepath.Join(procRoot, "1", "ns", "net"), GetNodeNSpath())
+
+	nsPath, err := FindNetnsForUID(warmupPodA, "")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(procRoot, strconv.Itoa(pidA), "ns", "net"), nsPath)
+
+	podNetnsCache.reset()
+	t.Cleanup(podNetnsCache.reset)
+	res, err := FindNetnsForPod(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: warmupPodA}})
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(strconv.Itoa(pidA), "ns", "net"), res)
+	cached, ok := podNetnsCache.Get(warmupPodA)
+	assert.True(t, ok)
+	assert.Equal(t, nsPath, cached)
+}
+
+func TestNetnsHandleFromPath(t *testing.T) {
+	cmd := exec.Command("unshare", "--net", "sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("unshare is not available: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	nsPath := filepath.Join("/proc", strconv.Itoa(cmd.Process.Pid), "ns", "net")
+	require.Eventually(t, func() bool {
+		self, _ := getNetnsInode("/proc/self/ns/net")
+		inode, err := getNetnsInode(nsPath)
+		return err == nil && inode != self
+	}, 5*time.Second, 10*time.Millisecond)
+	wantInode, err := getNetnsInode(nsPath)
+	require.NoError(t, err)
+
+	f, err := NetnsHandleFromPath(nsPath)
+	require.NoError(t, err)
+	defer f.Close()
+	var stat unix.Stat_t
+	require.NoError(t, unix.Fstat(int(f.Fd()), &stat))
+	assert.Equal(t, wantInode, stat.Ino)
+	flags, err := unix.FcntlInt(f.Fd(), unix.F_GETFD, 0)
+	require.NoError(t, err)
+	assert.NotZero(t, flags&unix.FD_CLOEXEC)
+
+	// the netns of the process has only lo
+	h, err := netlink.NewHandleAt(vnetns.NsHandle(f.Fd()))
+	require.NoError(t, err)
+	defer h.Close()
+	links, err := h.LinkList()
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+	assert.Equal(t, "lo", links[0].Attrs().Name)
+
+	_, err = NetnsHandleFromPath(filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorContains(t, err, "failed to open netns")
+}
+
+// newNodeProcRoot returns a proc root whose pid 1 is in the netns of a new process and the
+// inode of that netns
+func newNodeProcRoot(t *testing.T) (string, uint64) {
+	pid := newNetnsProcess(t)
+	procRoot := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(procRoot, "1"), 0755))
+	require.NoError(t, os.Symlink(filepath.Join("/proc", strconv.Itoa(pid), "ns"), filepath.Join(procRoot, "1", "ns")))
+	inode, err := getNetnsInode(filepath.Join(procRoot, "1", "ns", "net"))
+	require.NoError(t, err)
+	return procRoot, inode
+}
+
+func TestGetNodeNetns(t *testing.T) {
+	procRoot, wantInode := newNodeProcRoot(t)
+	t.Setenv(utils.HostProcRootEnv, procRoot)
+	f, err := GetNodeNetns()
+	require.NoError(t, err)
+	defer f.Close()
+	var stat unix.Stat_t
+	require.NoError(t, unix.Fstat(int(f.Fd()), &stat))
+	assert.Equal(t, wantInode, stat.Ino)
+
+	t.Setenv(utils.HostProcRootEnv, t.TempDir())
+	_, err = GetNodeNetns()
+	assert.ErrorContains(t, err, "failed to open netns")
+}
+
+func TestWithHostNetns(t *testing.T) {
+	procRoot, wantInode := newNodeProcRoot(t)
+	t.Setenv(utils.HostProcRootEnv, procRoot)
+	selfInode, err := getNetnsInode("/proc/thread-self/ns/net")
+	require.NoError(t, err)
+
+	errFn := errors.New("fn failed")
+	err = WithHostNetns(func() error {
+		inode, err := getNetnsInode("/proc/thread-self/ns/net")
+		require.NoError(t, err)
+		assert.Equal(t, wantInode, inode)
+		// the netns of the process has only lo
+		links, err := netlink.LinkList()
+		require.NoError(t, err)
+		assert.Len(t, links, 1)
+		return errFn
+	})
+	assert.ErrorIs(t, err, errFn)
+	// back in the netns of the test
+	inode, err := getNetnsInode("/proc/thread-self/ns/net")
+	require.NoError(t, err)
+	assert.Equal(t, selfInode, inode)
+
+	t.Setenv(utils.HostProcRootEnv, t.TempDir())
+	err = WithHostNetns(func() error {
+		t.Fatal("fn must not run")
+		return nil
+	})
+	assert.ErrorContains(t, err, "failed to open netns")
+}
+
+func TestFindNetnsForUID(t *testing.T) {
+	procRoot, pidA, pidB := newWarmupProcRoot(t)
+
+	nsPath, err := FindNetnsForUID(warmupPodA, procRoot)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(procRoot, strconv.Itoa(pidA), "ns", "net"), nsPath)
+
+	// the slice of a pod without container scope
+	nsPath, err = FindNetnsForUID(warmupPodB, procRoot)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(procRoot, strconv.Itoa(pidB), "ns", "net"), nsPath)
+
+	_, err = FindNetnsForUID("c4a8e5d0-7b19-4f6a-8e3d-2a1b0c9d8e7f", procRoot)
+	assert.ErrorContains(t, err, "No matching network namespace found")
+	_, err = FindNetnsForUID(warmupPodA, filepath.Join(procRoot, "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// DefaultPoolCapacity is the number of idle handles kept by NetnsPooledExecutor
+const DefaultPoolCapacity = 64
+
+// poolKey contains the inode so that a netns recreated at the same path gets a new handle
+type poolKey struct {
+	nsPath string
+	inode  uint64
+}
+
+type pooledHandle struct {
+	key    poolKey
+	handle *netlink.Handle
+	refs   int
+	elem   *list.Element
+}
+
+// NetnsPooledExecutor runs netlink operations inside network namespaces,
+// reusing the netlink handle of a netns across calls.
+// Handles in use are never evicted, so the pool can exceed its capacity
+// while more than capacity netns are in use at the same time.
+type NetnsPooledExecutor struct {
+	mu       sync.Mutex
+	capacity int
+	handles  map[poolKey]*pooledHandle
+	// lru holds the handles, from the most to the least recently used
+	lru *list.List
+
+	newHandle func(nsPath string) (*netlink.Handle, error)
+}
+
+func NewNetnsPooledExecutor(capacity int) *NetnsPooledExecutor {
+	if capacity <= 0 {
+		capacity = DefaultPoolCapacity
+	}
+	return &NetnsPooledExecutor{
+		capacity:  capacity,
+		handles:   make(map[poolKey]*pooledHandle),
+		lru:       list.New(),
+		newHandle: newNetlinkHandle,
+	}
+}
+
+func newNetlinkHandle(nsPath string) (*netlink.Handle, error) {
+	nsHandle, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netns %s: %v", nsPath, err)
+	}
+	defer nsHandle.Close()
+
+	handle, err := netlink.NewHandleAt(nsHandle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create netlink handle in netns %s: %v", nsPath, err)
+	}
+	return handle, nil
+}
+
+// Execute runs fn with a netlink handle in the netns at nsPath
+func (e *NetnsPooledExecutor) Execute(nsPath string, fn func(*netlink.Handle) error) error {
+	inode, err := getNetnsInode(nsPath)
+	if err != nil {
+		return err
+	}
+
+	h, err := e.acquire(poolKey{nsPath: nsPath, inode: inode})
+	if err != nil {
+		return err
+	}
+	defer e.release(h)
+	return fn(h.handle)
+}
+
+func (e *NetnsPooledExecutor) acquire(key poolKey) (*pooledHandle, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if h, ok := e.handles[key]; ok {
+		h.refs++
+		e.lru.MoveToFront(h.elem)
+		return h, nil
+	}
+
+	handle, err := e.newHandle(key.nsPath)
+	if err != nil {
+		return nil, err
+	}
+	h := &pooledHandle{key: key, handle: handle, refs: 1}
+	h.elem = e.lru.PushFront(h)
+	e.handles[key] = h
+	e.evictLocked()
+	return h, nil
+}
+
+func (e *NetnsPooledExecutor) release(h *pooledHandle) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	h.refs--
+	e.evictLocked()
+}
+
+// evictLocked closes the least recently used idle handles until the pool fits its capacity
+func (e *NetnsPooledExecutor) evictLocked() {
+	for elem := e.lru.Back(); elem != nil && len(e.handles) > e.capacity; {
+		h := elem.Value.(*pooledHandle)
+		elem = elem.Prev()
+		if h.refs > 0 {
+			continue
+		}
+		e.removeLocked(h)
+	}
+}
+
+func (e *NetnsPooledExecutor) removeLocked(h *pooledHandle) {
+	e.lru.Remove(h.elem)
+	delete(e.handles, h.key)
+	h.handle.Close()
+}
+
+// Len returns the number of pooled handles
+func (e *NetnsPooledExecutor) Len() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.handles)
+}
+
+// Close closes all the idle handles, the handles in use are closed once released
+func (e *NetnsPooledExecutor) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.capacity = 0
+	e.evictLocked()
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestNetnsPooledExecutor(t *testing.T) {
+	// the path of a ns.TempNetNS is not unique, use named netns instead
+	namedNetnsDir = t.TempDir()
+	defer func() {
+		_ = DeleteNamedNetns("ut-ns1")
+		_ = DeleteNamedNetns("ut-ns2")
+		namedNetnsDir = NamedNetnsDir
+	}()
+	ns1, err := CreateNamedNetns("ut-ns1")
+	require.NoError(t, err)
+	ns2, err := CreateNamedNetns("ut-ns2")
+	require.NoError(t, err)
+
+	e := NewNetnsPooledExecutor(1)
+	created := map[string]int{}
+	e.newHandle = func(nsPath string) (*netlink.Handle, error) {
+		created[nsPath]++
+		return newNetlinkHandle(nsPath)
+	}
+
+	var handles []*netlink.Handle
+	record := func(h *netlink.Handle) error {
+		handles = append(handles, h)
+		_, err := h.LinkByName("lo")
+		return err
+	}
+
+	// reuse
+	require.NoError(t, e.Execute(ns1, record))
+	require.NoError(t, e.Execute(ns1, record))
+	assert.Same(t, handles[0], handles[1])
+	assert.Equal(t, 1, created[ns1])
+	assert.Equal(t, 1, e.Len())
+
+	// ns1 is evicted by ns2
+	require.NoError(t, e.Execute(ns2, record))
+	assert.Equal(t, 1, e.Len())
+	require.NoError(t, e.Execute(ns1, record))
+	assert.Equal(t, 2, created[ns1])
+
+	// a handle in use is not evicted
+	err = e.Execute(ns1, func(h1 *netlink.Handle) error {
+		return e.Execute(ns2, func(h2 *netlink.Handle) error {
+			assert.Equal(t, 2, e.Len())
+			return errors.New("failed")
+		})
+	})
+	assert.EqualError(t, err, "failed")
+	assert.Equal(t, 1, e.Len())
+	assert.Equal(t, 2, created[ns1])
+	assert.Equal(t, 2, created[ns2])
+
+	assert.Error(t, e.Execute("/not/exist", record))
+
+	e.Close()
+	assert.Equal(t, 0, e.Len())
+}
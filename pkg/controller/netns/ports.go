@@ -0,0 +1,121 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+const (
+	// tcpListen is the TCP_LISTEN state in /proc/net/tcp
+	tcpListen = "0A"
+	// udpUnconnected is the TCP_CLOSE state of unconnected udp sockets in /proc/net/udp
+	udpUnconnected = "07"
+)
+
+// procNetFiles are the files of /proc/net holding sockets, mapped to whether they are udp
+var procNetFiles = []struct {
+	name string
+	udp  bool
+}{
+	{"tcp", false},
+	{"tcp6", false},
+	{"udp", true},
+	{"udp6", true},
+}
+
+// GetNetnsListeningPorts returns the sorted tcp and udp ports listened on in the netns at nsPath
+func GetNetnsListeningPorts(nsPath string) ([]uint16, error) {
+	var ports []uint16
+	err := ns.WithNetNSPath(nsPath, func(_ ns.NetNS) error {
+		var err error
+		// only the current thread is in the netns, /proc/net is the netns of the main thread
+		ports, err = readListeningPorts("/proc/thread-self/net")
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get listening ports of netns %s: %v", nsPath, err)
+	}
+	return ports, nil
+}
+
+func readListeningPorts(procNetDir string) ([]uint16, error) {
+	var ports []uint16
+	for _, file := range procNetFiles {
+		f, err := os.Open(filepath.Join(procNetDir, file.name))
+		if errors.Is(err, fs.ErrNotExist) {
+			// tcp6 and udp6 do not exist if ipv6 is disabled
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		filePorts, err := parseProcNetPorts(f, file.udp)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", f.Name(), err)
+		}
+		ports = append(ports, filePorts...)
+	}
+
+	slices.Sort(ports)
+	return slices.Compact(ports), nil
+}
+
+// parseProcNetPorts returns the local ports of the listening sockets of a /proc/net/{tcp,udp}[6] file
+func parseProcNetPorts(r io.Reader, udp bool) ([]uint16, error) {
+	var ports []uint16
+	scanner := bufio.NewScanner(r)
+	// skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		if udp {
+			if fields[3] != udpUnconnected || !strings.HasSuffix(fields[2], ":0000") {
+				continue
+			}
+		} else if fields[3] != tcpListen {
+			continue
+		}
+
+		_, port, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid local address %q", fields[1])
+		}
+		p, err := strconv.ParseUint(port, 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local address %q: %v", fields[1], err)
+		}
+		ports = append(ports, uint16(p))
+	}
+	return ports, scanner.Err()
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testProcNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:3039 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1002 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1F90 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 1003 1 0000000000000000 20 4 30 10 -1
+`
+	testProcNetTCP6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:1F90 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2001 1 0000000000000000 100 0 0 10 0
+   1: 00000000000000000000000000000000:0050 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2002 1 0000000000000000 100 0 0 10 0
+`
+	testProcNetUDP = `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  100: 00000000:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 3001 2 0000000000000000 0
+  101: 0100007F:E2F1 0100007F:0035 01 00000000:00000000 00:00000000 00000000     0        0 3002 2 0000000000000000 0
+`
+)
+
+func TestReadListeningPorts(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tcp"), []byte(testProcNetTCP), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tcp6"), []byte(testProcNetTCP6), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "udp"), []byte(testProcNetUDP), 0644))
+
+	// udp6 does not exist
+	ports, err := readListeningPorts(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{53, 80, 8080, 12345}, ports)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "udp6"), []byte("header\n 0: 00000000:XYZ 00000000:0000 07\n"), 0644))
+	_, err = readListeningPorts(dir)
+	assert.ErrorContains(t, err, "udp6")
+}
+
+func TestGetNetnsListeningPorts(t *testing.T) {
+	namedNetnsDir = t.TempDir()
+	defer func() {
+		_ = DeleteNamedNetns("ut-ports")
+		namedNetnsDir = NamedNetnsDir
+	}()
+	nsPath, err := CreateNamedNetns("ut-ports")
+	require.NoError(t, err)
+
+	var listener net.Listener
+	err = ns.WithNetNSPath(nsPath, func(_ ns.NetNS) error {
+		listener, err = net.Listen("tcp4", "0.0.0.0:0")
+		return err
+	})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	ports, err := GetNetnsListeningPorts(nsPath)
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{uint16(listener.Addr().(*net.TCPAddr).Port)}, ports)
+
+	_, err = GetNetnsListeningPorts("/not/exist")
+	assert.Error(t, err)
+}
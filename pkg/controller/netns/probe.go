@@ -0,0 +1,89 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	nd "istio.io/istio/cni/pkg/nodeagent"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// NetnsProbeResult describes the state of a netns for debugging
+type NetnsProbeResult struct {
+	// Interfaces are the network interfaces inside the netns
+	Interfaces []net.Interface
+	// ProcessCount is the number of host processes running in the netns
+	ProcessCount int
+	Inode        uint64
+}
+
+// ProbeNetns enters the netns temporarily and collects its interfaces,
+// the processes in it are counted by scanning the proc of the host.
+func ProbeNetns(nsPath string) (*NetnsProbeResult, error) {
+	return probeNetns(nsPath, utils.GetProcRootFromEnv())
+}
+
+func probeNetns(nsPath, procRoot string) (*NetnsProbeResult, error) {
+	inode, err := getNetnsInode(nsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &NetnsProbeResult{Inode: inode}
+	if err = ns.WithNetNSPath(nsPath, func(_ ns.NetNS) error {
+		res.Interfaces, err = net.Interfaces()
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list interfaces in netns %s: %v", nsPath, err)
+	}
+
+	res.ProcessCount, err = countNetnsProcesses(os.DirFS(procRoot), inode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count processes in netns %s: %v", nsPath, err)
+	}
+	return res, nil
+}
+
+func countNetnsProcesses(proc fs.FS, inode uint64) (int, error) {
+	entries, err := fs.ReadDir(proc, ".")
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, entry := range entries {
+		if !utils.IsProcEntry(entry) {
+			continue
+		}
+		// the process may exit during the scan
+		fi, err := fs.Stat(proc, path.Join(entry.Name(), "ns", "net"))
+		if err != nil {
+			continue
+		}
+		if ino, err := nd.GetInode(fi); err == nil && ino == inode {
+			count++
+		}
+	}
+	return count, nil
+}
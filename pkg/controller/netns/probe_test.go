@@ -0,0 +1,58 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeNetns(t *testing.T) {
+	// unshare runs sleep in a new netns which only has a loopback interface
+	cmd := exec.Command("unshare", "--net", "sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("unshare is not available: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	nsPath := "/proc/" + strconv.Itoa(cmd.Process.Pid) + "/ns/net"
+	var (
+		res *NetnsProbeResult
+		err error
+	)
+	// wait for unshare to exec sleep in the new netns
+	assert.Eventually(t, func() bool {
+		res, err = probeNetns(nsPath, "/proc")
+		return err == nil && len(res.Interfaces) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	require.NoError(t, err)
+
+	assert.Equal(t, "lo", res.Interfaces[0].Name)
+	assert.Equal(t, 1, res.ProcessCount)
+	assert.NotZero(t, res.Inode)
+
+	_, err = probeNetns("/proc/not-exist/ns/net", "/proc")
+	assert.Error(t, err)
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/clock"
+)
+
+// NetnsSlowDiscoveryUID is the mean netns discovery duration in seconds of the slowest pods,
+// the pods are ranked from 1, the slowest, to the top N of the profiler.
+var NetnsSlowDiscoveryUID = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "kmesh_netns_slow_discovery_uid",
+		Help: "The mean netns discovery duration in seconds of the pods slower than the configured percentile.",
+	},
+	[]string{"pod_uid", "rank"},
+)
+
+// DefaultDiscoveryBuckets are the upper bounds of the discovery duration histograms
+var DefaultDiscoveryBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// DiscoveryHistogram is the distribution of the netns discovery durations of a pod.
+// Counts[i] is the number of discoveries not longer than Buckets[i], the last count
+// is the number of discoveries longer than all the buckets.
+type DiscoveryHistogram struct {
+	Buckets []time.Duration
+	Counts  []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+// Mean returns the mean discovery duration, 0 if nothing has been recorded
+func (h DiscoveryHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+func (h *DiscoveryHistogram) observe(d time.Duration) {
+	i, _ := slices.BinarySearch(h.Buckets, d)
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// SlowDiscovery is a pod whose mean discovery duration exceeds the percentile of the profiler
+type SlowDiscovery struct {
+	UID  types.UID
+	Mean time.Duration
+}
+
+// NetnsDiscoveryProfiler records the netns discovery durations of each pod to find the pods
+// that are consistently slower to discover than the others, e.g. because of deeply nested cgroups.
+type NetnsDiscoveryProfiler struct {
+	mu         sync.Mutex
+	buckets    []time.Duration
+	percentile float64
+	topN       int
+	pods       map[types.UID]*DiscoveryHistogram
+}
+
+// NewNetnsDiscoveryProfiler creates a profiler reporting the pods slower than the percentile,
+// in (0, 100], of the mean discovery durations of all the pods. At most topN of them are
+// exported by UpdateMetrics.
+func NewNetnsDiscoveryProfiler(percentile float64, topN int) *NetnsDiscoveryProfiler {
+	return &NetnsDiscoveryProfiler{
+		buckets:    DefaultDiscoveryBuckets,
+		percentile: percentile,
+		topN:       topN,
+		pods:       make(map[types.UID]*DiscoveryHistogram),
+	}
+}
+
+// DefaultDiscoveryProfiler records the discoveries of GetPodNSpath
+var DefaultDiscoveryProfiler = NewNetnsDiscoveryProfiler(95, 10)
+
+// Record adds a discovery of the netns of the pod uid taking d
+func (p *NetnsDiscoveryProfiler) Record(uid types.UID, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, ok := p.pods[uid]
+	if !ok {
+		h = &DiscoveryHistogram{Buckets: p.buckets, Counts: make([]uint64, len(p.buckets)+1)}
+		p.pods[uid] = h
+	}
+	h.observe(d)
+}
+
+// Histogram returns a copy of the discovery histogram of the pod uid
+func (p *NetnsDiscoveryProfiler) Histogram(uid types.UID) (DiscoveryHistogram, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, ok := p.pods[uid]
+	if !ok {
+		return DiscoveryHistogram{}, false
+	}
+	cp := *h
+	cp.Counts = slices.Clone(h.Counts)
+	return cp, true
+}
+
+// Forget drops the durations recorded for the pod uid, it should be called once the pod is deleted
+func (p *NetnsDiscoveryProfiler) Forget(uid types.UID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pods, uid)
+}
+
+// Threshold returns the percentile of the mean discovery durations of the pods
+func (p *NetnsDiscoveryProfiler) Threshold() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return percentile(p.means(), p.percentile)
+}
+
+func (p *NetnsDiscoveryProfiler) means() []time.Duration {
+	means := make([]time.Duration, 0, len(p.pods))
+	for _, h := range p.pods {
+		means = append(means, h.Mean())
+	}
+	slices.Sort(means)
+	return means
+}
+
+// percentile returns the nearest-rank percentile p of the sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	rank = min(max(rank, 1), len(sorted))
+	return sorted[rank-1]
+}
+
+// Outliers returns the pods whose mean discovery duration exceeds the threshold,
+// the slowest first.
+func (p *NetnsDiscoveryProfiler) Outliers() []SlowDiscovery {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	threshold := percentile(p.means(), p.percentile)
+	var outliers []SlowDiscovery
+	for uid, h := range p.pods {
+		if mean := h.Mean(); mean > threshold {
+			outliers = append(outliers, SlowDiscovery{UID: uid, Mean: mean})
+		}
+	}
+	slices.SortFunc(outliers, func(a, b SlowDiscovery) int {
+		return cmp.Or(cmp.Compare(b.Mean, a.Mean), cmp.Compare(a.UID, b.UID))
+	})
+	return outliers
+}
+
+// UpdateMetrics exports the top N outliers as NetnsSlowDiscoveryUID
+func (p *NetnsDiscoveryProfiler) UpdateMetrics() {
+	outliers := p.Outliers()
+	if len(outliers) > p.topN {
+		outliers = outliers[:p.topN]
+	}
+
+	NetnsSlowDiscoveryUID.Reset()
+	for i, o := range outliers {
+		NetnsSlowDiscoveryUID.WithLabelValues(string(o.UID), strconv.Itoa(i+1)).Set(o.Mean.Seconds())
+	}
+}
+
+// RunMetricsUpdate runs UpdateMetrics every interval until ctx is done
+func (p *NetnsDiscoveryProfiler) RunMetricsUpdate(ctx context.Context, interval time.Duration) {
+	p.runMetricsUpdate(ctx, clock.RealClock{}, interval)
+}
+
+func (p *NetnsDiscoveryProfiler) runMetricsUpdate(ctx context.Context, clock clock.WithTicker, interval time.Duration) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			p.UpdateMetrics()
+		}
+	}
+}
+
+// discoveryProfilerMetricsInterval is how often RunDiscoveryProfilerMetrics exports the outliers
+const discoveryProfilerMetricsInterval = 30 * time.Second
+
+// RunDiscoveryProfilerMetrics exports the outliers of DefaultDiscoveryProfiler as
+// NetnsSlowDiscoveryUID until ctx is done
+func RunDiscoveryProfilerMetrics(ctx context.Context) {
+	DefaultDiscoveryProfiler.RunMetricsUpdate(ctx, discoveryProfilerMetricsInterval)
+}
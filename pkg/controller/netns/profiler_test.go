@@ -0,0 +1,146 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestDiscoveryHistogram(t *testing.T) {
+	p := NewNetnsDiscoveryProfiler(90, 3)
+	for _, d := range []time.Duration{
+		500 * time.Microsecond,
+		time.Millisecond, // on the bucket bound
+		3 * time.Millisecond,
+		700 * time.Millisecond,
+		2 * time.Second,
+	} {
+		p.Record("uid", d)
+	}
+
+	h, ok := p.Histogram("uid")
+	require.True(t, ok)
+	assert.Equal(t, DefaultDiscoveryBuckets, h.Buckets)
+	assert.Equal(t, []uint64{2, 1, 0, 0, 0, 0, 1, 1}, h.Counts)
+	assert.Equal(t, uint64(5), h.Count)
+	assert.Equal(t, 2704500*time.Microsecond, h.Sum)
+	assert.Equal(t, 540900*time.Microsecond, h.Mean())
+
+	// the histogram returned is a copy
+	h.Counts[0] = 100
+	h, _ = p.Histogram("uid")
+	assert.Equal(t, uint64(2), h.Counts[0])
+
+	_, ok = p.Histogram("unknown")
+	assert.False(t, ok)
+	assert.Zero(t, DiscoveryHistogram{}.Mean())
+
+	p.Forget("uid")
+	_, ok = p.Histogram("uid")
+	assert.False(t, ok)
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{p: 0, want: 1},
+		{p: 10, want: 1},
+		{p: 11, want: 2},
+		{p: 50, want: 5},
+		{p: 90, want: 9},
+		{p: 95, want: 10},
+		{p: 100, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.p), func(t *testing.T) {
+			assert.Equal(t, tt.want, percentile(sorted, tt.p))
+		})
+	}
+	assert.Zero(t, percentile(nil, 50))
+}
+
+func TestNetnsDiscoveryProfilerOutliers(t *testing.T) {
+	p := NewNetnsDiscoveryProfiler(80, 2)
+	assert.Empty(t, p.Outliers())
+
+	for i := 0; i < 7; i++ {
+		p.Record(types.UID(fmt.Sprintf("fast-%d", i)), time.Millisecond)
+	}
+	p.Record("slow-1", 200*time.Millisecond)
+	p.Record("slow-1", 400*time.Millisecond)
+	p.Record("slow-2", 100*time.Millisecond)
+	p.Record("slow-3", 50*time.Millisecond)
+
+	// the 80th percentile of the 10 means is the 8th, which is 50ms
+	assert.Equal(t, 50*time.Millisecond, p.Threshold())
+	assert.Equal(t, []SlowDiscovery{
+		{UID: "slow-1", Mean: 300 * time.Millisecond},
+		{UID: "slow-2", Mean: 100 * time.Millisecond},
+	}, p.Outliers())
+
+	p.Record("slow-3", 950*time.Millisecond)
+	p.UpdateMetrics()
+	assert.Equal(t, 2, testutil.CollectAndCount(NetnsSlowDiscoveryUID))
+	assert.Equal(t, 0.5, testutil.ToFloat64(NetnsSlowDiscoveryUID.WithLabelValues("slow-3", "1")))
+	assert.Equal(t, 0.3, testutil.ToFloat64(NetnsSlowDiscoveryUID.WithLabelValues("slow-1", "2")))
+
+	// the series of the previous update are replaced
+	p.Forget("slow-1")
+	p.Forget("slow-3")
+	p.UpdateMetrics()
+	assert.Equal(t, 1, testutil.CollectAndCount(NetnsSlowDiscoveryUID))
+	assert.Equal(t, 0.1, testutil.ToFloat64(NetnsSlowDiscoveryUID.WithLabelValues("slow-2", "1")))
+}
+
+func TestNetnsDiscoveryProfilerRunMetricsUpdate(t *testing.T) {
+	NetnsSlowDiscoveryUID.Reset()
+	defer NetnsSlowDiscoveryUID.Reset()
+	p := NewNetnsDiscoveryProfiler(50, 3)
+	p.Record("fast", time.Millisecond)
+	p.Record("slow", time.Second)
+
+	fakeClock := clocktesting.NewFakeClock(time.Unix(1700000000, 0))
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan struct{})
+	go func() {
+		p.runMetricsUpdate(ctx, fakeClock, 30*time.Second)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	require.Eventually(t, fakeClock.HasWaiters, 5*time.Second, time.Millisecond)
+	assert.Zero(t, testutil.CollectAndCount(NetnsSlowDiscoveryUID))
+	fakeClock.Step(30 * time.Second)
+	require.Eventually(t, func() bool {
+		return testutil.CollectAndCount(NetnsSlowDiscoveryUID) == 1
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(NetnsSlowDiscoveryUID.WithLabelValues("slow", "1")))
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"istio.io/pkg/log"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// DefaultNetnsStatePath is where the netns enrollment state is saved, it must outlive a
+// reboot of the node for ResyncNetnsOnNodeReboot to detect the reboot.
+const DefaultNetnsStatePath = "/mnt/kmesh/netns_state"
+
+// ResyncNetnsOnNodeReboot drops the netns cached before a reboot of the node and finds the
+// netns of the running pods again. A reboot is detected if the node has been up for less
+// time than has passed since the state was saved to DefaultNetnsStatePath.
+func ResyncNetnsOnNodeReboot(ctx context.Context) error {
+	_, err := resyncNetnsOnNodeReboot(ctx, utils.GetProcRootFromEnv(), DefaultNetnsStatePath, time.Now(), BackfillNetnsForRunningPods)
+	return err
+}
+
+// resyncNetnsOnNodeReboot returns true if a reboot since the state saved at statePath
+// was detected and backfill was called
+func resyncNetnsOnNodeReboot(ctx context.Context, procRoot, statePath string, now time.Time,
+	backfill func(ctx context.Context) error) (bool, error) {
+	state, err := LoadState(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		// nothing cached from before
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	uptime, err := readUptime(procRoot)
+	if err != nil {
+		return false, err
+	}
+
+	saveAge := now.Sub(time.Unix(0, state.SavedAtUnixNano))
+	if uptime >= saveAge {
+		return false, nil
+	}
+	log.Infof("node rebooted since the netns state was saved %s ago, up for %s, resync the netns of the pods", saveAge, uptime)
+	if err := backfill(ctx); err != nil {
+		return true, fmt.Errorf("failed to backfill netns after node reboot: %w", err)
+	}
+	return true, nil
+}
+
+// readUptime returns the uptime of the node from the uptime file of procRoot
+func readUptime(procRoot string) (time.Duration, error) {
+	path := filepath.Join(procRoot, "uptime")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read uptime: %v", err)
+	}
+	// the uptime and the idle time in seconds
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid uptime %q in %s", data, path)
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid uptime %q in %s", fields[0], path)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// BackfillNetnsForRunningPods replaces the netns cached for the pods and the sandboxes by
+// the netns of the pods running on the node, found in the proc of the host.
+func BackfillNetnsForRunningPods(ctx context.Context) error {
+	sandboxCache.reset()
+	return backfillNetns(ctx, utils.GetProcRootFromEnv(), podNetnsCache)
+}
+
+func backfillNetns(ctx context.Context, procRoot string, cache *NetnsCache) error {
+	cache.reset()
+	w := NewNetnsWarmup(procRoot)
+	w.cache = cache
+	return w.Run(ctx)
+}
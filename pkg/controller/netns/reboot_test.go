@@ -0,0 +1,123 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestUptime(t *testing.T, procRoot, uptime string) {
+	require.NoError(t, os.WriteFile(filepath.Join(procRoot, "uptime"), []byte(uptime), 0444))
+}
+
+func TestResyncNetnsOnNodeReboot(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	statePath := filepath.Join(t.TempDir(), "netns_state")
+	require.NoError(t, saveState(&NetnsEnrollmentState{
+		SchemaVersion:   NetnsEnrollmentStateSchemaVersion,
+		SavedAtUnixNano: now.Add(-time.Hour).UnixNano(),
+	}, statePath))
+
+	tests := []struct {
+		name    string
+		uptime  string
+		resync  bool
+		wantErr string
+	}{
+		{name: "up since before the save", uptime: "7200.52 14000.10\n"},
+		{name: "up exactly since the save", uptime: "3600.00 7100.00\n"},
+		{name: "rebooted after the save", uptime: "120.25 230.75\n", resync: true},
+		{name: "empty", uptime: "", wantErr: "invalid uptime"},
+		{name: "not a number", uptime: "up 3 days\n", wantErr: "invalid uptime"},
+		{name: "negative", uptime: "-5.0 10.0\n", wantErr: "invalid uptime"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			procRoot := t.TempDir()
+			writeTestUptime(t, procRoot, tt.uptime)
+			called := 0
+			resynced, err := resyncNetnsOnNodeReboot(context.TODO(), procRoot, statePath, now, func(ctx context.Context) error {
+				called++
+				return nil
+			})
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				assert.Zero(t, called)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.resync, resynced)
+			assert.Equal(t, tt.resync, called == 1)
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		procRoot := t.TempDir()
+		backfill := func(ctx context.Context) error {
+			return errors.New("no proc")
+		}
+		// no uptime
+		_, err := resyncNetnsOnNodeReboot(context.TODO(), procRoot, statePath, now, backfill)
+		assert.ErrorContains(t, err, "failed to read uptime")
+
+		writeTestUptime(t, procRoot, "1.00 2.00\n")
+		resynced, err := resyncNetnsOnNodeReboot(context.TODO(), procRoot, statePath, now, backfill)
+		assert.True(t, resynced)
+		assert.ErrorContains(t, err, "no proc")
+
+		// nothing saved before
+		resynced, err = resyncNetnsOnNodeReboot(context.TODO(), procRoot, filepath.Join(t.TempDir(), "netns_state"), now, backfill)
+		assert.NoError(t, err)
+		assert.False(t, resynced)
+
+		invalid := filepath.Join(t.TempDir(), "netns_state")
+		require.NoError(t, os.WriteFile(invalid, []byte("invalid"), 0600))
+		_, err = resyncNetnsOnNodeReboot(context.TODO(), procRoot, invalid, now, backfill)
+		assert.Error(t, err)
+	})
+}
+
+func TestBackfillNetns(t *testing.T) {
+	procRoot, pidA, _ := newWarmupProcRoot(t)
+	cache := NewNetnsCache()
+	// cached before the reboot
+	cache.Add("stale-pod", "/host/proc/1234/ns/net")
+	cache.Add(warmupPodA, "/host/proc/1234/ns/net")
+
+	require.NoError(t, backfillNetns(context.TODO(), procRoot, cache))
+	_, ok := cache.Get("stale-pod")
+	assert.False(t, ok)
+	nsPath, ok := cache.Get(warmupPodA)
+	require.True(t, ok)
+	assert.Equal(t, filepath.Join(procRoot, strconv.Itoa(pidA), "ns", "net"), nsPath)
+	_, ok = cache.Get(warmupPodB)
+	assert.True(t, ok)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	assert.ErrorIs(t, backfillNetns(ctx, procRoot, cache), context.Canceled)
+	assert.Zero(t, cache.Len())
+}
@@ -0,0 +1,293 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"istio.io/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// ReconcileEvent is the kind of pod event reconciled by ReconcileNetnsEnrollment
+type ReconcileEvent int
+
+const (
+	EventAdd ReconcileEvent = iota
+	EventUpdate
+	EventDelete
+)
+
+func (e ReconcileEvent) String() string {
+	switch e {
+	case EventAdd:
+		return "add"
+	case EventUpdate:
+		return "update"
+	case EventDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(e))
+	}
+}
+
+// TCEnroller attaches and detaches the tc programs of a pod living in the netns at nsPath.
+// The nsPath passed to Unenroll may be stale or empty when the netns of the pod is gone.
+type TCEnroller interface {
+	Enroll(ctx context.Context, pod *corev1.Pod, nsPath string) error
+	Unenroll(ctx context.Context, pod *corev1.Pod, nsPath string) error
+}
+
+// HostVethTCEnroller attaches the tc program ProgFd to the host side veth of a pod.
+// The host veth is annotated with the pod uid so that it can be found on unenrollment.
+type HostVethTCEnroller struct {
+	ProgFd int
+}
+
+func (e HostVethTCEnroller) Enroll(_ context.Context, pod *corev1.Pod, nsPath string) error {
+	var peerIndex uint64
+	err := ns.WithNetNSPath(nsPath, func(_ ns.NetNS) error {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return err
+		}
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			if peerIndex, err = utils.GetVethPeerIndexFromInterface(iface); err == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("no veth found in netns %s", nsPath)
+	})
+	if err != nil {
+		return err
+	}
+
+	return ns.WithNetNSPath(GetNodeNSpath(), func(_ ns.NetNS) error {
+		link, err := netlink.LinkByIndex(int(peerIndex))
+		if err != nil {
+			return fmt.Errorf("failed to get host veth of index %d: %v", peerIndex, err)
+		}
+
+		// the annotation is removed if the program cannot be attached, so that
+		// the interface is not taken for an enrolled one
+		tx := NewNetnsEnrollmentRollback()
+		tx.Begin(pod.UID)
+		tx.AddStep(func() error {
+			return utils.AnnotateInterface(link, map[string]string{utils.InterfaceAnnotationPodUID: string(pod.UID)})
+		}, func() error {
+			return utils.AnnotateInterface(link, map[string]string{utils.InterfaceAnnotationPodUID: ""})
+		})
+		tx.AddStep(func() error {
+			return utils.ManageTCProgramByFd(link, e.ProgFd, constants.TC_ATTACH, 0)
+		}, nil)
+		return tx.Commit()
+	})
+}
+
+func (e HostVethTCEnroller) Unenroll(_ context.Context, pod *corev1.Pod, _ string) error {
+	return ns.WithNetNSPath(GetNodeNSpath(), func(_ ns.NetNS) error {
+		n, err := utils.DetachTCProgramsByPodUID(pod.UID)
+		log.Debugf("detached tc programs of pod %s/%s from %d interfaces", pod.Namespace, pod.Name, n)
+		return err
+	})
+}
+
+// NetnsEnrollmentReconciler keeps the tc enrollment of pods in line with their netns. The
+// netns paths resolved are cached by GetPodNSpath, r keeps only the ones the pods are enrolled in.
+type NetnsEnrollmentReconciler struct {
+	enroller TCEnroller
+	detector *PodSandboxRecreationDetector
+
+	mu       sync.Mutex
+	enrolled map[types.UID]string
+
+	// resolveNetns returns the netns path of a pod, it is GetPodNSpath by default
+	resolveNetns func(pod *corev1.Pod) (string, error)
+	// journal records the enrollments if set
+	journal *NetnsEnrollmentJournal
+	// warmup is waited for before the first enrollments
+	warmup *NetnsWarmup
+}
+
+// NewNetnsEnrollmentReconciler creates a reconciler enrolling pods with enroller
+func NewNetnsEnrollmentReconciler(enroller TCEnroller) *NetnsEnrollmentReconciler {
+	return &NetnsEnrollmentReconciler{
+		enroller:     enroller,
+		detector:     NewPodSandboxRecreationDetector(nil),
+		enrolled:     make(map[types.UID]string),
+		resolveNetns: GetPodNSpath,
+		warmup:       defaultWarmup,
+	}
+}
+
+// SetJournal makes r record every enrollment attempt in journal, nil disables recording
+func (r *NetnsEnrollmentReconciler) SetJournal(journal *NetnsEnrollmentJournal) {
+	r.journal = journal
+}
+
+var (
+	defaultReconcilerMu sync.RWMutex
+	defaultReconciler   *NetnsEnrollmentReconciler
+)
+
+// SetTCEnroller sets the enroller used by ReconcileNetnsEnrollment
+func SetTCEnroller(enroller TCEnroller) {
+	defaultReconcilerMu.Lock()
+	defer defaultReconcilerMu.Unlock()
+	defaultReconciler = NewNetnsEnrollmentReconciler(enroller)
+}
+
+// ReconcileNetnsEnrollment reconciles the tc enrollment of a pod on event with the
+// enroller set by SetTCEnroller.
+func ReconcileNetnsEnrollment(ctx context.Context, pod *corev1.Pod, event ReconcileEvent) error {
+	defaultReconcilerMu.RLock()
+	r := defaultReconciler
+	defaultReconcilerMu.RUnlock()
+	if r == nil {
+		return errors.New("no tc enroller set")
+	}
+	return r.Reconcile(ctx, pod, event)
+}
+
+// Reconcile enrolls a pod on EventAdd and unenrolls it on EventDelete. On EventUpdate the pod
+// is enrolled again in its new netns if its sandbox has been recreated.
+func (r *NetnsEnrollmentReconciler) Reconcile(ctx context.Context, pod *corev1.Pod, event ReconcileEvent) error {
+	if pod == nil {
+		return errors.New("pod is nil")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	switch event {
+	case EventAdd:
+		return r.add(ctx, pod)
+	case EventUpdate:
+		return r.update(ctx, pod)
+	case EventDelete:
+		return r.delete(ctx, pod)
+	default:
+		return fmt.Errorf("unsupported event %s for pod %s/%s", event, pod.Namespace, pod.Name)
+	}
+}
+
+func (r *NetnsEnrollmentReconciler) add(ctx context.Context, pod *corev1.Pod) error {
+	if err := r.warmup.Wait(DefaultWarmupTimeout); err != nil {
+		// the netns is found by a scan of its own
+		log.Warnf("enrolling pod %s/%s without warmup: %v", pod.Namespace, pod.Name, err)
+	}
+	nsPath, err := r.resolveNetns(pod)
+	if err != nil {
+		return fmt.Errorf("failed to get netns for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	if _, err := r.detector.checkNetns(pod, nsPath); err != nil {
+		return err
+	}
+	return r.enroll(ctx, pod, nsPath)
+}
+
+func (r *NetnsEnrollmentReconciler) update(ctx context.Context, pod *corev1.Pod) error {
+	oldPath, ok := r.enrolledPath(pod.UID)
+	if !ok {
+		// the pod has never been enrolled successfully
+		return r.add(ctx, pod)
+	}
+
+	nsPath, err := r.resolveNetns(pod)
+	if err != nil {
+		return fmt.Errorf("failed to get netns for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	recreated, err := r.detector.checkNetns(pod, nsPath)
+	if err != nil {
+		return err
+	}
+	if !recreated {
+		return nil
+	}
+
+	// the old netns is usually gone together with the old sandbox, so failing
+	// to clean it up must not prevent enrolling the new one
+	if err := r.enroller.Unenroll(ctx, pod, oldPath); err != nil {
+		log.Warnf("failed to unenroll pod %s/%s from old netns %s: %v", pod.Namespace, pod.Name, oldPath, err)
+	}
+	return r.enroll(ctx, pod, nsPath)
+}
+
+func (r *NetnsEnrollmentReconciler) delete(ctx context.Context, pod *corev1.Pod) error {
+	nsPath, err := r.resolveNetns(pod)
+	if err != nil {
+		// the processes of a deleted pod may be gone already
+		nsPath, _ = r.enrolledPath(pod.UID)
+	}
+
+	if err := r.enroller.Unenroll(ctx, pod, nsPath); err != nil {
+		return fmt.Errorf("failed to unenroll pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	r.setEnrolled(pod.UID, "")
+	ForgetPodNetns(pod.UID)
+	r.detector.Forget(pod.UID)
+	DefaultDiscoveryProfiler.Forget(pod.UID)
+	return nil
+}
+
+func (r *NetnsEnrollmentReconciler) enroll(ctx context.Context, pod *corev1.Pod, nsPath string) error {
+	err := r.enroller.Enroll(ctx, pod, nsPath)
+	if r.journal != nil {
+		if jerr := r.journal.RecordEnrollment(pod, nsPath, err); jerr != nil {
+			log.Errorf("failed to record enrollment of pod %s/%s: %v", pod.Namespace, pod.Name, jerr)
+		}
+	}
+	if err != nil {
+		// not enrolled anymore, so that the next update retries
+		r.setEnrolled(pod.UID, "")
+		return fmt.Errorf("failed to enroll pod %s/%s in netns %s: %v", pod.Namespace, pod.Name, nsPath, err)
+	}
+	r.setEnrolled(pod.UID, nsPath)
+	return nil
+}
+
+// enrolledPath returns the netns path the pod uid is enrolled in
+func (r *NetnsEnrollmentReconciler) enrolledPath(uid types.UID) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	nsPath, ok := r.enrolled[uid]
+	return nsPath, ok
+}
+
+// setEnrolled records the pod uid as enrolled in nsPath, as not enrolled if empty
+func (r *NetnsEnrollmentReconciler) setEnrolled(uid types.UID, nsPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if nsPath == "" {
+		delete(r.enrolled, uid)
+		return
+	}
+	r.enrolled[uid] = nsPath
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type mockTCEnroller struct {
+	calls       []string
+	enrollErr   error
+	unenrollErr error
+}
+
+func (m *mockTCEnroller) Enroll(_ context.Context, _ *corev1.Pod, nsPath string) error {
+	m.calls = append(m.calls, "enroll "+nsPath)
+	return m.enrollErr
+}
+
+func (m *mockTCEnroller) Unenroll(_ context.Context, _ *corev1.Pod, nsPath string) error {
+	m.calls = append(m.calls, "unenroll "+nsPath)
+	return m.unenrollErr
+}
+
+type reconcileFixture struct {
+	r          *NetnsEnrollmentReconciler
+	enroller   *mockTCEnroller
+	pod        *corev1.Pod
+	oldNetns   string
+	newNetns   string
+	current    string
+	resolveErr error
+}
+
+func newReconcileFixture(t *testing.T) *reconcileFixture {
+	dir := t.TempDir()
+	f := &reconcileFixture{
+		enroller: &mockTCEnroller{},
+		pod: &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "ut-pod",
+				Namespace: "ut-ns",
+				UID:       "ut-uid",
+			},
+		},
+		oldNetns: filepath.Join(dir, "old"),
+		newNetns: filepath.Join(dir, "new"),
+	}
+	require.NoError(t, os.WriteFile(f.oldNetns, nil, 0644))
+	require.NoError(t, os.WriteFile(f.newNetns, nil, 0644))
+	f.current = f.oldNetns
+
+	f.r = NewNetnsEnrollmentReconciler(f.enroller)
+	f.r.resolveNetns = func(_ *corev1.Pod) (string, error) {
+		return f.current, f.resolveErr
+	}
+	return f
+}
+
+func TestReconcileAdd(t *testing.T) {
+	f := newReconcileFixture(t)
+	ctx := context.Background()
+
+	require.NoError(t, f.r.Reconcile(ctx, f.pod, EventAdd))
+	assert.Equal(t, []string{"enroll " + f.oldNetns}, f.enroller.calls)
+	path, ok := f.r.enrolledPath(f.pod.UID)
+	assert.True(t, ok)
+	assert.Equal(t, f.oldNetns, path)
+
+	// enroll failure
+	f = newReconcileFixture(t)
+	f.enroller.enrollErr = errors.New("attach failed")
+	assert.ErrorContains(t, f.r.Reconcile(ctx, f.pod, EventAdd), "attach failed")
+	assert.Equal(t, 0, len(f.r.enrolled))
+
+	// netns not found
+	f = newReconcileFixture(t)
+	f.resolveErr = errors.New("not found")
+	assert.ErrorContains(t, f.r.Reconcile(ctx, f.pod, EventAdd), "not found")
+	assert.Empty(t, f.enroller.calls)
+
+	// netns cannot be stat
+	f = newReconcileFixture(t)
+	f.current = "/not/exist"
+	assert.Error(t, f.r.Reconcile(ctx, f.pod, EventAdd))
+	assert.Empty(t, f.enroller.calls)
+}
+
+func TestReconcileUpdate(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("unchanged sandbox", func(t *testing.T) {
+		f := newReconcileFixture(t)
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventAdd))
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventUpdate))
+		assert.Equal(t, []string{"enroll " + f.oldNetns}, f.enroller.calls)
+	})
+
+	t.Run("recreated sandbox", func(t *testing.T) {
+		f := newReconcileFixture(t)
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventAdd))
+		f.current = f.newNetns
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventUpdate))
+		assert.Equal(t, []string{"enroll " + f.oldNetns, "unenroll " + f.oldNetns, "enroll " + f.newNetns}, f.enroller.calls)
+		path, _ := f.r.enrolledPath(f.pod.UID)
+		assert.Equal(t, f.newNetns, path)
+	})
+
+	t.Run("unenroll failure of old netns is ignored", func(t *testing.T) {
+		f := newReconcileFixture(t)
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventAdd))
+		f.current = f.newNetns
+		f.enroller.unenrollErr = errors.New("gone")
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventUpdate))
+		assert.Equal(t, "enroll "+f.newNetns, f.enroller.calls[len(f.enroller.calls)-1])
+	})
+
+	t.Run("enrollment retried after failure", func(t *testing.T) {
+		f := newReconcileFixture(t)
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventAdd))
+		f.current = f.newNetns
+		f.enroller.enrollErr = errors.New("attach failed")
+		assert.ErrorContains(t, f.r.Reconcile(ctx, f.pod, EventUpdate), "attach failed")
+
+		f.enroller.enrollErr = nil
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventUpdate))
+		assert.Equal(t, "enroll "+f.newNetns, f.enroller.calls[len(f.enroller.calls)-1])
+		path, _ := f.r.enrolledPath(f.pod.UID)
+		assert.Equal(t, f.newNetns, path)
+	})
+
+	t.Run("not enrolled yet", func(t *testing.T) {
+		f := newReconcileFixture(t)
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventUpdate))
+		assert.Equal(t, []string{"enroll " + f.oldNetns}, f.enroller.calls)
+	})
+
+	t.Run("netns not found", func(t *testing.T) {
+		f := newReconcileFixture(t)
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventAdd))
+		f.resolveErr = errors.New("not found")
+		assert.ErrorContains(t, f.r.Reconcile(ctx, f.pod, EventUpdate), "not found")
+	})
+}
+
+func TestReconcileDelete(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("running pod", func(t *testing.T) {
+		f := newReconcileFixture(t)
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventAdd))
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventDelete))
+		assert.Equal(t, []string{"enroll " + f.oldNetns, "unenroll " + f.oldNetns}, f.enroller.calls)
+		assert.Equal(t, 0, len(f.r.enrolled))
+
+		// the detector forgot the pod, adding it in another netns is not a recreation
+		f.current = f.newNetns
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventAdd))
+		recreated, err := f.r.detector.checkNetns(f.pod, f.newNetns)
+		assert.NoError(t, err)
+		assert.False(t, recreated)
+	})
+
+	t.Run("processes gone", func(t *testing.T) {
+		f := newReconcileFixture(t)
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventAdd))
+		f.resolveErr = errors.New("not found")
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventDelete))
+		assert.Equal(t, "unenroll "+f.oldNetns, f.enroller.calls[1])
+	})
+
+	t.Run("unknown pod", func(t *testing.T) {
+		f := newReconcileFixture(t)
+		f.resolveErr = errors.New("not found")
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventDelete))
+		assert.Equal(t, []string{"unenroll "}, f.enroller.calls)
+	})
+
+	t.Run("unenroll failure", func(t *testing.T) {
+		f := newReconcileFixture(t)
+		require.NoError(t, f.r.Reconcile(ctx, f.pod, EventAdd))
+		f.enroller.unenrollErr = errors.New("detach failed")
+		assert.ErrorContains(t, f.r.Reconcile(ctx, f.pod, EventDelete), "detach failed")
+		assert.Equal(t, 1, len(f.r.enrolled))
+	})
+}
+
+func TestReconcileInvalid(t *testing.T) {
+	f := newReconcileFixture(t)
+
+	assert.Error(t, f.r.Reconcile(context.Background(), nil, EventAdd))
+	assert.ErrorContains(t, f.r.Reconcile(context.Background(), f.pod, ReconcileEvent(10)), "unknown(10)")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, f.r.Reconcile(ctx, f.pod, EventAdd), context.Canceled)
+	assert.Empty(t, f.enroller.calls)
+}
+
+func TestReconcileNetnsEnrollment(t *testing.T) {
+	defer func() {
+		defaultReconciler = nil
+	}()
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "ut-uid"}}
+	assert.EqualError(t, ReconcileNetnsEnrollment(context.Background(), pod, EventAdd), "no tc enroller set")
+
+	enroller := &mockTCEnroller{}
+	SetTCEnroller(enroller)
+	assert.NoError(t, ReconcileNetnsEnrollment(context.Background(), pod, EventDelete))
+	assert.Len(t, enroller.calls, 1)
+}
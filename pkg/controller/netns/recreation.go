@@ -0,0 +1,95 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+	"sync"
+
+	"istio.io/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// PodSandboxRecreationDetector detects pods whose sandbox has been recreated.
+// A recreated sandbox keeps the pod UID but gets a brand new netns, so the
+// detector remembers the netns inode last seen for every pod UID.
+type PodSandboxRecreationDetector struct {
+	mu     sync.Mutex
+	inodes map[types.UID]uint64
+
+	// resolveNetns returns the netns path of a pod, it is GetPodNSpath by default
+	resolveNetns func(pod *corev1.Pod) (string, error)
+	// onRecreation is called when a sandbox recreation is detected so that
+	// the pod can be enrolled again
+	onRecreation func(pod *corev1.Pod)
+}
+
+// NewPodSandboxRecreationDetector creates a detector, onRecreation may be nil
+func NewPodSandboxRecreationDetector(onRecreation func(pod *corev1.Pod)) *PodSandboxRecreationDetector {
+	return &PodSandboxRecreationDetector{
+		inodes:       make(map[types.UID]uint64),
+		resolveNetns: GetPodNSpath,
+		onRecreation: onRecreation,
+	}
+}
+
+// CheckForRecreation returns true when the current netns inode of the pod differs
+// from the stored one. The first check of a pod only records its inode.
+func (d *PodSandboxRecreationDetector) CheckForRecreation(pod *corev1.Pod) (bool, error) {
+	nsPath, err := d.resolveNetns(pod)
+	if err != nil {
+		return false, fmt.Errorf("failed to get netns for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	return d.checkNetns(pod, nsPath)
+}
+
+// checkNetns is CheckForRecreation with the netns path of the pod already resolved
+func (d *PodSandboxRecreationDetector) checkNetns(pod *corev1.Pod, nsPath string) (bool, error) {
+	inode, err := getNetnsInode(nsPath)
+	if err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	old, ok := d.inodes[pod.UID]
+	d.inodes[pod.UID] = inode
+	d.mu.Unlock()
+
+	if !ok || old == inode {
+		return false, nil
+	}
+
+	log.Infof("sandbox of pod %s/%s recreated, netns inode changed from %d to %d", pod.Namespace, pod.Name, old, inode)
+	if d.onRecreation != nil {
+		d.onRecreation(pod)
+	}
+	return true, nil
+}
+
+// Forget removes the stored inode of a pod, it should be called on pod deletion
+func (d *PodSandboxRecreationDetector) Forget(uid types.UID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.inodes, uid)
+}
+
+func getNetnsInode(nsPath string) (uint64, error) {
+	return utils.GetNetnsInode(nsPath)
+}
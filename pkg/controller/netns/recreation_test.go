@@ -0,0 +1,78 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCheckForRecreation(t *testing.T) {
+	dir := t.TempDir()
+	oldNetns := filepath.Join(dir, "old")
+	newNetns := filepath.Join(dir, "new")
+	assert.NoError(t, os.WriteFile(oldNetns, nil, 0644))
+	assert.NoError(t, os.WriteFile(newNetns, nil, 0644))
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ut-pod",
+			Namespace: "ut-ns",
+			UID:       "ut-uid",
+		},
+	}
+
+	recreated := 0
+	d := NewPodSandboxRecreationDetector(func(_ *corev1.Pod) {
+		recreated++
+	})
+	current := oldNetns
+	d.resolveNetns = func(_ *corev1.Pod) (string, error) {
+		return current, nil
+	}
+
+	// first check only records the inode
+	changed, err := d.CheckForRecreation(pod)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	changed, err = d.CheckForRecreation(pod)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	current = newNetns
+	changed, err = d.CheckForRecreation(pod)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, 1, recreated)
+
+	d.Forget(pod.UID)
+	current = oldNetns
+	changed, err = d.CheckForRecreation(pod)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, 1, recreated)
+
+	current = filepath.Join(dir, "not-exist")
+	_, err = d.CheckForRecreation(pod)
+	assert.Error(t, err)
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"istio.io/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/clock"
+)
+
+// MaxEnrollmentRetryDelay caps the backoff of NetnsEnrollmentRetryQueue
+const MaxEnrollmentRetryDelay = 5 * time.Minute
+
+type enrollmentRetry struct {
+	pod        *corev1.Pod
+	maxRetries int
+	baseDelay  time.Duration
+	// attempts is the number of failed attempts
+	attempts int
+}
+
+// NetnsEnrollmentRetryQueue resolves the netns of the pods whose resolution failed. Each pod is
+// retried with an exponential backoff from its base delay until its retries are exhausted.
+type NetnsEnrollmentRetryQueue struct {
+	queue     workqueue.TypedDelayingInterface[types.UID]
+	find      func(pod *corev1.Pod) (string, error)
+	onSuccess func(pod *corev1.Pod, nsPath string)
+	onFailure func(pod *corev1.Pod, err error)
+
+	mu      sync.Mutex
+	pending map[types.UID]*enrollmentRetry
+	failed  map[types.UID]bool
+}
+
+// NewNetnsEnrollmentRetryQueue creates a queue resolving the netns of the pods with FindNetnsForPod.
+// onSuccess is called with the netns found, onFailure once the retries of a pod are exhausted.
+func NewNetnsEnrollmentRetryQueue(onSuccess func(pod *corev1.Pod, nsPath string), onFailure func(pod *corev1.Pod, err error)) *NetnsEnrollmentRetryQueue {
+	return newNetnsEnrollmentRetryQueue(clock.RealClock{}, FindNetnsForPod, onSuccess, onFailure)
+}
+
+func newNetnsEnrollmentRetryQueue(clock clock.WithTicker, find func(pod *corev1.Pod) (string, error),
+	onSuccess func(pod *corev1.Pod, nsPath string), onFailure func(pod *corev1.Pod, err error)) *NetnsEnrollmentRetryQueue {
+	return &NetnsEnrollmentRetryQueue{
+		queue: workqueue.NewTypedDelayingQueueWithConfig(workqueue.TypedDelayingQueueConfig[types.UID]{
+			Name:  "netnsEnrollmentRetry",
+			Clock: clock,
+		}),
+		find:      find,
+		onSuccess: onSuccess,
+		onFailure: onFailure,
+		pending:   make(map[types.UID]*enrollmentRetry),
+		failed:    make(map[types.UID]bool),
+	}
+}
+
+// Enqueue adds pod to be resolved now, and then retried up to maxRetries times with a delay
+// doubling from baseDelay. A pod already queued keeps its remaining retries.
+func (q *NetnsEnrollmentRetryQueue) Enqueue(pod *corev1.Pod, maxRetries int, baseDelay time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if item, ok := q.pending[pod.UID]; ok {
+		item.pod = pod
+		return
+	}
+	delete(q.failed, pod.UID)
+	q.pending[pod.UID] = &enrollmentRetry{pod: pod, maxRetries: maxRetries, baseDelay: baseDelay}
+	q.queue.Add(pod.UID)
+}
+
+// Forget drops pod from the queue, e.g. once it is deleted
+func (q *NetnsEnrollmentRetryQueue) Forget(uid types.UID) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, uid)
+	delete(q.failed, uid)
+}
+
+// QueueDepth returns the number of pods waiting to be resolved
+func (q *NetnsEnrollmentRetryQueue) QueueDepth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// FailedPods returns the sorted uids of the pods whose retries are exhausted
+func (q *NetnsEnrollmentRetryQueue) FailedPods() []types.UID {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	uids := make([]types.UID, 0, len(q.failed))
+	for uid := range q.failed {
+		uids = append(uids, uid)
+	}
+	slices.Sort(uids)
+	return uids
+}
+
+// Run resolves the pods queued until ctx is done
+func (q *NetnsEnrollmentRetryQueue) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		q.queue.ShutDown()
+	}()
+	for q.processNext() {
+	}
+}
+
+func (q *NetnsEnrollmentRetryQueue) processNext() bool {
+	uid, quit := q.queue.Get()
+	if quit {
+		return false
+	}
+	defer q.queue.Done(uid)
+
+	q.mu.Lock()
+	item, ok := q.pending[uid]
+	q.mu.Unlock()
+	if !ok {
+		// forgotten
+		return true
+	}
+
+	nsPath, err := q.find(item.pod)
+
+	q.mu.Lock()
+	if q.pending[uid] != item {
+		// forgotten while resolved
+		q.mu.Unlock()
+		return true
+	}
+	if err == nil {
+		delete(q.pending, uid)
+		q.mu.Unlock()
+		if q.onSuccess != nil {
+			q.onSuccess(item.pod, nsPath)
+		}
+		return true
+	}
+
+	item.attempts++
+	if item.attempts > item.maxRetries {
+		delete(q.pending, uid)
+		q.failed[uid] = true
+		q.mu.Unlock()
+		log.Warnf("failed to find netns of pod %s/%s after %d attempts: %v", item.pod.Namespace, item.pod.Name, item.attempts, err)
+		if q.onFailure != nil {
+			q.onFailure(item.pod, err)
+		}
+		return true
+	}
+	delay := retryDelay(item.baseDelay, item.attempts)
+	q.mu.Unlock()
+	log.Debugf("retry finding netns of pod %s/%s in %s: %v", item.pod.Namespace, item.pod.Name, delay, err)
+	q.queue.AddAfter(uid, delay)
+	return true
+}
+
+// retryDelay returns the delay before the retry following the failed attempt, baseDelay
+// doubled for each attempt before, up to MaxEnrollmentRetryDelay
+func retryDelay(baseDelay time.Duration, attempt int) time.Duration {
+	delay := baseDelay
+	for i := 1; i < attempt && delay < MaxEnrollmentRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, MaxEnrollmentRetryDelay)
+}
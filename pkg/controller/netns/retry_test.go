@@ -0,0 +1,161 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+type retryRecorder struct {
+	mu        sync.Mutex
+	clock     *clocktesting.FakeClock
+	attempts  []time.Time
+	failUntil int
+	succeeded []string
+	failed    []types.UID
+}
+
+func (r *retryRecorder) find(pod *corev1.Pod) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts = append(r.attempts, r.clock.Now())
+	if len(r.attempts) <= r.failUntil {
+		return "", errors.New("No matching network namespace found")
+	}
+	return "/host/proc/1234/ns/net", nil
+}
+
+func (r *retryRecorder) numAttempts() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.attempts)
+}
+
+func newTestRetryQueue(t *testing.T, failUntil int) (*NetnsEnrollmentRetryQueue, *retryRecorder) {
+	r := &retryRecorder{clock: clocktesting.NewFakeClock(time.Unix(0, 0)), failUntil: failUntil}
+	q := newNetnsEnrollmentRetryQueue(r.clock, r.find, func(pod *corev1.Pod, nsPath string) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.succeeded = append(r.succeeded, nsPath)
+	}, func(pod *corev1.Pod, err error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.failed = append(r.failed, pod.UID)
+	})
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return q, r
+}
+
+// stepUntilAttempt advances the clock by step and waits for the attempt n
+func stepUntilAttempt(t *testing.T, r *retryRecorder, step time.Duration, n int) {
+	// the attempt is not made before the delay
+	if step > time.Nanosecond {
+		r.clock.Step(step - time.Nanosecond)
+		time.Sleep(20 * time.Millisecond)
+		require.Less(t, r.numAttempts(), n, "attempt %d made before its delay", n)
+		step = time.Nanosecond
+	}
+	r.clock.Step(step)
+	require.Eventually(t, func() bool {
+		return r.numAttempts() >= n
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestNetnsEnrollmentRetryQueueBackoff(t *testing.T) {
+	q, r := newTestRetryQueue(t, 3)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "uid-1", Namespace: "ns", Name: "pod"}}
+	q.Enqueue(pod, 5, time.Second)
+	assert.Equal(t, 1, q.QueueDepth())
+
+	// the first attempt is immediate, then the delay doubles
+	require.Eventually(t, func() bool { return r.numAttempts() == 1 }, 5*time.Second, time.Millisecond)
+	stepUntilAttempt(t, r, time.Second, 2)
+	stepUntilAttempt(t, r, 2*time.Second, 3)
+	stepUntilAttempt(t, r, 4*time.Second, 4)
+	require.Eventually(t, func() bool { return q.QueueDepth() == 0 }, 5*time.Second, time.Millisecond)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	start := time.Unix(0, 0)
+	assert.Equal(t, []time.Duration{0, time.Second, 3 * time.Second, 7 * time.Second}, []time.Duration{
+		r.attempts[0].Sub(start), r.attempts[1].Sub(start), r.attempts[2].Sub(start), r.attempts[3].Sub(start),
+	})
+	assert.Equal(t, []string{"/host/proc/1234/ns/net"}, r.succeeded)
+	assert.Empty(t, r.failed)
+	assert.Empty(t, q.FailedPods())
+}
+
+func TestNetnsEnrollmentRetryQueueExhausted(t *testing.T) {
+	q, r := newTestRetryQueue(t, 100)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "uid-1"}}
+	q.Enqueue(pod, 2, time.Second)
+	// a pod already queued keeps its budget
+	q.Enqueue(pod, 10, time.Hour)
+
+	require.Eventually(t, func() bool { return r.numAttempts() == 1 }, 5*time.Second, time.Millisecond)
+	stepUntilAttempt(t, r, time.Second, 2)
+	stepUntilAttempt(t, r, 2*time.Second, 3)
+	require.Eventually(t, func() bool { return len(q.FailedPods()) == 1 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, []types.UID{"uid-1"}, q.FailedPods())
+	assert.Zero(t, q.QueueDepth())
+
+	// no more retries
+	r.clock.Step(time.Hour)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 3, r.numAttempts())
+	r.mu.Lock()
+	assert.Equal(t, []types.UID{"uid-1"}, r.failed)
+	r.mu.Unlock()
+
+	// enqueued again with a new budget
+	q.Enqueue(pod, 0, time.Second)
+	assert.Empty(t, q.FailedPods())
+	require.Eventually(t, func() bool { return len(q.FailedPods()) == 1 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, 4, r.numAttempts())
+
+	q.Forget("uid-1")
+	assert.Empty(t, q.FailedPods())
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, time.Second, retryDelay(time.Second, 1))
+	assert.Equal(t, 2*time.Second, retryDelay(time.Second, 2))
+	assert.Equal(t, 8*time.Second, retryDelay(time.Second, 4))
+	assert.Equal(t, MaxEnrollmentRetryDelay, retryDelay(time.Second, 20))
+	assert.Equal(t, MaxEnrollmentRetryDelay, retryDelay(time.Second, 1000))
+}
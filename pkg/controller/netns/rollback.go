@@ -0,0 +1,88 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"errors"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type enrollmentStep struct {
+	do   func() error
+	undo func() error
+}
+
+// NetnsEnrollmentRollback is an enrollment transaction of a pod. The steps added are run by
+// Commit, if one of them fails the steps run before are undone in reverse order, so that the
+// pod is never left partially enrolled, e.g. with only some of its interfaces attached.
+type NetnsEnrollmentRollback struct {
+	podUID types.UID
+	steps  []enrollmentStep
+	// done is the number of steps run successfully by Commit
+	done int
+}
+
+// NewNetnsEnrollmentRollback creates a transaction, Begin must be called before adding steps
+func NewNetnsEnrollmentRollback() *NetnsEnrollmentRollback {
+	return &NetnsEnrollmentRollback{}
+}
+
+// Begin starts the transaction of the enrollment of the pod podUID, dropping the steps of
+// the previous transaction without undoing them.
+func (r *NetnsEnrollmentRollback) Begin(podUID types.UID) {
+	r.podUID = podUID
+	r.steps = nil
+	r.done = 0
+}
+
+// AddStep adds op, undone by undoOp, to the transaction. undoOp may be nil if op needs no undo.
+func (r *NetnsEnrollmentRollback) AddStep(op func() error, undoOp func() error) {
+	r.steps = append(r.steps, enrollmentStep{do: op, undo: undoOp})
+}
+
+// Commit runs the steps not run yet in the order they are added. If a step fails, the steps
+// run before are undone and the error of the step is returned together with the undo errors.
+func (r *NetnsEnrollmentRollback) Commit() error {
+	if r.podUID == "" {
+		return errors.New("enrollment transaction is not begun")
+	}
+	for ; r.done < len(r.steps); r.done++ {
+		if err := r.steps[r.done].do(); err != nil {
+			err = fmt.Errorf("step %d of enrollment of pod %s failed: %v", r.done+1, r.podUID, err)
+			return errors.Join(err, r.Rollback())
+		}
+	}
+	return nil
+}
+
+// Rollback undoes the steps run by Commit in reverse order. All the steps are undone even if
+// some undo fails, the undo errors are returned joined.
+func (r *NetnsEnrollmentRollback) Rollback() error {
+	var errs []error
+	for ; r.done > 0; r.done-- {
+		undo := r.steps[r.done-1].undo
+		if undo == nil {
+			continue
+		}
+		if err := undo(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to undo step %d of enrollment of pod %s: %v", r.done, r.podUID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
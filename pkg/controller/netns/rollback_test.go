@@ -0,0 +1,147 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetnsEnrollmentRollback(t *testing.T) {
+	var calls []string
+	step := func(name string, err error) (func() error, func() error) {
+		return func() error {
+				calls = append(calls, "do "+name)
+				return err
+			}, func() error {
+				calls = append(calls, "undo "+name)
+				return nil
+			}
+	}
+
+	tests := []struct {
+		name      string
+		steps     []error
+		noUndo    int
+		wantCalls []string
+		wantErr   string
+	}{
+		{
+			name:      "all steps succeed",
+			steps:     []error{nil, nil, nil},
+			wantCalls: []string{"do 1", "do 2", "do 3"},
+		},
+		{
+			name:      "last step fails",
+			steps:     []error{nil, nil, errors.New("attach failed")},
+			wantCalls: []string{"do 1", "do 2", "do 3", "undo 2", "undo 1"},
+			wantErr:   "step 3 of enrollment of pod ut-uid failed: attach failed",
+		},
+		{
+			name:      "first step fails",
+			steps:     []error{errors.New("annotate failed"), nil},
+			wantCalls: []string{"do 1"},
+			wantErr:   "step 1 of enrollment of pod ut-uid failed",
+		},
+		{
+			name:      "step without undo",
+			steps:     []error{nil, nil, errors.New("attach failed")},
+			noUndo:    2,
+			wantCalls: []string{"do 1", "do 2", "do 3", "undo 1"},
+			wantErr:   "attach failed",
+		},
+		{
+			name:  "no steps",
+			steps: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			tx := NewNetnsEnrollmentRollback()
+			tx.Begin("ut-uid")
+			for i, err := range tt.steps {
+				do, undo := step(fmt.Sprint(i+1), err)
+				if i+1 == tt.noUndo {
+					undo = nil
+				}
+				tx.AddStep(do, undo)
+			}
+
+			err := tx.Commit()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
+
+func TestNetnsEnrollmentRollbackAfterCommit(t *testing.T) {
+	var calls []string
+	tx := NewNetnsEnrollmentRollback()
+	assert.ErrorContains(t, tx.Commit(), "not begun")
+
+	tx.Begin("ut-uid")
+	for _, name := range []string{"1", "2", "3"} {
+		tx.AddStep(func() error {
+			calls = append(calls, "do "+name)
+			return nil
+		}, func() error {
+			calls = append(calls, "undo "+name)
+			if name == "2" {
+				return errors.New("detach failed")
+			}
+			return nil
+		})
+	}
+	require.NoError(t, tx.Commit())
+	// committed steps are not run again
+	require.NoError(t, tx.Commit())
+
+	// all the steps are undone despite the failure of one
+	err := tx.Rollback()
+	assert.ErrorContains(t, err, "failed to undo step 2 of enrollment of pod ut-uid: detach failed")
+	assert.Equal(t, []string{"do 1", "do 2", "do 3", "undo 3", "undo 2", "undo 1"}, calls)
+
+	// nothing left to undo
+	calls = nil
+	assert.NoError(t, tx.Rollback())
+	assert.Empty(t, calls)
+
+	// a new transaction drops the steps of the previous one
+	tx.Begin("other-uid")
+	require.NoError(t, tx.Commit())
+	assert.Empty(t, calls)
+}
+
+func TestNetnsEnrollmentRollbackUndoErrors(t *testing.T) {
+	tx := NewNetnsEnrollmentRollback()
+	tx.Begin("ut-uid")
+	tx.AddStep(func() error { return nil }, func() error { return errors.New("undo failed") })
+	tx.AddStep(func() error { return errors.New("attach failed") }, nil)
+
+	err := tx.Commit()
+	assert.ErrorContains(t, err, "attach failed")
+	assert.ErrorContains(t, err, "failed to undo step 1 of enrollment of pod ut-uid: undo failed")
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"sync"
+	"time"
+)
+
+// sandboxNetnsCache records the netns paths of the cri sandboxes, for the components
+// knowing the sandbox id but not the pod uid
+type sandboxNetnsCache struct {
+	mu      sync.Mutex
+	entries map[string]netnsCacheEntry
+}
+
+var sandboxCache = &sandboxNetnsCache{entries: make(map[string]netnsCacheEntry)}
+
+// CacheSandboxNetns records path as the netns of the sandbox sandboxID
+func CacheSandboxNetns(sandboxID, path string) {
+	inode, _ := getNetnsInode(path)
+
+	sandboxCache.mu.Lock()
+	defer sandboxCache.mu.Unlock()
+	sandboxCache.entries[sandboxID] = netnsCacheEntry{path: path, inode: inode, addedAt: time.Now()}
+}
+
+// GetNetnsForSandboxFromCache returns the netns path cached for the sandbox sandboxID. The
+// entry is dropped if the path no longer refers to the netns it referred to when cached.
+func GetNetnsForSandboxFromCache(sandboxID string) (string, bool) {
+	sandboxCache.mu.Lock()
+	entry, ok := sandboxCache.entries[sandboxID]
+	sandboxCache.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+
+	inode, err := getNetnsInode(entry.path)
+	if err != nil || inode != entry.inode {
+		InvalidateSandboxCache(sandboxID)
+		return "", false
+	}
+	return entry.path, true
+}
+
+// InvalidateSandboxCache drops the netns cached for the sandbox sandboxID, together with
+// the netns cached for the pods by the same path, so that both caches are resolved again.
+func InvalidateSandboxCache(sandboxID string) {
+	sandboxCache.mu.Lock()
+	entry, ok := sandboxCache.entries[sandboxID]
+	delete(sandboxCache.entries, sandboxID)
+	sandboxCache.mu.Unlock()
+	if ok {
+		podNetnsCache.deletePath(entry.path)
+	}
+}
+
+// reset drops the netns cached for all the sandboxes
+func (c *sandboxNetnsCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]netnsCacheEntry)
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	tasks "github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func resetSandboxCache(t *testing.T) {
+	oldSandboxCache, oldPodCache := sandboxCache, podNetnsCache
+	sandboxCache = &sandboxNetnsCache{entries: make(map[string]netnsCacheEntry)}
+	podNetnsCache = NewNetnsCache()
+	t.Cleanup(func() {
+		sandboxCache, podNetnsCache = oldSandboxCache, oldPodCache
+	})
+}
+
+func TestGetNetnsForSandboxFromCache(t *testing.T) {
+	resetSandboxCache(t)
+	pid := os.Getpid()
+	procRoot := newTestProcRoot(t, pid)
+	nsPath := filepath.Join(procRoot, strconv.Itoa(pid), "ns", "net")
+
+	_, ok := GetNetnsForSandboxFromCache("sandbox-1")
+	assert.False(t, ok)
+
+	CacheSandboxNetns("sandbox-1", nsPath)
+	podNetnsCache.Add("uid-1", nsPath)
+	podNetnsCache.Add("uid-2", "/host/proc/2/ns/net")
+	got, ok := GetNetnsForSandboxFromCache("sandbox-1")
+	assert.True(t, ok)
+	assert.Equal(t, nsPath, got)
+
+	// the pods sharing the netns of the sandbox are invalidated too
+	InvalidateSandboxCache("sandbox-1")
+	_, ok = GetNetnsForSandboxFromCache("sandbox-1")
+	assert.False(t, ok)
+	_, ok = podNetnsCache.Get("uid-1")
+	assert.False(t, ok)
+	_, ok = podNetnsCache.Get("uid-2")
+	assert.True(t, ok)
+	InvalidateSandboxCache("not-cached")
+	assert.Equal(t, 1, podNetnsCache.Len())
+
+	// the sandbox exited since it was cached
+	CacheSandboxNetns("sandbox-2", nsPath)
+	podNetnsCache.Add("uid-1", nsPath)
+	require.NoError(t, os.RemoveAll(filepath.Join(procRoot, strconv.Itoa(pid))))
+	_, ok = GetNetnsForSandboxFromCache("sandbox-2")
+	assert.False(t, ok)
+	assert.Empty(t, sandboxCache.entries)
+	_, ok = podNetnsCache.Get("uid-1")
+	assert.False(t, ok)
+}
+
+func TestGetNetnsFromContainerdTaskAPICachesSandbox(t *testing.T) {
+	resetSandboxCache(t)
+	pid := os.Getpid()
+	oldConfig := DefaultContainerdClientConfig
+	DefaultContainerdClientConfig.ProcRoot = newTestProcRoot(t, pid)
+	defer func() {
+		DefaultContainerdClientConfig = oldConfig
+	}()
+
+	socket := filepath.Join(t.TempDir(), "containerd.sock")
+	lis, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	tasks.RegisterTasksServer(server, &mockTasksServer{
+		namespace: ContainerdK8sNamespace,
+		processes: map[string]*task.Process{
+			"sandbox-1": {ID: "sandbox-1", Pid: uint32(pid), Status: task.Status_RUNNING},
+		},
+	})
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	defer server.Stop()
+
+	nsPath, err := GetNetnsFromContainerdTaskAPI(socket, "sandbox-1")
+	require.NoError(t, err)
+	cached, ok := GetNetnsForSandboxFromCache("sandbox-1")
+	assert.True(t, ok)
+	assert.Equal(t, nsPath, cached)
+
+	// failures are not cached
+	_, err = GetNetnsFromContainerdTaskAPI(socket, "sandbox-2")
+	assert.Error(t, err)
+	_, ok = GetNetnsForSandboxFromCache("sandbox-2")
+	assert.False(t, ok)
+}
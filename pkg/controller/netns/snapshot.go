@@ -0,0 +1,119 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/types"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// DefaultNetnsSnapshotPath is where NetnsSnapshotExporter writes the netns of the pods
+const DefaultNetnsSnapshotPath = "/var/run/kmesh/netns-snapshot.json"
+
+// DumpNetnsMap returns the netns paths of the pods resolved by GetPodNSpath
+func DumpNetnsMap() map[types.UID]string {
+	return podNetnsCache.Dump()
+}
+
+// Dump returns the netns paths of the pods of c
+func (c *NetnsCache) Dump() map[types.UID]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	paths := make(map[types.UID]string, len(c.entries))
+	for uid, entry := range c.entries {
+		paths[uid] = entry.path
+	}
+	return paths
+}
+
+// netnsSnapshot is the json document written by NetnsSnapshotExporter
+type netnsSnapshot struct {
+	SavedAt time.Time            `json:"savedAt"`
+	Pods    map[types.UID]string `json:"pods"`
+}
+
+// NetnsSnapshotExporter writes the netns of the pods to a json file, so that the enrollment
+// can be inspected on the node and survives restarts of the controller
+type NetnsSnapshotExporter struct {
+	dump func() map[types.UID]string
+	now  func() time.Time
+}
+
+// NewNetnsSnapshotExporter creates an exporter of DumpNetnsMap
+func NewNetnsSnapshotExporter() *NetnsSnapshotExporter {
+	return &NetnsSnapshotExporter{dump: DumpNetnsMap, now: time.Now}
+}
+
+// Start writes the snapshot to path, DefaultNetnsSnapshotPath if empty, now and then every
+// interval in the background until ctx is done
+func (e *NetnsSnapshotExporter) Start(ctx context.Context, interval time.Duration, path string) {
+	if path == "" {
+		path = DefaultNetnsSnapshotPath
+	}
+	go e.run(ctx, interval, path)
+}
+
+func (e *NetnsSnapshotExporter) run(ctx context.Context, interval time.Duration, path string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := e.write(path); err != nil {
+			log.Warnf("failed to write netns snapshot: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *NetnsSnapshotExporter) write(path string) error {
+	data, err := json.MarshalIndent(netnsSnapshot{SavedAt: e.now(), Pods: e.dump()}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal netns snapshot: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory of netns snapshot %s: %v", path, err)
+	}
+	return utils.AtomicWrite(path, data, 0644)
+}
+
+// LoadSnapshot reads the netns of the pods written by NetnsSnapshotExporter at path
+func LoadSnapshot(path string) (map[types.UID]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := netnsSnapshot{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal netns snapshot %s: %v", path, err)
+	}
+	if snapshot.Pods == nil {
+		snapshot.Pods = map[types.UID]string{}
+	}
+	return snapshot.Pods, nil
+}
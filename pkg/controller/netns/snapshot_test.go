@@ -0,0 +1,114 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestNetnsCacheDump(t *testing.T) {
+	c := NewNetnsCache()
+	assert.Empty(t, c.Dump())
+	c.Add("uid-1", "/host/proc/1/ns/net")
+	c.Add("uid-2", "/host/proc/2/ns/net")
+
+	paths := c.Dump()
+	assert.Equal(t, map[types.UID]string{"uid-1": "/host/proc/1/ns/net", "uid-2": "/host/proc/2/ns/net"}, paths)
+	// the dump is a copy
+	paths["uid-3"] = "/host/proc/3/ns/net"
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestNetnsSnapshotExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kmesh", "netns-snapshot.json")
+
+	var mu sync.Mutex
+	pods := map[types.UID]string{"uid-1": "/host/proc/1/ns/net"}
+	e := &NetnsSnapshotExporter{
+		dump: func() map[types.UID]string {
+			mu.Lock()
+			defer mu.Unlock()
+			return maps.Clone(pods)
+		},
+		now: func() time.Time { return time.Unix(1700000000, 0) },
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan struct{})
+	go func() {
+		e.run(ctx, 10*time.Millisecond, path)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// written when started
+	require.Eventually(t, func() bool {
+		got, err := LoadSnapshot(path)
+		return err == nil && len(got) == 1
+	}, 5*time.Second, time.Millisecond)
+	got, err := LoadSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[types.UID]string{"uid-1": "/host/proc/1/ns/net"}, got)
+
+	mu.Lock()
+	pods["uid-2"] = "/host/proc/2/ns/net"
+	delete(pods, "uid-1")
+	mu.Unlock()
+	require.Eventually(t, func() bool {
+		got, err := LoadSnapshot(path)
+		return err == nil && got["uid-2"] != "" && got["uid-1"] == ""
+	}, 5*time.Second, time.Millisecond)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"savedAt": "`+time.Unix(1700000000, 0).Format(time.RFC3339)+`", "pods": {"uid-2": "/host/proc/2/ns/net"}}`, string(data))
+	// no temporary file is left
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	_, err := LoadSnapshot(filepath.Join(dir, "missing.json"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	path := filepath.Join(dir, "invalid.json")
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0644))
+	_, err = LoadSnapshot(path)
+	assert.ErrorContains(t, err, "failed to unmarshal netns snapshot")
+
+	path = filepath.Join(dir, "empty.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"savedAt": "2024-05-01T10:00:00Z"}`), 0644))
+	got, err := LoadSnapshot(path)
+	require.NoError(t, err)
+	assert.NotNil(t, got)
+	assert.Empty(t, got)
+}
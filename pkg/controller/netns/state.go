@@ -0,0 +1,112 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"k8s.io/apimachinery/pkg/types"
+
+	netnsapi "kmesh.net/kmesh/api/v2/netns"
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// NetnsEnrollmentStateSchemaVersion is the schema version written by SaveState,
+// LoadState refuses states of other versions.
+const NetnsEnrollmentStateSchemaVersion = 1
+
+// NetnsEnrollmentState is the persisted form of the netns cache
+type NetnsEnrollmentState = netnsapi.NetnsEnrollmentState
+
+// State returns the entries of c sorted by pod uid
+func (c *NetnsCache) State() *NetnsEnrollmentState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	state := &NetnsEnrollmentState{
+		SchemaVersion:   NetnsEnrollmentStateSchemaVersion,
+		SavedAtUnixNano: c.now().UnixNano(),
+	}
+	for uid, entry := range c.entries {
+		state.Pods = append(state.Pods, &netnsapi.PodNetnsEnrollment{
+			Uid:                string(uid),
+			NetnsPath:          entry.path,
+			Inode:              entry.inode,
+			EnrolledAtUnixNano: entry.addedAt.UnixNano(),
+		})
+	}
+	slices.SortFunc(state.Pods, func(a, b *netnsapi.PodNetnsEnrollment) int {
+		return strings.Compare(a.Uid, b.Uid)
+	})
+	return state
+}
+
+// Restore adds the pods of state to c, existing entries of the same pods are replaced
+func (c *NetnsCache) Restore(state *NetnsEnrollmentState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, pod := range state.GetPods() {
+		c.entries[types.UID(pod.Uid)] = netnsCacheEntry{
+			path:    pod.NetnsPath,
+			inode:   pod.Inode,
+			addedAt: time.Unix(0, pod.EnrolledAtUnixNano),
+		}
+	}
+}
+
+// SaveState writes the netns enrollment state of the pods to path atomically,
+// together with the ids of the maps updated by maps.
+func SaveState(path string, maps ...utils.BPFMapUpdater) error {
+	state := podNetnsCache.State()
+	for _, m := range maps {
+		if err := m.Persist(state); err != nil {
+			return fmt.Errorf("failed to persist map %d: %v", m.MapID, err)
+		}
+	}
+	return saveState(state, path)
+}
+
+func saveState(state *NetnsEnrollmentState, path string) error {
+	data, err := proto.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal netns enrollment state: %v", err)
+	}
+	return utils.AtomicWrite(path, data, 0600)
+}
+
+// LoadState reads the netns enrollment state saved by SaveState at path
+func LoadState(path string) (*NetnsEnrollmentState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &NetnsEnrollmentState{}
+	if err := proto.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal netns enrollment state %s: %v", path, err)
+	}
+	if state.SchemaVersion != NetnsEnrollmentStateSchemaVersion {
+		return nil, fmt.Errorf("unsupported schema version %d of netns enrollment state %s, expect %d",
+			state.SchemaVersion, path, NetnsEnrollmentStateSchemaVersion)
+	}
+	return state, nil
+}
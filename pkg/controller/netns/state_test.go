@@ -0,0 +1,113 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	nsPath := filepath.Join(dir, "netns")
+	require.NoError(t, os.WriteFile(nsPath, nil, 0644))
+	inode, err := getNetnsInode(nsPath)
+	require.NoError(t, err)
+
+	now := time.Unix(1700000000, 123)
+	c := NewNetnsCache()
+	c.now = func() time.Time { return now }
+	c.Add("uid-b", nsPath)
+	c.Add("uid-a", "/not/exist")
+
+	oldCache := podNetnsCache
+	podNetnsCache = c
+	defer func() {
+		podNetnsCache = oldCache
+	}()
+
+	statePath := filepath.Join(dir, "state")
+	require.NoError(t, SaveState(statePath))
+	state, err := LoadState(statePath)
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(c.State(), state))
+
+	pods := state.GetPods()
+	require.Len(t, pods, 2)
+	assert.Equal(t, "uid-a", pods[0].Uid)
+	assert.Equal(t, uint64(0), pods[0].Inode)
+	assert.Equal(t, "uid-b", pods[1].Uid)
+	assert.Equal(t, nsPath, pods[1].NetnsPath)
+	assert.Equal(t, inode, pods[1].Inode)
+	assert.Equal(t, now.UnixNano(), pods[1].EnrolledAtUnixNano)
+
+	restored := NewNetnsCache()
+	restored.Restore(state)
+	entry, ok := restored.entry("uid-b")
+	require.True(t, ok)
+	assert.Equal(t, netnsCacheEntry{path: nsPath, inode: inode, addedAt: time.Unix(0, now.UnixNano())}, entry)
+	assert.Equal(t, 2, restored.Len())
+
+	// the maps are reopened by id after restart
+	m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Array, KeySize: 4, ValueSize: 4, MaxEntries: 1})
+	require.NoError(t, err)
+	defer m.Close()
+	info, err := m.Info()
+	require.NoError(t, err)
+	mapID, _ := info.ID()
+	require.NoError(t, SaveState(statePath, utils.BPFMapUpdater{MapID: uint32(mapID)}))
+	state, err = LoadState(statePath)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{uint32(mapID)}, state.GetBpfMapIds())
+	var u utils.BPFMapUpdater
+	assert.NoError(t, u.Restore(state.GetBpfMapIds()[0]))
+	assert.Error(t, SaveState(statePath, utils.BPFMapUpdater{MapID: math.MaxUint32}))
+
+	// no temp file is left behind
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestLoadStateInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := LoadState(filepath.Join(dir, "not-exist"))
+	assert.True(t, os.IsNotExist(err))
+
+	garbage := filepath.Join(dir, "garbage")
+	require.NoError(t, os.WriteFile(garbage, []byte{0xff, 0xff}, 0600))
+	_, err = LoadState(garbage)
+	assert.ErrorContains(t, err, "failed to unmarshal")
+
+	future := filepath.Join(dir, "future")
+	state := NewNetnsCache().State()
+	state.SchemaVersion = NetnsEnrollmentStateSchemaVersion + 1
+	require.NoError(t, saveState(state, future))
+	_, err = LoadState(future)
+	assert.ErrorContains(t, err, "unsupported schema version 2")
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+
+	"istio.io/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// GetNetnsForTerminatingPod returns the netns path of a terminating pod. If the processes
+// of the pod are already gone, the last known path is returned with stale set, the netns
+// may not exist anymore.
+func GetNetnsForTerminatingPod(pod *corev1.Pod) (string, bool, error) {
+	nsPath, err := GetPodNSpath(pod)
+	if err == nil {
+		return nsPath, false, nil
+	}
+
+	if cached, ok := podNetnsCache.Get(pod.UID); ok {
+		log.Debugf("netns of terminating pod %s/%s not found, use the last known %s: %v", pod.Namespace, pod.Name, cached, err)
+		return cached, true, nil
+	}
+	return "", false, fmt.Errorf("failed to get netns of terminating pod %s/%s: %v", pod.Namespace, pod.Name, err)
+}
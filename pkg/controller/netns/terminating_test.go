@@ -0,0 +1,86 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+func TestGetNetnsForTerminatingPod(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "ut-pod", Namespace: "ut-ns", UID: "ut-terminating"}}
+	defer podNetnsCache.Delete(pod.UID)
+
+	// the processes of the pod are gone and the netns is unknown
+	_, stale, err := GetNetnsForTerminatingPod(pod)
+	assert.Error(t, err)
+	assert.False(t, stale)
+
+	podNetnsCache.Add(pod.UID, "/host/proc/1234/ns/net")
+	nsPath, stale, err := GetNetnsForTerminatingPod(pod)
+	assert.NoError(t, err)
+	assert.True(t, stale)
+	assert.Equal(t, "/host/proc/1234/ns/net", nsPath)
+}
+
+func TestGetNetnsForTerminatingPodNetnsGone(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "ut-pod", Namespace: "ut-ns", UID: "ut-terminating-gone"}}
+	defer podNetnsCache.Delete(pod.UID)
+	// no process has the cgroup of the pod, it is found by the cache only
+	t.Setenv(utils.HostProcRootEnv, "/proc")
+
+	cmd := exec.Command("unshare", "--net", "sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("unshare is not available: %v", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	nsPath := filepath.Join("/proc", strconv.Itoa(cmd.Process.Pid), "ns", "net")
+	require.Eventually(t, func() bool {
+		self, err := getNetnsInode("/proc/self/ns/net")
+		require.NoError(t, err)
+		inode, err := getNetnsInode(nsPath)
+		return err == nil && inode != self
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the netns cached is a real one
+	podNetnsCache.Add(pod.UID, nsPath)
+	got, stale, err := GetNetnsForTerminatingPod(pod)
+	require.NoError(t, err)
+	assert.False(t, stale)
+	assert.Equal(t, nsPath, got)
+
+	// the processes of the pod exit, the last known path is returned
+	require.NoError(t, cmd.Process.Kill())
+	_ = cmd.Wait()
+	got, stale, err = GetNetnsForTerminatingPod(pod)
+	require.NoError(t, err)
+	assert.True(t, stale)
+	assert.Equal(t, nsPath, got)
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"istio.io/istio/pkg/util/sets"
+	corev1 "k8s.io/api/core/v1"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// ResolutionStep is one stage of the netns path resolution of a pod
+type ResolutionStep struct {
+	Name     string
+	Input    string
+	Output   string
+	Duration time.Duration
+	Error    error
+}
+
+// NetnsPathResolution is the resolution chain of the netns path of a pod, the last
+// step is the failed one if Error is set.
+type NetnsPathResolution struct {
+	Steps     []ResolutionStep
+	FinalPath string
+	Error     error
+}
+
+func (r *NetnsPathResolution) String() string {
+	var b strings.Builder
+	for _, step := range r.Steps {
+		fmt.Fprintf(&b, "%s: input=%q output=%q duration=%s", step.Name, step.Input, step.Output, step.Duration)
+		if step.Error != nil {
+			fmt.Fprintf(&b, " error=%q", step.Error.Error())
+		}
+		b.WriteString("\n")
+	}
+	if r.Error != nil {
+		fmt.Fprintf(&b, "failed: %v", r.Error)
+	} else {
+		fmt.Fprintf(&b, "resolved: %s", r.FinalPath)
+	}
+	return b.String()
+}
+
+// step runs fn as a step named name, the error of fn becomes the error of r
+func (r *NetnsPathResolution) step(name, input string, fn func() (string, error)) error {
+	start := time.Now()
+	output, err := fn()
+	r.Steps = append(r.Steps, ResolutionStep{
+		Name:     name,
+		Input:    input,
+		Output:   output,
+		Duration: time.Since(start),
+		Error:    err,
+	})
+	r.Error = err
+	return err
+}
+
+// GetPodNSPathWithTrace is GetPodNSpath recording every step of the resolution,
+// the resolution is returned on failure too.
+func GetPodNSPathWithTrace(pod *corev1.Pod) (*NetnsPathResolution, error) {
+	res := getPodNSPathWithTrace(utils.GetProcRootFromEnv(), pod)
+	health.record(res.Error)
+	if res.Error != nil {
+		return res, res.Error
+	}
+	podNetnsCache.Add(pod.UID, res.FinalPath)
+	return res, nil
+}
+
+func getPodNSPathWithTrace(procRoot string, pod *corev1.Pod) *NetnsPathResolution {
+	res := &NetnsPathResolution{}
+	proc := os.DirFS(procRoot)
+
+	var processes []fs.DirEntry
+	err := res.step("proc-scan", procRoot, func() (string, error) {
+		entries, err := fs.ReadDir(proc, ".")
+		if err != nil {
+			return "", err
+		}
+		for _, entry := range entries {
+			if utils.IsProcEntry(entry) {
+				processes = append(processes, entry)
+			}
+		}
+		return fmt.Sprintf("%d processes", len(processes)), nil
+	})
+	if err != nil {
+		return res
+	}
+
+	var netnsName string
+	err = res.step("cgroup-parse", string(pod.UID), func() (string, error) {
+		netnsObserved := sets.New[uint64]()
+		for _, entry := range processes {
+			if name, _, _, ok := matchProcessEntry(proc, netnsObserved, UIDNetnsFilter(pod.UID), entry); ok {
+				netnsName = name
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("no process of pod %s found in %d processes", pod.UID, len(processes))
+	})
+	if err != nil {
+		return res
+	}
+
+	nsPath := path.Join(procRoot, netnsName)
+	err = res.step("path-validation", nsPath, func() (string, error) {
+		inode, err := getNetnsInode(nsPath)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("inode %d", inode), nil
+	})
+	if err != nil {
+		return res
+	}
+	res.FinalPath = nsPath
+	return res
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetPodNSPathWithTrace(t *testing.T) {
+	const podUID = "2c48913c-b29f-11e7-9350-020968147796"
+	pid := os.Getpid()
+	procRoot := newTestProcRoot(t, pid)
+	require.NoError(t, os.WriteFile(filepath.Join(procRoot, "1", "cgroup"), []byte("0::/init.scope\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"),
+		[]byte("0::/kubepods/pod"+podUID+"/9bca8d63d5fa610783847915bcff0ecac1273e5b4bed3f6fa1b07350e0135961\n"), 0644))
+	// not a process
+	require.NoError(t, os.MkdirAll(filepath.Join(procRoot, "net"), 0755))
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: podUID}}
+	res := getPodNSPathWithTrace(procRoot, pod)
+	require.NoError(t, res.Error)
+	wantPath := filepath.Join(procRoot, strconv.Itoa(pid), "ns", "net")
+	assert.Equal(t, wantPath, res.FinalPath)
+
+	require.Len(t, res.Steps, 3)
+	names := []string{res.Steps[0].Name, res.Steps[1].Name, res.Steps[2].Name}
+	assert.Equal(t, []string{"proc-scan", "cgroup-parse", "path-validation"}, names)
+	assert.Equal(t, procRoot, res.Steps[0].Input)
+	assert.Equal(t, "2 processes", res.Steps[0].Output)
+	assert.Equal(t, podUID, res.Steps[1].Input)
+	assert.Equal(t, strconv.Itoa(pid)+"/ns/net", res.Steps[1].Output)
+	assert.Equal(t, wantPath, res.Steps[2].Input)
+	assert.Contains(t, res.Steps[2].Output, "inode ")
+	for _, step := range res.Steps {
+		assert.NoError(t, step.Error)
+	}
+	assert.Contains(t, res.String(), "resolved: "+wantPath)
+
+	// no process of the pod
+	res = getPodNSPathWithTrace(procRoot, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "other"}})
+	assert.Error(t, res.Error)
+	assert.Empty(t, res.FinalPath)
+	require.Len(t, res.Steps, 2)
+	assert.Equal(t, res.Error, res.Steps[1].Error)
+	assert.Contains(t, res.String(), "cgroup-parse")
+	assert.Contains(t, res.String(), "failed: no process of pod other found in 2 processes")
+
+	// proc root not found
+	res = getPodNSPathWithTrace(filepath.Join(procRoot, "not-exist"), pod)
+	assert.Error(t, res.Error)
+	require.Len(t, res.Steps, 1)
+	assert.Equal(t, "proc-scan", res.Steps[0].Name)
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"istio.io/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultNetnsWaitTimeout is how long after its creation the netns of a pod is waited for
+	DefaultNetnsWaitTimeout = 30 * time.Second
+	// netnsWaitInterval is the delay between the attempts of WaitForNetns
+	netnsWaitInterval = 200 * time.Millisecond
+	// netnsWaitWarnRatio is the part of the timeout left when the warning is logged
+	netnsWaitWarnRatio = 5
+)
+
+func warnNetnsWait(pod *corev1.Pod, remaining time.Duration) {
+	log.Warnf("netns of pod %s/%s still not found, giving up in %s", pod.Namespace, pod.Name, remaining.Round(time.Millisecond))
+}
+
+// WaitForNetns resolves the netns path of pod until it succeeds or ctx is done,
+// the last failure is returned with the error of ctx.
+func WaitForNetns(ctx context.Context, pod *corev1.Pod) (string, error) {
+	ticker := time.NewTicker(netnsWaitInterval)
+	defer ticker.Stop()
+	for {
+		nsPath, err := GetPodNSpath(pod)
+		if err == nil {
+			return nsPath, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("netns of pod %s/%s not found: %w: %v", pod.Namespace, pod.Name, ctx.Err(), err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetNetnsForPodWithTimeout waits for the netns of pod until timeout after the creation of the pod,
+// DefaultNetnsWaitTimeout if timeout is 0, so that the pods never getting a netns do not block the
+// enrollments. A warning is logged once the last fifth of the timeout is reached.
+func GetNetnsForPodWithTimeout(ctx context.Context, pod *corev1.Pod, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		timeout = DefaultNetnsWaitTimeout
+	}
+	now := time.Now()
+	created := pod.CreationTimestamp.Time
+	if created.IsZero() || created.After(now) {
+		created = now
+	}
+	deadline := created.Add(timeout)
+	if !deadline.After(now) {
+		return "", fmt.Errorf("netns of pod %s/%s not found %s after its creation", pod.Namespace, pod.Name, timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, deadline.Sub(now))
+	defer cancel()
+	warnAt := deadline.Add(-timeout / netnsWaitWarnRatio)
+	warning := time.AfterFunc(warnAt.Sub(now), func() {
+		warnNetnsWait(pod, time.Until(deadline))
+	})
+	defer warning.Stop()
+	return WaitForNetns(ctx, pod)
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// stubNetnsWait makes the netns found after found attempts, never if found is negative,
+// and returns the number of attempts and of warnings
+func stubNetnsWait(t *testing.T, found int32) (attempts, warnings *atomic.Int32) {
+	attempts, warnings = &atomic.Int32{}, &atomic.Int32{}
+	patches := gomonkey.NewPatches()
+	t.Cleanup(patches.Reset)
+	patches.ApplyFunc(GetPodNSpath, func(pod *corev1.Pod) (string, error) {
+		if n := attempts.Add(1); found < 0 || n < found {
+			return "", errors.New("No matching network namespace found")
+		}
+		return "/host/proc/1234/ns/net", nil
+	})
+	patches.ApplyFunc(warnNetnsWait, func(pod *corev1.Pod, remaining time.Duration) {
+		warnings.Add(1)
+	})
+	return attempts, warnings
+}
+
+func createdAgo(d time.Duration) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:         "ns",
+		Name:              "pod",
+		CreationTimestamp: metav1.NewTime(time.Now().Add(-d)),
+	}}
+}
+
+func TestWaitForNetns(t *testing.T) {
+	attempts, _ := stubNetnsWait(t, 3)
+	nsPath, err := WaitForNetns(context.TODO(), createdAgo(0))
+	require.NoError(t, err)
+	assert.Equal(t, "/host/proc/1234/ns/net", nsPath)
+	assert.Equal(t, int32(3), attempts.Load())
+
+	stubNetnsWait(t, -1)
+	ctx, cancel := context.WithTimeout(context.TODO(), 300*time.Millisecond)
+	defer cancel()
+	_, err = WaitForNetns(ctx, createdAgo(0))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "No matching network namespace found")
+}
+
+func TestGetNetnsForPodWithTimeout(t *testing.T) {
+	t.Run("found", func(t *testing.T) {
+		_, warnings := stubNetnsWait(t, 2)
+		nsPath, err := GetNetnsForPodWithTimeout(context.TODO(), createdAgo(0), 5*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, "/host/proc/1234/ns/net", nsPath)
+		assert.Zero(t, warnings.Load())
+	})
+
+	t.Run("timeout from creation", func(t *testing.T) {
+		attempts, warnings := stubNetnsWait(t, -1)
+		start := time.Now()
+		// 1s of the 2s timeout are already elapsed
+		_, err := GetNetnsForPodWithTimeout(context.TODO(), createdAgo(time.Second), 2*time.Second)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		elapsed := time.Since(start)
+		assert.Less(t, elapsed, 1500*time.Millisecond)
+		assert.GreaterOrEqual(t, elapsed, 900*time.Millisecond)
+		assert.Greater(t, attempts.Load(), int32(1))
+		assert.Equal(t, int32(1), warnings.Load())
+	})
+
+	t.Run("deadline passed", func(t *testing.T) {
+		attempts, warnings := stubNetnsWait(t, 1)
+		_, err := GetNetnsForPodWithTimeout(context.TODO(), createdAgo(time.Minute), 0)
+		assert.ErrorContains(t, err, "not found 30s after its creation")
+		assert.Zero(t, attempts.Load())
+		assert.Zero(t, warnings.Load())
+	})
+
+	t.Run("no creation timestamp", func(t *testing.T) {
+		stubNetnsWait(t, -1)
+		start := time.Now()
+		_, err := GetNetnsForPodWithTimeout(context.TODO(), &corev1.Pod{}, 300*time.Millisecond)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		stubNetnsWait(t, -1)
+		ctx, cancel := context.WithCancel(context.TODO())
+		cancel()
+		_, err := GetNetnsForPodWithTimeout(ctx, createdAgo(0), time.Minute)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	nd "istio.io/istio/cni/pkg/nodeagent"
+	"istio.io/istio/pkg/util/sets"
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/types"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// NetnsFilter selects the processes whose netns WalkProcForPodNetns visits
+type NetnsFilter interface {
+	// Match reports whether the process of the /proc/<pid>/cgroup content is selected, and the
+	// uid of its pod if known
+	Match(cgroupContent string) (matched bool, uid types.UID)
+}
+
+// UIDNetnsFilter selects the processes of the pod of the uid, as FindNetnsForPod does
+type UIDNetnsFilter types.UID
+
+func (f UIDNetnsFilter) Match(cgroupContent string) (bool, types.UID) {
+	uid, err := podUIDOfCgroup(*bytes.NewBufferString(cgroupContent))
+	if err != nil || uid == "" {
+		return false, ""
+	}
+	return uid == types.UID(f), uid
+}
+
+// ContainerIDNetnsFilter selects the processes of the container of the id, the full id of the
+// runtime or a docker short id of 12 characters at least, in the cgroup paths of the cgroupfs
+// driver, .../<id>, or of the systemd driver, .../<runtime>-<id>.scope
+type ContainerIDNetnsFilter string
+
+func (f ContainerIDNetnsFilter) Match(cgroupContent string) (bool, types.UID) {
+	for _, line := range strings.Split(cgroupContent, "\n") {
+		for _, segment := range strings.Split(line, "/") {
+			segment = strings.TrimSuffix(segment, ".scope")
+			if i := strings.LastIndexByte(segment, '-'); i >= 0 {
+				segment = segment[i+1:]
+			}
+			if strings.HasPrefix(segment, string(f)) {
+				uid, _ := podUIDOfCgroup(*bytes.NewBufferString(cgroupContent))
+				return true, uid
+			}
+		}
+	}
+	return false, ""
+}
+
+// podNetnsFilter selects the processes of all the pods
+type podNetnsFilter struct{}
+
+func (podNetnsFilter) Match(cgroupContent string) (bool, types.UID) {
+	uid, err := podUIDOfCgroup(*bytes.NewBufferString(cgroupContent))
+	if err != nil || uid == "" {
+		return false, ""
+	}
+	return true, uid
+}
+
+// minContainerIDLen is the length of the docker short ids
+const minContainerIDLen = 12
+
+// GetContainerNetnsPath returns the netns path of a process of the container of containerID
+// found in procRoot, GetProcRootFromEnv if empty, for the events of the container runtime
+// without pod. containerID is the full id, with the <runtime>:// prefix of the pod status or
+// not, or a docker short id.
+func GetContainerNetnsPath(containerID string, procRoot string) (string, error) {
+	if i := strings.Index(containerID, "://"); i >= 0 {
+		containerID = containerID[i+len("://"):]
+	}
+	containerID = strings.ToLower(containerID)
+	if len(containerID) < minContainerIDLen || strings.IndexFunc(containerID, isNotHex) != -1 {
+		return "", fmt.Errorf("invalid container id %q", containerID)
+	}
+
+	var res string
+	err := WalkProcForPodNetns(procRoot, ContainerIDNetnsFilter(containerID), func(_ string, nsPath string) error {
+		res = nsPath
+		return fs.SkipAll
+	})
+	if err != nil {
+		return "", err
+	}
+	if res == "" {
+		return "", fmt.Errorf("No matching network namespace found for container %s", containerID)
+	}
+	return res, nil
+}
+
+func isNotHex(r rune) bool {
+	return (r < '0' || r > '9') && (r < 'a' || r > 'f')
+}
+
+// WalkProcForPodNetns calls visitor with the pid and the netns path of a process of each netns
+// of procRoot, GetProcRootFromEnv if empty, selected by filter. The walk stops at the first error
+// of visitor, which is returned unless it is fs.SkipAll.
+func WalkProcForPodNetns(procRoot string, filter NetnsFilter, visitor func(pid string, nsPath string) error) error {
+	if procRoot == "" {
+		procRoot = utils.GetProcRootFromEnv()
+	}
+	proc := os.DirFS(procRoot)
+	entries, err := fs.ReadDir(proc, ".")
+	if err != nil {
+		return err
+	}
+	return walkProcForPodNetns(context.Background(), proc, entries, filter, func(pid string, _ types.UID, nsPath string) error {
+		return visitor(pid, path.Join(procRoot, nsPath))
+	})
+}
+
+// walkProcForPodNetns is WalkProcForPodNetns over the entries of proc, with the netns paths
+// relative to proc and the uids returned by filter. The walk stops with the error of ctx once
+// it is done.
+func walkProcForPodNetns(ctx context.Context, proc fs.FS, entries []fs.DirEntry, filter NetnsFilter,
+	visitor func(pid string, uid types.UID, nsPath string) error) error {
+	netnsObserved := sets.New[uint64]()
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !utils.IsProcEntry(entry) {
+			continue
+		}
+		netnsName, inode, uid, ok := matchProcessEntry(proc, netnsObserved, filter, entry)
+		if !ok {
+			continue
+		}
+		netnsObserved.Insert(inode)
+		if err := visitor(entry.Name(), uid, netnsName); err != nil {
+			if errors.Is(err, fs.SkipAll) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// matchProcessEntry returns the relative netns path, the netns inode and the uid returned by
+// filter of the process of entry if its netns has not been observed and it is selected by filter
+func matchProcessEntry(proc fs.FS, netnsObserved sets.Set[uint64], filter NetnsFilter, entry fs.DirEntry) (string, uint64, types.UID, bool) {
+	netnsName := path.Join(entry.Name(), "ns", "net")
+	fi, err := fs.Stat(proc, netnsName)
+	if err != nil {
+		log.Debugf("error processing entry: %s %v", entry.Name(), err)
+		return "", 0, "", false
+	}
+	inode, err := nd.GetInode(fi)
+	if err != nil {
+		log.Debugf("error processing entry: %s %v", entry.Name(), err)
+		return "", 0, "", false
+	}
+	if netnsObserved.Contains(inode) {
+		log.Debugf("netns: %d already processed. skipping", inode)
+		return "", 0, "", false
+	}
+
+	// the process may have exited
+	cgroupData, err := fs.ReadFile(proc, path.Join(entry.Name(), "cgroup"))
+	if err != nil {
+		return "", 0, "", false
+	}
+	matched, uid := filter.Match(string(cgroupData))
+	if !matched {
+		return "", 0, "", false
+	}
+	return netnsName, inode, uid, true
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// anyPodNetnsFilter selects the processes of all the pods
+type anyPodNetnsFilter struct{}
+
+func (anyPodNetnsFilter) Match(cgroupContent string) (bool, types.UID) {
+	uid, ok := matchPodCgroup(cgroupContent)
+	return ok, uid
+}
+
+// staticPodNetnsFilter selects the processes by a cgroup path prefix, e.g. of static pods
+type staticPodNetnsFilter string
+
+func (f staticPodNetnsFilter) Match(cgroupContent string) (bool, types.UID) {
+	return strings.HasPrefix(cgroupContent, "0::"+string(f)), ""
+}
+
+// newNetnsProcess starts a process in a netns of its own and returns its pid
+func newNetnsProcess(t *testing.T) int {
+	cmd := exec.Command("unshare", "--net", "sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("unshare is not available: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	// wait for unshare to exec sleep in the new netns
+	require.Eventually(t, func() bool {
+		self, err := getNetnsInode("/proc/self/ns/net")
+		require.NoError(t, err)
+		inode, err := getNetnsInode("/proc/" + strconv.Itoa(cmd.Process.Pid) + "/ns/net")
+		return err == nil && inode != self
+	}, 5*time.Second, 10*time.Millisecond)
+	return cmd.Process.Pid
+}
+
+func TestWalkProcForPodNetns(t *testing.T) {
+	const (
+		podA = types.UID("3f1a9c52-8d7e-4b60-a1f2-5c9e8d7b6a41")
+		podB = types.UID("8f0e6d1a-3c2b-4e5f-9a8b-7c6d5e4f3a2b")
+	)
+	pidA, pidB := newNetnsProcess(t), newNetnsProcess(t)
+
+	// 10 and 11 are the containers of pod A, 20 is pod B and 30 a static pod in the host netns
+	procRoot := t.TempDir()
+	for pid, p := range map[string]struct {
+		target int
+		cgroup string
+	}{
+		"1":  {os.Getpid(), "0::/init.scope\n"},
+		"10": {pidA, "0::/kubepods/burstable/pod" + string(podA) + "/9bca8d63d5fa610783847915bcff0ecac1273e5b4bed3f6fa1b07350e0135961\n"},
+		"11": {pidA, "0::/kubepods/burstable/pod" + string(podA) + "/1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f\n"},
+		"20": {pidB, "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod8f0e6d1a_3c2b_4e5f_9a8b_7c6d5e4f3a2b.slice\n"},
+		"30": {os.Getpid(), "0::/kubelet.slice/static-etcd.scope\n"},
+	} {
+		dir := filepath.Join(procRoot, pid)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, os.Symlink("/proc/"+strconv.Itoa(p.target)+"/ns", filepath.Join(dir, "ns")))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "cgroup"), []byte(p.cgroup), 0644))
+	}
+	// a process without cgroup, e.g. exited during the walk
+	require.NoError(t, os.MkdirAll(filepath.Join(procRoot, "40"), 0755))
+	require.NoError(t, os.Symlink("/proc/"+strconv.Itoa(pidB)+"/ns", filepath.Join(procRoot, "40", "ns")))
+
+	walk := func(filter NetnsFilter) map[string]string {
+		visited := make(map[string]string)
+		require.NoError(t, WalkProcForPodNetns(procRoot, filter, func(pid string, nsPath string) error {
+			visited[pid] = nsPath
+			return nil
+		}))
+		return visited
+	}
+	nsPath := func(pid string) string {
+		return filepath.Join(procRoot, pid, "ns", "net")
+	}
+
+	// the netns of pod A is visited once
+	assert.Equal(t, map[string]string{"10": nsPath("10")}, walk(UIDNetnsFilter(podA)))
+	assert.Equal(t, map[string]string{"20": nsPath("20")}, walk(UIDNetnsFilter(podB)))
+	assert.Empty(t, walk(UIDNetnsFilter("c4a8e5d0-7b19-4f6a-8e3d-2a1b0c9d8e7f")))
+	assert.Equal(t, map[string]string{"10": nsPath("10"), "20": nsPath("20")}, walk(anyPodNetnsFilter{}))
+	assert.Equal(t, map[string]string{"30": nsPath("30")}, walk(staticPodNetnsFilter("/kubelet.slice/")))
+
+	// the walk stops at the first error of visitor
+	var visits int
+	errVisit := errors.New("visit failed")
+	err := WalkProcForPodNetns(procRoot, anyPodNetnsFilter{}, func(_ string, _ string) error {
+		visits++
+		return errVisit
+	})
+	assert.ErrorIs(t, err, errVisit)
+	assert.Equal(t, 1, visits)
+
+	visits = 0
+	err = WalkProcForPodNetns(procRoot, anyPodNetnsFilter{}, func(_ string, _ string) error {
+		visits++
+		return fs.SkipAll
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, visits)
+
+	err = WalkProcForPodNetns(filepath.Join(procRoot, "missing"), anyPodNetnsFilter{}, func(_ string, _ string) error {
+		return nil
+	})
+	assert.Error(t, err)
+}
+
+func TestUIDNetnsFilter(t *testing.T) {
+	const uid = types.UID("2c48913c-b29f-11e7-9350-020968147796")
+	tests := []struct {
+		name        string
+		cgroup      string
+		wantMatched bool
+		wantUID     types.UID
+	}{
+		{
+			name:        "cgroupfs",
+			cgroup:      "0::/kubepods/besteffort/pod" + string(uid) + "/9bca8d63d5fa610783847915bcff0ecac1273e5b4bed3f6fa1b07350e0135961\n",
+			wantMatched: true,
+			wantUID:     uid,
+		},
+		{
+			name:        "systemd slice without container scope",
+			cgroup:      "0::/kubepods.slice/kubepods-pod2c48913c_b29f_11e7_9350_020968147796.slice\n",
+			wantMatched: true,
+			wantUID:     uid,
+		},
+		{
+			name:    "other pod",
+			cgroup:  "0::/kubepods/pod8f0e6d1a-3c2b-4e5f-9a8b-7c6d5e4f3a2b\n",
+			wantUID: "8f0e6d1a-3c2b-4e5f-9a8b-7c6d5e4f3a2b",
+		},
+		{name: "host process", cgroup: "0::/init.scope\n"},
+		{name: "empty", cgroup: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matched, gotUID := UIDNetnsFilter(uid).Match(tt.cgroup)
+			assert.Equal(t, tt.wantMatched, matched)
+			assert.Equal(t, tt.wantUID, gotUID)
+		})
+	}
+}
+
+func TestGetContainerNetnsPath(t *testing.T) {
+	const (
+		dockerID     = "4a1c3f5e7b9d0e2f4a6c8e0b2d4f6a8c0e2b4d6f8a0c2e4b6d8f0a2c4e6b8d0f"
+		containerdID = "9bca8d63d5fa610783847915bcff0ecac1273e5b4bed3f6fa1b07350e0135961"
+		crioID       = "1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f"
+		kubepodsID   = "c0ffee0123456789abcdef0123456789abcdef0123456789abcdef0123456789"
+		podUID       = "8f0e6d1a-3c2b-4e5f-9a8b-7c6d5e4f3a2b"
+	)
+
+	// all the processes are in the netns of the test, they are told apart by their cgroup
+	procRoot := t.TempDir()
+	for pid, cgroup := range map[string]string{
+		"1":   "0::/init.scope\n",
+		"100": "12:pids:/docker/" + dockerID + "\n11:memory:/docker/" + dockerID + "\n",
+		"200": "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod8f0e6d1a_3c2b_4e5f_9a8b_7c6d5e4f3a2b.slice/cri-containerd-" + containerdID + ".scope\n",
+		"300": "0::/kubepods.slice/kubepods-pod2c48913c_b29f_11e7_9350_020968147796.slice/crio-" + crioID + ".scope\n",
+		"400": "0::/kubepods/burstable/pod" + podUID + "/" + kubepodsID + "\n",
+	} {
+		dir := filepath.Join(procRoot, pid)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, os.Symlink("/proc/self/ns", filepath.Join(dir, "ns")))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "cgroup"), []byte(cgroup), 0644))
+	}
+	nsPath := func(pid string) string {
+		return filepath.Join(procRoot, pid, "ns", "net")
+	}
+
+	tests := []struct {
+		name        string
+		containerID string
+		want        string
+		wantErr     string
+	}{
+		{name: "docker", containerID: dockerID, want: nsPath("100")},
+		{name: "docker short id", containerID: dockerID[:12], want: nsPath("100")},
+		{name: "docker pod status id", containerID: "docker://" + dockerID, want: nsPath("100")},
+		{name: "containerd systemd", containerID: containerdID, want: nsPath("200")},
+		{name: "containerd pod status id", containerID: "containerd://" + containerdID, want: nsPath("200")},
+		{name: "upper case", containerID: strings.ToUpper(containerdID), want: nsPath("200")},
+		{name: "crio", containerID: "cri-o://" + crioID, want: nsPath("300")},
+		{name: "containerd cgroupfs", containerID: kubepodsID, want: nsPath("400")},
+		{name: "unknown container", containerID: "0123456789abcdef", wantErr: "No matching network namespace found"},
+		{name: "too short", containerID: dockerID[:8], wantErr: "invalid container id"},
+		{name: "not hex", containerID: "pod" + dockerID, wantErr: "invalid container id"},
+		{name: "empty", wantErr: "invalid container id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetContainerNetnsPath(tt.containerID, procRoot)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	// the pod uid is reported with the container
+	matched, uid := ContainerIDNetnsFilter(kubepodsID).Match("0::/kubepods/burstable/pod" + podUID + "/" + kubepodsID + "\n")
+	assert.True(t, matched)
+	assert.Equal(t, types.UID(podUID), uid)
+	matched, uid = ContainerIDNetnsFilter(dockerID).Match("12:pids:/docker/" + dockerID + "\n")
+	assert.True(t, matched)
+	assert.Empty(t, uid)
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"istio.io/pkg/log"
+	"k8s.io/apimachinery/pkg/types"
+
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// DefaultWarmupTimeout is how long the enrollments wait for the warmup
+const DefaultWarmupTimeout = 30 * time.Second
+
+// WarmupProgress is the progress of the warmup, Found is the number of pods whose netns
+// has been found in the Scanned processes. The processes of a netns found already are not
+// scanned.
+type WarmupProgress struct {
+	Scanned int
+	Found   int
+}
+
+// NetnsWarmup scans the proc of the host once for the netns of all the pods, so that the
+// first enrollments after startup do not need to scan the proc each.
+type NetnsWarmup struct {
+	procRoot string
+	// cache holds the netns paths found, each is taken once by the first resolution of its pod
+	cache    *NetnsCache
+	progress chan WarmupProgress
+
+	mu      sync.Mutex
+	started bool
+	done    chan struct{}
+	err     error
+}
+
+// NewNetnsWarmup creates a warmup scanning the proc mounted at procRoot
+func NewNetnsWarmup(procRoot string) *NetnsWarmup {
+	return &NetnsWarmup{
+		procRoot: procRoot,
+		cache:    NewNetnsCache(),
+		progress: make(chan WarmupProgress, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+var defaultWarmup = NewNetnsWarmup(utils.GetProcRootFromEnv())
+
+// PodNetnsWarmup scans the proc of the host for the netns of the pods, it should be run in the
+// background on controller initialization. The progress is sent to WarmupProgressUpdates.
+func PodNetnsWarmup(ctx context.Context) error {
+	return defaultWarmup.Run(ctx)
+}
+
+// WarmupProgressUpdates returns the progress of PodNetnsWarmup
+func WarmupProgressUpdates() <-chan WarmupProgress {
+	return defaultWarmup.Progress()
+}
+
+// Progress returns the channel receiving the progress of Run, it is closed once Run returns.
+// Only the latest progress is kept if the channel is not read.
+func (w *NetnsWarmup) Progress() <-chan WarmupProgress {
+	return w.progress
+}
+
+// Run scans the proc, it can only be run once
+func (w *NetnsWarmup) Run(ctx context.Context) error {
+	w.mu.Lock()
+	if w.started {
+		w.mu.Unlock()
+		return errors.New("netns warmup has already been run")
+	}
+	w.started = true
+	w.mu.Unlock()
+
+	err := w.scan(ctx)
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+	close(w.progress)
+	close(w.done)
+	return err
+}
+
+func (w *NetnsWarmup) scan(ctx context.Context) error {
+	proc := os.DirFS(w.procRoot)
+	entries, err := fs.ReadDir(proc, ".")
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", w.procRoot, err)
+	}
+
+	var progress WarmupProgress
+	filter := scannedNetnsFilter{NetnsFilter: podNetnsFilter{}, scanned: &progress.Scanned}
+	err = walkProcForPodNetns(ctx, proc, entries, filter, func(_ string, uid types.UID, netnsName string) error {
+		// the processes of a pod share its netns
+		if _, ok := w.cache.Get(uid); !ok {
+			w.cache.Add(uid, path.Join(w.procRoot, netnsName))
+			progress.Found++
+		}
+		w.report(progress)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("netns warmup stopped after %d processes: %w", progress.Scanned, err)
+	}
+	w.report(progress)
+	log.Infof("netns warmup found %d pods in %d processes", progress.Found, progress.Scanned)
+	return nil
+}
+
+// scannedNetnsFilter counts the processes matched against its filter
+type scannedNetnsFilter struct {
+	NetnsFilter
+	scanned *int
+}
+
+func (f scannedNetnsFilter) Match(cgroupContent string) (bool, types.UID) {
+	*f.scanned++
+	return f.NetnsFilter.Match(cgroupContent)
+}
+
+// report replaces the progress not read yet
+func (w *NetnsWarmup) report(progress WarmupProgress) {
+	select {
+	case <-w.progress:
+	default:
+	}
+	w.progress <- progress
+}
+
+// Wait blocks until Run returns or timeout expires, it returns immediately if Run has not
+// been started. The error of Run is returned.
+func (w *NetnsWarmup) Wait(timeout time.Duration) error {
+	w.mu.Lock()
+	started := w.started
+	w.mu.Unlock()
+	if !started {
+		return nil
+	}
+
+	select {
+	case <-w.done:
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.err
+	case <-time.After(timeout):
+		return fmt.Errorf("netns warmup not completed in %s", timeout)
+	}
+}
+
+// take returns the netns path found for the pod uid if its netns inode is unchanged since,
+// the path is removed from the warmup cache.
+func (w *NetnsWarmup) take(uid types.UID) (string, bool) {
+	entry, ok := w.cache.entry(uid)
+	if !ok {
+		return "", false
+	}
+	w.cache.Delete(uid)
+
+	inode, err := getNetnsInode(entry.path)
+	if err != nil || inode == 0 || inode != entry.inode {
+		return "", false
+	}
+	return entry.path, true
+}
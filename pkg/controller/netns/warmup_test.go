@@ -0,0 +1,136 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	warmupPodA = types.UID("2c48913c-b29f-11e7-9350-020968147796")
+	warmupPodB = types.UID("8f0e6d1a-3c2b-4e5f-9a8b-7c6d5e4f3a2b")
+)
+
+// newWarmupProcRoot creates a fake proc root with a process of warmupPodA, in the netns of
+// the test, and of warmupPodB in a netns of its own
+func newWarmupProcRoot(t *testing.T) (string, int, int) {
+	pidA, pidB := os.Getpid(), newNetnsProcess(t)
+	procRoot := newTestProcRoot(t, pidA, pidB)
+	writeCgroup := func(pid int, cgroup string) {
+		require.NoError(t, os.WriteFile(filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"), []byte(cgroup), 0644))
+	}
+	writeCgroup(1, "0::/init.scope\n")
+	writeCgroup(pidA, "0::/kubepods/pod"+string(warmupPodA)+"/9bca8d63d5fa610783847915bcff0ecac1273e5b4bed3f6fa1b07350e0135961\n")
+	writeCgroup(pidB, "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod8f0e6d1a_3c2b_4e5f_9a8b_7c6d5e4f3a2b.slice\n")
+	return procRoot, pidA, pidB
+}
+
+func TestNetnsWarmup(t *testing.T) {
+	procRoot, pidA, pidB := newWarmupProcRoot(t)
+	w := NewNetnsWarmup(procRoot)
+
+	// nothing to wait for before the warmup is started
+	assert.NoError(t, w.Wait(time.Millisecond))
+
+	require.NoError(t, w.Run(context.TODO()))
+	assert.NoError(t, w.Wait(time.Millisecond))
+	assert.Error(t, w.Run(context.TODO()))
+
+	var last WarmupProgress
+	for progress := range w.Progress() {
+		last = progress
+	}
+	assert.Equal(t, WarmupProgress{Scanned: 3, Found: 2}, last)
+
+	assert.Equal(t, 2, w.cache.Len())
+	nsPath, ok := w.take(warmupPodA)
+	require.True(t, ok)
+	assert.Equal(t, filepath.Join(procRoot, strconv.Itoa(pidA), "ns", "net"), nsPath)
+	// a path is taken once
+	_, ok = w.take(warmupPodA)
+	assert.False(t, ok)
+
+	nsPath, ok = w.take(warmupPodB)
+	require.True(t, ok)
+	assert.Equal(t, filepath.Join(procRoot, strconv.Itoa(pidB), "ns", "net"), nsPath)
+	_, ok = w.take("unknown")
+	assert.False(t, ok)
+}
+
+func TestNetnsWarmupStaleEntry(t *testing.T) {
+	procRoot, pidA, _ := newWarmupProcRoot(t)
+	w := NewNetnsWarmup(procRoot)
+	require.NoError(t, w.Run(context.TODO()))
+
+	// the process exited since the warmup
+	require.NoError(t, os.RemoveAll(filepath.Join(procRoot, strconv.Itoa(pidA))))
+	_, ok := w.take(warmupPodA)
+	assert.False(t, ok)
+}
+
+func TestNetnsWarmupErrors(t *testing.T) {
+	procRoot, _, _ := newWarmupProcRoot(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	w := NewNetnsWarmup(procRoot)
+	assert.ErrorIs(t, w.Run(ctx), context.Canceled)
+	assert.ErrorIs(t, w.Wait(time.Millisecond), context.Canceled)
+	assert.Zero(t, w.cache.Len())
+
+	w = NewNetnsWarmup(filepath.Join(procRoot, "not-exist"))
+	assert.Error(t, w.Run(context.TODO()))
+
+	// a running warmup times out the wait
+	w = NewNetnsWarmup(procRoot)
+	w.started = true
+	assert.ErrorContains(t, w.Wait(10*time.Millisecond), "not completed in 10ms")
+}
+
+func TestGetPodNSpathFromWarmup(t *testing.T) {
+	procRoot, pidA, _ := newWarmupProcRoot(t)
+	oldWarmup, oldCache := defaultWarmup, podNetnsCache
+	defaultWarmup, podNetnsCache = NewNetnsWarmup(procRoot), NewNetnsCache()
+	defer func() {
+		defaultWarmup, podNetnsCache = oldWarmup, oldCache
+	}()
+
+	go func() {
+		_ = PodNetnsWarmup(context.TODO())
+	}()
+	for range WarmupProgressUpdates() {
+	}
+
+	// the proc of the host is not scanned
+	nsPath, err := GetPodNSpath(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: warmupPodA}})
+	require.NoError(t, err)
+	wantPath := filepath.Join(procRoot, strconv.Itoa(pidA), "ns", "net")
+	assert.Equal(t, wantPath, nsPath)
+	cached, ok := podNetnsCache.Get(warmupPodA)
+	assert.True(t, ok)
+	assert.Equal(t, wantPath, cached)
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// interfaceEventsBufferSize is the number of events WatchInterfaceEvents buffers for its caller
+const interfaceEventsBufferSize = 64
+
+// InterfaceEvent is a change of the flags of an interface, e.g. it going down or up. A new
+// interface has no old flags, a deleted one has no new flags.
+type InterfaceEvent struct {
+	Name     string
+	Index    int
+	OldFlags net.Flags
+	NewFlags net.Flags
+	Deleted  bool
+}
+
+// InterfaceEventWatcher is the signature of WatchInterfaceEvents, FakeInterfaceEvents.Watch
+// replaces it in tests
+type InterfaceEventWatcher func(ctx context.Context) (<-chan InterfaceEvent, error)
+
+// WatchInterfaceEvents returns the changes of the interfaces of the current netns until ctx is
+// done, the channel is closed then. The caller must drain the channel promptly: while it is
+// full the notifications are not read from the netlink socket, whose buffer overflowing in the
+// kernel loses events.
+func WatchInterfaceEvents(ctx context.Context) (<-chan InterfaceEvent, error) {
+	updates := make(chan netlink.LinkUpdate, interfaceEventsBufferSize)
+	done := make(chan struct{})
+	err := netlink.LinkSubscribeWithOptions(updates, done, netlink.LinkSubscribeOptions{
+		ErrorCallback: func(err error) {
+			log.Warnf("interface events: %v", err)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to interface events: %v", err)
+	}
+	// listed once subscribed, so that no change is missed in between
+	links, err := netlink.LinkList()
+	if err != nil {
+		close(done)
+		return nil, fmt.Errorf("failed to list interfaces: %v", err)
+	}
+	flags := make(map[int]net.Flags, len(links))
+	for _, link := range links {
+		flags[link.Attrs().Index] = link.Attrs().Flags
+	}
+
+	events := make(chan InterfaceEvent, interfaceEventsBufferSize)
+	go func() {
+		defer close(events)
+		defer func() {
+			close(done)
+			// the subscription closes updates once stopped
+			for range updates {
+			}
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case update, ok := <-updates:
+				if !ok {
+					return
+				}
+				event, changed := interfaceEventOf(flags, update)
+				if !changed {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// interfaceEventOf returns the event of update given the flags known of the interfaces, which
+// are updated. changed is false if update does not change the flags.
+func interfaceEventOf(flags map[int]net.Flags, update netlink.LinkUpdate) (InterfaceEvent, bool) {
+	attrs := update.Attrs()
+	old, known := flags[attrs.Index]
+	event := InterfaceEvent{Name: attrs.Name, Index: attrs.Index, OldFlags: old}
+	if update.Header.Type == unix.RTM_DELLINK {
+		delete(flags, attrs.Index)
+		event.Deleted = true
+		return event, true
+	}
+	flags[attrs.Index] = attrs.Flags
+	event.NewFlags = attrs.Flags
+	return event, !known || old != attrs.Flags
+}
+
+// FakeInterfaceEvents is an InterfaceEventWatcher sending the events given to Send
+type FakeInterfaceEvents struct {
+	mu       sync.Mutex
+	watchers []chan InterfaceEvent
+}
+
+// Watch returns the events sent from now until ctx is done
+func (f *FakeInterfaceEvents) Watch(ctx context.Context) (<-chan InterfaceEvent, error) {
+	events := make(chan InterfaceEvent, interfaceEventsBufferSize)
+	f.mu.Lock()
+	f.watchers = append(f.watchers, events)
+	f.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i, w := range f.watchers {
+			if w == events {
+				f.watchers = append(f.watchers[:i], f.watchers[i+1:]...)
+				break
+			}
+		}
+		close(events)
+	}()
+	return events, nil
+}
+
+// Send sends event to the watchers, a watcher whose channel is full loses it
+func (f *FakeInterfaceEvents) Send(event InterfaceEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, w := range f.watchers {
+		select {
+		case w <- event:
+		default:
+		}
+	}
+}
+
+// defaultInterfacePollInterval is the poll interval of WaitForInterface given none
+const defaultInterfacePollInterval = 100 * time.Millisecond
+
+// WaitForInterface returns the link name of the current netns once it exists, or the error of
+// ctx if it is done before. The new links are notified by a link subscription, the link is
+// looked up every pollInterval, defaultInterfacePollInterval if not positive, only if the
+// subscription fails or stops.
+func WaitForInterface(ctx context.Context, name string, pollInterval time.Duration) (netlink.Link, error) {
+	if pollInterval <= 0 {
+		pollInterval = defaultInterfacePollInterval
+	}
+	updates := make(chan netlink.LinkUpdate, interfaceEventsBufferSize)
+	done := make(chan struct{})
+	err := netlink.LinkSubscribeWithOptions(updates, done, netlink.LinkSubscribeOptions{
+		ErrorCallback: func(err error) {
+			log.Warnf("wait for interface %v: %v", name, err)
+		},
+	})
+	if err == nil {
+		// updates is set to nil by the loop once closed, the drain reads sub
+		sub := updates
+		defer func() {
+			close(done)
+			// the subscription closes sub once stopped
+			go func() {
+				for range sub {
+				}
+			}()
+		}()
+	} else {
+		log.Warnf("failed to subscribe to interface events, polling interface %v: %v", name, err)
+		updates = nil
+	}
+
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	poll := func() {
+		ticker = time.NewTicker(pollInterval)
+		tick = ticker.C
+	}
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	if updates == nil {
+		poll()
+	}
+
+	// looked up once subscribed, so that a link added in between is not missed
+	link, err := lookupInterface(name)
+	for link == nil && err == nil {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("interface %v not found: %w", name, ctx.Err())
+		case <-tick:
+		case update, ok := <-updates:
+			if !ok {
+				updates = nil
+				poll()
+			} else if update.Header.Type != unix.RTM_NEWLINK || update.Attrs().Name != name {
+				continue
+			}
+		}
+		link, err = lookupInterface(name)
+	}
+	return link, err
+}
+
+// lookupInterface returns the link name, nil if it does not exist
+func lookupInterface(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface %v: %v", name, err)
+	}
+	return link, nil
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// nextInterfaceEvent returns the next event of the interface name
+func nextInterfaceEvent(t *testing.T, events <-chan InterfaceEvent, name string) InterfaceEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			require.True(t, ok, "events closed")
+			if event.Name == name {
+				return event
+			}
+		case <-timeout:
+			require.FailNow(t, "no event of interface "+name)
+		}
+	}
+}
+
+// nextInterfaceUpChange returns the next event of interface name setting it up or down, the
+// carrier changes notified late by the kernel are skipped
+func nextInterfaceUpChange(t *testing.T, events <-chan InterfaceEvent, name string) InterfaceEvent {
+	t.Helper()
+	for {
+		event := nextInterfaceEvent(t, events, name)
+		if event.Deleted || (event.OldFlags^event.NewFlags)&net.FlagUp != 0 {
+			return event
+		}
+	}
+}
+
+func TestWatchInterfaceEvents(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	var events <-chan InterfaceEvent
+	require.NoError(t, env.Do(func() error {
+		var err error
+		events, err = WatchInterfaceEvents(ctx)
+		require.NoError(t, err)
+
+		require.NoError(t, netlink.LinkSetDown(env.Link1))
+		event := nextInterfaceUpChange(t, events, "veth0")
+		assert.Equal(t, env.Link1.Attrs().Index, event.Index)
+		assert.NotZero(t, event.OldFlags&net.FlagUp)
+		assert.Zero(t, event.NewFlags&net.FlagUp)
+		assert.False(t, event.Deleted)
+
+		require.NoError(t, netlink.LinkSetUp(env.Link1))
+		event = nextInterfaceUpChange(t, events, "veth0")
+		assert.Zero(t, event.OldFlags&net.FlagUp)
+		assert.NotZero(t, event.NewFlags&net.FlagUp)
+
+		// a new interface, then deleted
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-watch-a"}, PeerName: "ut-watch-b"}))
+		event = nextInterfaceEvent(t, events, "ut-watch-a")
+		assert.Zero(t, event.OldFlags)
+		assert.False(t, event.Deleted)
+		link, err := netlink.LinkByName("ut-watch-a")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkDel(link))
+		event = nextInterfaceEvent(t, events, "ut-watch-a")
+		assert.True(t, event.Deleted)
+		assert.Zero(t, event.NewFlags)
+		return nil
+	}))
+
+	cancel()
+	require.Eventually(t, func() bool {
+		select {
+		case _, ok := <-events:
+			return !ok
+		default:
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestWatchInterfaceEventsSubscribeError(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(netlink.LinkSubscribeWithOptions, func(_ chan<- netlink.LinkUpdate, _ <-chan struct{}, _ netlink.LinkSubscribeOptions) error {
+		return errors.New("permission denied")
+	})
+	_, err := WatchInterfaceEvents(context.TODO())
+	assert.ErrorContains(t, err, "permission denied")
+}
+
+func TestInterfaceEventOf(t *testing.T) {
+	update := func(msgType uint16, index int, flags net.Flags) netlink.LinkUpdate {
+		u := netlink.LinkUpdate{Link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: index, Flags: flags}}}
+		u.Header.Type = msgType
+		return u
+	}
+	flags := map[int]net.Flags{2: net.FlagUp | net.FlagRunning}
+
+	// the flags do not change
+	_, changed := interfaceEventOf(flags, update(unix.RTM_NEWLINK, 2, net.FlagUp|net.FlagRunning))
+	assert.False(t, changed)
+
+	event, changed := interfaceEventOf(flags, update(unix.RTM_NEWLINK, 2, net.FlagUp))
+	assert.True(t, changed)
+	assert.Equal(t, InterfaceEvent{Name: "eth0", Index: 2, OldFlags: net.FlagUp | net.FlagRunning, NewFlags: net.FlagUp}, event)
+
+	event, changed = interfaceEventOf(flags, update(unix.RTM_NEWLINK, 3, 0))
+	assert.True(t, changed)
+	assert.Equal(t, InterfaceEvent{Name: "eth0", Index: 3}, event)
+
+	event, changed = interfaceEventOf(flags, update(unix.RTM_DELLINK, 2, net.FlagUp))
+	assert.True(t, changed)
+	assert.Equal(t, InterfaceEvent{Name: "eth0", Index: 2, OldFlags: net.FlagUp, Deleted: true}, event)
+	assert.Equal(t, map[int]net.Flags{3: 0}, flags)
+}
+
+func TestFakeInterfaceEvents(t *testing.T) {
+	var watch InterfaceEventWatcher
+	fake := &FakeInterfaceEvents{}
+	watch = fake.Watch
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	events, err := watch(ctx)
+	require.NoError(t, err)
+	fake.Send(InterfaceEvent{Name: "eth0", Index: 2, NewFlags: net.FlagUp})
+	assert.Equal(t, InterfaceEvent{Name: "eth0", Index: 2, NewFlags: net.FlagUp}, <-events)
+
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+	// no watcher anymore
+	fake.Send(InterfaceEvent{Name: "eth0"})
+}
+
+func TestWaitForInterface(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	// addLater adds the veth name to the netns of the test after a while
+	addLater := func(name string) {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			assert.NoError(t, env.Do(func() error {
+				return netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "-p"})
+			}))
+		}()
+	}
+
+	require.NoError(t, env.Do(func() error {
+		ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+		defer cancel()
+
+		// already there
+		link, err := WaitForInterface(ctx, "veth0", time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, env.Link1.Attrs().Index, link.Attrs().Index)
+
+		// notified by the subscription, the poll interval is never reached
+		addLater("ut-wait-a")
+		link, err = WaitForInterface(ctx, "ut-wait-a", time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, "ut-wait-a", link.Attrs().Name)
+		assert.Equal(t, "veth", link.Type())
+
+		timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer timeoutCancel()
+		_, err = WaitForInterface(timeoutCtx, "ut-wait-missing", 0)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// polled if the subscription fails
+		patches.ApplyFunc(netlink.LinkSubscribeWithOptions, func(_ chan<- netlink.LinkUpdate, _ <-chan struct{}, _ netlink.LinkSubscribeOptions) error {
+			return errors.New("permission denied")
+		})
+		addLater("ut-wait-b")
+		link, err = WaitForInterface(ctx, "ut-wait-b", 10*time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, "ut-wait-b", link.Attrs().Name)
+
+		// or stops
+		patches.ApplyFunc(netlink.LinkSubscribeWithOptions, func(ch chan<- netlink.LinkUpdate, _ <-chan struct{}, _ netlink.LinkSubscribeOptions) error {
+			close(ch)
+			return nil
+		})
+		addLater("ut-wait-c")
+		link, err = WaitForInterface(ctx, "ut-wait-c", 10*time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, "ut-wait-c", link.Attrs().Name)
+		return nil
+	}))
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"io/fs"
+	"os"
+	"strings"
+)
+
+const (
+	// HostProcRootEnv is the environment variable overriding where the proc of the host is mounted
+	HostProcRootEnv = "KMESH_HOST_PROC_ROOT"
+	// DefaultHostProcRoot is where the proc of the host is mounted by default
+	DefaultHostProcRoot = "/host/proc"
+)
+
+// GetProcRootFromEnv returns where the proc of the host is mounted, KMESH_HOST_PROC_ROOT if
+// set, e.g. /proc in some docker in docker setups, otherwise /host/proc
+func GetProcRootFromEnv() string {
+	if procRoot := os.Getenv(HostProcRootEnv); procRoot != "" {
+		return procRoot
+	}
+	return DefaultHostProcRoot
+}
+
+func isNotNumber(r rune) bool {
+	return r < '0' || r > '9'
+}
+
+// IsNumericString returns whether s is not empty and has only the ascii digits, the other
+// unicode digits excluded, e.g. to tell the pid entries of proc
+func IsNumericString(s string) bool {
+	return s != "" && strings.IndexFunc(s, isNotNumber) == -1
+}
+
+// IsProcEntry returns whether entry of a proc like filesystem is the dir of a process
+func IsProcEntry(entry fs.DirEntry) bool {
+	return entry.IsDir() && IsNumericString(entry.Name())
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"io/fs"
+	"strconv"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetProcRootFromEnv(t *testing.T) {
+	t.Setenv(HostProcRootEnv, "")
+	assert.Equal(t, DefaultHostProcRoot, GetProcRootFromEnv())
+	t.Setenv(HostProcRootEnv, "/proc")
+	assert.Equal(t, "/proc", GetProcRootFromEnv())
+}
+
+func TestIsNumericString(t *testing.T) {
+	for s, want := range map[string]bool{
+		"1":          true,
+		"4194304":    true,
+		"0123":       true,
+		"":           false,
+		"self":       false,
+		"12a":        false,
+		"-1":         false,
+		"1 ":         false,
+		"١٢٣":        false,
+		"１２":         false,
+		"12\xff":     false,
+		"thread-123": false,
+	} {
+		assert.Equal(t, want, IsNumericString(s), "%q", s)
+	}
+}
+
+func FuzzIsNumericString(f *testing.F) {
+	for _, seed := range []string{"1", "4194304", "", "self", "١٢٣", "１２", "12\xff", "\x00"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		got := IsNumericString(s)
+		// only the ascii digits, byte by byte so that no multi-byte rune can match
+		var want bool
+		if s != "" {
+			want = true
+			for i := 0; i < len(s); i++ {
+				if s[i] < '0' || s[i] > '9' {
+					want = false
+				}
+			}
+		}
+		if got != want {
+			t.Fatalf("IsNumericString(%q) = %v, want %v", s, got, want)
+		}
+		if _, err := strconv.ParseUint(s, 10, 64); err == nil && !got {
+			t.Fatalf("IsNumericString(%q) = false for a number", s)
+		}
+	})
+}
+
+func TestIsProcEntry(t *testing.T) {
+	proc := fstest.MapFS{
+		"1/cgroup":       {Data: []byte("0::/init.scope\n")},
+		"1234/cgroup":    {Data: []byte("0::/init.scope\n")},
+		"self/cgroup":    {Data: []byte("0::/init.scope\n")},
+		"12a/cgroup":     {Data: []byte("0::/init.scope\n")},
+		"4321":           {Data: []byte("a file")},
+		"sys/kernel/pid": {Data: []byte("1")},
+	}
+	entries, err := fs.ReadDir(proc, ".")
+	require.NoError(t, err)
+	var processes []string
+	for _, entry := range entries {
+		if IsProcEntry(entry) {
+			processes = append(processes, entry.Name())
+		}
+	}
+	assert.Equal(t, []string{"1", "1234"}, processes)
+}
@@ -17,34 +17,147 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/features"
+	ebpflink "github.com/cilium/ebpf/link"
+	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/safchain/ethtool"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/yaml"
 
+	netnsapi "kmesh.net/kmesh/api/v2/netns"
 	"kmesh.net/kmesh/pkg/constants"
 )
 
-func ManageTCProgramByFd(link netlink.Link, tcFd int, mode int) error {
+// DefaultTCFilterPriority is the priority of the filters of ManageTCProgramByFd given no priority
+const DefaultTCFilterPriority = 1
+
+// ManageTCProgramByFd attaches or detaches the program of tcFd to the ingress of link with the
+// filter priority, DefaultTCFilterPriority if 0. The programs of the lower priorities run first,
+// the priority of a detach must be the one of the attach. link may be of any type with a clsact
+// qdisc, e.g. a veth, a bond, an ipvlan or a physical nic, but not a loopback or a tun.
+func ManageTCProgramByFd(link netlink.Link, tcFd int, mode int, priority uint16) error {
+	return manageTCProgramByFd(link, tcFd, constants.TC_INGRESS, mode, priority)
+}
+
+// ErrUnsupportedLinkType is returned for a link whose programs cannot be managed with clsact
+var ErrUnsupportedLinkType = errors.New("unsupported link type")
+
+// tcLinkTypeChecks are the checks of the link types which need one, by netlink.Link.Type(). The
+// other types are supported, they all use the clsact qdisc of the link itself, the peer of a
+// veth is not involved.
+var tcLinkTypeChecks = map[string]func(link netlink.Link) error{
+	// netlink reports a loopback as a device
+	"device": func(link netlink.Link) error {
+		if link.Attrs().Flags&net.FlagLoopback != 0 || link.Attrs().EncapType == "loopback" {
+			return fmt.Errorf("interface %v is a loopback: %w", link.Attrs().Name, ErrUnsupportedLinkType)
+		}
+		return nil
+	},
+	"tuntap": func(link netlink.Link) error {
+		if tuntap, ok := link.(*netlink.Tuntap); ok && tuntap.Mode == netlink.TUNTAP_MODE_TUN {
+			return fmt.Errorf("interface %v is a tun: %w", link.Attrs().Name, ErrUnsupportedLinkType)
+		}
+		return nil
+	},
+}
+
+// isLinkType reports whether link is a link with attributes of the netlink type typ
+func isLinkType(link netlink.Link, typ string) bool {
+	return link != nil && link.Attrs() != nil && link.Type() == typ
+}
+
+// IsVethInterface reports whether link is a veth
+func IsVethInterface(link netlink.Link) bool {
+	return isLinkType(link, "veth")
+}
+
+// IsBridgeInterface reports whether link is a bridge
+func IsBridgeInterface(link netlink.Link) bool {
+	return isLinkType(link, "bridge")
+}
+
+// IsIPVLANInterface reports whether link is an ipvlan
+func IsIPVLANInterface(link netlink.Link) bool {
+	return isLinkType(link, "ipvlan")
+}
+
+// IsBondInterface reports whether link is a bond
+func IsBondInterface(link netlink.Link) bool {
+	return isLinkType(link, "bond")
+}
+
+// checkTCLinkType returns ErrUnsupportedLinkType if link is a loopback or a tun
+func checkTCLinkType(link netlink.Link) error {
+	if check, ok := tcLinkTypeChecks[link.Type()]; ok {
+		return check(link)
+	}
+	return nil
+}
+
+// manageTCProgramByFd attaches or detaches the program of tcFd to the direction of link
+func manageTCProgramByFd(link netlink.Link, tcFd int, direction TCDirection, mode int, priority uint16) error {
+	if err := checkTCLinkType(link); err != nil {
+		return err
+	}
 	if mode == constants.TC_ATTACH {
-		if err := replaceQdisc(link); err != nil {
-			return fmt.Errorf("failed to replace qdisc for interface %v: %v", link.Attrs().Name, err)
+		if err := requireBPFFeatures(BPFFeatureTC); err != nil {
+			return err
+		}
+		if err := ValidateTCProgType(tcFd); err != nil {
+			return err
+		}
+		if _, err := ReplaceQdiscIfChanged(link); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), qdiscReadyTimeout)
+		defer cancel()
+		if err := WaitForQdiscReady(ctx, link); err != nil {
+			return err
 		}
 	}
 
-	var parent uint32 = netlink.HANDLE_MIN_INGRESS
-	var tcName string = "tc_ingress"
+	parent, err := direction.parent()
+	if err != nil {
+		return err
+	}
+	if priority == 0 {
+		priority = DefaultTCFilterPriority
+	}
+	var tcName string = "tc_" + direction.String()
 	filter := &netlink.BpfFilter{
 		FilterAttrs: netlink.FilterAttrs{
 			LinkIndex: link.Attrs().Index,
 			Parent:    parent,
 			Handle:    1,
 			Protocol:  unix.ETH_P_ALL,
-			Priority:  1,
+			Priority:  priority,
 		},
 		Fd:           tcFd,
 		Name:         fmt.Sprintf("%s-%s", tcName, link.Attrs().Name),
@@ -53,12 +166,14 @@ func ManageTCProgramByFd(link netlink.Link, tcFd int, mode int) error {
 
 	if mode == constants.TC_ATTACH {
 		if err := netlink.FilterReplace(filter); err != nil {
-			return fmt.Errorf("failed to replace filter for interface %v: %v", link.Attrs().Name, err)
+			return fmt.Errorf("failed to replace filter for interface %v: %w", link.Attrs().Name, err)
 		}
+		DefaultTCRegistry.Register(link.Attrs().Name, tcFd, direction)
 	} else if mode == constants.TC_DETACH {
 		if err := netlink.FilterDel(filter); err != nil {
-			return fmt.Errorf("failed to delete filter for interface %v: %v", link.Attrs().Name, err)
+			return fmt.Errorf("failed to delete filter for interface %v: %w", link.Attrs().Name, err)
 		}
+		DefaultTCRegistry.Unregister(link.Attrs().Name, direction)
 	} else {
 		return fmt.Errorf("invalid mode in ManageTCProgramByFd")
 	}
@@ -66,75 +181,2933 @@ func ManageTCProgramByFd(link netlink.Link, tcFd int, mode int) error {
 }
 
 func ManageTCProgram(link netlink.Link, tc *ebpf.Program, mode int) error {
-	return ManageTCProgramByFd(link, tc.FD(), mode)
+	return ManageTCProgramByFd(link, tc.FD(), mode, 0)
 }
 
-func replaceQdisc(link netlink.Link) error {
-	attrs := netlink.QdiscAttrs{
-		LinkIndex: link.Attrs().Index,
-		Handle:    netlink.MakeHandle(0xffff, 0),
-		Parent:    netlink.HANDLE_CLSACT,
+// EnsureTCProgram adds the clsact qdisc to link if missing and attaches the program of fd to the
+// direction of link with priority, DefaultTCFilterPriority if 0. If the attachment fails, the
+// qdisc added by the call is deleted again, so that link is not left with a qdisc and no filter.
+// A qdisc link had before is kept, with the filters already attached to it.
+func EnsureTCProgram(link netlink.Link, fd int, direction TCDirection, priority uint16) error {
+	if err := checkTCLinkType(link); err != nil {
+		return err
+	}
+	created, err := ReplaceQdiscIfChanged(link)
+	if err != nil {
+		return err
 	}
+	err = manageTCProgramByFd(link, fd, direction, constants.TC_ATTACH, priority)
+	if err == nil || !created {
+		return err
+	}
+	if rollbackErr := DeleteQdisc(link); rollbackErr != nil && !errors.Is(rollbackErr, ErrQdiscNotFound) {
+		return errors.Join(err, fmt.Errorf("failed to roll back qdisc: %w", rollbackErr))
+	}
+	return err
+}
 
-	qdisc := &netlink.GenericQdisc{
-		QdiscAttrs: attrs,
-		QdiscType:  "clsact",
+// TCFilterOverrides are the fields of a filter changed by CloneTCFilter, nil keeps the field of the filter
+type TCFilterOverrides struct {
+	Direction *TCDirection
+	Handle    *uint32
+	Priority  *uint16
+}
+
+// CloneTCFilter returns a copy of filter with overrides applied, e.g. to attach the program of an
+// ingress filter to the egress too. The name of a filter attached by ManageTCProgramByFd follows its
+// direction.
+func CloneTCFilter(filter *netlink.BpfFilter, overrides TCFilterOverrides) (*netlink.BpfFilter, error) {
+	if filter == nil {
+		return nil, fmt.Errorf("no filter to clone")
+	}
+	clone := *filter
+	if filter.Chain != nil {
+		chain := *filter.Chain
+		clone.Chain = &chain
 	}
 
-	return netlink.QdiscReplace(qdisc)
+	if overrides.Direction != nil {
+		parent, err := overrides.Direction.parent()
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range []TCDirection{constants.TC_INGRESS, constants.TC_EGRESS} {
+			if p, _ := d.parent(); p == filter.Parent {
+				clone.Name = strings.Replace(clone.Name, "tc_"+d.String()+"-", "tc_"+overrides.Direction.String()+"-", 1)
+			}
+		}
+		clone.Parent = parent
+	}
+	if overrides.Handle != nil {
+		clone.Handle = *overrides.Handle
+	}
+	if overrides.Priority != nil {
+		clone.Priority = *overrides.Priority
+	}
+
+	if clone.Parent != netlink.HANDLE_MIN_INGRESS && clone.Parent != netlink.HANDLE_MIN_EGRESS {
+		return nil, fmt.Errorf("filter parent %s is neither the ingress nor the egress of clsact", netlink.HandleStr(clone.Parent))
+	}
+	if clone.Handle == 0 {
+		return nil, fmt.Errorf("filter handle must not be 0")
+	}
+	if clone.DirectAction && clone.ClassId != 0 {
+		return nil, fmt.Errorf("filter class %s is ignored by a direct action filter", netlink.HandleStr(clone.ClassId))
+	}
+	return &clone, nil
 }
 
-func GetVethPeerIndexFromName(ifaceName string) (uint64, error) {
-	var ifIndex uint64
-	ethHandle, err := ethtool.NewEthtool()
+// DetachOptions is a bitmask of the programs DetachAllTCPrograms detaches besides the tc ones
+type DetachOptions uint32
+
+const (
+	// DetachXDP detaches the xdp program of the link too
+	DetachXDP DetachOptions = 1 << iota
+)
+
+// DetachAllTCPrograms removes all the bpf filters on the ingress and egress of link,
+// a link without clsact qdisc has nothing to detach. Once they are removed, the annotations of
+// link are cleared. With DetachXDP in opts, the xdp program of link is detached too, whether
+// link has a clsact qdisc or not.
+func DetachAllTCPrograms(link netlink.Link, opts ...DetachOptions) error {
+	var options DetachOptions
+	for _, opt := range opts {
+		options |= opt
+	}
+	_, err := detachAllTCPrograms(link)
+	if err == nil {
+		// nothing of kmesh is left on link
+		err = ClearInterfaceAnnotations(link)
+	}
+	if options&DetachXDP != 0 {
+		_, xdpErr := detachXDPProgram(link)
+		err = errors.Join(err, xdpErr)
+	}
+	return err
+}
+
+func hasClsactQdisc(link netlink.Link) (bool, error) {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return false, fmt.Errorf("failed to list qdisc for interface %v: %w", link.Attrs().Name, err)
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Type() == "clsact" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// qdiscReadyTimeout is how long ManageTCProgramByFd waits for the clsact qdisc it adds
+const qdiscReadyTimeout = time.Second
+
+// qdiscReadyBackoff is the delay between the qdisc lookups of WaitForQdiscReady
+var qdiscReadyBackoff = wait.Backoff{
+	Duration: time.Millisecond,
+	Factor:   2,
+	Jitter:   0.5,
+	Steps:    math.MaxInt32,
+	Cap:      100 * time.Millisecond,
+}
+
+// WaitForQdiscReady waits until the clsact qdisc of link is listed with its handle set, i.e. it
+// is initialized and accepts filters, or returns the error of ctx if it is done before.
+func WaitForQdiscReady(ctx context.Context, link netlink.Link) error {
+	backoff := qdiscReadyBackoff
+	for {
+		qdiscs, err := netlink.QdiscList(link)
+		if err != nil {
+			return fmt.Errorf("failed to list qdisc for interface %v: %w", link.Attrs().Name, err)
+		}
+		for _, qdisc := range qdiscs {
+			if qdisc.Type() == "clsact" && qdisc.Attrs().Handle != 0 {
+				return nil
+			}
+		}
+
+		timer := time.NewTimer(backoff.Step())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("clsact qdisc of interface %v is not ready: %w", link.Attrs().Name, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// QdiscCounters are the statistics of a qdisc
+type QdiscCounters struct {
+	Packets    uint64
+	Bytes      uint64
+	Drops      uint64
+	Overlimits uint64
+}
+
+func qdiscCounters(stats *netlink.QdiscStatistics) QdiscCounters {
+	var c QdiscCounters
+	if stats == nil {
+		return c
+	}
+	if stats.Basic != nil {
+		c.Packets, c.Bytes = uint64(stats.Basic.Packets), stats.Basic.Bytes
+	}
+	if stats.Queue != nil {
+		c.Drops, c.Overlimits = uint64(stats.Queue.Drops), uint64(stats.Queue.Overlimits)
+	}
+	return c
+}
+
+// ClsactStats are the qdisc statistics of the directions of a link. The kernel keeps a single
+// set of counters for the clsact qdisc, updated by the filters of both its hooks, they are
+// reported as Ingress. Egress are the counters of the root qdisc transmitting the packets,
+// they stay 0 for a noqueue root qdisc such as the one of a veth.
+type ClsactStats struct {
+	Ingress QdiscCounters
+	Egress  QdiscCounters
+}
+
+// GetClsactStats returns the qdisc statistics of link, an error wrapping unix.ENOENT is returned
+// if it has no clsact qdisc.
+func GetClsactStats(link netlink.Link) (*ClsactStats, error) {
+	qdiscs, err := netlink.QdiscList(link)
 	if err != nil {
+		return nil, fmt.Errorf("failed to list qdisc for interface %v: %w", link.Attrs().Name, err)
+	}
+
+	stats := &ClsactStats{}
+	found := false
+	for _, qdisc := range qdiscs {
+		switch {
+		case qdisc.Type() == "clsact":
+			stats.Ingress = qdiscCounters(qdisc.Attrs().Statistics)
+			found = true
+		case qdisc.Attrs().Parent == netlink.HANDLE_ROOT:
+			stats.Egress = qdiscCounters(qdisc.Attrs().Statistics)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no clsact qdisc for interface %v: %w", link.Attrs().Name, unix.ENOENT)
+	}
+	return stats, nil
+}
+
+// detachAllTCPrograms returns the number of bpf filters removed from link
+func detachAllTCPrograms(link netlink.Link) (int, error) {
+	ok, err := hasClsactQdisc(link)
+	if err != nil || !ok {
 		return 0, err
 	}
-	defer ethHandle.Close()
-	if driver, err := ethHandle.DriverName(ifaceName); err != nil {
-		return 0, fmt.Errorf("failed to get %v driver name, %v", ifaceName, err)
-	} else if strings.Compare(driver, "veth") != 0 {
-		return 0, fmt.Errorf("interface: %v is %v, not a veth", ifaceName, driver)
+
+	var errs []error
+	count := 0
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		filters, err := netlink.FilterList(link, parent)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list filter for interface %v: %w", link.Attrs().Name, err))
+			continue
+		}
+		for _, filter := range filters {
+			if _, ok := filter.(*netlink.BpfFilter); !ok {
+				continue
+			}
+			if err := netlink.FilterDel(filter); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete filter %v for interface %v: %w", filter.Attrs().Handle, link.Attrs().Name, err))
+				continue
+			}
+			count++
+		}
 	}
+	return count, errors.Join(errs...)
+}
 
-	if stats, err := ethHandle.Stats(ifaceName); err != nil {
-		return 0, fmt.Errorf("failed to get %v stats, %v", ifaceName, err)
-	} else {
-		ifIndex = stats["peer_ifindex"]
+// maxTCPrograms is the maximum number of programs the kernel allows on a tc hook
+const maxTCPrograms = 64
+
+// ListTCFilters returns the filters attached to the direction of link, e.g. to find the bpf
+// programs attached before attaching them again. A link without clsact qdisc has no filters.
+func ListTCFilters(link netlink.Link, direction TCDirection) ([]netlink.Filter, error) {
+	parent, err := direction.parent()
+	if err != nil {
+		return nil, err
 	}
-	return ifIndex, nil
+	ok, err := hasClsactQdisc(link)
+	if err != nil || !ok {
+		return nil, err
+	}
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list filter for interface %v: %w", link.Attrs().Name, err)
+	}
+	return filters, nil
 }
 
-func GetVethPeerIndexFromInterface(iface net.Interface) (uint64, error) {
-	if iface.Flags&net.FlagLoopback != 0 {
-		return 0, fmt.Errorf("interface: %v is a local interface", iface)
+const (
+	minTCHandle = 0x1
+	maxTCHandle = 0xffff
+)
+
+// ErrNoTCHandle is returned by AllocateTCHandle if all the handles of a link direction are used
+var ErrNoTCHandle = errors.New("no tc filter handle available")
+
+// tcHandleBitmap has a bit per handle, set if the handle is reserved
+type tcHandleBitmap [(maxTCHandle + 1) / 64]uint64
+
+func (b *tcHandleBitmap) isSet(handle uint32) bool {
+	return b[handle/64]&(1<<(handle%64)) != 0
+}
+
+func (b *tcHandleBitmap) set(handle uint32) {
+	b[handle/64] |= 1 << (handle % 64)
+}
+
+// tcHandleReservations are the handles reserved by the process, per link direction, they are
+// never released
+var tcHandleReservations = struct {
+	mu       sync.Mutex
+	reserved map[tcKey]*tcHandleBitmap
+}{reserved: make(map[tcKey]*tcHandleBitmap)}
+
+func reservedTCHandles(key tcKey) *tcHandleBitmap {
+	b, ok := tcHandleReservations.reserved[key]
+	if !ok {
+		b = new(tcHandleBitmap)
+		tcHandleReservations.reserved[key] = b
 	}
+	return b
+}
 
-	if iface.Flags&net.FlagUp == 0 {
-		return 0, fmt.Errorf("interface: %v not up", iface)
+// AllocateTCHandle returns the lowest handle in 0x1-0xffff used neither by the filters of the
+// direction of link nor by a handle reserved by the process, and reserves it, so that the
+// components attaching filters to the same link do not collide with EEXIST.
+func AllocateTCHandle(link netlink.Link, direction TCDirection) (uint32, error) {
+	filters, err := ListTCFilters(link, direction)
+	if err != nil {
+		return 0, err
+	}
+	var used tcHandleBitmap
+	for _, filter := range filters {
+		if handle := filter.Attrs().Handle; handle >= minTCHandle && handle <= maxTCHandle {
+			used.set(handle)
+		}
 	}
 
-	return GetVethPeerIndexFromName(iface.Name)
+	tcHandleReservations.mu.Lock()
+	defer tcHandleReservations.mu.Unlock()
+	reserved := reservedTCHandles(tcKey{ifIndex: link.Attrs().Index, direction: direction})
+	for handle := uint32(minTCHandle); handle <= maxTCHandle; handle++ {
+		if !used.isSet(handle) && !reserved.isSet(handle) {
+			reserved.set(handle)
+			return handle, nil
+		}
+	}
+	return 0, fmt.Errorf("interface %v %v: %w", link.Attrs().Name, direction, ErrNoTCHandle)
 }
 
-func IfaceContainIPs(iface net.Interface, IPs []string) (bool, error) {
-	addresses, err := iface.Addrs()
+// ReserveTCHandle reserves handle on the direction of link for the lifetime of the process, so
+// that AllocateTCHandle does not return it. An error is returned if it is reserved already.
+func ReserveTCHandle(link netlink.Link, direction TCDirection, handle uint32) error {
+	if handle < minTCHandle || handle > maxTCHandle {
+		return fmt.Errorf("invalid tc handle %#x, must be in %#x-%#x", handle, minTCHandle, maxTCHandle)
+	}
+	tcHandleReservations.mu.Lock()
+	defer tcHandleReservations.mu.Unlock()
+	reserved := reservedTCHandles(tcKey{ifIndex: link.Attrs().Index, direction: direction})
+	if reserved.isSet(handle) {
+		return fmt.Errorf("tc handle %#x of interface %v %v is reserved already", handle, link.Attrs().Name, direction)
+	}
+	reserved.set(handle)
+	return nil
+}
+
+// GetNumPrograms returns the number of bpf programs attached to the direction of link,
+// both bpf classifiers and filters with bpf actions are counted.
+func GetNumPrograms(link netlink.Link, direction TCDirection) (int, error) {
+	parent, err := direction.parent()
 	if err != nil {
-		return false, fmt.Errorf("failed to get interface %v address: %v", iface.Name, err)
+		return 0, err
+	}
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list filter for interface %v: %v", link.Attrs().Name, err)
 	}
 
-	for _, rawAddr := range addresses {
-		addr, ok := rawAddr.(*net.IPNet)
+	count := 0
+	for _, filter := range filters {
+		if hasBpfProgram(filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func hasBpfProgram(filter netlink.Filter) bool {
+	var actions []netlink.Action
+	switch f := filter.(type) {
+	case *netlink.BpfFilter:
+		return true
+	case *netlink.U32:
+		actions = f.Actions
+	case *netlink.MatchAll:
+		actions = f.Actions
+	case *netlink.Flower:
+		actions = f.Actions
+	}
+	return slices.ContainsFunc(actions, func(a netlink.Action) bool {
+		_, ok := a.(*netlink.BpfAction)
+		return ok
+	})
+}
+
+// GetMaxSupportedPrograms returns the maximum number of programs that can be attached
+// to a direction, it is 0 for an invalid direction.
+func GetMaxSupportedPrograms(direction TCDirection) int {
+	if _, err := direction.parent(); err != nil {
+		return 0
+	}
+	return maxTCPrograms
+}
+
+// IsSafeDetachError returns true if err only means that the link or its qdisc is already
+// gone, e.g. removed by CNI DEL, so there is nothing left to detach.
+func IsSafeDetachError(err error) bool {
+	return errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENODEV)
+}
+
+// SafeDetach detaches the bpf programs from the direction of link. Unlike DetachAllTCPrograms,
+// it succeeds if the link or its clsact qdisc has already been removed.
+func SafeDetach(link netlink.Link, direction TCDirection) error {
+	parent, err := direction.parent()
+	if err != nil {
+		return err
+	}
+
+	ok, err := hasClsactQdisc(link)
+	if err == nil && ok {
+		err = safeDetach(link, parent)
+	}
+	if IsSafeDetachError(err) {
+		log.Debugf("skip detaching tc programs from interface %v: %v", link.Attrs().Name, err)
+		return nil
+	}
+	return err
+}
+
+func safeDetach(link netlink.Link, parent uint32) error {
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return fmt.Errorf("failed to list filter for interface %v: %w", link.Attrs().Name, err)
+	}
+
+	var errs []error
+	for _, filter := range filters {
+		if _, ok := filter.(*netlink.BpfFilter); !ok {
+			continue
+		}
+		if err := netlink.FilterDel(filter); err != nil && !IsSafeDetachError(err) {
+			errs = append(errs, fmt.Errorf("failed to delete filter %v for interface %v: %w", filter.Attrs().Handle, link.Attrs().Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// programFromFd returns a program holding a duplicate of fd, the caller keeps the ownership of fd
+func programFromFd(fd int) (*ebpf.Program, error) {
+	dup, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dup program fd %d: %v", fd, err)
+	}
+	prog, err := ebpf.NewProgramFromFD(dup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open program fd %d: %v", fd, err)
+	}
+	return prog, nil
+}
+
+// ErrWrongBPFProgType is returned by ValidateTCProgType for a program which is not a tc classifier
+var ErrWrongBPFProgType = errors.New("wrong bpf program type")
+
+// ValidateTCProgType returns ErrWrongBPFProgType if the program of fd is not of type
+// BPF_PROG_TYPE_SCHED_CLS, which the kernel would reject with a bare EINVAL on attach
+func ValidateTCProgType(fd int) error {
+	prog, err := programFromFd(fd)
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+	if prog.Type() != ebpf.SchedCLS {
+		return fmt.Errorf("program fd %d is of type %v, not %v: %w", fd, prog.Type(), ebpf.SchedCLS, ErrWrongBPFProgType)
+	}
+	return nil
+}
+
+// GetProgramLoadTime returns the wall clock time the bpf program referenced by fd was loaded at.
+// The kernel records the load time since boot, it is converted using CLOCK_BOOTTIME.
+func GetProgramLoadTime(fd int) (time.Time, error) {
+	prog, err := programFromFd(fd)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer prog.Close()
+
+	info, err := prog.Info()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get info of program fd %d: %v", fd, err)
+	}
+	loadTime, ok := info.LoadTime()
+	if !ok {
+		return time.Time{}, fmt.Errorf("load time of program fd %d is not available", fd)
+	}
+	return bootTimeToWallClock(loadTime)
+}
+
+// bootTimeToWallClock converts a time since boot to the wall clock
+func bootTimeToWallClock(sinceBoot time.Duration) (time.Time, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts); err != nil {
+		return time.Time{}, fmt.Errorf("failed to get boot time: %v", err)
+	}
+	return time.Now().Add(sinceBoot - time.Duration(ts.Nano())), nil
+}
+
+// BPFProgramSummary describes a bpf program attached to an interface
+type BPFProgramSummary struct {
+	ID       uint32
+	Name     string
+	Tag      [8]byte
+	LoadTime time.Time
+	Type     string
+}
+
+// bpfProgramSummary returns the summary of the program of a bpf filter
+func bpfProgramSummary(filter *netlink.BpfFilter) (BPFProgramSummary, error) {
+	var prog *ebpf.Program
+	var err error
+	// the filters dumped by the kernel only carry the id of their program
+	if filter.Fd > 0 {
+		prog, err = programFromFd(filter.Fd)
+	} else {
+		prog, err = ebpf.NewProgramFromID(ebpf.ProgramID(filter.Id))
+	}
+	if err != nil {
+		return BPFProgramSummary{}, err
+	}
+	defer prog.Close()
+
+	info, err := prog.Info()
+	if err != nil {
+		return BPFProgramSummary{}, fmt.Errorf("failed to get info of program %s: %v", filter.Name, err)
+	}
+	summary := BPFProgramSummary{Name: info.Name, Type: info.Type.String()}
+	if id, ok := info.ID(); ok {
+		summary.ID = uint32(id)
+	}
+	if _, err = hex.Decode(summary.Tag[:], []byte(info.Tag)); err != nil {
+		return BPFProgramSummary{}, fmt.Errorf("invalid tag %q of program %s: %v", info.Tag, filter.Name, err)
+	}
+	if loadTime, ok := info.LoadTime(); ok {
+		if summary.LoadTime, err = bootTimeToWallClock(loadTime); err != nil {
+			return BPFProgramSummary{}, err
+		}
+	}
+	return summary, nil
+}
+
+// GetTCFilterBPFProgramInfo returns the summaries of the programs of the bpf filters attached
+// to the direction of link, in the order of the filters.
+func GetTCFilterBPFProgramInfo(link netlink.Link, direction TCDirection) ([]BPFProgramSummary, error) {
+	parent, err := direction.parent()
+	if err != nil {
+		return nil, err
+	}
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list filter for interface %v: %w", link.Attrs().Name, err)
+	}
+
+	var summaries []BPFProgramSummary
+	for _, filter := range filters {
+		bpfFilter, ok := filter.(*netlink.BpfFilter)
 		if !ok {
-			log.Warnf("failed to convert ifaddr %v, %v", rawAddr, err)
 			continue
 		}
-		for _, rawLocalAddr := range IPs {
-			localAddr := net.ParseIP(rawLocalAddr)
-			if addr.IP.Equal(localAddr) {
-				return true, nil
-			}
+		summary, err := bpfProgramSummary(bpfFilter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get program of filter %v for interface %v: %w", filter.Attrs().Handle, link.Attrs().Name, err)
 		}
+		summaries = append(summaries, summary)
 	}
-	return false, nil
+	return summaries, nil
+}
+
+// TCProgramVersionMapName is the name of the map holding the version of a tc program.
+// The programs define it in their .maps BTF section as an array of a single
+// struct { __u32 major; __u32 minor; }.
+const TCProgramVersionMapName = "kmesh_version"
+
+// ErrNoProgramVersion is returned by ReadProgramVersion for programs without version map
+var ErrNoProgramVersion = errors.New("program has no version")
+
+// TCProgramVersion is the version of the map schemas of a tc program
+type TCProgramVersion struct {
+	Major int
+	Minor int
+}
+
+func (v TCProgramVersion) String() string {
+	return fmt.Sprintf("v%d.%d", v.Major, v.Minor)
+}
+
+// ParseTCProgramVersion parses the version formatted by TCProgramVersion.String, e.g. v1.2
+func ParseTCProgramVersion(s string) (TCProgramVersion, error) {
+	var v TCProgramVersion
+	major, minor, ok := strings.Cut(strings.TrimPrefix(s, "v"), ".")
+	if !ok {
+		return v, fmt.Errorf("invalid program version %q", s)
+	}
+	var err error
+	if v.Major, err = strconv.Atoi(major); err != nil || v.Major < 0 {
+		return TCProgramVersion{}, fmt.Errorf("invalid major of program version %q", s)
+	}
+	if v.Minor, err = strconv.Atoi(minor); err != nil || v.Minor < 0 {
+		return TCProgramVersion{}, fmt.Errorf("invalid minor of program version %q", s)
+	}
+	return v, nil
+}
+
+func (v TCProgramVersion) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+func (v *TCProgramVersion) UnmarshalText(text []byte) error {
+	parsed, err := ParseTCProgramVersion(string(text))
+	if err != nil {
+		return err
+	}
+	*v = parsed
+	return nil
+}
+
+// ReadProgramVersion returns the version of the program referenced by fd
+// from its TCProgramVersionMapName map.
+func ReadProgramVersion(fd int) (TCProgramVersion, error) {
+	prog, err := programFromFd(fd)
+	if err != nil {
+		return TCProgramVersion{}, err
+	}
+	defer prog.Close()
+
+	info, err := prog.Info()
+	if err != nil {
+		return TCProgramVersion{}, fmt.Errorf("failed to get info of program fd %d: %v", fd, err)
+	}
+	ids, _ := info.MapIDs()
+	for _, id := range ids {
+		m, err := ebpf.NewMapFromID(id)
+		if err != nil {
+			return TCProgramVersion{}, fmt.Errorf("failed to open map %d of program fd %d: %v", id, fd, err)
+		}
+		v, ok, err := readVersionMap(m)
+		m.Close()
+		if ok || err != nil {
+			return v, err
+		}
+	}
+	return TCProgramVersion{}, fmt.Errorf("%w: fd %d", ErrNoProgramVersion, fd)
+}
+
+// readVersionMap reads m if it is the version map
+func readVersionMap(m *ebpf.Map) (TCProgramVersion, bool, error) {
+	info, err := m.Info()
+	if err != nil {
+		return TCProgramVersion{}, false, fmt.Errorf("failed to get info of map %v: %v", m, err)
+	}
+	if info.Name != TCProgramVersionMapName {
+		return TCProgramVersion{}, false, nil
+	}
+	if m.Type() != ebpf.Array || m.KeySize() != 4 || m.ValueSize() != 8 {
+		return TCProgramVersion{}, true, fmt.Errorf("invalid version map %v", m)
+	}
+
+	var value [2]uint32
+	if err := m.Lookup(uint32(0), &value); err != nil {
+		return TCProgramVersion{}, true, fmt.Errorf("failed to read version map %v: %v", m, err)
+	}
+	return TCProgramVersion{Major: int(value[0]), Minor: int(value[1])}, true, nil
+}
+
+// IsCompatible reports whether a program of version installed can be used where version
+// required is expected. Minor versions only add to the map schemas, so installed must have
+// the major version of required and at least its minor version. Before 1.0 every minor
+// version may break the schemas.
+func IsCompatible(installed, required TCProgramVersion) bool {
+	if installed.Major != required.Major {
+		return false
+	}
+	if installed.Major == 0 {
+		return installed.Minor == required.Minor
+	}
+	return installed.Minor >= required.Minor
+}
+
+// MapSpec is the layout of a map a tc program must keep to read the data of the program it replaces
+type MapSpec struct {
+	Name      string
+	KeySize   uint32
+	ValueSize uint32
+}
+
+// ErrIncompatibleBTF is returned by TCProgramCompatChecker.Check for a map whose layout
+// differs from its MapSpec
+type ErrIncompatibleBTF struct {
+	MapName           string
+	ExpectedKeySize   uint32
+	ActualKeySize     uint32
+	ExpectedValueSize uint32
+	ActualValueSize   uint32
+}
+
+func (e *ErrIncompatibleBTF) Error() string {
+	return fmt.Sprintf("map %s of key size %d and value size %d is incompatible, expect key size %d and value size %d",
+		e.MapName, e.ActualKeySize, e.ActualValueSize, e.ExpectedKeySize, e.ExpectedValueSize)
+}
+
+// TCProgramCompatChecker checks that a program defines the maps of RequiredMaps with the same layout
+type TCProgramCompatChecker struct {
+	RequiredMaps []MapSpec
+}
+
+// Check reads the map definitions of the program of programFD from its BTF, or from the maps it
+// references if it has no BTF. A *ErrIncompatibleBTF is returned for each map of another layout.
+func (c TCProgramCompatChecker) Check(programFD int) error {
+	prog, err := programFromFd(programFD)
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+
+	info, err := prog.Info()
+	if err != nil {
+		return fmt.Errorf("failed to get info of program fd %d: %v", programFD, err)
+	}
+	var maps map[string]MapSpec
+	if id, ok := info.BTFID(); ok {
+		if maps, err = programBTFMapSpecs(id); err != nil {
+			return fmt.Errorf("failed to read btf of program fd %d: %v", programFD, err)
+		}
+	}
+	if len(maps) == 0 {
+		if maps, err = programMapSpecs(info); err != nil {
+			return fmt.Errorf("failed to read maps of program fd %d: %v", programFD, err)
+		}
+	}
+	return c.checkMaps(maps)
+}
+
+func (c TCProgramCompatChecker) checkMaps(maps map[string]MapSpec) error {
+	var errs []error
+	for _, required := range c.RequiredMaps {
+		actual, ok := maps[required.Name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("map %s is not defined", required.Name))
+			continue
+		}
+		if actual.KeySize != required.KeySize || actual.ValueSize != required.ValueSize {
+			errs = append(errs, &ErrIncompatibleBTF{
+				MapName:           required.Name,
+				ExpectedKeySize:   required.KeySize,
+				ActualKeySize:     actual.KeySize,
+				ExpectedValueSize: required.ValueSize,
+				ActualValueSize:   actual.ValueSize,
+			})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func programBTFMapSpecs(id btf.ID) (map[string]MapSpec, error) {
+	handle, err := btf.NewHandleFromID(id)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	spec, err := handle.Spec(nil)
+	if err != nil {
+		return nil, err
+	}
+	return btfMapSpecs(spec)
+}
+
+// btfMapSpecs returns the maps defined in the .maps section of spec. The definitions follow the
+// libbpf convention, __uint(name, val) is a pointer to an array of val elements and
+// __type(name, val) a pointer to val.
+func btfMapSpecs(spec *btf.Spec) (map[string]MapSpec, error) {
+	var sec *btf.Datasec
+	if err := spec.TypeByName(".maps", &sec); errors.Is(err, btf.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	maps := make(map[string]MapSpec, len(sec.Vars))
+	for _, vsi := range sec.Vars {
+		v, ok := vsi.Type.(*btf.Var)
+		if !ok {
+			continue
+		}
+		def, ok := btf.UnderlyingType(v.Type).(*btf.Struct)
+		if !ok {
+			return nil, fmt.Errorf("map %s is not defined by a struct", v.Name)
+		}
+		m := MapSpec{Name: v.Name}
+		for _, member := range def.Members {
+			ptr, ok := member.Type.(*btf.Pointer)
+			if !ok {
+				continue
+			}
+			var size *uint32
+			switch member.Name {
+			case "key", "key_size":
+				size = &m.KeySize
+			case "value", "value_size":
+				size = &m.ValueSize
+			default:
+				continue
+			}
+			if strings.HasSuffix(member.Name, "_size") {
+				array, ok := ptr.Target.(*btf.Array)
+				if !ok {
+					return nil, fmt.Errorf("invalid %s of map %s", member.Name, v.Name)
+				}
+				*size = array.Nelems
+				continue
+			}
+			n, err := btf.Sizeof(ptr.Target)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s of map %s: %v", member.Name, v.Name, err)
+			}
+			*size = uint32(n)
+		}
+		maps[v.Name] = m
+	}
+	return maps, nil
+}
+
+// programMapSpecs returns the layouts of the maps referenced by the program of info
+func programMapSpecs(info *ebpf.ProgramInfo) (map[string]MapSpec, error) {
+	ids, _ := info.MapIDs()
+	maps := make(map[string]MapSpec, len(ids))
+	for _, id := range ids {
+		m, err := ebpf.NewMapFromID(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open map %d: %v", id, err)
+		}
+		mapInfo, err := m.Info()
+		m.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get info of map %d: %v", id, err)
+		}
+		maps[mapInfo.Name] = MapSpec{Name: mapInfo.Name, KeySize: mapInfo.KeySize, ValueSize: mapInfo.ValueSize}
+	}
+	return maps, nil
+}
+
+// SwapTCProgram replaces the program attached by ManageTCProgramByFd to the direction of link
+// with the program of fd. The new program is rejected if checker is not nil and finds its
+// maps incompatible.
+func SwapTCProgram(link netlink.Link, direction TCDirection, fd int, checker *TCProgramCompatChecker) error {
+	if checker != nil {
+		if err := checker.Check(fd); err != nil {
+			return fmt.Errorf("program fd %d is incompatible with the maps of interface %v: %w", fd, link.Attrs().Name, err)
+		}
+	}
+	return manageTCProgramByFd(link, fd, direction, constants.TC_ATTACH, 0)
+}
+
+// InterfaceAnnotationPodUID is the interface annotation holding the uid of the pod owning the interface
+const InterfaceAnnotationPodUID = "pod-uid"
+
+// DetachTCProgramsByPodUID detaches the tc programs of all the interfaces annotated
+// with podUID and returns the number of detached programs. An annotation is only taken for
+// the interface of its index if it has the name of the interface too, it is cleared once the
+// programs of the interface are detached.
+func DetachTCProgramsByPodUID(podUID types.UID) (int, error) {
+	m, err := openInterfaceAnnotationsMap(false)
+	if err != nil || m == nil {
+		// no interface was ever annotated
+		return 0, err
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list links: %v", err)
+	}
+
+	var errs []error
+	count := 0
+	for _, link := range links {
+		attrs := link.Attrs()
+		annotations, err := lookupInterfaceAnnotations(m, attrs.Index, attrs.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read annotations of interface %v: %v", attrs.Name, err))
+			continue
+		}
+		if annotations[InterfaceAnnotationPodUID] != string(podUID) {
+			continue
+		}
+		n, err := detachAllTCPrograms(link)
+		count += n
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err = clearInterfaceAnnotations(attrs.Index, attrs.Name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return count, errors.Join(errs...)
+}
+
+func replaceQdisc(link netlink.Link) error {
+	attrs := netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(0xffff, 0),
+		Parent:    netlink.HANDLE_CLSACT,
+	}
+
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: attrs,
+		QdiscType:  "clsact",
+	}
+
+	return netlink.QdiscReplace(qdisc)
+}
+
+// ErrQdiscNotFound is returned by DeleteQdisc for a link without clsact qdisc
+var ErrQdiscNotFound = errors.New("clsact qdisc not found")
+
+// DeleteQdisc removes the clsact qdisc of link and all its filters with it, e.g. before the link
+// is deleted. ErrQdiscNotFound is returned if link has no clsact qdisc.
+func DeleteQdisc(link netlink.Link) error {
+	ok, err := hasClsactQdisc(link)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("interface %v: %w", link.Attrs().Name, ErrQdiscNotFound)
+	}
+	err = netlink.QdiscDel(&netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	})
+	// deleted in the meantime
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("interface %v: %w", link.Attrs().Name, ErrQdiscNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete qdisc of interface %v: %w", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// ReplaceQdiscIfChanged adds the clsact qdisc to link unless it has one already, so that the
+// links reconciled again cost a qdisc list only. changed is false if nothing was done.
+func ReplaceQdiscIfChanged(link netlink.Link) (changed bool, err error) {
+	ok, err := hasClsactQdisc(link)
+	if err != nil || ok {
+		return false, err
+	}
+	if err := replaceQdisc(link); err != nil {
+		return false, fmt.Errorf("failed to replace qdisc for interface %v: %w", link.Attrs().Name, err)
+	}
+	return true, nil
+}
+
+// multiQueueDrivers are the drivers of the usual multi-queue NICs, for the links whose number
+// of tx queues is not known
+var multiQueueDrivers = map[string]bool{
+	"bnxt_en":    true,
+	"ena":        true,
+	"gve":        true,
+	"i40e":       true,
+	"ice":        true,
+	"igb":        true,
+	"ixgbe":      true,
+	"mlx4_en":    true,
+	"mlx5_core":  true,
+	"virtio_net": true,
+	"vmxnet3":    true,
+}
+
+// linkDriverName returns the driver of the interface name
+func linkDriverName(name string) (string, error) {
+	ethHandle, err := ethtool.NewEthtool()
+	if err != nil {
+		return "", err
+	}
+	defer ethHandle.Close()
+	return ethHandle.DriverName(name)
+}
+
+// IsMultiQueueLink reports whether link transmits on several tx queues. NumTxQueues is set for
+// the links got from the kernel, the driver of link is checked against multiQueueDrivers
+// otherwise. TxQLen is the length of the queues, not their number, it tells nothing here.
+func IsMultiQueueLink(link netlink.Link) bool {
+	if n := link.Attrs().NumTxQueues; n != 0 {
+		return n > 1
+	}
+	driver, err := linkDriverName(link.Attrs().Name)
+	if err != nil {
+		log.Debugf("failed to get driver of interface %v: %v", link.Attrs().Name, err)
+		return false
+	}
+	return multiQueueDrivers[driver]
+}
+
+// ReplaceQdiscMQ adds the clsact qdisc to the multi-queue link, e.g. a NIC with a mq root qdisc,
+// as to any other link. The kernel has one clsact qdisc per device, it is not a child of the
+// root qdisc and cannot be added under the queues of mq, so the root mq qdisc and its per-queue
+// children are kept as they are. The tradeoffs are those of clsact: the ingress programs run
+// once per packet before any queue, on the cpu of the rx queue, and the egress programs run
+// before the tx queue is selected, on the sending cpu, so they don't contend on a qdisc lock,
+// but a program is shared by all the queues and its maps are too, per-cpu maps avoid the
+// contention. The programs are attached with ManageTCProgramByFd afterwards.
+func ReplaceQdiscMQ(link netlink.Link) error {
+	if err := checkTCLinkType(link); err != nil {
+		return err
+	}
+	if IsMultiQueueLink(link) {
+		log.Debugf("interface %v is multi-queue, its root qdisc is kept", link.Attrs().Name)
+	}
+	_, err := ReplaceQdiscIfChanged(link)
+	return err
+}
+
+func GetVethPeerIndexFromName(ifaceName string) (uint64, error) {
+	var ifIndex uint64
+	ethHandle, err := ethtool.NewEthtool()
+	if err != nil {
+		return 0, err
+	}
+	defer ethHandle.Close()
+	if driver, err := ethHandle.DriverName(ifaceName); err != nil {
+		return 0, fmt.Errorf("failed to get %v driver name, %v", ifaceName, err)
+	} else if strings.Compare(driver, "veth") != 0 {
+		return 0, fmt.Errorf("interface: %v is %v, not a veth", ifaceName, driver)
+	}
+
+	if stats, err := ethHandle.Stats(ifaceName); err != nil {
+		return 0, fmt.Errorf("failed to get %v stats, %v", ifaceName, err)
+	} else {
+		ifIndex = stats["peer_ifindex"]
+	}
+	return ifIndex, nil
+}
+
+func GetVethPeerIndexFromInterface(iface net.Interface) (uint64, error) {
+	if iface.Flags&net.FlagLoopback != 0 {
+		return 0, fmt.Errorf("interface: %v is a local interface", iface)
+	}
+
+	if iface.Flags&net.FlagUp == 0 {
+		return 0, fmt.Errorf("interface: %v not up", iface)
+	}
+
+	return GetVethPeerIndexFromName(iface.Name)
+}
+
+// ErrInterfaceNotFound is returned by GetInterfaceByIndex if no interface has the index,
+// e.g. the peer of a veth deleted with its pod in the meantime
+var ErrInterfaceNotFound = errors.New("interface not found")
+
+// GetInterfaceByIndex returns the interface of index. The error has the index and wraps
+// ErrInterfaceNotFound if there is no such interface, unlike the failures to list the
+// interfaces, e.g. for lack of permission.
+func GetInterfaceByIndex(index int) (net.Interface, error) {
+	iface, err := net.InterfaceByIndex(index)
+	if err == nil {
+		return *iface, nil
+	}
+	var syscallErr *os.SyscallError
+	if errors.As(err, &syscallErr) {
+		return net.Interface{}, fmt.Errorf("failed to get interface of index %d: %w", index, err)
+	}
+	return net.Interface{}, fmt.Errorf("interface of index %d: %w: %v", index, ErrInterfaceNotFound, err)
+}
+
+// ErrNotLinkPair is returned by GetVethPeerLink for an interface which is not a veth or an ipvlan
+var ErrNotLinkPair = errors.New("interface is not a veth or an ipvlan")
+
+// GetVethPeerLink returns the peer of the veth iface, or the master of the ipvlan iface, looked
+// up in its own netns. The peer of a veth must point back to iface, so that an index reused
+// by another interface in the meantime is not mistaken for the peer.
+func GetVethPeerLink(iface net.Interface) (netlink.Link, error) {
+	if iface.Flags&net.FlagLoopback != 0 {
+		return nil, fmt.Errorf("interface %v is a local interface: %w", iface.Name, ErrNotLinkPair)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface %v not up", iface.Name)
+	}
+
+	link, err := netlink.LinkByIndex(iface.Index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface %v: %v", iface.Name, err)
+	}
+	if link.Attrs().Name != iface.Name {
+		return nil, fmt.Errorf("interface %v of index %d is renamed to %v", iface.Name, iface.Index, link.Attrs().Name)
+	}
+	if !IsVethInterface(link) && !IsIPVLANInterface(link) {
+		return nil, fmt.Errorf("interface %v is a %v: %w", iface.Name, link.Type(), ErrNotLinkPair)
+	}
+	peerIndex := link.Attrs().ParentIndex
+	if peerIndex == 0 {
+		return nil, fmt.Errorf("%v %v has no peer", link.Type(), iface.Name)
+	}
+
+	peer, _, err := linkPeerByIndex(link, peerIndex)
+	if err != nil {
+		return nil, err
+	}
+	if IsVethInterface(link) && peer.Attrs().ParentIndex != link.Attrs().Index {
+		return nil, fmt.Errorf("interface %v of index %d is not the peer of veth %v", peer.Attrs().Name, peerIndex, iface.Name)
+	}
+	return peer, nil
+}
+
+// linkPeerByIndex returns the link of peerIndex in the netns of the peer of link and the path
+// of that netns, empty if it is the current netns
+func linkPeerByIndex(link netlink.Link, peerIndex int) (netlink.Link, string, error) {
+	var peer netlink.Link
+	getPeer := func() error {
+		var err error
+		if peer, err = netlink.LinkByIndex(peerIndex); err != nil {
+			return fmt.Errorf("failed to get peer of index %d of interface %v: %v", peerIndex, link.Attrs().Name, err)
+		}
+		return nil
+	}
+	if link.Attrs().NetNsID < 0 {
+		return peer, "", getPeer()
+	}
+	nsPath, err := GetLinkNamespace(link)
+	if err != nil {
+		return nil, "", err
+	}
+	err = ns.WithNetNSPath(nsPath, func(_ ns.NetNS) error {
+		return getPeer()
+	})
+	return peer, nsPath, err
+}
+
+// VethPair are the two ends of a veth, Link is in the current netns and Peer in the netns at
+// PeerNetns, the current netns too if empty
+type VethPair struct {
+	Link      netlink.Link
+	Peer      netlink.Link
+	PeerNetns string
+}
+
+// GetAllVethPairs returns the veth pairs of the veths of the current netns, e.g. to attach the
+// tc programs again after a restart without the pods of the api server. A pair with both ends in
+// the current netns is returned once. The veths whose peer cannot be found, e.g. deleted in the
+// meantime, are skipped.
+func GetAllVethPairs() ([]VethPair, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+
+	var res []VethPair
+	seen := make(map[int]bool)
+	for _, link := range links {
+		veth, ok := link.(*netlink.Veth)
+		if !ok || seen[veth.Index] {
+			continue
+		}
+		peerIndex, err := netlink.VethPeerIndex(veth)
+		if err != nil {
+			log.Warnf("failed to get peer index of veth %v: %v", veth.Name, err)
+			continue
+		}
+		peer, peerNetns, err := linkPeerByIndex(veth, peerIndex)
+		if err != nil {
+			log.Warnf("failed to get peer of veth %v: %v", veth.Name, err)
+			continue
+		}
+		if peerNetns == "" {
+			seen[peerIndex] = true
+		}
+		res = append(res, VethPair{Link: veth, Peer: peer, PeerNetns: peerNetns})
+	}
+	return res, nil
+}
+
+// GetLinkNamespace returns the netns path of the peer of link, e.g. the netns of the pod of a
+// host veth. The NetNsID of link is only meaningful in the current netns, it is matched against
+// the ids of the netns of the host processes found under GetProcRootFromEnv, each netns inode
+// is checked once.
+func GetLinkNamespace(link netlink.Link) (string, error) {
+	nsid := link.Attrs().NetNsID
+	if nsid < 0 {
+		return "", fmt.Errorf("interface %v has no peer in another netns", link.Attrs().Name)
+	}
+
+	procRoot := GetProcRootFromEnv()
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", procRoot, err)
+	}
+	observed := make(map[uint64]struct{})
+	for _, entry := range entries {
+		if !IsProcEntry(entry) {
+			continue
+		}
+		nsPath := filepath.Join(procRoot, entry.Name(), "ns", "net")
+		inode, err := GetNetnsInode(nsPath)
+		// the process may have exited
+		if err != nil {
+			continue
+		}
+		if _, ok := observed[inode]; ok {
+			continue
+		}
+		observed[inode] = struct{}{}
+
+		if id, err := getNetnsID(nsPath); err == nil && id == nsid {
+			return nsPath, nil
+		}
+	}
+	return "", fmt.Errorf("netns of id %d of interface %v not found", nsid, link.Attrs().Name)
+}
+
+// GetNetnsInode returns the inode of the netns of nsPath, which identifies the netns,
+// e.g. /proc/<pid>/ns/net of the processes in the same netns have the same inode
+func GetNetnsInode(nsPath string) (uint64, error) {
+	fi, err := os.Stat(nsPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat netns %s: %v", nsPath, err)
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("failed to get inode of netns %s", nsPath)
+	}
+	return stat.Ino, nil
+}
+
+// SameNetns returns whether pathA and pathB are the same netns, by their inodes
+func SameNetns(pathA, pathB string) (bool, error) {
+	inodeA, err := GetNetnsInode(pathA)
+	if err != nil {
+		return false, err
+	}
+	inodeB, err := GetNetnsInode(pathB)
+	if err != nil {
+		return false, err
+	}
+	return inodeA == inodeB, nil
+}
+
+// NetnsChangedSince returns whether the netns of nsPath is no longer the one of inode expectedInode,
+// e.g. the netns of a pod whose sandbox has been recreated
+func NetnsChangedSince(nsPath string, expectedInode uint64) (bool, error) {
+	inode, err := GetNetnsInode(nsPath)
+	if err != nil {
+		return false, err
+	}
+	return inode != expectedInode, nil
+}
+
+func getNetnsID(nsPath string) (int, error) {
+	f, err := os.Open(nsPath)
+	if err != nil {
+		return -1, err
+	}
+	defer f.Close()
+	return netlink.GetNetNsIdByFd(int(f.Fd()))
+}
+
+// IfaceContainIPs returns whether an address of iface is one of IPs, the ipv6 ones may have a zone
+func IfaceContainIPs(iface net.Interface, IPs []string) (bool, error) {
+	addresses, err := iface.Addrs()
+	if err != nil {
+		return false, fmt.Errorf("failed to get interface %v address: %v", iface.Name, err)
+	}
+	return addrsContainIPs(addresses, IPs), nil
+}
+
+// addrsContainIPs returns whether one of addresses is one of IPs. The zone of the ipv6
+// link-local addresses, e.g. fe80::1%eth0, is ignored, the addresses are those of one interface.
+func addrsContainIPs(addresses []net.Addr, IPs []string) bool {
+	for _, ip := range normalizeAddrs(addresses) {
+		for _, rawLocalAddr := range IPs {
+			rawLocalAddr, _, _ = strings.Cut(rawLocalAddr, "%")
+			if ip.Equal(net.ParseIP(rawLocalAddr)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetInterfaceAddrs returns the ips of the addresses of iface, whether the kernel reports them
+// as *net.IPNet or *net.IPAddr. The ipv4 ones, in the 4 bytes form even if reported ipv4-mapped,
+// come before the ipv6 ones, the zone of the link-local ones is dropped and each ip is once.
+func GetInterfaceAddrs(iface net.Interface) ([]net.IP, error) {
+	addresses, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface %v address: %v", iface.Name, err)
+	}
+	return normalizeAddrs(addresses), nil
+}
+
+func normalizeAddrs(addresses []net.Addr) []net.IP {
+	var ipv4s, ipv6s []net.IP
+	for _, rawAddr := range addresses {
+		var ip net.IP
+		switch addr := rawAddr.(type) {
+		case *net.IPNet:
+			ip = addr.IP
+		case *net.IPAddr:
+			ip = addr.IP
+		default:
+			log.Warnf("failed to convert ifaddr %v", rawAddr)
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			if !slices.ContainsFunc(ipv4s, ip4.Equal) {
+				ipv4s = append(ipv4s, ip4)
+			}
+		} else if ip6 := ip.To16(); ip6 != nil {
+			if !slices.ContainsFunc(ipv6s, ip6.Equal) {
+				ipv6s = append(ipv6s, ip6)
+			}
+		} else {
+			log.Warnf("failed to convert ifaddr %v", rawAddr)
+		}
+	}
+	return append(ipv4s, ipv6s...)
+}
+
+// IfaceContainCIDRs returns whether an address of iface is in one of cidrs, an invalid cidr
+// is an error
+func IfaceContainCIDRs(iface net.Interface, cidrs []string) (bool, error) {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return false, err
+	}
+	addresses, err := iface.Addrs()
+	if err != nil {
+		return false, fmt.Errorf("failed to get interface %v address: %v", iface.Name, err)
+	}
+	return addrsInCIDRs(addresses, nets), nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %v", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func addrsInCIDRs(addresses []net.Addr, nets []*net.IPNet) bool {
+	for _, ip := range normalizeAddrs(addresses) {
+		for _, ipNet := range nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetEBPFMapValueByKey returns the raw value of key in the bpf map with mapID.
+// It works with any map type, the value of a per-cpu map contains the values of all cpus.
+func GetEBPFMapValueByKey(mapID uint32, keyBytes []byte) ([]byte, error) {
+	m, err := ebpf.NewMapFromID(ebpf.MapID(mapID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open map %d: %v", mapID, err)
+	}
+	defer m.Close()
+
+	value, err := m.LookupBytes(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup key %x in map %d: %v", keyBytes, mapID, err)
+	}
+	if value == nil {
+		return nil, fmt.Errorf("key %x not found in map %d: %w", keyBytes, mapID, ebpf.ErrKeyNotExist)
+	}
+	return value, nil
+}
+
+// DumpEBPFMap returns all the entries of the bpf map with mapID,
+// each entry holds the raw bytes of "key" and "value"
+func DumpEBPFMap(mapID uint32) ([]map[string][]byte, error) {
+	m, err := ebpf.NewMapFromID(ebpf.MapID(mapID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open map %d: %v", mapID, err)
+	}
+	defer m.Close()
+
+	var (
+		entries []map[string][]byte
+		prev    interface{}
+	)
+	for {
+		key, err := m.NextKeyBytes(prev)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get next key of map %d: %v", mapID, err)
+		}
+		if key == nil {
+			break
+		}
+		prev = key
+
+		value, err := m.LookupBytes(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup key %x in map %d: %v", key, mapID, err)
+		}
+		// the entry was deleted during the iteration
+		if value == nil {
+			continue
+		}
+		entries = append(entries, map[string][]byte{
+			"key":   key,
+			"value": value,
+		})
+	}
+	return entries, nil
+}
+
+// BPFMapEntry is a raw key and value of a bpf map
+type BPFMapEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// GetBPFMapID returns the id of the bpf map referenced by fd. Unlike the fd,
+// the id stays valid across restarts of the process as long as the map is alive.
+func GetBPFMapID(fd int) (uint32, error) {
+	dup, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to dup map fd %d: %v", fd, err)
+	}
+	m, err := ebpf.NewMapFromFD(dup)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open map fd %d: %v", fd, err)
+	}
+	defer m.Close()
+
+	info, err := m.Info()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get info of map fd %d: %v", fd, err)
+	}
+	id, ok := info.ID()
+	if !ok {
+		return 0, fmt.Errorf("map id of fd %d is not supported by the kernel", fd)
+	}
+	return uint32(id), nil
+}
+
+// OpenBPFMapByID returns a new fd of the bpf map with id, the caller owns the fd
+func OpenBPFMapByID(id uint32) (int, error) {
+	m, err := ebpf.NewMapFromID(ebpf.MapID(id))
+	if err != nil {
+		return -1, fmt.Errorf("failed to open map %d: %v", id, err)
+	}
+	defer m.Close()
+
+	fd, err := unix.FcntlInt(uintptr(m.FD()), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to dup fd of map %d: %v", id, err)
+	}
+	return fd, nil
+}
+
+// BPFMapUpdater updates the configuration map of a tc program at runtime
+type BPFMapUpdater struct {
+	MapID uint32
+}
+
+func (u BPFMapUpdater) open() (*ebpf.Map, error) {
+	m, err := ebpf.NewMapFromID(ebpf.MapID(u.MapID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open map %d: %v", u.MapID, err)
+	}
+	return m, nil
+}
+
+// Persist adds the map id of u to the bpf map ids of state, the map must still exist
+func (u BPFMapUpdater) Persist(state *netnsapi.NetnsEnrollmentState) error {
+	fd, err := OpenBPFMapByID(u.MapID)
+	if err != nil {
+		return err
+	}
+	unix.Close(fd)
+
+	if !slices.Contains(state.BpfMapIds, u.MapID) {
+		state.BpfMapIds = append(state.BpfMapIds, u.MapID)
+	}
+	return nil
+}
+
+// Restore makes u update the map with id, a map id persisted before a restart. It fails
+// if the map is gone, e.g. because its tc programs have been detached in the meantime.
+func (u *BPFMapUpdater) Restore(id uint32) error {
+	fd, err := OpenBPFMapByID(id)
+	if err != nil {
+		return fmt.Errorf("failed to restore map updater: %v", err)
+	}
+	unix.Close(fd)
+
+	u.MapID = id
+	return nil
+}
+
+// UpdateEntry creates or updates key in the map
+func (u BPFMapUpdater) UpdateEntry(key, value []byte) error {
+	m, err := u.open()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err = m.Update(key, value, ebpf.UpdateAny); err != nil {
+		return fmt.Errorf("failed to update key %x in map %d: %v", key, u.MapID, err)
+	}
+	return nil
+}
+
+// DeleteEntry deletes key from the map
+func (u BPFMapUpdater) DeleteEntry(key []byte) error {
+	m, err := u.open()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err = m.Delete(key); err != nil {
+		return fmt.Errorf("failed to delete key %x in map %d: %w", key, u.MapID, err)
+	}
+	return nil
+}
+
+// packBatch copies each of the values of size bytes into a slice of byte arrays,
+// which is the layout expected by the batch syscalls.
+func packBatch(values [][]byte, size int) (interface{}, error) {
+	batch := reflect.MakeSlice(reflect.SliceOf(reflect.ArrayOf(size, reflect.TypeOf(byte(0)))), len(values), len(values))
+	for i, value := range values {
+		if len(value) != size {
+			return nil, fmt.Errorf("%x has size %d, expected %d", value, len(value), size)
+		}
+		reflect.Copy(batch.Index(i), reflect.ValueOf(value))
+	}
+	return batch.Interface(), nil
+}
+
+// BatchUpdate updates all the entries with a single BPF_MAP_UPDATE_BATCH syscall,
+// it falls back to updating the entries one by one if the kernel does not support it.
+func (u BPFMapUpdater) BatchUpdate(entries []BPFMapEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	m, err := u.open()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	keys := make([][]byte, 0, len(entries))
+	values := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+		values = append(values, entry.Value)
+	}
+	keyBatch, err := packBatch(keys, int(m.KeySize()))
+	if err != nil {
+		return fmt.Errorf("invalid key for map %d: %v", u.MapID, err)
+	}
+	valueBatch, err := packBatch(values, int(m.ValueSize()))
+	if err != nil {
+		return fmt.Errorf("invalid value for map %d: %v", u.MapID, err)
+	}
+
+	_, err = m.BatchUpdate(keyBatch, valueBatch, nil)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ebpf.ErrNotSupported) {
+		return fmt.Errorf("failed to batch update map %d: %v", u.MapID, err)
+	}
+
+	log.Debugf("batch update not supported by map %d, updating entries one by one", u.MapID)
+	for _, entry := range entries {
+		if err = m.Update(entry.Key, entry.Value, ebpf.UpdateAny); err != nil {
+			return fmt.Errorf("failed to update key %x in map %d: %v", entry.Key, u.MapID, err)
+		}
+	}
+	return nil
+}
+
+// ipSetKeySize is the size of the lpm trie key of IPSetBPFMap,
+// struct { __u32 prefixlen; __u8 addr[16]; }
+const ipSetKeySize = 4 + net.IPv6len
+
+// IPSetBPFMap is an allowlist of cidrs stored in the bpf lpm trie map MapFD. IPv4 cidrs are
+// stored as IPv4-mapped IPv6 cidrs, so that both families are looked up in the same map.
+type IPSetBPFMap struct {
+	MapFD int
+}
+
+func (s IPSetBPFMap) open() (*ebpf.Map, error) {
+	dup, err := unix.FcntlInt(uintptr(s.MapFD), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dup map fd %d: %v", s.MapFD, err)
+	}
+	m, err := ebpf.NewMapFromFD(dup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open map fd %d: %v", s.MapFD, err)
+	}
+	if m.Type() != ebpf.LPMTrie || m.KeySize() != ipSetKeySize {
+		m.Close()
+		return nil, fmt.Errorf("map fd %d is not an lpm trie with %d bytes keys", s.MapFD, ipSetKeySize)
+	}
+	return m, nil
+}
+
+// ipSetKey returns the lpm trie key of cidr, the prefix length is in host byte order
+// and the address in network byte order as expected by the kernel.
+func ipSetKey(cidr *net.IPNet) ([]byte, error) {
+	if cidr == nil {
+		return nil, errors.New("cidr is nil")
+	}
+	ones, bits := cidr.Mask.Size()
+	ip := cidr.IP.Mask(cidr.Mask)
+	switch {
+	case bits == 8*net.IPv4len && ip.To4() != nil:
+		ones += 8 * (net.IPv6len - net.IPv4len)
+	case bits == 8*net.IPv6len:
+	default:
+		return nil, fmt.Errorf("invalid cidr %v", cidr)
+	}
+
+	key := binary.NativeEndian.AppendUint32(make([]byte, 0, ipSetKeySize), uint32(ones))
+	return append(key, ip.To16()...), nil
+}
+
+// ipSetCIDR is the reverse of ipSetKey
+func ipSetCIDR(key []byte) *net.IPNet {
+	ones := int(binary.NativeEndian.Uint32(key))
+	ip := net.IP(slices.Clone(key[4:]))
+	if v4 := ip.To4(); v4 != nil && ones >= 8*(net.IPv6len-net.IPv4len) {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(ones-8*(net.IPv6len-net.IPv4len), 8*net.IPv4len)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 8*net.IPv6len)}
+}
+
+func (s IPSetBPFMap) update(m *ebpf.Map, key []byte) error {
+	value := make([]byte, m.ValueSize())
+	if len(value) > 0 {
+		value[0] = 1
+	}
+	return m.Update(key, value, ebpf.UpdateAny)
+}
+
+// AddCIDR adds cidr to the set
+func (s IPSetBPFMap) AddCIDR(cidr *net.IPNet) error {
+	key, err := ipSetKey(cidr)
+	if err != nil {
+		return err
+	}
+	m, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err = s.update(m, key); err != nil {
+		return fmt.Errorf("failed to add %v to map fd %d: %v", cidr, s.MapFD, err)
+	}
+	return nil
+}
+
+// RemoveCIDR removes cidr from the set, ebpf.ErrKeyNotExist is wrapped if it is not in the set
+func (s IPSetBPFMap) RemoveCIDR(cidr *net.IPNet) error {
+	key, err := ipSetKey(cidr)
+	if err != nil {
+		return err
+	}
+	m, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if err = m.Delete(key); err != nil {
+		return fmt.Errorf("failed to remove %v from map fd %d: %w", cidr, s.MapFD, err)
+	}
+	return nil
+}
+
+// ContainsCIDR reports whether cidr is covered by a cidr of the set, which is the
+// longest prefix match done by the tc programs.
+func (s IPSetBPFMap) ContainsCIDR(cidr *net.IPNet) (bool, error) {
+	key, err := ipSetKey(cidr)
+	if err != nil {
+		return false, err
+	}
+	m, err := s.open()
+	if err != nil {
+		return false, err
+	}
+	defer m.Close()
+
+	// the value is nil if no cidr matches
+	value, err := m.LookupBytes(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to lookup %v in map fd %d: %v", cidr, s.MapFD, err)
+	}
+	return value != nil, nil
+}
+
+// Sync makes the set hold exactly the desired cidrs
+func (s IPSetBPFMap) Sync(desired []*net.IPNet) error {
+	want := make(map[string][]byte, len(desired))
+	for _, cidr := range desired {
+		key, err := ipSetKey(cidr)
+		if err != nil {
+			return err
+		}
+		want[string(key)] = key
+	}
+
+	m, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	var stale [][]byte
+	key := make([]byte, ipSetKeySize)
+	iter := m.Iterate()
+	var value []byte
+	for iter.Next(&key, &value) {
+		if _, ok := want[string(key)]; ok {
+			delete(want, string(key))
+		} else {
+			stale = append(stale, slices.Clone(key))
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to iterate map fd %d: %v", s.MapFD, err)
+	}
+
+	var errs []error
+	for _, key := range stale {
+		if err := m.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			errs = append(errs, fmt.Errorf("failed to remove %v from map fd %d: %v", ipSetCIDR(key), s.MapFD, err))
+		}
+	}
+	for _, key := range want {
+		if err := s.update(m, key); err != nil {
+			errs = append(errs, fmt.Errorf("failed to add %v to map fd %d: %v", ipSetCIDR(key), s.MapFD, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// InterfaceAnnotationsPinPath is where the map holding the interface annotations is pinned,
+// the map is keyed by interface index and holds the name of the interface and its annotations
+// encoded as json. Interface indexes are only unique inside a netns, so only the links of the
+// host netns should be annotated.
+const InterfaceAnnotationsPinPath = constants.BpfFsPath + "/kmesh/iface_annotations"
+
+const (
+	interfaceAnnotationsMaxEntries = 4096
+	interfaceAnnotationsValueSize  = 1024
+)
+
+// interfaceAnnotationsPinPath can be replaced in tests
+var interfaceAnnotationsPinPath = InterfaceAnnotationsPinPath
+
+// interfaceAnnotations is the map holding the interface annotations, it is opened once
+var interfaceAnnotations struct {
+	mu sync.Mutex
+	m  *ebpf.Map
+}
+
+// interfaceAnnotationsEntry is the value of the interface annotations map. The name tells an
+// entry of the link from one left by a deleted link whose index was reused.
+type interfaceAnnotationsEntry struct {
+	Name        string            `json:"name"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// openInterfaceAnnotationsMap returns the interface annotations map, it is nil if the map is
+// not pinned and create is false. The map is created and pinned only for the writers.
+func openInterfaceAnnotationsMap(create bool) (*ebpf.Map, error) {
+	interfaceAnnotations.mu.Lock()
+	defer interfaceAnnotations.mu.Unlock()
+	if interfaceAnnotations.m != nil {
+		return interfaceAnnotations.m, nil
+	}
+
+	m, err := ebpf.LoadPinnedMap(interfaceAnnotationsPinPath, nil)
+	if err == nil {
+		interfaceAnnotations.m = m
+		return m, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load map %s: %v", interfaceAnnotationsPinPath, err)
+	}
+	if !create {
+		return nil, nil
+	}
+
+	if err = os.MkdirAll(filepath.Dir(interfaceAnnotationsPinPath), 0750); err != nil {
+		return nil, err
+	}
+	m, err = ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "km_iface_annot",
+		Type:       ebpf.Hash,
+		KeySize:    4,
+		ValueSize:  interfaceAnnotationsValueSize,
+		MaxEntries: interfaceAnnotationsMaxEntries,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create interface annotations map: %v", err)
+	}
+	if err = m.Pin(interfaceAnnotationsPinPath); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("failed to pin map %s: %v", interfaceAnnotationsPinPath, err)
+	}
+	interfaceAnnotations.m = m
+	return m, nil
+}
+
+func interfaceAnnotationsKey(index int) []byte {
+	return binary.NativeEndian.AppendUint32(nil, uint32(index))
+}
+
+// lookupInterfaceAnnotations returns the annotations of the interface name of index, they are
+// empty if the entry of index belongs to another interface
+func lookupInterfaceAnnotations(m *ebpf.Map, index int, name string) (map[string]string, error) {
+	entry, err := lookupInterfaceAnnotationsEntry(m, index)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Name != name || entry.Annotations == nil {
+		return make(map[string]string), nil
+	}
+	return entry.Annotations, nil
+}
+
+func lookupInterfaceAnnotationsEntry(m *ebpf.Map, index int) (interfaceAnnotationsEntry, error) {
+	var entry interfaceAnnotationsEntry
+	value, err := m.LookupBytes(interfaceAnnotationsKey(index))
+	if err != nil || value == nil {
+		return entry, err
+	}
+	if err = json.Unmarshal(bytes.TrimRight(value, "\x00"), &entry); err != nil {
+		return entry, fmt.Errorf("failed to decode annotations: %v", err)
+	}
+	return entry, nil
+}
+
+// AnnotateInterface merges annotations into the annotations of link,
+// an annotation with an empty value is removed.
+func AnnotateInterface(link netlink.Link, annotations map[string]string) error {
+	m, err := openInterfaceAnnotationsMap(true)
+	if err != nil {
+		return err
+	}
+
+	attrs := link.Attrs()
+	merged, err := lookupInterfaceAnnotations(m, attrs.Index, attrs.Name)
+	if err != nil {
+		return fmt.Errorf("failed to read annotations of interface %v: %v", attrs.Name, err)
+	}
+	for k, v := range annotations {
+		if v == "" {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+
+	key := interfaceAnnotationsKey(attrs.Index)
+	if len(merged) == 0 {
+		if err = m.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to delete annotations of interface %v: %v", attrs.Name, err)
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(interfaceAnnotationsEntry{Name: attrs.Name, Annotations: merged})
+	if err != nil {
+		return err
+	}
+	if len(data) > interfaceAnnotationsValueSize {
+		return fmt.Errorf("annotations of interface %v exceed %d bytes", attrs.Name, interfaceAnnotationsValueSize)
+	}
+	value := make([]byte, interfaceAnnotationsValueSize)
+	copy(value, data)
+	if err = m.Update(key, value, ebpf.UpdateAny); err != nil {
+		return fmt.Errorf("failed to write annotations of interface %v: %v", attrs.Name, err)
+	}
+	return nil
+}
+
+// ReadInterfaceAnnotations returns the annotations of link, it is empty if link is not annotated
+func ReadInterfaceAnnotations(link netlink.Link) (map[string]string, error) {
+	m, err := openInterfaceAnnotationsMap(false)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return make(map[string]string), nil
+	}
+
+	attrs := link.Attrs()
+	annotations, err := lookupInterfaceAnnotations(m, attrs.Index, attrs.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read annotations of interface %v: %v", attrs.Name, err)
+	}
+	return annotations, nil
+}
+
+// ClearInterfaceAnnotations removes all the annotations of link
+func ClearInterfaceAnnotations(link netlink.Link) error {
+	return clearInterfaceAnnotations(link.Attrs().Index, link.Attrs().Name)
+}
+
+// clearInterfaceAnnotations removes the entry of index if it belongs to the interface name
+func clearInterfaceAnnotations(index int, name string) error {
+	m, err := openInterfaceAnnotationsMap(false)
+	if err != nil || m == nil {
+		return err
+	}
+	entry, err := lookupInterfaceAnnotationsEntry(m, index)
+	if err != nil {
+		return fmt.Errorf("failed to read annotations of interface %v: %v", name, err)
+	}
+	if entry.Name != name {
+		return nil
+	}
+	if err = m.Delete(interfaceAnnotationsKey(index)); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("failed to delete annotations of interface %v: %v", name, err)
+	}
+	return nil
+}
+
+// ClearInterfaceAnnotationsOnDelete removes the annotations of the interfaces deleted, as
+// reported by watch, until ctx is done. The index of a deleted interface may be reused by the
+// next one created.
+func ClearInterfaceAnnotationsOnDelete(ctx context.Context, watch InterfaceEventWatcher) error {
+	events, err := watch(ctx)
+	if err != nil {
+		return err
+	}
+	for event := range events {
+		if !event.Deleted {
+			continue
+		}
+		if err := clearInterfaceAnnotations(event.Index, event.Name); err != nil {
+			log.Warnf("failed to clear annotations of deleted interface %v: %v", event.Name, err)
+		}
+	}
+	return nil
+}
+
+const (
+	icmpEchoRequest     = 8
+	icmpEchoReply       = 0
+	icmpDstUnreach      = 3
+	icmpFragNeeded      = 4
+	icmpHeaderLen       = 8
+	ipv4MinHeaderLen    = 20
+	mtuProbeTimeout     = time.Second
+	mtuProbeMaxAttempts = 8
+)
+
+// ErrMTUTooSmall is returned by MTUProbe if the path cannot carry packets of the required size
+type ErrMTUTooSmall struct {
+	Actual   int
+	Required int
+}
+
+func (e *ErrMTUTooSmall) Error() string {
+	return fmt.Sprintf("path mtu %d is smaller than the required %d", e.Actual, e.Required)
+}
+
+// mtuProbeSocket is a raw icmp socket connected to the probe target
+type mtuProbeSocket interface {
+	Send(b []byte) error
+	// Recv returns an ip packet, including the ip header
+	Recv(b []byte, timeout time.Duration) (int, error)
+	PathMTU() (int, error)
+	Close() error
+}
+
+// MTUProbe sends an icmp echo request of targetMTU bytes with the DF bit set through link
+// to its ipv4 gateway, and checks that it is answered without the need to fragment it.
+// It must be called in the netns of link.
+func MTUProbe(link netlink.Link, targetMTU int) error {
+	if targetMTU < ipv4MinHeaderLen+icmpHeaderLen {
+		return fmt.Errorf("invalid target mtu %d", targetMTU)
+	}
+	if mtu := link.Attrs().MTU; mtu > 0 && mtu < targetMTU {
+		return &ErrMTUTooSmall{Actual: mtu, Required: targetMTU}
+	}
+
+	sock, err := newRawMTUProbeSocket(link)
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+
+	id, seq := uint16(os.Getpid()), uint16(time.Now().UnixNano())
+	if err = sock.Send(newICMPEcho(id, seq, targetMTU-ipv4MinHeaderLen)); err != nil {
+		if errors.Is(err, unix.EMSGSIZE) {
+			mtu, mtuErr := sock.PathMTU()
+			if mtuErr != nil {
+				return fmt.Errorf("failed to get path mtu of interface %v: %v", link.Attrs().Name, mtuErr)
+			}
+			return &ErrMTUTooSmall{Actual: mtu, Required: targetMTU}
+		}
+		return fmt.Errorf("failed to send mtu probe through interface %v: %v", link.Attrs().Name, err)
+	}
+
+	buf := make([]byte, targetMTU)
+	deadline := time.Now().Add(mtuProbeTimeout)
+	// a raw socket receives all the icmp packets, skip the unrelated ones
+	for i := 0; i < mtuProbeMaxAttempts; i++ {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			break
+		}
+		n, err := sock.Recv(buf, timeout)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) {
+				break
+			}
+			return fmt.Errorf("failed to receive mtu probe reply on interface %v: %v", link.Attrs().Name, err)
+		}
+		reply, ok := parseIPv4Payload(buf[:n])
+		if !ok || len(reply) < icmpHeaderLen {
+			continue
+		}
+		switch {
+		case reply[0] == icmpEchoReply && isICMPEcho(reply, id, seq):
+			return nil
+		case reply[0] == icmpDstUnreach && reply[1] == icmpFragNeeded:
+			// the original datagram follows the icmp header
+			if orig, ok := parseIPv4Payload(reply[icmpHeaderLen:]); ok && isICMPEcho(orig, id, seq) {
+				return &ErrMTUTooSmall{Actual: int(binary.BigEndian.Uint16(reply[6:8])), Required: targetMTU}
+			}
+		}
+	}
+	return fmt.Errorf("no reply to the mtu probe through interface %v", link.Attrs().Name)
+}
+
+// newICMPEcho returns an icmp echo request of size bytes
+func newICMPEcho(id, seq uint16, size int) []byte {
+	b := make([]byte, size)
+	b[0] = icmpEchoRequest
+	binary.BigEndian.PutUint16(b[4:6], id)
+	binary.BigEndian.PutUint16(b[6:8], seq)
+	binary.BigEndian.PutUint16(b[2:4], icmpChecksum(b))
+	return b
+}
+
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func isICMPEcho(b []byte, id, seq uint16) bool {
+	return len(b) >= icmpHeaderLen && binary.BigEndian.Uint16(b[4:6]) == id && binary.BigEndian.Uint16(b[6:8]) == seq
+}
+
+// parseIPv4Payload returns the payload of an ipv4 icmp packet
+func parseIPv4Payload(b []byte) ([]byte, bool) {
+	if len(b) < ipv4MinHeaderLen || b[0]>>4 != 4 || b[9] != unix.IPPROTO_ICMP {
+		return nil, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if ihl < ipv4MinHeaderLen || len(b) < ihl {
+		return nil, false
+	}
+	return b[ihl:], true
+}
+
+// mtuProbeTarget returns the ipv4 gateway of the routes through link
+func mtuProbeTarget(link netlink.Link) (net.IP, error) {
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes of interface %v: %v", link.Attrs().Name, err)
+	}
+	for _, route := range routes {
+		if route.Gw != nil {
+			return route.Gw, nil
+		}
+	}
+	return nil, fmt.Errorf("no ipv4 gateway through interface %v", link.Attrs().Name)
+}
+
+type rawMTUProbeSocket struct {
+	fd int
+}
+
+func newRawMTUProbeSocket(link netlink.Link) (mtuProbeSocket, error) {
+	target, err := mtuProbeTarget(link)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_ICMP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create raw socket: %v", err)
+	}
+	sock := &rawMTUProbeSocket{fd: fd}
+
+	if err = unix.BindToDevice(fd, link.Attrs().Name); err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("failed to bind raw socket to interface %v: %v", link.Attrs().Name, err)
+	}
+	// set the DF bit and fail the packets larger than the known path mtu
+	if err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO); err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("failed to set IP_MTU_DISCOVER: %v", err)
+	}
+	addr := &unix.SockaddrInet4{}
+	copy(addr.Addr[:], target.To4())
+	if err = unix.Connect(fd, addr); err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("failed to connect raw socket to %v: %v", target, err)
+	}
+	return sock, nil
+}
+
+func (s *rawMTUProbeSocket) Send(b []byte) error {
+	_, err := unix.Write(s.fd, b)
+	return err
+}
+
+func (s *rawMTUProbeSocket) Recv(b []byte, timeout time.Duration) (int, error) {
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(s.fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return 0, err
+	}
+	return unix.Read(s.fd, b)
+}
+
+func (s *rawMTUProbeSocket) PathMTU() (int, error) {
+	return unix.GetsockoptInt(s.fd, unix.IPPROTO_IP, unix.IP_MTU)
+}
+
+func (s *rawMTUProbeSocket) Close() error {
+	return unix.Close(s.fd)
+}
+
+// PolicyClass selects the tc programs attached to an interface
+type PolicyClass string
+
+const (
+	// PolicyClassMesh gets the full mesh interception
+	PolicyClassMesh PolicyClass = "mesh"
+	// PolicyClassObservability only gets the observability programs
+	PolicyClassObservability PolicyClass = "observability"
+)
+
+// InterfaceClassesConfigMapKey is the key of the ConfigMap data holding the classification rules
+const InterfaceClassesConfigMapKey = "interface-classes"
+
+var ErrInterfaceNotClassified = errors.New("no classification rule matches the interface")
+
+// ClassificationRule matches an interface if all of its set conditions match
+type ClassificationRule struct {
+	Class PolicyClass `json:"class"`
+	// NamePattern is a shell pattern matching the interface name, e.g. "eth*"
+	NamePattern string `json:"namePattern,omitempty"`
+	// MACPrefix matches the leading bytes of the hardware address, e.g. "02:42"
+	MACPrefix string `json:"macPrefix,omitempty"`
+	// CIDR matches if any address of the interface is in it
+	CIDR string `json:"cidr,omitempty"`
+
+	macPrefix net.HardwareAddr
+	ipNet     *net.IPNet
+}
+
+func (r *ClassificationRule) compile() error {
+	if r.Class == "" {
+		return fmt.Errorf("class of classification rule is empty")
+	}
+	if r.NamePattern == "" && r.MACPrefix == "" && r.CIDR == "" {
+		return fmt.Errorf("classification rule of class %s has no condition", r.Class)
+	}
+	if r.NamePattern != "" {
+		if _, err := filepath.Match(r.NamePattern, ""); err != nil {
+			return fmt.Errorf("invalid name pattern %q: %v", r.NamePattern, err)
+		}
+	}
+	r.macPrefix = nil
+	if r.MACPrefix != "" {
+		for _, part := range strings.Split(r.MACPrefix, ":") {
+			b, err := strconv.ParseUint(part, 16, 8)
+			if err != nil || len(part) != 2 {
+				return fmt.Errorf("invalid mac prefix %q", r.MACPrefix)
+			}
+			r.macPrefix = append(r.macPrefix, byte(b))
+		}
+	}
+	r.ipNet = nil
+	if r.CIDR != "" {
+		_, ipNet, err := net.ParseCIDR(r.CIDR)
+		if err != nil {
+			return fmt.Errorf("invalid cidr %q: %v", r.CIDR, err)
+		}
+		r.ipNet = ipNet
+	}
+	return nil
+}
+
+func (r *ClassificationRule) match(link netlink.Link) (bool, error) {
+	attrs := link.Attrs()
+	if r.NamePattern != "" {
+		if ok, _ := filepath.Match(r.NamePattern, attrs.Name); !ok {
+			return false, nil
+		}
+	}
+	if r.macPrefix != nil && !bytes.HasPrefix(attrs.HardwareAddr, r.macPrefix) {
+		return false, nil
+	}
+	if r.ipNet != nil {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return false, fmt.Errorf("failed to list addresses of interface %v: %v", attrs.Name, err)
+		}
+		return slices.ContainsFunc(addrs, func(addr netlink.Addr) bool {
+			return addr.IPNet != nil && r.ipNet.Contains(addr.IP)
+		}), nil
+	}
+	return true, nil
+}
+
+// InterfaceClassifier maps interfaces to policy classes, the first matching rule wins
+type InterfaceClassifier struct {
+	mu    sync.RWMutex
+	rules []ClassificationRule
+}
+
+func NewInterfaceClassifier(rules ...ClassificationRule) (*InterfaceClassifier, error) {
+	c := &InterfaceClassifier{}
+	if err := c.setRules(rules); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *InterfaceClassifier) setRules(rules []ClassificationRule) error {
+	rules = slices.Clone(rules)
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("invalid classification rule %d: %v", i, err)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = rules
+	return nil
+}
+
+// Classify returns the class of the first rule matching link,
+// ErrInterfaceNotClassified is returned if no rule matches.
+func (c *InterfaceClassifier) Classify(link netlink.Link) (PolicyClass, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for i := range c.rules {
+		ok, err := c.rules[i].match(link)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return c.rules[i].Class, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %v", ErrInterfaceNotClassified, link.Attrs().Name)
+}
+
+// LoadFromConfigMap replaces the rules with the yaml list of rules
+// under InterfaceClassesConfigMapKey in cm. The rules are kept on error.
+func (c *InterfaceClassifier) LoadFromConfigMap(cm *corev1.ConfigMap) error {
+	data, ok := cm.Data[InterfaceClassesConfigMapKey]
+	if !ok {
+		return fmt.Errorf("configmap %s/%s has no %s", cm.Namespace, cm.Name, InterfaceClassesConfigMapKey)
+	}
+	var rules []ClassificationRule
+	if err := yaml.Unmarshal([]byte(data), &rules); err != nil {
+		return fmt.Errorf("failed to parse %s of configmap %s/%s: %v", InterfaceClassesConfigMapKey, cm.Namespace, cm.Name, err)
+	}
+	return c.setRules(rules)
+}
+
+// BPFFeatureSet is a bitfield of the bpf features supported by the kernel
+type BPFFeatureSet uint32
+
+const (
+	// BPFFeatureTC is the support of sched_cls programs attached by tc
+	BPFFeatureTC BPFFeatureSet = 1 << iota
+	// BPFFeatureMultiProg is the support of attaching multiple programs to a hook by tcx
+	BPFFeatureMultiProg
+	BPFFeatureMapInMap
+	BPFFeatureRingBuf
+	BPFFeaturePerCPUMap
+)
+
+var bpfFeatureNames = []struct {
+	feature BPFFeatureSet
+	name    string
+}{
+	{BPFFeatureTC, "tc"},
+	{BPFFeatureMultiProg, "multi-prog"},
+	{BPFFeatureMapInMap, "map-in-map"},
+	{BPFFeatureRingBuf, "ringbuf"},
+	{BPFFeaturePerCPUMap, "percpu-map"},
+}
+
+// Has returns true if all the features of f are in s
+func (s BPFFeatureSet) Has(f BPFFeatureSet) bool {
+	return s&f == f
+}
+
+func (s BPFFeatureSet) String() string {
+	var names []string
+	for _, n := range bpfFeatureNames {
+		if s.Has(n.feature) {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// probeBPFFeature returns nil if the kernel supports feature
+func probeBPFFeature(feature BPFFeatureSet) error {
+	switch feature {
+	case BPFFeatureTC:
+		return features.HaveProgramType(ebpf.SchedCLS)
+	case BPFFeatureMultiProg:
+		return probeTCX()
+	case BPFFeatureMapInMap:
+		return features.HaveMapType(ebpf.HashOfMaps)
+	case BPFFeatureRingBuf:
+		return features.HaveMapType(ebpf.RingBuf)
+	case BPFFeaturePerCPUMap:
+		return features.HaveMapType(ebpf.PerCPUHash)
+	}
+	return fmt.Errorf("unknown bpf feature %d: %w", feature, ebpf.ErrNotSupported)
+}
+
+func probeTCX() error {
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:    ebpf.SchedCLS,
+		License: "Dual BSD/GPL",
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R0, 0),
+			asm.Return(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+
+	// attaching to an interface that does not exist fails with ENODEV if tcx is supported
+	l, err := ebpflink.AttachTCX(ebpflink.TCXOptions{Interface: math.MaxInt32, Program: prog, Attach: ebpf.AttachTCXIngress})
+	if errors.Is(err, ebpf.ErrNotSupported) {
+		return err
+	}
+	if err == nil {
+		return l.Close()
+	}
+	return nil
+}
+
+// bpfFeaturesCache holds the probe results, the features probed and which of them are supported
+var bpfFeaturesCache struct {
+	mu        sync.Mutex
+	probed    BPFFeatureSet
+	supported BPFFeatureSet
+}
+
+// VerifyKernelBPFFeatures returns the bpf features supported by the kernel. Each feature is
+// probed once, the later calls return the cached result. A feature whose probe fails other
+// than with ebpf.ErrNotSupported, e.g. for lack of permission or memlock, is reported as
+// supported.
+func VerifyKernelBPFFeatures() BPFFeatureSet {
+	var all BPFFeatureSet
+	for _, n := range bpfFeatureNames {
+		all |= n.feature
+	}
+	return probeBPFFeatures(all)
+}
+
+// probeBPFFeatures returns the features of set supported by the kernel, the features of set
+// not probed yet are probed, see VerifyKernelBPFFeatures
+func probeBPFFeatures(set BPFFeatureSet) BPFFeatureSet {
+	bpfFeaturesCache.mu.Lock()
+	defer bpfFeaturesCache.mu.Unlock()
+
+	for _, n := range bpfFeatureNames {
+		if !set.Has(n.feature) || bpfFeaturesCache.probed.Has(n.feature) {
+			continue
+		}
+		err := probeBPFFeature(n.feature)
+		bpfFeaturesCache.probed |= n.feature
+		switch {
+		case err == nil:
+			bpfFeaturesCache.supported |= n.feature
+		case errors.Is(err, ebpf.ErrNotSupported):
+			log.Infof("bpf feature %s is not supported by the kernel", n.name)
+		default:
+			bpfFeaturesCache.supported |= n.feature
+			log.Warnf("failed to probe bpf feature %s, it is assumed to be supported: %v", n.name, err)
+		}
+	}
+	return bpfFeaturesCache.supported & set
+}
+
+// requireBPFFeatures returns an error if the kernel does not support all the features of
+// required, only the features of required are probed
+func requireBPFFeatures(required BPFFeatureSet) error {
+	if missing := required &^ probeBPFFeatures(required); missing != 0 {
+		return fmt.Errorf("bpf features %s are not supported by the kernel", missing)
+	}
+	return nil
+}
+
+// DefaultBPFProgramPinner pins programs in the bpffs mounted at constants.BpfFsPath
+var DefaultBPFProgramPinner = BPFProgramPinner{BaseDir: constants.BpfFsPath}
+
+// BPFProgramPinner pins bpf programs at <BaseDir>/kmesh/<program_type>/<name>, where
+// program_type is the lower case type of the program, e.g. schedcls. Names are unique
+// across the program types. The pins of pkg/bpf keep their paths, e.g. sendmsg_prog under
+// the bpffs path of the mode: a restarted or upgraded daemon loads them from there, and the
+// pin of cgroup_sockops_prog is a link, which BPFProgramPinner does not pin.
+type BPFProgramPinner struct {
+	BaseDir string
+}
+
+func (p BPFProgramPinner) dir() string {
+	return filepath.Join(p.BaseDir, "kmesh")
+}
+
+// ProgramPath returns the pin path of a program of progType named name
+func (p BPFProgramPinner) ProgramPath(progType ebpf.ProgramType, name string) string {
+	return filepath.Join(p.dir(), strings.ToLower(progType.String()), name)
+}
+
+func validatePinName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("invalid pinned program name %q", name)
+	}
+	return nil
+}
+
+// lookup returns the pin path of the program named name
+func (p BPFProgramPinner) lookup(name string) (string, error) {
+	if err := validatePinName(name); err != nil {
+		return "", err
+	}
+	types, err := os.ReadDir(p.dir())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	for _, t := range types {
+		if !t.IsDir() {
+			continue
+		}
+		path := filepath.Join(p.dir(), t.Name(), name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("program %s is not pinned in %s: %w", name, p.dir(), os.ErrNotExist)
+}
+
+// PinProgram pins the program referenced by fd as name and returns the pin path
+func (p BPFProgramPinner) PinProgram(name string, fd int) (string, error) {
+	if err := validatePinName(name); err != nil {
+		return "", err
+	}
+	prog, err := programFromFd(fd)
+	if err != nil {
+		return "", err
+	}
+	defer prog.Close()
+
+	path := p.ProgramPath(prog.Type(), name)
+	if existing, err := p.lookup(name); err == nil && existing != path {
+		return "", fmt.Errorf("program %s is already pinned at %s", name, existing)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return "", fmt.Errorf("failed to create pin dir of program %s: %v", name, err)
+	}
+	if err := prog.Pin(path); err != nil {
+		return "", fmt.Errorf("failed to pin program %s: %v", name, err)
+	}
+	return path, nil
+}
+
+// UnpinProgram removes the pin of the program named name
+func (p BPFProgramPinner) UnpinProgram(name string) error {
+	path, err := p.lookup(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// OpenPinnedProgram returns a new fd of the program pinned as name, the caller must close it
+func (p BPFProgramPinner) OpenPinnedProgram(name string) (int, error) {
+	path, err := p.lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	prog, err := ebpf.LoadPinnedProgram(path, nil)
+	if err != nil {
+		return -1, fmt.Errorf("failed to load pinned program %s: %v", path, err)
+	}
+	defer prog.Close()
+
+	// the fd of prog is closed with prog
+	fd, err := unix.FcntlInt(uintptr(prog.FD()), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to dup fd of pinned program %s: %v", path, err)
+	}
+	return fd, nil
+}
+
+// ListPinnedPrograms returns the sorted names of the pinned programs
+func (p BPFProgramPinner) ListPinnedPrograms() ([]string, error) {
+	types, err := os.ReadDir(p.dir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, t := range types {
+		if !t.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(p.dir(), t.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// BackpressureStrategy is what RateLimitedTCAttach does with the operations exceeding the rate limit
+type BackpressureStrategy int
+
+const (
+	// BackpressureDrop fails the operation with ErrTCAttachRateLimited
+	BackpressureDrop BackpressureStrategy = iota
+	// BackpressureBlock waits until the operation is allowed
+	BackpressureBlock
+	// BackpressureDefer queues the operation and runs it in the background once allowed,
+	// the operation fails with ErrTCAttachRateLimited if the queue is full. The fd of a
+	// queued operation is duplicated, the caller may close its own.
+	BackpressureDefer
+)
+
+// ErrTCAttachRateLimited is returned for the operations dropped by RateLimitedTCAttach
+var ErrTCAttachRateLimited = errors.New("tc operation is rate limited")
+
+// ErrTCAttachClosed is returned for the operations of a RateLimitedTCAttach closed already
+var ErrTCAttachClosed = errors.New("tc operation on a closed rate limited attach")
+
+// DefaultTCAttachQueueSize is the number of operations RateLimitedTCAttach defers at most
+const DefaultTCAttachQueueSize = 1024
+
+type tcAttachOp struct {
+	link     netlink.Link
+	fd       int
+	mode     int
+	priority uint16
+}
+
+// RateLimitedTCAttach wraps ManageTCProgramByFd with a rate limit, so that an event storm
+// such as a mass pod restart does not overload the netlink socket of the kernel.
+type RateLimitedTCAttach struct {
+	limiter  *rate.Limiter
+	strategy BackpressureStrategy
+	queue    chan tcAttachOp
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	// mu orders the operations of BackpressureDefer, none runs while pending ones are
+	// queued or running. It is held across an operation run directly, so the operations
+	// of BackpressureDefer run one at a time whatever their link.
+	mu      sync.Mutex
+	pending int
+	closed  bool
+
+	// manage is ManageTCProgramByFd, it can be replaced in tests
+	manage func(link netlink.Link, tcFd int, mode int, priority uint16) error
+}
+
+// NewRateLimitedTCAttach allows limit operations per second with bursts of burst operations.
+// Close must be called to stop the background worker of BackpressureDefer.
+func NewRateLimitedTCAttach(limit rate.Limit, burst int, strategy BackpressureStrategy) *RateLimitedTCAttach {
+	a := &RateLimitedTCAttach{
+		limiter:  rate.NewLimiter(limit, burst),
+		strategy: strategy,
+		manage:   ManageTCProgramByFd,
+	}
+	if strategy == BackpressureDefer {
+		var ctx context.Context
+		ctx, a.cancel = context.WithCancel(context.Background())
+		a.queue = make(chan tcAttachOp, DefaultTCAttachQueueSize)
+		a.done = make(chan struct{})
+		go a.runDeferred(ctx)
+	}
+	return a
+}
+
+// ManageTCProgramByFd is ManageTCProgramByFd under the rate limit. With BackpressureDefer,
+// nil is returned for a queued operation and its error is only logged, the operations run in
+// the order they are called. ErrTCAttachClosed is returned once a is closed.
+func (a *RateLimitedTCAttach) ManageTCProgramByFd(link netlink.Link, tcFd int, mode int, priority uint16) error {
+	if a.strategy != BackpressureDefer && a.isClosed() {
+		return ErrTCAttachClosed
+	}
+	switch a.strategy {
+	case BackpressureBlock:
+		if err := a.limiter.Wait(context.Background()); err != nil {
+			return fmt.Errorf("%w: %v", ErrTCAttachRateLimited, err)
+		}
+	case BackpressureDefer:
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.closed {
+			// the worker is gone, a queued operation would never run
+			return ErrTCAttachClosed
+		}
+		if a.pending > 0 || !a.limiter.Allow() {
+			return a.enqueue(link, tcFd, mode, priority)
+		}
+	default:
+		if !a.limiter.Allow() {
+			return ErrTCAttachRateLimited
+		}
+	}
+	return a.manage(link, tcFd, mode, priority)
+}
+
+// enqueue defers the operation on a duplicate of tcFd, a.mu must be held
+func (a *RateLimitedTCAttach) enqueue(link netlink.Link, tcFd int, mode int, priority uint16) error {
+	fd, err := unix.FcntlInt(uintptr(tcFd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to duplicate program fd %d: %v", tcFd, err)
+	}
+	select {
+	case a.queue <- tcAttachOp{link: link, fd: fd, mode: mode, priority: priority}:
+		a.pending++
+		return nil
+	default:
+		unix.Close(fd)
+		return ErrTCAttachRateLimited
+	}
+}
+
+func (a *RateLimitedTCAttach) runDeferred(ctx context.Context) {
+	defer close(a.done)
+	for {
+		select {
+		case <-ctx.Done():
+			a.dropDeferred()
+			return
+		case op := <-a.queue:
+			if err := a.limiter.Wait(ctx); err != nil {
+				log.Warnf("drop deferred tc operation on interface %v: %v", op.link.Attrs().Name, err)
+			} else if err := a.manage(op.link, op.fd, op.mode, op.priority); err != nil {
+				log.Errorf("deferred tc operation on interface %v failed: %v", op.link.Attrs().Name, err)
+			}
+			unix.Close(op.fd)
+			a.mu.Lock()
+			a.pending--
+			a.mu.Unlock()
+		}
+	}
+}
+
+// dropDeferred closes the fds of the operations left in the queue
+func (a *RateLimitedTCAttach) dropDeferred() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pending > 0 {
+		log.Warnf("drop %d deferred tc operations", a.pending)
+	}
+	for ; a.pending > 0; a.pending-- {
+		unix.Close((<-a.queue).fd)
+	}
+}
+
+func (a *RateLimitedTCAttach) isClosed() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closed
+}
+
+// Close stops the background worker, the deferred operations not run yet are dropped and
+// the later operations fail with ErrTCAttachClosed
+func (a *RateLimitedTCAttach) Close() {
+	a.mu.Lock()
+	a.closed = true
+	a.mu.Unlock()
+	if a.cancel == nil {
+		return
+	}
+	a.cancel()
+	<-a.done
+}
+
+// TCOp is an operation of BatchManageTCPrograms
+type TCOp struct {
+	Link      netlink.Link
+	Fd        int
+	Direction TCDirection
+	// Mode is constants.TC_ATTACH or constants.TC_DETACH
+	Mode int
+	// Priority is the priority of the filter, DefaultTCFilterPriority if 0
+	Priority uint16
+}
+
+// TCOpResult is the result of the TCOp of the same index
+type TCOpResult struct {
+	Op  TCOp
+	Err error
+}
+
+type batchTCOptions struct {
+	parallelism int
+}
+
+// BatchTCOption configures BatchManageTCPrograms
+type BatchTCOption func(*batchTCOptions)
+
+// WithBatchParallelism makes BatchManageTCPrograms run up to n operations at the same time,
+// the operations run one after the other by default
+func WithBatchParallelism(n int) BatchTCOption {
+	return func(o *batchTCOptions) {
+		o.parallelism = n
+	}
+}
+
+// BatchManageTCPrograms runs all the ops, even if some of them fail, and returns their results
+// in the order of ops, so that the callers can retry only the failed ones.
+func BatchManageTCPrograms(ops []TCOp, opts ...BatchTCOption) []TCOpResult {
+	o := batchTCOptions{parallelism: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	parallelism := max(1, min(o.parallelism, len(ops)))
+
+	results := make([]TCOpResult, len(ops))
+	run := func(i int) {
+		op := ops[i]
+		results[i] = TCOpResult{Op: op, Err: manageTCProgramByFd(op.Link, op.Fd, op.Direction, op.Mode, op.Priority)}
+	}
+	if parallelism == 1 {
+		for i := range ops {
+			run(i)
+		}
+		return results
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range parallelism {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				run(i)
+			}
+		}()
+	}
+	for i := range ops {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// FailedTCOps returns the ops of the failed results, e.g. to retry them with BatchManageTCPrograms
+func FailedTCOps(results []TCOpResult) []TCOp {
+	var ops []TCOp
+	for _, r := range results {
+		if r.Err != nil {
+			ops = append(ops, r.Op)
+		}
+	}
+	return ops
+}
+
+// InterfaceStats are the traffic counters of an interface
+type InterfaceStats struct {
+	RxPackets uint64
+	TxPackets uint64
+	RxBytes   uint64
+	TxBytes   uint64
+	RxDropped uint64
+	TxDropped uint64
+}
+
+// GetInterfaceRxStats returns the current traffic counters of link, e.g. to capture
+// a baseline before attaching the tc programs.
+func GetInterfaceRxStats(link netlink.Link) (*InterfaceStats, error) {
+	// the statistics of link are the ones of when it was listed
+	current, err := netlink.LinkByIndex(link.Attrs().Index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface %v: %v", link.Attrs().Name, err)
+	}
+	s := current.Attrs().Statistics
+	if s == nil {
+		return nil, fmt.Errorf("no statistics reported for interface %v", link.Attrs().Name)
+	}
+	return &InterfaceStats{
+		RxPackets: s.RxPackets,
+		TxPackets: s.TxPackets,
+		RxBytes:   s.RxBytes,
+		TxBytes:   s.TxBytes,
+		RxDropped: s.RxDropped,
+		TxDropped: s.TxDropped,
+	}, nil
+}
+
+// DiffStats returns the traffic between before and after. A counter lower in after
+// has been reset, its value in after is taken as the delta.
+func DiffStats(before, after InterfaceStats) InterfaceStats {
+	delta := func(b, a uint64) uint64 {
+		if a < b {
+			return a
+		}
+		return a - b
+	}
+	return InterfaceStats{
+		RxPackets: delta(before.RxPackets, after.RxPackets),
+		TxPackets: delta(before.TxPackets, after.TxPackets),
+		RxBytes:   delta(before.RxBytes, after.RxBytes),
+		TxBytes:   delta(before.TxBytes, after.TxBytes),
+		RxDropped: delta(before.RxDropped, after.RxDropped),
+		TxDropped: delta(before.TxDropped, after.TxDropped),
+	}
+}
+
+// TCLinkPair are the two ends of the veth of a pod, PodLink is in the netns at PodNetns,
+// the current netns if empty, and HostLink in the current netns
+type TCLinkPair struct {
+	PodLink  netlink.Link
+	HostLink netlink.Link
+	PodNetns string
+}
+
+// tcPairAttachment is a program of the pair, fd is negative for no program
+type tcPairAttachment struct {
+	pod       bool
+	direction TCDirection
+	fd        int
+}
+
+func (p TCLinkPair) attachments(podIngressFD, podEgressFD, hostIngressFD, hostEgressFD int) []tcPairAttachment {
+	return []tcPairAttachment{
+		{pod: true, direction: constants.TC_INGRESS, fd: podIngressFD},
+		{pod: true, direction: constants.TC_EGRESS, fd: podEgressFD},
+		{pod: false, direction: constants.TC_INGRESS, fd: hostIngressFD},
+		{pod: false, direction: constants.TC_EGRESS, fd: hostEgressFD},
+	}
+}
+
+// manage attaches or detaches the program of a to its link
+func (p TCLinkPair) manage(a tcPairAttachment, mode int) error {
+	if !a.pod {
+		return manageTCProgramByFd(p.HostLink, a.fd, a.direction, mode, 0)
+	}
+	if p.PodNetns == "" {
+		return manageTCProgramByFd(p.PodLink, a.fd, a.direction, mode, 0)
+	}
+	return ns.WithNetNSPath(p.PodNetns, func(_ ns.NetNS) error {
+		return manageTCProgramByFd(p.PodLink, a.fd, a.direction, mode, 0)
+	})
+}
+
+// AttachProgramPair attaches the programs to both links, a negative fd attaches no program
+// to the direction. The pair is attached as a whole: if an attachment fails, the programs
+// attached before are detached.
+func (p TCLinkPair) AttachProgramPair(podIngressFD, podEgressFD, hostIngressFD, hostEgressFD int) error {
+	if p.PodLink == nil || p.HostLink == nil {
+		return errors.New("link of tc link pair is nil")
+	}
+
+	var attached []tcPairAttachment
+	for _, a := range p.attachments(podIngressFD, podEgressFD, hostIngressFD, hostEgressFD) {
+		if a.fd < 0 {
+			continue
+		}
+		if err := p.manage(a, constants.TC_ATTACH); err != nil {
+			errs := []error{fmt.Errorf("failed to attach %s of pair %v/%v: %v", a.direction, p.PodLink.Attrs().Name, p.HostLink.Attrs().Name, err)}
+			for i := len(attached) - 1; i >= 0; i-- {
+				if err := p.manage(attached[i], constants.TC_DETACH); err != nil {
+					errs = append(errs, fmt.Errorf("failed to roll back: %v", err))
+				}
+			}
+			return errors.Join(errs...)
+		}
+		attached = append(attached, a)
+	}
+	return nil
+}
+
+// DetachProgramPair detaches the programs attached by AttachProgramPair from both links,
+// the programs or links already removed are skipped.
+func (p TCLinkPair) DetachProgramPair() error {
+	if p.PodLink == nil || p.HostLink == nil {
+		return errors.New("link of tc link pair is nil")
+	}
+
+	var errs []error
+	for _, a := range p.attachments(0, 0, 0, 0) {
+		if err := p.manage(a, constants.TC_DETACH); err != nil && !IsSafeDetachError(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,887 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+// TCDirection is the clsact hook a tc filter is attached to,
+// either constants.TC_INGRESS or constants.TC_EGRESS
+type TCDirection int
+
+func (d TCDirection) String() string {
+	switch d {
+	case constants.TC_INGRESS:
+		return "ingress"
+	case constants.TC_EGRESS:
+		return "egress"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(d))
+	}
+}
+
+func (d TCDirection) parent() (uint32, error) {
+	switch d {
+	case constants.TC_INGRESS:
+		return netlink.HANDLE_MIN_INGRESS, nil
+	case constants.TC_EGRESS:
+		return netlink.HANDLE_MIN_EGRESS, nil
+	default:
+		return 0, fmt.Errorf("invalid tc direction %d", int(d))
+	}
+}
+
+// TCFilterPriorities are the priorities of the filters installed by TCManager. A direct-action
+// bpf filter ends the classification, so the drop and rate filters must run before it.
+type TCFilterPriorities struct {
+	DropV4  uint16 `json:"dropV4"`
+	DropV6  uint16 `json:"dropV6"`
+	Rate    uint16 `json:"rate"`
+	Program uint16 `json:"program"`
+}
+
+// DefaultTCFilterPriorities are the filter priorities of NewTCManager
+var DefaultTCFilterPriorities = TCFilterPriorities{DropV4: 10, DropV6: 11, Rate: 20, Program: 30}
+
+func (p TCFilterPriorities) validate() error {
+	if p.DropV4 == 0 || p.DropV6 == 0 || p.Rate == 0 || p.Program == 0 {
+		return fmt.Errorf("tc filter priorities %+v must not be 0", p)
+	}
+	if p.DropV4 == p.DropV6 || max(p.DropV4, p.DropV6) >= p.Rate || p.Rate >= p.Program {
+		return fmt.Errorf("tc filter priorities %+v must order the drop filters before the rate filter before the program", p)
+	}
+	return nil
+}
+
+const (
+	tcPolicyRateHandle = 1
+	tcPolicyProgHandle = 1
+	// DefaultTCRateLimitBurstBytes is the default bucket size of the rate limit police action
+	DefaultTCRateLimitBurstBytes = 64 * 1024
+)
+
+// TCPassthroughProgramName is the pinned name of the passthrough program used by TCManager.Pause
+const TCPassthroughProgramName = "tc_passthrough"
+
+// TCPolicy describes the desired tc state of one direction of a link
+type TCPolicy struct {
+	Link      netlink.Link
+	Direction TCDirection
+	// ProgramName is the name of a loaded bpf program attached as a direct-action filter,
+	// empty means no program
+	ProgramName string
+	// RateLimitBps limits the traffic in bytes per second, zero means no limit
+	RateLimitBps uint64
+	// DropPorts are the tcp/udp destination ports whose packets are dropped
+	DropPorts []uint16
+}
+
+type TCChangeType string
+
+const (
+	TCChangeAttachProgram   TCChangeType = "AttachProgram"
+	TCChangeDetachProgram   TCChangeType = "DetachProgram"
+	TCChangeSetRateLimit    TCChangeType = "SetRateLimit"
+	TCChangeRemoveRateLimit TCChangeType = "RemoveRateLimit"
+	TCChangeAddDropPort     TCChangeType = "AddDropPort"
+	TCChangeRemoveDropPort  TCChangeType = "RemoveDropPort"
+	// TCChangeAddQdisc is only reported by DryRun, ApplyPolicy always replaces the qdisc
+	TCChangeAddQdisc TCChangeType = "AddQdisc"
+)
+
+// TCChange is a single step needed to move a link from one TCPolicy to another
+type TCChange struct {
+	Type      TCChangeType
+	Link      netlink.Link
+	Direction TCDirection
+	Detail    string
+
+	// value carries the program name, rate or port of the change
+	value any
+}
+
+func (c TCChange) String() string {
+	name := "<nil>"
+	if c.Link != nil {
+		name = c.Link.Attrs().Name
+	}
+	return fmt.Sprintf("%s %s/%s: %s", c.Type, name, c.Direction, c.Detail)
+}
+
+type tcKey struct {
+	ifIndex   int
+	direction TCDirection
+}
+
+// TCAttachment records a bpf program attached by TCManager
+type TCAttachment struct {
+	LinkName    string
+	LinkIndex   int
+	Direction   TCDirection
+	ProgramName string
+	// ProgramID is the kernel id of the attached program
+	ProgramID uint32
+	// ProgFd is the fd of the attached program, it stays open
+	// until the program is detached so that it can be attached again
+	ProgFd   int
+	Handle   uint32
+	Priority uint16
+	// Paused is true when the program is replaced by the passthrough program
+	Paused bool
+
+	prog *ebpf.Program
+}
+
+// TCManager manages the tc filters of links from TCPolicy intents
+type TCManager struct {
+	// Pinner holds the program pinned as TCPassthroughProgramName that
+	// replaces the attached programs while a link is paused
+	Pinner BPFProgramPinner
+	// RequiredVersion rejects the programs incompatible with it, the zero version accepts all
+	RequiredVersion TCProgramVersion
+	// Priorities of the filters installed, the filters of other priorities are left untouched
+	Priorities TCFilterPriorities
+	// RateLimitBurstBytes is the bucket size of the rate limits
+	RateLimitBurstBytes uint32
+	// MaxRateLimitBps rejects the policies limiting the rate above it
+	MaxRateLimitBps uint64
+	// ReplaceNewerPrograms replaces the installed program even if it was
+	// loaded after the proposed one
+	ReplaceNewerPrograms bool
+
+	mu       sync.Mutex
+	policies map[tcKey]TCPolicy
+	// attachments is the registry of the attached programs
+	attachments map[tcKey]*TCAttachment
+	stats       tcManagerStats
+	// logger logs the netlink operations, nothing is logged if nil
+	logger *slog.Logger
+}
+
+func NewTCManager() *TCManager {
+	return &TCManager{
+		Pinner:              DefaultBPFProgramPinner,
+		Priorities:          DefaultTCFilterPriorities,
+		RateLimitBurstBytes: DefaultTCRateLimitBurstBytes,
+		MaxRateLimitBps:     math.MaxUint32,
+		policies:            make(map[tcKey]TCPolicy),
+		attachments:         make(map[tcKey]*TCAttachment),
+	}
+}
+
+// WithLogger makes m log each netlink operation at debug level with l, with the link, the
+// direction and the kernel error code of the failed ones. m is returned for chaining.
+func (m *TCManager) WithLogger(l *slog.Logger) *TCManager {
+	m.logger = l
+	return m
+}
+
+// logNetlinkOp logs the netlink operation op on the direction of link
+func (m *TCManager) logNetlinkOp(op string, link netlink.Link, direction TCDirection, err error, attrs ...slog.Attr) {
+	if m.logger == nil {
+		return
+	}
+	attrs = append([]slog.Attr{
+		slog.String("op", op),
+		slog.String("link", link.Attrs().Name),
+		slog.Int("ifindex", link.Attrs().Index),
+		slog.String("direction", direction.String()),
+	}, attrs...)
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+		var errno unix.Errno
+		if errors.As(err, &errno) {
+			attrs = append(attrs, slog.String("errno", unix.ErrnoName(errno)))
+		}
+	}
+	m.logger.LogAttrs(context.Background(), slog.LevelDebug, "netlink operation", attrs...)
+}
+
+func filterAttrs(filter netlink.Filter) []slog.Attr {
+	return []slog.Attr{
+		slog.String("filter", filter.Type()),
+		slog.Int("priority", int(filter.Attrs().Priority)),
+		slog.String("handle", netlink.HandleStr(filter.Attrs().Handle)),
+	}
+}
+
+func (m *TCManager) filterReplace(link netlink.Link, direction TCDirection, filter netlink.Filter) error {
+	err := netlink.FilterReplace(filter)
+	m.logNetlinkOp("filter replace", link, direction, err, filterAttrs(filter)...)
+	return err
+}
+
+func (m *TCManager) filterDel(link netlink.Link, direction TCDirection, filter netlink.Filter) error {
+	err := netlink.FilterDel(filter)
+	m.logNetlinkOp("filter delete", link, direction, err, filterAttrs(filter)...)
+	return err
+}
+
+func (m *TCManager) filterList(link netlink.Link, direction TCDirection, parent uint32) ([]netlink.Filter, error) {
+	filters, err := netlink.FilterList(link, parent)
+	m.logNetlinkOp("filter list", link, direction, err, slog.Int("filters", len(filters)))
+	return filters, err
+}
+
+// DiffPolicy returns the changes needed to move from current to desired.
+// Link and Direction of the changes are taken from desired.
+func DiffPolicy(current, desired TCPolicy) []TCChange {
+	var changes []TCChange
+	newChange := func(t TCChangeType, value any, detail string) TCChange {
+		return TCChange{
+			Type:      t,
+			Link:      desired.Link,
+			Direction: desired.Direction,
+			Detail:    detail,
+			value:     value,
+		}
+	}
+
+	if current.ProgramName != desired.ProgramName {
+		if current.ProgramName != "" {
+			changes = append(changes, newChange(TCChangeDetachProgram, current.ProgramName,
+				fmt.Sprintf("detach program %s", current.ProgramName)))
+		}
+		if desired.ProgramName != "" {
+			changes = append(changes, newChange(TCChangeAttachProgram, desired.ProgramName,
+				fmt.Sprintf("attach program %s", desired.ProgramName)))
+		}
+	}
+
+	if current.RateLimitBps != desired.RateLimitBps {
+		if desired.RateLimitBps == 0 {
+			changes = append(changes, newChange(TCChangeRemoveRateLimit, uint64(0),
+				"remove rate limit"))
+		} else {
+			changes = append(changes, newChange(TCChangeSetRateLimit, desired.RateLimitBps,
+				fmt.Sprintf("set rate limit to %d Bps", desired.RateLimitBps)))
+		}
+	}
+
+	for _, port := range current.DropPorts {
+		if !slices.Contains(desired.DropPorts, port) {
+			changes = append(changes, newChange(TCChangeRemoveDropPort, port,
+				fmt.Sprintf("stop dropping port %d", port)))
+		}
+	}
+	for _, port := range desired.DropPorts {
+		if !slices.Contains(current.DropPorts, port) {
+			changes = append(changes, newChange(TCChangeAddDropPort, port,
+				fmt.Sprintf("drop port %d", port)))
+		}
+	}
+
+	return changes
+}
+
+func (m *TCManager) validateTCPolicy(policy TCPolicy) error {
+	if policy.Link == nil {
+		return fmt.Errorf("link of tc policy is nil")
+	}
+	if policy.ProgramName != "" {
+		if err := requireBPFFeatures(BPFFeatureTC); err != nil {
+			return err
+		}
+	}
+	if _, err := policy.Direction.parent(); err != nil {
+		return err
+	}
+	if policy.RateLimitBps > min(m.MaxRateLimitBps, math.MaxUint32) {
+		return fmt.Errorf("rate limit %d Bps exceeds the maximum %d", policy.RateLimitBps, min(m.MaxRateLimitBps, math.MaxUint32))
+	}
+	for _, port := range policy.DropPorts {
+		if port == 0 {
+			return fmt.Errorf("invalid drop port 0")
+		}
+	}
+	return nil
+}
+
+// currentPolicy returns the recorded policy of key, the policy of a link
+// direction not managed by m yet is read from its filters.
+func (m *TCManager) currentPolicy(key tcKey, link netlink.Link) (TCPolicy, error) {
+	if a, ok := m.attachments[key]; ok && a.Paused {
+		return TCPolicy{}, fmt.Errorf("%s of interface %v is paused", key.direction, link.Attrs().Name)
+	}
+	if current, ok := m.policies[key]; ok {
+		return current, nil
+	}
+	return m.readTCPolicy(link, key.direction)
+}
+
+// readTCPolicy builds the policy of the link direction from the filters installed by TCManager
+func (m *TCManager) readTCPolicy(link netlink.Link, direction TCDirection) (TCPolicy, error) {
+	policy := TCPolicy{Link: link, Direction: direction}
+	ok, err := hasClsactQdisc(link)
+	if err != nil || !ok {
+		return policy, err
+	}
+	parent, err := direction.parent()
+	if err != nil {
+		return policy, err
+	}
+	filters, err := m.filterList(link, direction, parent)
+	if err != nil {
+		return policy, fmt.Errorf("failed to list filter for interface %v: %v", link.Attrs().Name, err)
+	}
+
+	for _, filter := range filters {
+		attrs := filter.Attrs()
+		switch f := filter.(type) {
+		case *netlink.BpfFilter:
+			if attrs.Priority == m.Priorities.Program && attrs.Handle == tcPolicyProgHandle {
+				policy.ProgramName = strings.TrimSuffix(f.Name, "-"+link.Attrs().Name)
+			}
+		case *netlink.MatchAll:
+			if attrs.Priority != m.Priorities.Rate {
+				continue
+			}
+			for _, action := range f.Actions {
+				if police, ok := action.(*netlink.PoliceAction); ok {
+					policy.RateLimitBps = uint64(police.Rate)
+				}
+			}
+		case *netlink.Flower:
+			if attrs.Priority != m.Priorities.DropV4 && attrs.Priority != m.Priorities.DropV6 {
+				continue
+			}
+			if f.DestPort != 0 && !slices.Contains(policy.DropPorts, f.DestPort) {
+				policy.DropPorts = append(policy.DropPorts, f.DestPort)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// ApplyPolicy makes the tc state of policy.Link match the policy.
+// Changes applied before a failure are kept and recorded, so calling
+// ApplyPolicy again only retries the remaining ones. The program is not replaced
+// if the installed one was loaded after the proposed one.
+func (m *TCManager) ApplyPolicy(policy TCPolicy) error {
+	if err := m.validateTCPolicy(policy); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := tcKey{ifIndex: policy.Link.Attrs().Index, direction: policy.Direction}
+	current, err := m.currentPolicy(key, policy.Link)
+	if err != nil {
+		return err
+	}
+	changes := m.skipOlderProgram(key, DiffPolicy(current, policy))
+	if len(changes) == 0 {
+		return nil
+	}
+	// check before the installed program is detached
+	if err := m.checkProgramVersion(changes); err != nil {
+		return err
+	}
+
+	changed, err := ReplaceQdiscIfChanged(policy.Link)
+	m.logNetlinkOp("qdisc replace", policy.Link, policy.Direction, err, slog.Bool("changed", changed))
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		if err := m.applyTCChange(key, change); err != nil {
+			m.setPolicy(key, current)
+			return fmt.Errorf("failed to %s: %v", change, err)
+		}
+		current = recordTCChange(current, change)
+	}
+	m.setPolicy(key, current)
+	return nil
+}
+
+// setPolicy records the policy applied to key and counts its filters
+func (m *TCManager) setPolicy(key tcKey, policy TCPolicy) {
+	m.stats.activeFilters.Add(policyFilterCount(policy) - policyFilterCount(m.policies[key]))
+	m.policies[key] = policy
+}
+
+// DryRun returns the changes ApplyPolicy would make for policy without
+// changing the kernel state.
+func (m *TCManager) DryRun(policy TCPolicy) ([]TCChange, error) {
+	if err := m.validateTCPolicy(policy); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := tcKey{ifIndex: policy.Link.Attrs().Index, direction: policy.Direction}
+	current, err := m.currentPolicy(key, policy.Link)
+	if err != nil {
+		return nil, err
+	}
+	changes := m.skipOlderProgram(key, DiffPolicy(current, policy))
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	for _, change := range changes {
+		if change.Type != TCChangeAttachProgram {
+			continue
+		}
+		prog, err := GetProgramByName(change.value.(string))
+		if err != nil {
+			return nil, fmt.Errorf("failed to %s: %v", change, err)
+		}
+		prog.Close()
+	}
+
+	ok, err := hasClsactQdisc(policy.Link)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		changes = append([]TCChange{{
+			Type:      TCChangeAddQdisc,
+			Link:      policy.Link,
+			Direction: policy.Direction,
+			Detail:    "add clsact qdisc",
+		}}, changes...)
+	}
+	return changes, nil
+}
+
+// recordTCChange returns the policy after the change is applied to it
+func recordTCChange(policy TCPolicy, change TCChange) TCPolicy {
+	policy.Link = change.Link
+	policy.Direction = change.Direction
+	switch change.Type {
+	case TCChangeAttachProgram:
+		policy.ProgramName = change.value.(string)
+	case TCChangeDetachProgram:
+		policy.ProgramName = ""
+	case TCChangeSetRateLimit, TCChangeRemoveRateLimit:
+		policy.RateLimitBps = change.value.(uint64)
+	case TCChangeAddDropPort:
+		policy.DropPorts = append(slices.Clone(policy.DropPorts), change.value.(uint16))
+	case TCChangeRemoveDropPort:
+		port := change.value.(uint16)
+		policy.DropPorts = slices.DeleteFunc(slices.Clone(policy.DropPorts), func(p uint16) bool {
+			return p == port
+		})
+	}
+	return policy
+}
+
+func (m *TCManager) applyTCChange(key tcKey, change TCChange) error {
+	parent, err := change.Direction.parent()
+	if err != nil {
+		return err
+	}
+	link := change.Link
+
+	switch change.Type {
+	case TCChangeAttachProgram:
+		start := time.Now()
+		name := change.value.(string)
+		prog, err := GetProgramByName(name)
+		if err != nil {
+			m.stats.recordAttach(start, err)
+			return err
+		}
+		err = m.filterReplace(link, change.Direction, m.newPolicyProgFilter(link, parent, prog.FD(), name))
+		m.stats.recordAttach(start, err)
+		if err != nil {
+			prog.Close()
+			return err
+		}
+		m.recordAttachment(key, link, name, prog)
+		return nil
+	case TCChangeDetachProgram:
+		err := m.filterDel(link, change.Direction, m.newPolicyProgFilter(link, parent, 0, change.value.(string)))
+		m.stats.recordDetach(err)
+		if err != nil {
+			return err
+		}
+		m.removeAttachment(key)
+		return nil
+	case TCChangeSetRateLimit:
+		return m.filterReplace(link, change.Direction, m.newPolicyRateFilter(link, parent, change.value.(uint64)))
+	case TCChangeRemoveRateLimit:
+		return m.filterDel(link, change.Direction, m.newPolicyRateFilter(link, parent, 0))
+	case TCChangeAddDropPort:
+		for _, filter := range m.newPolicyDropFilters(link, parent, change.value.(uint16)) {
+			if err := m.filterReplace(link, change.Direction, filter); err != nil {
+				return err
+			}
+		}
+		return nil
+	case TCChangeRemoveDropPort:
+		for _, filter := range m.newPolicyDropFilters(link, parent, change.value.(uint16)) {
+			if err := m.filterDel(link, change.Direction, filter); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown tc change type %s", change.Type)
+	}
+}
+
+// skipOlderProgram drops the program changes if the proposed program
+// was loaded before the installed one
+func (m *TCManager) skipOlderProgram(key tcKey, changes []TCChange) []TCChange {
+	a, ok := m.attachments[key]
+	if !ok || m.ReplaceNewerPrograms {
+		return changes
+	}
+	i := slices.IndexFunc(changes, func(c TCChange) bool {
+		return c.Type == TCChangeAttachProgram
+	})
+	if i < 0 {
+		return changes
+	}
+	name := changes[i].value.(string)
+	prog, err := GetProgramByName(name)
+	if err != nil {
+		// fail when applying the change
+		return changes
+	}
+	defer prog.Close()
+	if !isProgramNewer(a.ProgFd, prog.FD()) {
+		return changes
+	}
+
+	log.Infof("skip to attach %s to %s of interface %v, the installed %s is newer",
+		name, key.direction, a.LinkName, a.ProgramName)
+	return slices.DeleteFunc(changes, func(c TCChange) bool {
+		return c.Type == TCChangeAttachProgram || c.Type == TCChangeDetachProgram
+	})
+}
+
+// checkProgramVersion fails if the program attached by changes is incompatible with m.RequiredVersion
+func (m *TCManager) checkProgramVersion(changes []TCChange) error {
+	if m.RequiredVersion == (TCProgramVersion{}) {
+		return nil
+	}
+	i := slices.IndexFunc(changes, func(c TCChange) bool {
+		return c.Type == TCChangeAttachProgram
+	})
+	if i < 0 {
+		return nil
+	}
+	name := changes[i].value.(string)
+	prog, err := GetProgramByName(name)
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+
+	version, err := ReadProgramVersion(prog.FD())
+	if err != nil {
+		return fmt.Errorf("failed to read version of program %s: %v", name, err)
+	}
+	if !IsCompatible(version, m.RequiredVersion) {
+		return fmt.Errorf("program %s of version %s is incompatible with the required version %s", name, version, m.RequiredVersion)
+	}
+	return nil
+}
+
+// isProgramNewer reports whether the program of fd was loaded after the program of otherFd,
+// it is false if the load times are not available.
+func isProgramNewer(fd, otherFd int) bool {
+	loadTime, err := GetProgramLoadTime(fd)
+	if err != nil {
+		log.Debugf("%v", err)
+		return false
+	}
+	otherLoadTime, err := GetProgramLoadTime(otherFd)
+	if err != nil {
+		log.Debugf("%v", err)
+		return false
+	}
+	return loadTime.After(otherLoadTime)
+}
+
+func (m *TCManager) recordAttachment(key tcKey, link netlink.Link, name string, prog *ebpf.Program) {
+	m.removeAttachment(key)
+
+	var progID uint32
+	if info, err := prog.Info(); err == nil {
+		if id, ok := info.ID(); ok {
+			progID = uint32(id)
+		}
+	}
+	m.attachments[key] = &TCAttachment{
+		LinkName:    link.Attrs().Name,
+		LinkIndex:   link.Attrs().Index,
+		Direction:   key.direction,
+		ProgramName: name,
+		ProgramID:   progID,
+		ProgFd:      prog.FD(),
+		Handle:      tcPolicyProgHandle,
+		Priority:    m.Priorities.Program,
+		prog:        prog,
+	}
+}
+
+func (m *TCManager) removeAttachment(key tcKey) {
+	if a, ok := m.attachments[key]; ok {
+		a.prog.Close()
+		delete(m.attachments, key)
+	}
+}
+
+func (m *TCManager) newPolicyProgFilter(link netlink.Link, parent uint32, fd int, name string) *netlink.BpfFilter {
+	return &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Handle:    tcPolicyProgHandle,
+			Protocol:  unix.ETH_P_ALL,
+			Priority:  m.Priorities.Program,
+		},
+		Fd:           fd,
+		Name:         fmt.Sprintf("%s-%s", name, link.Attrs().Name),
+		DirectAction: true,
+	}
+}
+
+func (m *TCManager) newPolicyRateFilter(link netlink.Link, parent uint32, rateBps uint64) *netlink.MatchAll {
+	police := netlink.NewPoliceAction()
+	police.Rate = uint32(rateBps)
+	police.Burst = m.RateLimitBurstBytes
+	police.ExceedAction = netlink.TC_POLICE_SHOT
+	// continue with the next filter when the rate is not exceeded
+	police.NotExceedAction = netlink.TC_POLICE_UNSPEC
+
+	return &netlink.MatchAll{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Handle:    tcPolicyRateHandle,
+			Protocol:  unix.ETH_P_ALL,
+			Priority:  m.Priorities.Rate,
+		},
+		Actions: []netlink.Action{police},
+	}
+}
+
+// newPolicyDropFilters returns the flower filters dropping tcp and udp packets
+// of both ip families to the port
+func (m *TCManager) newPolicyDropFilters(link netlink.Link, parent uint32, port uint16) []netlink.Filter {
+	var filters []netlink.Filter
+	families := []struct {
+		ethType  uint16
+		priority uint16
+	}{
+		{unix.ETH_P_IP, m.Priorities.DropV4},
+		{unix.ETH_P_IPV6, m.Priorities.DropV6},
+	}
+	protos := []nl.IPProto{nl.IPPROTO_TCP, nl.IPPROTO_UDP}
+
+	for _, family := range families {
+		for i := range protos {
+			drop := &netlink.GenericAction{
+				ActionAttrs: netlink.ActionAttrs{Action: netlink.TC_ACT_SHOT},
+			}
+			filters = append(filters, &netlink.Flower{
+				FilterAttrs: netlink.FilterAttrs{
+					LinkIndex: link.Attrs().Index,
+					Parent:    parent,
+					// one handle per port and protocol, handle 0 is reserved
+					Handle:   (uint32(port)<<1 | uint32(i)) + 1,
+					Protocol: family.ethType,
+					Priority: family.priority,
+				},
+				EthType:  family.ethType,
+				IPProto:  &protos[i],
+				DestPort: port,
+				Actions:  []netlink.Action{drop},
+			})
+		}
+	}
+	return filters
+}
+
+// Pause replaces the programs attached to both directions of link with the
+// passthrough program, so traffic bypasses kmesh while the original programs
+// are kept in the registry for Resume.
+func (m *TCManager) Pause(link netlink.Link) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attachments := m.linkAttachments(link)
+	if len(attachments) == 0 {
+		return fmt.Errorf("no tc program is attached to interface %v", link.Attrs().Name)
+	}
+
+	fd, err := m.Pinner.OpenPinnedProgram(TCPassthroughProgramName)
+	if err != nil {
+		return fmt.Errorf("failed to load passthrough program: %v", err)
+	}
+	passthrough, err := ebpf.NewProgramFromFD(fd)
+	if err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to load passthrough program: %v", err)
+	}
+	// the filter holds its own reference of the program
+	defer passthrough.Close()
+
+	for _, a := range attachments {
+		if a.Paused {
+			continue
+		}
+		parent, _ := a.Direction.parent()
+		if err = m.filterReplace(link, a.Direction, m.newPolicyProgFilter(link, parent, passthrough.FD(), a.ProgramName)); err != nil {
+			return fmt.Errorf("failed to pause %s of interface %v: %v", a.Direction, link.Attrs().Name, err)
+		}
+		a.Paused = true
+	}
+	return nil
+}
+
+// Resume installs the original programs of link paused by Pause again
+func (m *TCManager) Resume(link netlink.Link) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attachments := m.linkAttachments(link)
+	if len(attachments) == 0 {
+		return fmt.Errorf("no tc program is attached to interface %v", link.Attrs().Name)
+	}
+
+	for _, a := range attachments {
+		if !a.Paused {
+			continue
+		}
+		parent, _ := a.Direction.parent()
+		if err := m.filterReplace(link, a.Direction, m.newPolicyProgFilter(link, parent, a.ProgFd, a.ProgramName)); err != nil {
+			return fmt.Errorf("failed to resume %s of interface %v: %v", a.Direction, link.Attrs().Name, err)
+		}
+		a.Paused = false
+	}
+	return nil
+}
+
+// IsPaused returns whether the program of the link direction is paused
+func (m *TCManager) IsPaused(link netlink.Link, direction TCDirection) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.attachments[tcKey{ifIndex: link.Attrs().Index, direction: direction}]
+	return ok && a.Paused
+}
+
+func (m *TCManager) linkAttachments(link netlink.Link) []*TCAttachment {
+	var res []*TCAttachment
+	for _, direction := range []TCDirection{constants.TC_INGRESS, constants.TC_EGRESS} {
+		if a, ok := m.attachments[tcKey{ifIndex: link.Attrs().Index, direction: direction}]; ok {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// Attachments returns a copy of the registry ordered by link index and direction
+func (m *TCManager) Attachments() []TCAttachment {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make([]TCAttachment, 0, len(m.attachments))
+	for _, a := range m.attachments {
+		res = append(res, *a)
+	}
+	slices.SortFunc(res, func(a, b TCAttachment) int {
+		if a.LinkIndex != b.LinkIndex {
+			return a.LinkIndex - b.LinkIndex
+		}
+		return int(a.Direction) - int(b.Direction)
+	})
+	return res
+}
+
+type forEachLinkOptions struct {
+	continueOnError bool
+}
+
+// ForEachLinkOption configures TCManager.ForEachLink
+type ForEachLinkOption func(*forEachLinkOptions)
+
+// ContinueOnError makes ForEachLink call fn for all the attachments and return the
+// errors of fn joined, instead of stopping at the first error.
+func ContinueOnError() ForEachLinkOption {
+	return func(o *forEachLinkOptions) {
+		o.continueOnError = true
+	}
+}
+
+// ForEachLink calls fn for each attachment of the registry, ordered by link index and
+// direction. The registry is not locked while fn runs, so fn may call the methods of m.
+// It stops and returns the first error of fn unless ContinueOnError is set.
+func (m *TCManager) ForEachLink(fn func(link netlink.Link, direction TCDirection, info TCAttachment) error, opts ...ForEachLinkOption) error {
+	var o forEachLinkOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	m.mu.Lock()
+	links := make(map[int]netlink.Link)
+	for key, policy := range m.policies {
+		if _, ok := m.attachments[key]; ok && policy.Link != nil {
+			links[key.ifIndex] = policy.Link
+		}
+	}
+	m.mu.Unlock()
+
+	visit := func(a TCAttachment) error {
+		link, ok := links[a.LinkIndex]
+		if !ok {
+			var err error
+			if link, err = netlink.LinkByIndex(a.LinkIndex); err != nil {
+				return fmt.Errorf("failed to get interface %s(%d): %v", a.LinkName, a.LinkIndex, err)
+			}
+		}
+		return fn(link, a.Direction, a)
+	}
+
+	var errs []error
+	for _, a := range m.Attachments() {
+		err := visit(a)
+		if err == nil {
+			continue
+		}
+		if !o.continueOnError {
+			return err
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Keys of the TCManagerConfig fields in a ConfigMap
+const (
+	TCConfigBPFFsPath            = "bpfFsPath"
+	TCConfigRequiredVersion      = "requiredVersion"
+	TCConfigDropV4Priority       = "dropV4Priority"
+	TCConfigDropV6Priority       = "dropV6Priority"
+	TCConfigRatePriority         = "ratePriority"
+	TCConfigProgramPriority      = "programPriority"
+	TCConfigRateLimitBurstBytes  = "rateLimitBurstBytes"
+	TCConfigMaxRateLimitBps      = "maxRateLimitBps"
+	TCConfigReplaceNewerPrograms = "replaceNewerPrograms"
+)
+
+// TCManagerConfig is the serializable configuration of a TCManager
+type TCManagerConfig struct {
+	// BPFFsPath is the bpffs of the pinned programs, see BPFProgramPinner.BaseDir
+	BPFFsPath            string             `json:"bpfFsPath"`
+	RequiredVersion      TCProgramVersion   `json:"requiredVersion"`
+	Priorities           TCFilterPriorities `json:"priorities"`
+	RateLimitBurstBytes  uint32             `json:"rateLimitBurstBytes"`
+	MaxRateLimitBps      uint64             `json:"maxRateLimitBps"`
+	ReplaceNewerPrograms bool               `json:"replaceNewerPrograms"`
+}
+
+// DefaultTCManagerConfig returns the configuration of NewTCManager
+func DefaultTCManagerConfig() TCManagerConfig {
+	return NewTCManager().Export()
+}
+
+// Validate returns an error if cfg cannot configure a TCManager
+func (cfg TCManagerConfig) Validate() error {
+	if cfg.BPFFsPath == "" {
+		return errors.New("bpffs path is empty")
+	}
+	if err := cfg.Priorities.validate(); err != nil {
+		return err
+	}
+	if cfg.RateLimitBurstBytes == 0 {
+		return errors.New("rate limit burst must not be 0")
+	}
+	if cfg.MaxRateLimitBps == 0 || cfg.MaxRateLimitBps > math.MaxUint32 {
+		return fmt.Errorf("maximum rate limit %d Bps is not in [1, %d]", cfg.MaxRateLimitBps, uint64(math.MaxUint32))
+	}
+	return nil
+}
+
+// Export returns the configuration of m, NewTCManagerFromConfig creates a manager configured alike
+func (m *TCManager) Export() TCManagerConfig {
+	return TCManagerConfig{
+		BPFFsPath:            m.Pinner.BaseDir,
+		RequiredVersion:      m.RequiredVersion,
+		Priorities:           m.Priorities,
+		RateLimitBurstBytes:  m.RateLimitBurstBytes,
+		MaxRateLimitBps:      m.MaxRateLimitBps,
+		ReplaceNewerPrograms: m.ReplaceNewerPrograms,
+	}
+}
+
+// NewTCManagerFromConfig creates a TCManager configured by cfg
+func NewTCManagerFromConfig(cfg TCManagerConfig) (*TCManager, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid tc manager config: %v", err)
+	}
+	m := NewTCManager()
+	m.Pinner = BPFProgramPinner{BaseDir: cfg.BPFFsPath}
+	m.RequiredVersion = cfg.RequiredVersion
+	m.Priorities = cfg.Priorities
+	m.RateLimitBurstBytes = cfg.RateLimitBurstBytes
+	m.MaxRateLimitBps = cfg.MaxRateLimitBps
+	m.ReplaceNewerPrograms = cfg.ReplaceNewerPrograms
+	return m, nil
+}
+
+// LoadConfigFromConfigMap reads the TCManagerConfig from the data of cm, keyed by the
+// TCConfig* constants. The keys missing keep the values of DefaultTCManagerConfig.
+func LoadConfigFromConfigMap(cm *corev1.ConfigMap) (*TCManagerConfig, error) {
+	if cm == nil {
+		return nil, errors.New("config map is nil")
+	}
+	cfg := DefaultTCManagerConfig()
+	priorities := map[string]*uint16{
+		TCConfigDropV4Priority:  &cfg.Priorities.DropV4,
+		TCConfigDropV6Priority:  &cfg.Priorities.DropV6,
+		TCConfigRatePriority:    &cfg.Priorities.Rate,
+		TCConfigProgramPriority: &cfg.Priorities.Program,
+	}
+
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		keys = append(keys, key)
+	}
+	// report the first invalid key in a stable order
+	slices.Sort(keys)
+	for _, key := range keys {
+		value := cm.Data[key]
+		var err error
+		switch key {
+		case TCConfigBPFFsPath:
+			cfg.BPFFsPath = value
+		case TCConfigRequiredVersion:
+			cfg.RequiredVersion, err = ParseTCProgramVersion(value)
+		case TCConfigDropV4Priority, TCConfigDropV6Priority, TCConfigRatePriority, TCConfigProgramPriority:
+			var priority uint64
+			priority, err = strconv.ParseUint(value, 10, 16)
+			*priorities[key] = uint16(priority)
+		case TCConfigRateLimitBurstBytes:
+			var burst uint64
+			burst, err = strconv.ParseUint(value, 10, 32)
+			cfg.RateLimitBurstBytes = uint32(burst)
+		case TCConfigMaxRateLimitBps:
+			cfg.MaxRateLimitBps, err = strconv.ParseUint(value, 10, 64)
+		case TCConfigReplaceNewerPrograms:
+			cfg.ReplaceNewerPrograms, err = strconv.ParseBool(value)
+		default:
+			err = errors.New("unknown key")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s of config map %s/%s: %v", key, cm.Namespace, cm.Name, err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid tc manager config of config map %s/%s: %v", cm.Namespace, cm.Name, err)
+	}
+	return &cfg, nil
+}
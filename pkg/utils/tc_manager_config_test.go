@@ -0,0 +1,209 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+func TestTCManagerConfigExport(t *testing.T) {
+	cfg := DefaultTCManagerConfig()
+	assert.Equal(t, TCManagerConfig{
+		BPFFsPath:           constants.BpfFsPath,
+		Priorities:          DefaultTCFilterPriorities,
+		RateLimitBurstBytes: DefaultTCRateLimitBurstBytes,
+		MaxRateLimitBps:     math.MaxUint32,
+	}, cfg)
+
+	cfg.BPFFsPath = "/tmp/bpffs"
+	cfg.RequiredVersion = TCProgramVersion{Major: 1, Minor: 2}
+	cfg.Priorities = TCFilterPriorities{DropV4: 100, DropV6: 101, Rate: 200, Program: 300}
+	cfg.RateLimitBurstBytes = 1024
+	cfg.MaxRateLimitBps = 1 << 20
+	cfg.ReplaceNewerPrograms = true
+
+	m, err := NewTCManagerFromConfig(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, BPFProgramPinner{BaseDir: "/tmp/bpffs"}, m.Pinner)
+	assert.Equal(t, cfg, m.Export())
+
+	data, err := json.Marshal(cfg)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"requiredVersion":"v1.2"`)
+	var decoded TCManagerConfig
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, cfg, decoded)
+
+	_, err = NewTCManagerFromConfig(TCManagerConfig{})
+	assert.ErrorContains(t, err, "invalid tc manager config")
+}
+
+func TestLoadConfigFromConfigMap(t *testing.T) {
+	defaults := DefaultTCManagerConfig()
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    func(cfg *TCManagerConfig)
+		wantErr string
+	}{
+		{
+			name: "empty config map",
+			want: func(cfg *TCManagerConfig) {},
+		},
+		{
+			name: TCConfigBPFFsPath,
+			data: map[string]string{TCConfigBPFFsPath: "/tmp/bpffs"},
+			want: func(cfg *TCManagerConfig) { cfg.BPFFsPath = "/tmp/bpffs" },
+		},
+		{
+			name:    "empty " + TCConfigBPFFsPath,
+			data:    map[string]string{TCConfigBPFFsPath: ""},
+			wantErr: "bpffs path is empty",
+		},
+		{
+			name: TCConfigRequiredVersion,
+			data: map[string]string{TCConfigRequiredVersion: "v1.2"},
+			want: func(cfg *TCManagerConfig) { cfg.RequiredVersion = TCProgramVersion{Major: 1, Minor: 2} },
+		},
+		{
+			name:    "invalid " + TCConfigRequiredVersion,
+			data:    map[string]string{TCConfigRequiredVersion: "1"},
+			wantErr: "invalid requiredVersion",
+		},
+		{
+			name: TCConfigDropV4Priority,
+			data: map[string]string{TCConfigDropV4Priority: "5"},
+			want: func(cfg *TCManagerConfig) { cfg.Priorities.DropV4 = 5 },
+		},
+		{
+			name: TCConfigDropV6Priority,
+			data: map[string]string{TCConfigDropV6Priority: "5"},
+			want: func(cfg *TCManagerConfig) { cfg.Priorities.DropV6 = 5 },
+		},
+		{
+			name: TCConfigRatePriority,
+			data: map[string]string{TCConfigRatePriority: "25"},
+			want: func(cfg *TCManagerConfig) { cfg.Priorities.Rate = 25 },
+		},
+		{
+			name: TCConfigProgramPriority,
+			data: map[string]string{TCConfigProgramPriority: "1000"},
+			want: func(cfg *TCManagerConfig) { cfg.Priorities.Program = 1000 },
+		},
+		{
+			name:    "priority out of range",
+			data:    map[string]string{TCConfigProgramPriority: "65536"},
+			wantErr: "invalid programPriority",
+		},
+		{
+			name:    "program before rate limit",
+			data:    map[string]string{TCConfigProgramPriority: "15"},
+			wantErr: "must order the drop filters before the rate filter before the program",
+		},
+		{
+			name:    "same drop priorities",
+			data:    map[string]string{TCConfigDropV6Priority: "10"},
+			wantErr: "must order",
+		},
+		{
+			name: TCConfigRateLimitBurstBytes,
+			data: map[string]string{TCConfigRateLimitBurstBytes: "4096"},
+			want: func(cfg *TCManagerConfig) { cfg.RateLimitBurstBytes = 4096 },
+		},
+		{
+			name:    "zero " + TCConfigRateLimitBurstBytes,
+			data:    map[string]string{TCConfigRateLimitBurstBytes: "0"},
+			wantErr: "burst must not be 0",
+		},
+		{
+			name: TCConfigMaxRateLimitBps,
+			data: map[string]string{TCConfigMaxRateLimitBps: "1000000"},
+			want: func(cfg *TCManagerConfig) { cfg.MaxRateLimitBps = 1000000 },
+		},
+		{
+			name:    TCConfigMaxRateLimitBps + " above the police rate",
+			data:    map[string]string{TCConfigMaxRateLimitBps: "4294967296"},
+			wantErr: "maximum rate limit 4294967296 Bps",
+		},
+		{
+			name: TCConfigReplaceNewerPrograms,
+			data: map[string]string{TCConfigReplaceNewerPrograms: "true"},
+			want: func(cfg *TCManagerConfig) { cfg.ReplaceNewerPrograms = true },
+		},
+		{
+			name:    "invalid " + TCConfigReplaceNewerPrograms,
+			data:    map[string]string{TCConfigReplaceNewerPrograms: "sometimes"},
+			wantErr: "invalid replaceNewerPrograms of config map kmesh-system/tc-config",
+		},
+		{
+			name:    "unknown key",
+			data:    map[string]string{"priority": "1"},
+			wantErr: "invalid priority of config map kmesh-system/tc-config: unknown key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "kmesh-system", Name: "tc-config"},
+				Data:       tt.data,
+			}
+			cfg, err := LoadConfigFromConfigMap(cm)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			want := defaults
+			tt.want(&want)
+			assert.Equal(t, want, *cfg)
+		})
+	}
+
+	_, err := LoadConfigFromConfigMap(nil)
+	assert.Error(t, err)
+}
+
+func TestTCManagerMaxRateLimit(t *testing.T) {
+	link := NewTestTCEnvironment(t).Link1
+	m := NewTCManager()
+	m.MaxRateLimitBps = 1000
+	_, err := m.DryRun(TCPolicy{Link: link, Direction: constants.TC_INGRESS, RateLimitBps: 1001})
+	assert.ErrorContains(t, err, "rate limit 1001 Bps exceeds the maximum 1000")
+}
+
+func TestParseTCProgramVersion(t *testing.T) {
+	v, err := ParseTCProgramVersion("v2.10")
+	require.NoError(t, err)
+	assert.Equal(t, TCProgramVersion{Major: 2, Minor: 10}, v)
+	v, err = ParseTCProgramVersion("0.1")
+	require.NoError(t, err)
+	assert.Equal(t, TCProgramVersion{Minor: 1}, v)
+
+	for _, s := range []string{"", "v1", "v1.", "va.1", "v1.-1", "v1.2.3"} {
+		_, err := ParseTCProgramVersion(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,567 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+func newTestSchedClsProg(t *testing.T, name string) *ebpf.Program {
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type: ebpf.SchedCLS,
+		Name: name,
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R0, 0),
+			asm.Return(),
+		},
+		License: "GPL",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		prog.Close()
+	})
+	return prog
+}
+
+func changeTypes(changes []TCChange) []TCChangeType {
+	var types []TCChangeType
+	for _, c := range changes {
+		types = append(types, c.Type)
+	}
+	return types
+}
+
+func TestDiffPolicy(t *testing.T) {
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "dummy0", Index: 2}}
+	tests := []struct {
+		name    string
+		current TCPolicy
+		desired TCPolicy
+		want    []TCChangeType
+	}{
+		{
+			name:    "no change",
+			current: TCPolicy{Link: link, ProgramName: "prog", RateLimitBps: 100, DropPorts: []uint16{80}},
+			desired: TCPolicy{Link: link, ProgramName: "prog", RateLimitBps: 100, DropPorts: []uint16{80}},
+			want:    nil,
+		},
+		{
+			name:    "attach program",
+			current: TCPolicy{},
+			desired: TCPolicy{Link: link, ProgramName: "prog"},
+			want:    []TCChangeType{TCChangeAttachProgram},
+		},
+		{
+			name:    "replace program",
+			current: TCPolicy{Link: link, ProgramName: "old"},
+			desired: TCPolicy{Link: link, ProgramName: "new"},
+			want:    []TCChangeType{TCChangeDetachProgram, TCChangeAttachProgram},
+		},
+		{
+			name:    "detach program",
+			current: TCPolicy{Link: link, ProgramName: "prog"},
+			desired: TCPolicy{Link: link},
+			want:    []TCChangeType{TCChangeDetachProgram},
+		},
+		{
+			name:    "set rate limit",
+			current: TCPolicy{Link: link, RateLimitBps: 100},
+			desired: TCPolicy{Link: link, RateLimitBps: 200},
+			want:    []TCChangeType{TCChangeSetRateLimit},
+		},
+		{
+			name:    "remove rate limit",
+			current: TCPolicy{Link: link, RateLimitBps: 100},
+			desired: TCPolicy{Link: link},
+			want:    []TCChangeType{TCChangeRemoveRateLimit},
+		},
+		{
+			name:    "update drop ports",
+			current: TCPolicy{Link: link, DropPorts: []uint16{80, 443}},
+			desired: TCPolicy{Link: link, DropPorts: []uint16{443, 8080}},
+			want:    []TCChangeType{TCChangeRemoveDropPort, TCChangeAddDropPort},
+		},
+		{
+			name:    "full policy",
+			current: TCPolicy{},
+			desired: TCPolicy{Link: link, Direction: constants.TC_EGRESS, ProgramName: "prog", RateLimitBps: 100, DropPorts: []uint16{80}},
+			want:    []TCChangeType{TCChangeAttachProgram, TCChangeSetRateLimit, TCChangeAddDropPort},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := DiffPolicy(tt.current, tt.desired)
+			assert.Equal(t, tt.want, changeTypes(changes))
+			for _, c := range changes {
+				assert.Equal(t, tt.desired.Link, c.Link)
+				assert.Equal(t, tt.desired.Direction, c.Direction)
+				assert.NotEmpty(t, c.Detail)
+			}
+		})
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	testNs, link := env.TestNs, env.Link1
+	newTestSchedClsProg(t, "ut_tc_policy")
+
+	listFilters := func(direction TCDirection) []netlink.Filter {
+		parent, err := direction.parent()
+		require.NoError(t, err)
+		var filters []netlink.Filter
+		err = testNs.Do(func(_ ns.NetNS) error {
+			filters, err = netlink.FilterList(link, parent)
+			return err
+		})
+		require.NoError(t, err)
+		return filters
+	}
+
+	m := NewTCManager()
+	// rate limit and drop ports need the matchall and flower classifiers
+	var classifierErr error
+	_ = testNs.Do(func(_ ns.NetNS) error {
+		if classifierErr = replaceQdisc(link); classifierErr != nil {
+			return nil
+		}
+		parent, _ := TCDirection(constants.TC_INGRESS).parent()
+		filters := append(m.newPolicyDropFilters(link, parent, 1), m.newPolicyRateFilter(link, parent, 1))
+		for _, filter := range filters {
+			if classifierErr = netlink.FilterAdd(filter); classifierErr != nil {
+				return nil
+			}
+			_ = netlink.FilterDel(filter)
+		}
+		return nil
+	})
+
+	tests := []struct {
+		name        string
+		policy      TCPolicy
+		wantErr     bool
+		wantFilters int
+	}{
+		{
+			name:        "program only",
+			policy:      TCPolicy{Link: link, Direction: constants.TC_INGRESS, ProgramName: "ut_tc_policy"},
+			wantFilters: 1,
+		},
+		{
+			name:        "program and rate limit",
+			policy:      TCPolicy{Link: link, Direction: constants.TC_INGRESS, ProgramName: "ut_tc_policy", RateLimitBps: 1 << 20},
+			wantFilters: 2,
+		},
+		{
+			name:        "program, rate limit and drop ports",
+			policy:      TCPolicy{Link: link, Direction: constants.TC_INGRESS, ProgramName: "ut_tc_policy", RateLimitBps: 1 << 20, DropPorts: []uint16{80, 443}},
+			wantFilters: 10,
+		},
+		{
+			name:        "drop ports only",
+			policy:      TCPolicy{Link: link, Direction: constants.TC_INGRESS, DropPorts: []uint16{443}},
+			wantFilters: 4,
+		},
+		{
+			name:        "empty policy",
+			policy:      TCPolicy{Link: link, Direction: constants.TC_INGRESS},
+			wantFilters: 0,
+		},
+		{
+			name:    "unknown program",
+			policy:  TCPolicy{Link: link, Direction: constants.TC_INGRESS, ProgramName: "ut_not_exist"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid drop port",
+			policy:  TCPolicy{Link: link, Direction: constants.TC_INGRESS, DropPorts: []uint16{0}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid direction",
+			policy:  TCPolicy{Link: link, Direction: 3},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if classifierErr != nil && !tt.wantErr && (tt.policy.RateLimitBps != 0 || len(tt.policy.DropPorts) != 0) {
+				t.Skipf("tc classifier not supported: %v", classifierErr)
+			}
+			err := testNs.Do(func(_ ns.NetNS) error {
+				return m.ApplyPolicy(tt.policy)
+			})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, listFilters(tt.policy.Direction), tt.wantFilters)
+		})
+	}
+
+	err := testNs.Do(func(_ ns.NetNS) error {
+		return m.ApplyPolicy(TCPolicy{Link: link, Direction: constants.TC_EGRESS, ProgramName: "ut_tc_policy"})
+	})
+	require.NoError(t, err)
+	assert.Len(t, listFilters(constants.TC_EGRESS), 1)
+	assert.Len(t, listFilters(constants.TC_INGRESS), 0)
+}
+
+func mountTestBpffs(t *testing.T) string {
+	dir := t.TempDir()
+	if err := unix.Mount("bpf", dir, "bpf", 0, ""); err != nil {
+		t.Skipf("failed to mount bpffs: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = unix.Unmount(dir, unix.MNT_DETACH)
+	})
+	return dir
+}
+
+func progID(t *testing.T, prog *ebpf.Program) int {
+	info, err := prog.Info()
+	require.NoError(t, err)
+	id, ok := info.ID()
+	require.True(t, ok)
+	return int(id)
+}
+
+func TestPauseResume(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	testNs, link := env.TestNs, env.Link1
+	prog := newTestSchedClsProg(t, "ut_tc_pause")
+	passthrough := newTestSchedClsProg(t, "ut_tc_passthru")
+	pinner := BPFProgramPinner{BaseDir: mountTestBpffs(t)}
+	_, err := pinner.PinProgram(TCPassthroughProgramName, passthrough.FD())
+	require.NoError(t, err)
+
+	attachedProgID := func(direction TCDirection) int {
+		parent, _ := direction.parent()
+		var filters []netlink.Filter
+		err := testNs.Do(func(_ ns.NetNS) error {
+			var err error
+			filters, err = netlink.FilterList(link, parent)
+			return err
+		})
+		require.NoError(t, err)
+		require.Len(t, filters, 1)
+		return filters[0].(*netlink.BpfFilter).Id
+	}
+
+	m := NewTCManager()
+	m.Pinner = pinner
+	policy := TCPolicy{Link: link, Direction: constants.TC_EGRESS, ProgramName: "ut_tc_pause"}
+	doInNs := func(fn func() error) error {
+		return testNs.Do(func(_ ns.NetNS) error {
+			return fn()
+		})
+	}
+
+	// nothing to pause
+	assert.Error(t, doInNs(func() error { return m.Pause(link) }))
+
+	require.NoError(t, doInNs(func() error { return m.ApplyPolicy(policy) }))
+	assert.Equal(t, progID(t, prog), attachedProgID(constants.TC_EGRESS))
+	assert.False(t, m.IsPaused(link, constants.TC_EGRESS))
+
+	require.NoError(t, doInNs(func() error { return m.Pause(link) }))
+	assert.Equal(t, progID(t, passthrough), attachedProgID(constants.TC_EGRESS))
+	assert.True(t, m.IsPaused(link, constants.TC_EGRESS))
+	assert.False(t, m.IsPaused(link, constants.TC_INGRESS))
+	// policy can not be changed while paused
+	assert.Error(t, doInNs(func() error { return m.ApplyPolicy(TCPolicy{Link: link, Direction: constants.TC_EGRESS}) }))
+
+	require.NoError(t, doInNs(func() error { return m.Resume(link) }))
+	assert.Equal(t, progID(t, prog), attachedProgID(constants.TC_EGRESS))
+	assert.False(t, m.IsPaused(link, constants.TC_EGRESS))
+}
+
+func TestApplyPolicySkipsOlderProgram(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	testNs, link := env.TestNs, env.Link1
+	older := newTestSchedClsProg(t, "ut_tc_older")
+	newer := newTestSchedClsProg(t, "ut_tc_newer")
+	require.True(t, isProgramNewer(newer.FD(), older.FD()))
+
+	m := NewTCManager()
+	err := testNs.Do(func(_ ns.NetNS) error {
+		require.NoError(t, m.ApplyPolicy(TCPolicy{Link: link, Direction: constants.TC_INGRESS, ProgramName: "ut_tc_newer"}))
+		// the installed program is newer, keep it
+		require.NoError(t, m.ApplyPolicy(TCPolicy{Link: link, Direction: constants.TC_INGRESS, ProgramName: "ut_tc_older"}))
+		return nil
+	})
+	require.NoError(t, err)
+
+	attachments := m.Attachments()
+	require.Len(t, attachments, 1)
+	assert.Equal(t, "ut_tc_newer", attachments[0].ProgramName)
+	assert.Equal(t, uint32(progID(t, newer)), attachments[0].ProgramID)
+}
+
+func TestDryRun(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	testNs, link := env.TestNs, env.Link1
+	newTestSchedClsProg(t, "ut_tc_dry_run")
+	policy := TCPolicy{Link: link, Direction: constants.TC_INGRESS, ProgramName: "ut_tc_dry_run"}
+
+	err := testNs.Do(func(_ ns.NetNS) error {
+		m := NewTCManager()
+		changes, err := m.DryRun(policy)
+		require.NoError(t, err)
+		assert.Equal(t, []TCChangeType{TCChangeAddQdisc, TCChangeAttachProgram}, changeTypes(changes))
+		// nothing is changed
+		ok, err := hasClsactQdisc(link)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		assert.Empty(t, m.Attachments())
+
+		require.NoError(t, m.ApplyPolicy(policy))
+		changes, err = m.DryRun(policy)
+		require.NoError(t, err)
+		assert.Empty(t, changes)
+
+		// the state of a link not managed by the manager is read from the kernel
+		other := NewTCManager()
+		changes, err = other.DryRun(policy)
+		require.NoError(t, err)
+		assert.Empty(t, changes)
+		changes, err = other.DryRun(TCPolicy{Link: link, Direction: constants.TC_INGRESS})
+		require.NoError(t, err)
+		assert.Equal(t, []TCChangeType{TCChangeDetachProgram}, changeTypes(changes))
+		assert.Equal(t, "detach program ut_tc_dry_run", changes[0].Detail)
+
+		changes, err = other.DryRun(TCPolicy{Link: link, Direction: constants.TC_EGRESS, ProgramName: "ut_tc_dry_run"})
+		require.NoError(t, err)
+		assert.Equal(t, []TCChangeType{TCChangeAttachProgram}, changeTypes(changes))
+
+		_, err = m.DryRun(TCPolicy{Link: link, Direction: constants.TC_INGRESS, ProgramName: "ut_tc_not_exist"})
+		assert.Error(t, err)
+		_, err = m.DryRun(TCPolicy{Link: link, Direction: constants.TC_INGRESS, DropPorts: []uint16{0}})
+		assert.Error(t, err)
+
+		filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+		require.NoError(t, err)
+		assert.Len(t, filters, 1)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestForEachLink(t *testing.T) {
+	m := NewTCManager()
+	links := map[int]netlink.Link{
+		2: &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Index: 2, Name: "veth2"}},
+		7: &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Index: 7, Name: "veth7"}},
+	}
+	for _, key := range []tcKey{
+		{ifIndex: 7, direction: constants.TC_INGRESS},
+		{ifIndex: 2, direction: constants.TC_EGRESS},
+		{ifIndex: 7, direction: constants.TC_EGRESS},
+		{ifIndex: 2, direction: constants.TC_INGRESS},
+	} {
+		link := links[key.ifIndex]
+		m.policies[key] = TCPolicy{Link: link, Direction: key.direction, ProgramName: "ut_prog"}
+		m.attachments[key] = &TCAttachment{
+			LinkName:    link.Attrs().Name,
+			LinkIndex:   key.ifIndex,
+			Direction:   key.direction,
+			ProgramName: "ut_prog",
+		}
+	}
+	// a policy without attachment is not visited
+	m.policies[tcKey{ifIndex: 9, direction: constants.TC_INGRESS}] = TCPolicy{DropPorts: []uint16{80}}
+
+	var visited []string
+	record := func(link netlink.Link, direction TCDirection, info TCAttachment) error {
+		assert.Equal(t, link.Attrs().Index, info.LinkIndex)
+		assert.Equal(t, direction, info.Direction)
+		visited = append(visited, fmt.Sprintf("%s/%s", link.Attrs().Name, direction))
+		// the registry is not locked while fn runs
+		assert.False(t, m.IsPaused(link, direction))
+		return nil
+	}
+	require.NoError(t, m.ForEachLink(record))
+	assert.Equal(t, []string{"veth2/ingress", "veth2/egress", "veth7/ingress", "veth7/egress"}, visited)
+
+	errFirst := errors.New("first")
+	errSecond := errors.New("second")
+	failing := func(link netlink.Link, direction TCDirection, info TCAttachment) error {
+		visited = append(visited, fmt.Sprintf("%s/%s", link.Attrs().Name, direction))
+		switch len(visited) {
+		case 2:
+			return errFirst
+		case 4:
+			return errSecond
+		}
+		return nil
+	}
+
+	visited = nil
+	assert.Equal(t, errFirst, m.ForEachLink(failing))
+	assert.Len(t, visited, 2)
+
+	visited = nil
+	err := m.ForEachLink(failing, ContinueOnError())
+	assert.Len(t, visited, 4)
+	assert.ErrorIs(t, err, errFirst)
+	assert.ErrorIs(t, err, errSecond)
+
+	// the link of an attachment without policy is looked up by index
+	m.attachments[tcKey{ifIndex: math.MaxInt32, direction: constants.TC_INGRESS}] = &TCAttachment{
+		LinkName:  "gone",
+		LinkIndex: math.MaxInt32,
+		Direction: constants.TC_INGRESS,
+	}
+	visited = nil
+	err = m.ForEachLink(record, ContinueOnError())
+	assert.ErrorContains(t, err, "failed to get interface gone")
+	assert.Len(t, visited, 4)
+}
+
+// newTestVersionedProg loads a tc program referencing a version map holding version
+func newTestVersionedProg(t *testing.T, name string, version TCProgramVersion) *ebpf.Program {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       TCProgramVersionMapName,
+		Type:       ebpf.Array,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 1,
+		Contents:   []ebpf.MapKV{{Key: uint32(0), Value: [2]uint32{uint32(version.Major), uint32(version.Minor)}}},
+	})
+	require.NoError(t, err)
+	// the program holds a reference of the map
+	defer m.Close()
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type: ebpf.SchedCLS,
+		Name: name,
+		Instructions: asm.Instructions{
+			asm.LoadMapPtr(asm.R1, m.FD()),
+			asm.Mov.Imm(asm.R0, 0),
+			asm.Return(),
+		},
+		License: "GPL",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		prog.Close()
+	})
+	return prog
+}
+
+func TestApplyPolicyRequiredVersion(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	testNs, link := env.TestNs, env.Link1
+	newTestVersionedProg(t, "ut_tc_v1_2", TCProgramVersion{Major: 1, Minor: 2})
+	newTestVersionedProg(t, "ut_tc_v2_0", TCProgramVersion{Major: 2, Minor: 0})
+	newTestSchedClsProg(t, "ut_tc_noversion")
+
+	m := NewTCManager()
+	m.RequiredVersion = TCProgramVersion{Major: 1, Minor: 1}
+	apply := func(name string) error {
+		return testNs.Do(func(_ ns.NetNS) error {
+			return m.ApplyPolicy(TCPolicy{Link: link, Direction: constants.TC_INGRESS, ProgramName: name})
+		})
+	}
+
+	require.NoError(t, apply("ut_tc_v1_2"))
+	assert.ErrorContains(t, apply("ut_tc_v2_0"), "incompatible with the required version v1.1")
+	assert.ErrorContains(t, apply("ut_tc_noversion"), "failed to read version")
+
+	// the compatible program is kept installed
+	attachments := m.Attachments()
+	require.Len(t, attachments, 1)
+	assert.Equal(t, "ut_tc_v1_2", attachments[0].ProgramName)
+
+	// no version is required by default
+	m = NewTCManager()
+	require.NoError(t, apply("ut_tc_noversion"))
+}
+
+func TestTCManagerWithLogger(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	newTestSchedClsProg(t, "ut_tc_logger")
+
+	var buf bytes.Buffer
+	m := NewTCManager().WithLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	records := func() []map[string]any {
+		var res []map[string]any
+		for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+			record := make(map[string]any)
+			require.NoError(t, json.Unmarshal(line, &record))
+			res = append(res, record)
+		}
+		buf.Reset()
+		return res
+	}
+
+	require.NoError(t, env.Do(func() error {
+		require.NoError(t, m.ApplyPolicy(TCPolicy{Link: env.Link1, Direction: constants.TC_EGRESS, ProgramName: "ut_tc_logger"}))
+		var ops []string
+		for _, r := range records() {
+			assert.Equal(t, "DEBUG", r["level"])
+			assert.Equal(t, "netlink operation", r["msg"])
+			assert.Equal(t, "veth0", r["link"])
+			assert.Equal(t, "egress", r["direction"])
+			assert.NotContains(t, r, "error")
+			ops = append(ops, r["op"].(string))
+		}
+		assert.Equal(t, []string{"qdisc replace", "filter replace"}, ops)
+
+		// the kernel error code of a failed operation is logged
+		err := m.applyTCChange(tcKey{ifIndex: env.Link1.Attrs().Index, direction: constants.TC_INGRESS}, TCChange{
+			Type:      TCChangeDetachProgram,
+			Link:      env.Link1,
+			Direction: constants.TC_INGRESS,
+			value:     "ut_tc_logger",
+		})
+		require.Error(t, err)
+		got := records()
+		require.Len(t, got, 1)
+		assert.Equal(t, "filter delete", got[0]["op"])
+		assert.Equal(t, "ingress", got[0]["direction"])
+		assert.Equal(t, "bpf", got[0]["filter"])
+		assert.Equal(t, float64(m.Priorities.Program), got[0]["priority"])
+		assert.NotEmpty(t, got[0]["error"])
+		assert.Equal(t, "ENOENT", got[0]["errno"])
+		return nil
+	}))
+
+	// nothing is logged without logger
+	m.WithLogger(nil)
+	require.NoError(t, env.Do(func() error {
+		return m.ApplyPolicy(TCPolicy{Link: env.Link1, Direction: constants.TC_EGRESS})
+	}))
+	assert.Zero(t, buf.Len())
+}
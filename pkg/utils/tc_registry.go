@@ -0,0 +1,99 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// TCEntry is a program attached by ManageTCProgramByFd
+type TCEntry struct {
+	IfName    string      `json:"ifName"`
+	Fd        int         `json:"fd"`
+	Direction TCDirection `json:"direction"`
+}
+
+type tcRegistryKey struct {
+	ifName    string
+	direction TCDirection
+}
+
+// TCRegistry tracks the programs attached to the interfaces by name and direction, it is
+// shared by the goroutines attaching and detaching programs
+type TCRegistry struct {
+	mu      sync.RWMutex
+	entries map[tcRegistryKey]TCEntry
+}
+
+func NewTCRegistry() *TCRegistry {
+	return &TCRegistry{entries: make(map[tcRegistryKey]TCEntry)}
+}
+
+// DefaultTCRegistry is updated by ManageTCProgramByFd on every attach and detach
+var DefaultTCRegistry = NewTCRegistry()
+
+// Register records the program of fd attached to the direction of ifName, replacing the one
+// registered before
+func (r *TCRegistry) Register(ifName string, fd int, direction TCDirection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[tcRegistryKey{ifName, direction}] = TCEntry{IfName: ifName, Fd: fd, Direction: direction}
+}
+
+func (r *TCRegistry) Unregister(ifName string, direction TCDirection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, tcRegistryKey{ifName, direction})
+}
+
+func (r *TCRegistry) IsRegistered(ifName string, direction TCDirection) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.entries[tcRegistryKey{ifName, direction}]
+	return ok
+}
+
+// All returns the entries sorted by interface name and direction
+func (r *TCRegistry) All() []TCEntry {
+	r.mu.RLock()
+	res := make([]TCEntry, 0, len(r.entries))
+	for _, e := range r.entries {
+		res = append(res, e)
+	}
+	r.mu.RUnlock()
+	slices.SortFunc(res, func(a, b TCEntry) int {
+		return cmp.Or(cmp.Compare(a.IfName, b.IfName), cmp.Compare(a.Direction, b.Direction))
+	})
+	return res
+}
+
+// ServeRegistryDump writes the entries of DefaultTCRegistry as json, for the debug endpoints
+func ServeRegistryDump(w http.ResponseWriter, r *http.Request) {
+	data, err := json.MarshalIndent(DefaultTCRegistry.All(), "", "  ")
+	if err != nil {
+		log.Errorf("Failed to marshal tc registry: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
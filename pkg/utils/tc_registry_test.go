@@ -0,0 +1,123 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+func TestTCRegistry(t *testing.T) {
+	r := NewTCRegistry()
+	assert.Empty(t, r.All())
+	assert.False(t, r.IsRegistered("eth0", constants.TC_INGRESS))
+
+	r.Register("eth1", 11, constants.TC_INGRESS)
+	r.Register("eth0", 10, constants.TC_EGRESS)
+	r.Register("eth0", 9, constants.TC_INGRESS)
+	// the program attached again replaces the registered one
+	r.Register("eth0", 12, constants.TC_INGRESS)
+	assert.True(t, r.IsRegistered("eth0", constants.TC_INGRESS))
+	assert.True(t, r.IsRegistered("eth0", constants.TC_EGRESS))
+	assert.False(t, r.IsRegistered("eth1", constants.TC_EGRESS))
+	assert.Equal(t, []TCEntry{
+		{IfName: "eth0", Fd: 12, Direction: constants.TC_INGRESS},
+		{IfName: "eth0", Fd: 10, Direction: constants.TC_EGRESS},
+		{IfName: "eth1", Fd: 11, Direction: constants.TC_INGRESS},
+	}, r.All())
+
+	r.Unregister("eth0", constants.TC_INGRESS)
+	r.Unregister("eth2", constants.TC_INGRESS)
+	assert.False(t, r.IsRegistered("eth0", constants.TC_INGRESS))
+	assert.Len(t, r.All(), 2)
+}
+
+func TestTCRegistryConcurrent(t *testing.T) {
+	r := NewTCRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ifName := fmt.Sprintf("veth%d", i)
+			for j := 0; j < 100; j++ {
+				r.Register(ifName, j, constants.TC_INGRESS)
+				r.Register(ifName, j, constants.TC_EGRESS)
+				_ = r.All()
+				r.Unregister(ifName, constants.TC_EGRESS)
+				assert.True(t, r.IsRegistered(ifName, constants.TC_INGRESS))
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, r.All(), 16)
+}
+
+func TestServeRegistryDump(t *testing.T) {
+	old := DefaultTCRegistry
+	DefaultTCRegistry = NewTCRegistry()
+	defer func() {
+		DefaultTCRegistry = old
+	}()
+
+	dump := func() []TCEntry {
+		w := httptest.NewRecorder()
+		ServeRegistryDump(w, httptest.NewRequest(http.MethodGet, "/debug/tc_registry", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var entries []TCEntry
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		return entries
+	}
+	assert.Empty(t, dump())
+
+	DefaultTCRegistry.Register("eth0", 10, constants.TC_EGRESS)
+	assert.Equal(t, []TCEntry{{IfName: "eth0", Fd: 10, Direction: constants.TC_EGRESS}}, dump())
+}
+
+func TestManageTCProgramByFdRegistry(t *testing.T) {
+	old := DefaultTCRegistry
+	DefaultTCRegistry = NewTCRegistry()
+	defer func() {
+		DefaultTCRegistry = old
+	}()
+	env := NewTestTCEnvironment(t)
+	prog := newTestSchedClsProg(t, "ut_tc_registry")
+	name := env.Link1.Attrs().Name
+
+	require.NoError(t, env.Do(func() error {
+		require.NoError(t, ManageTCProgramByFd(env.Link1, prog.FD(), constants.TC_ATTACH, 0))
+		assert.Equal(t, []TCEntry{{IfName: name, Fd: prog.FD(), Direction: constants.TC_INGRESS}}, DefaultTCRegistry.All())
+
+		// a failed attach is not registered
+		assert.Error(t, ManageTCProgramByFd(env.Link1, -1, constants.TC_ATTACH, 0))
+		assert.Equal(t, prog.FD(), DefaultTCRegistry.All()[0].Fd)
+
+		require.NoError(t, ManageTCProgramByFd(env.Link1, prog.FD(), constants.TC_DETACH, 0))
+		assert.False(t, DefaultTCRegistry.IsRegistered(name, constants.TC_INGRESS))
+		return nil
+	}))
+}
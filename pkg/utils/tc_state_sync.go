@@ -0,0 +1,171 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	"kmesh.net/kmesh/api/v2/tc"
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+// Serialize converts the attachment to its protobuf form, the fd is process local and not included
+func (a *TCAttachment) Serialize() (proto.Message, error) {
+	var direction tc.TCDirection
+	switch a.Direction {
+	case constants.TC_INGRESS:
+		direction = tc.TCDirection_INGRESS
+	case constants.TC_EGRESS:
+		direction = tc.TCDirection_EGRESS
+	default:
+		return nil, fmt.Errorf("invalid tc direction %d", int(a.Direction))
+	}
+
+	return &tc.TCAttachment{
+		LinkName:    a.LinkName,
+		LinkIndex:   int32(a.LinkIndex),
+		Direction:   direction,
+		ProgramName: a.ProgramName,
+		ProgramId:   a.ProgramID,
+		Handle:      a.Handle,
+		Priority:    uint32(a.Priority),
+		Paused:      a.Paused,
+	}, nil
+}
+
+// DeserializeTCAttachment converts a message created by TCAttachment.Serialize back.
+// ProgFd of the result is -1, the program can be opened again with ProgramID.
+func DeserializeTCAttachment(msg proto.Message) (*TCAttachment, error) {
+	pb, ok := msg.(*tc.TCAttachment)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", msg)
+	}
+
+	var direction TCDirection
+	switch pb.GetDirection() {
+	case tc.TCDirection_INGRESS:
+		direction = constants.TC_INGRESS
+	case tc.TCDirection_EGRESS:
+		direction = constants.TC_EGRESS
+	default:
+		return nil, fmt.Errorf("invalid tc direction %v", pb.GetDirection())
+	}
+	if pb.GetPriority() > 0xffff {
+		return nil, fmt.Errorf("invalid tc priority %d", pb.GetPriority())
+	}
+
+	return &TCAttachment{
+		LinkName:    pb.GetLinkName(),
+		LinkIndex:   int(pb.GetLinkIndex()),
+		Direction:   direction,
+		ProgramName: pb.GetProgramName(),
+		ProgramID:   pb.GetProgramId(),
+		ProgFd:      -1,
+		Handle:      pb.GetHandle(),
+		Priority:    uint16(pb.GetPriority()),
+		Paused:      pb.GetPaused(),
+	}, nil
+}
+
+// tcStateSyncService is the server side of the TCStateSync service defined in api/tc/tc_state.proto
+type tcStateSyncService interface {
+	GetState(req *tc.GetStateRequest, stream grpc.ServerStream) error
+}
+
+var tcStateSyncServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tc.TCStateSync",
+	HandlerType: (*tcStateSyncService)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GetState",
+			Handler:       getStateHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/tc/tc_state.proto",
+}
+
+func getStateHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := &tc.GetStateRequest{}
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(tcStateSyncService).GetState(req, stream)
+}
+
+// TCStateSyncServer streams the attachments of a TCManager to the replicas
+type TCStateSyncServer struct {
+	manager *TCManager
+}
+
+func NewTCStateSyncServer(manager *TCManager) *TCStateSyncServer {
+	return &TCStateSyncServer{manager: manager}
+}
+
+// Register registers the TCStateSync service to the grpc server
+func (s *TCStateSyncServer) Register(server *grpc.Server) {
+	server.RegisterService(&tcStateSyncServiceDesc, s)
+}
+
+func (s *TCStateSyncServer) GetState(_ *tc.GetStateRequest, stream grpc.ServerStream) error {
+	for _, a := range s.manager.Attachments() {
+		msg, err := a.Serialize()
+		if err != nil {
+			return err
+		}
+		if err = stream.SendMsg(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTCState fetches all the attachments from a TCStateSyncServer
+func GetTCState(ctx context.Context, cc grpc.ClientConnInterface) ([]*TCAttachment, error) {
+	stream, err := cc.NewStream(ctx, &tcStateSyncServiceDesc.Streams[0], "/tc.TCStateSync/GetState")
+	if err != nil {
+		return nil, err
+	}
+	if err = stream.SendMsg(&tc.GetStateRequest{}); err != nil {
+		return nil, err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	var res []*TCAttachment
+	for {
+		msg := &tc.TCAttachment{}
+		if err = stream.RecvMsg(msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return res, nil
+			}
+			return nil, err
+		}
+		a, err := DeserializeTCAttachment(msg)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, a)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+
+	"kmesh.net/kmesh/api/v2/tc"
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+func TestTCAttachmentSerialize(t *testing.T) {
+	tests := []TCAttachment{
+		{
+			LinkName:    "veth0",
+			LinkIndex:   3,
+			Direction:   constants.TC_INGRESS,
+			ProgramName: "tc_ingress",
+			ProgramID:   42,
+			ProgFd:      10,
+			Handle:      1,
+			Priority:    30,
+		},
+		{
+			LinkName:    "eth0",
+			LinkIndex:   2,
+			Direction:   constants.TC_EGRESS,
+			ProgramName: "tc_egress",
+			ProgramID:   7,
+			ProgFd:      11,
+			Handle:      2,
+			Priority:    1,
+			Paused:      true,
+		},
+	}
+	for _, want := range tests {
+		msg, err := want.Serialize()
+		require.NoError(t, err)
+
+		// go through the wire format
+		data, err := proto.Marshal(msg)
+		require.NoError(t, err)
+		pb := &tc.TCAttachment{}
+		require.NoError(t, proto.Unmarshal(data, pb))
+
+		got, err := DeserializeTCAttachment(pb)
+		require.NoError(t, err)
+		want.ProgFd = -1
+		assert.Equal(t, want, *got)
+	}
+
+	_, err := (&TCAttachment{Direction: 5}).Serialize()
+	assert.Error(t, err)
+	_, err = DeserializeTCAttachment(&tc.GetStateRequest{})
+	assert.Error(t, err)
+	_, err = DeserializeTCAttachment(&tc.TCAttachment{Priority: 0x10000})
+	assert.Error(t, err)
+}
+
+func TestTCStateSyncServer(t *testing.T) {
+	m := NewTCManager()
+	m.attachments[tcKey{ifIndex: 3, direction: constants.TC_EGRESS}] = &TCAttachment{
+		LinkName: "veth0", LinkIndex: 3, Direction: constants.TC_EGRESS, ProgramName: "tc_egress", ProgramID: 2,
+	}
+	m.attachments[tcKey{ifIndex: 3, direction: constants.TC_INGRESS}] = &TCAttachment{
+		LinkName: "veth0", LinkIndex: 3, Direction: constants.TC_INGRESS, ProgramName: "tc_ingress", ProgramID: 1,
+	}
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	NewTCStateSyncServer(m).Register(server)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	attachments, err := GetTCState(context.Background(), conn)
+	require.NoError(t, err)
+	require.Len(t, attachments, 2)
+	assert.Equal(t, "tc_ingress", attachments[0].ProgramName)
+	assert.Equal(t, uint32(1), attachments[0].ProgramID)
+	assert.Equal(t, "tc_egress", attachments[1].ProgramName)
+	assert.Equal(t, TCDirection(constants.TC_EGRESS), attachments[1].Direction)
+}
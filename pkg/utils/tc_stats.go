@@ -0,0 +1,179 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+)
+
+// TCManagerStats are the operation statistics of a TCManager. ActiveFilters is the number of
+// filters of the policies applied.
+type TCManagerStats struct {
+	TotalAttachments   int64
+	TotalDetachments   int64
+	AttachErrors       int64
+	DetachErrors       int64
+	ActiveFilters      int64
+	LastAttachDuration time.Duration
+}
+
+type tcManagerStats struct {
+	totalAttachments   atomic.Int64
+	totalDetachments   atomic.Int64
+	attachErrors       atomic.Int64
+	detachErrors       atomic.Int64
+	activeFilters      atomic.Int64
+	lastAttachDuration atomic.Int64
+}
+
+// GetTCStats returns the statistics of m, it does not block the operations in progress
+func (m *TCManager) GetTCStats() TCManagerStats {
+	return TCManagerStats{
+		TotalAttachments:   m.stats.totalAttachments.Load(),
+		TotalDetachments:   m.stats.totalDetachments.Load(),
+		AttachErrors:       m.stats.attachErrors.Load(),
+		DetachErrors:       m.stats.detachErrors.Load(),
+		ActiveFilters:      m.stats.activeFilters.Load(),
+		LastAttachDuration: time.Duration(m.stats.lastAttachDuration.Load()),
+	}
+}
+
+func (s *tcManagerStats) recordAttach(start time.Time, err error) {
+	if err != nil {
+		s.attachErrors.Add(1)
+		return
+	}
+	s.totalAttachments.Add(1)
+	s.lastAttachDuration.Store(int64(time.Since(start)))
+}
+
+func (s *tcManagerStats) recordDetach(err error) {
+	if err != nil {
+		s.detachErrors.Add(1)
+		return
+	}
+	s.totalDetachments.Add(1)
+}
+
+// policyFilterCount is the number of filters installed for policy
+func policyFilterCount(policy TCPolicy) int64 {
+	var count int64
+	if policy.ProgramName != "" {
+		count++
+	}
+	if policy.RateLimitBps != 0 {
+		count++
+	}
+	// tcp and udp of both ip families
+	return count + int64(len(policy.DropPorts))*4
+}
+
+var (
+	tcAttachmentsDesc = prometheus.NewDesc("kmesh_tc_attachments_total",
+		"The total number of tc programs attached.", nil, nil)
+	tcDetachmentsDesc = prometheus.NewDesc("kmesh_tc_detachments_total",
+		"The total number of tc programs detached.", nil, nil)
+	tcAttachErrorsDesc = prometheus.NewDesc("kmesh_tc_attach_errors_total",
+		"The total number of failures to attach a tc program.", nil, nil)
+	tcDetachErrorsDesc = prometheus.NewDesc("kmesh_tc_detach_errors_total",
+		"The total number of failures to detach a tc program.", nil, nil)
+	tcActiveFiltersDesc = prometheus.NewDesc("kmesh_tc_active_filters",
+		"The number of tc filters installed by the applied policies.", nil, nil)
+	tcLastAttachDurationDesc = prometheus.NewDesc("kmesh_tc_last_attach_duration_seconds",
+		"The duration of the last tc program attachment.", nil, nil)
+)
+
+// TCManagerStatsCollector exports the GetTCStats of a TCManager to prometheus
+type TCManagerStatsCollector struct {
+	manager *TCManager
+}
+
+// NewTCManagerStatsCollector creates the collector of the statistics of m
+func NewTCManagerStatsCollector(m *TCManager) *TCManagerStatsCollector {
+	return &TCManagerStatsCollector{manager: m}
+}
+
+func (c *TCManagerStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tcAttachmentsDesc
+	ch <- tcDetachmentsDesc
+	ch <- tcAttachErrorsDesc
+	ch <- tcDetachErrorsDesc
+	ch <- tcActiveFiltersDesc
+	ch <- tcLastAttachDurationDesc
+}
+
+func (c *TCManagerStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.manager.GetTCStats()
+	ch <- prometheus.MustNewConstMetric(tcAttachmentsDesc, prometheus.CounterValue, float64(stats.TotalAttachments))
+	ch <- prometheus.MustNewConstMetric(tcDetachmentsDesc, prometheus.CounterValue, float64(stats.TotalDetachments))
+	ch <- prometheus.MustNewConstMetric(tcAttachErrorsDesc, prometheus.CounterValue, float64(stats.AttachErrors))
+	ch <- prometheus.MustNewConstMetric(tcDetachErrorsDesc, prometheus.CounterValue, float64(stats.DetachErrors))
+	ch <- prometheus.MustNewConstMetric(tcActiveFiltersDesc, prometheus.GaugeValue, float64(stats.ActiveFilters))
+	ch <- prometheus.MustNewConstMetric(tcLastAttachDurationDesc, prometheus.GaugeValue, stats.LastAttachDuration.Seconds())
+}
+
+var (
+	clsactLabels = []string{"interface", "direction"}
+
+	clsactPacketsDesc = prometheus.NewDesc("kmesh_tc_qdisc_packets_total",
+		"The total number of packets of the qdisc of an interface direction.", clsactLabels, nil)
+	clsactBytesDesc = prometheus.NewDesc("kmesh_tc_qdisc_bytes_total",
+		"The total number of bytes of the qdisc of an interface direction.", clsactLabels, nil)
+	clsactDropsDesc = prometheus.NewDesc("kmesh_tc_qdisc_drops_total",
+		"The total number of packets dropped by the qdisc of an interface direction.", clsactLabels, nil)
+	clsactOverlimitsDesc = prometheus.NewDesc("kmesh_tc_qdisc_overlimits_total",
+		"The total number of overlimits of the qdisc of an interface direction.", clsactLabels, nil)
+)
+
+// ClsactStatsCollector exports the GetClsactStats of links to prometheus
+type ClsactStatsCollector struct {
+	links func() []netlink.Link
+}
+
+// NewClsactStatsCollector creates the collector of the qdisc statistics of the links returned
+// by links on each collection, the links without clsact qdisc are skipped.
+func NewClsactStatsCollector(links func() []netlink.Link) *ClsactStatsCollector {
+	return &ClsactStatsCollector{links: links}
+}
+
+func (c *ClsactStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clsactPacketsDesc
+	ch <- clsactBytesDesc
+	ch <- clsactDropsDesc
+	ch <- clsactOverlimitsDesc
+}
+
+func (c *ClsactStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, link := range c.links() {
+		stats, err := GetClsactStats(link)
+		if err != nil {
+			log.Debugf("%v", err)
+			continue
+		}
+		name := link.Attrs().Name
+		for direction, counters := range map[string]QdiscCounters{"ingress": stats.Ingress, "egress": stats.Egress} {
+			ch <- prometheus.MustNewConstMetric(clsactPacketsDesc, prometheus.CounterValue, float64(counters.Packets), name, direction)
+			ch <- prometheus.MustNewConstMetric(clsactBytesDesc, prometheus.CounterValue, float64(counters.Bytes), name, direction)
+			ch <- prometheus.MustNewConstMetric(clsactDropsDesc, prometheus.CounterValue, float64(counters.Drops), name, direction)
+			ch <- prometheus.MustNewConstMetric(clsactOverlimitsDesc, prometheus.CounterValue, float64(counters.Overlimits), name, direction)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+func TestGetTCStats(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	testNs, link := env.TestNs, env.Link1
+	newTestSchedClsProg(t, "ut_tc_stats_a")
+	newTestSchedClsProg(t, "ut_tc_stats_b")
+
+	m := NewTCManager()
+	apply := func(name string) error {
+		return testNs.Do(func(_ ns.NetNS) error {
+			return m.ApplyPolicy(TCPolicy{Link: link, Direction: constants.TC_INGRESS, ProgramName: name})
+		})
+	}
+	assert.Equal(t, TCManagerStats{}, m.GetTCStats())
+
+	require.NoError(t, apply("ut_tc_stats_a"))
+	stats := m.GetTCStats()
+	assert.Equal(t, int64(1), stats.TotalAttachments)
+	assert.Equal(t, int64(1), stats.ActiveFilters)
+	assert.Positive(t, stats.LastAttachDuration)
+
+	// detach a and attach b
+	require.NoError(t, apply("ut_tc_stats_b"))
+	// b is detached before the unknown program fails to attach
+	assert.Error(t, apply("ut_tc_stats_unknown"))
+	stats = m.GetTCStats()
+	assert.Equal(t, int64(2), stats.TotalAttachments)
+	assert.Equal(t, int64(2), stats.TotalDetachments)
+	assert.Equal(t, int64(1), stats.AttachErrors)
+	assert.Zero(t, stats.ActiveFilters)
+
+	// the filter deleted behind the manager can not be detached
+	require.NoError(t, apply("ut_tc_stats_a"))
+	err := testNs.Do(func(_ ns.NetNS) error {
+		parent, _ := TCDirection(constants.TC_INGRESS).parent()
+		return netlink.FilterDel(m.newPolicyProgFilter(link, parent, 0, "ut_tc_stats_a"))
+	})
+	require.NoError(t, err)
+	assert.Error(t, apply(""))
+
+	stats = m.GetTCStats()
+	stats.LastAttachDuration = 0
+	assert.Equal(t, TCManagerStats{
+		TotalAttachments: 3,
+		TotalDetachments: 2,
+		AttachErrors:     1,
+		DetachErrors:     1,
+		ActiveFilters:    1,
+	}, stats)
+}
+
+func TestTCManagerStatsCollector(t *testing.T) {
+	m := NewTCManager()
+	m.stats.totalAttachments.Store(3)
+	m.stats.totalDetachments.Store(2)
+	m.stats.attachErrors.Store(1)
+	m.setPolicy(tcKey{ifIndex: 1, direction: constants.TC_INGRESS}, TCPolicy{ProgramName: "ut_prog", DropPorts: []uint16{80}})
+
+	expected := `
+# HELP kmesh_tc_active_filters The number of tc filters installed by the applied policies.
+# TYPE kmesh_tc_active_filters gauge
+kmesh_tc_active_filters 5
+# HELP kmesh_tc_attach_errors_total The total number of failures to attach a tc program.
+# TYPE kmesh_tc_attach_errors_total counter
+kmesh_tc_attach_errors_total 1
+# HELP kmesh_tc_attachments_total The total number of tc programs attached.
+# TYPE kmesh_tc_attachments_total counter
+kmesh_tc_attachments_total 3
+# HELP kmesh_tc_detach_errors_total The total number of failures to detach a tc program.
+# TYPE kmesh_tc_detach_errors_total counter
+kmesh_tc_detach_errors_total 0
+# HELP kmesh_tc_detachments_total The total number of tc programs detached.
+# TYPE kmesh_tc_detachments_total counter
+kmesh_tc_detachments_total 2
+# HELP kmesh_tc_last_attach_duration_seconds The duration of the last tc program attachment.
+# TYPE kmesh_tc_last_attach_duration_seconds gauge
+kmesh_tc_last_attach_duration_seconds 0
+`
+	assert.NoError(t, testutil.CollectAndCompare(NewTCManagerStatsCollector(m), strings.NewReader(expected)))
+}
+
+func TestClsactStatsCollector(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(netlink.QdiscList, func(link netlink.Link) ([]netlink.Qdisc, error) {
+		if link.Attrs().Index != 1 {
+			return nil, nil
+		}
+		return []netlink.Qdisc{
+			newTestQdisc("clsact", netlink.HANDLE_CLSACT, 10, 1500, 2, 3),
+			newTestQdisc("fq_codel", netlink.HANDLE_ROOT, 20, 2000, 1, 0),
+		}, nil
+	})
+
+	collector := NewClsactStatsCollector(func() []netlink.Link {
+		return []netlink.Link{
+			&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth1", Index: 1}},
+			// skipped without clsact qdisc
+			&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth2", Index: 2}},
+		}
+	})
+	expected := `
+# HELP kmesh_tc_qdisc_bytes_total The total number of bytes of the qdisc of an interface direction.
+# TYPE kmesh_tc_qdisc_bytes_total counter
+kmesh_tc_qdisc_bytes_total{direction="egress",interface="veth1"} 2000
+kmesh_tc_qdisc_bytes_total{direction="ingress",interface="veth1"} 1500
+# HELP kmesh_tc_qdisc_drops_total The total number of packets dropped by the qdisc of an interface direction.
+# TYPE kmesh_tc_qdisc_drops_total counter
+kmesh_tc_qdisc_drops_total{direction="egress",interface="veth1"} 1
+kmesh_tc_qdisc_drops_total{direction="ingress",interface="veth1"} 2
+# HELP kmesh_tc_qdisc_overlimits_total The total number of overlimits of the qdisc of an interface direction.
+# TYPE kmesh_tc_qdisc_overlimits_total counter
+kmesh_tc_qdisc_overlimits_total{direction="egress",interface="veth1"} 0
+kmesh_tc_qdisc_overlimits_total{direction="ingress",interface="veth1"} 3
+# HELP kmesh_tc_qdisc_packets_total The total number of packets of the qdisc of an interface direction.
+# TYPE kmesh_tc_qdisc_packets_total counter
+kmesh_tc_qdisc_packets_total{direction="egress",interface="veth1"} 20
+kmesh_tc_qdisc_packets_total{direction="ingress",interface="veth1"} 10
+`
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+}
@@ -0,0 +1,2938 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+
+	netnsapi "kmesh.net/kmesh/api/v2/netns"
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+func newTestHashMap(t *testing.T) (*ebpf.Map, uint32) {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 16,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		m.Close()
+	})
+
+	info, err := m.Info()
+	require.NoError(t, err)
+	id, ok := info.ID()
+	require.True(t, ok)
+	return m, uint32(id)
+}
+
+func TestGetEBPFMapValueByKey(t *testing.T) {
+	m, id := newTestHashMap(t)
+	require.NoError(t, m.Put(uint32(1), uint64(100)))
+
+	key := binary.NativeEndian.AppendUint32(nil, 1)
+	value, err := GetEBPFMapValueByKey(id, key)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), binary.NativeEndian.Uint64(value))
+
+	_, err = GetEBPFMapValueByKey(id, binary.NativeEndian.AppendUint32(nil, 2))
+	assert.True(t, errors.Is(err, ebpf.ErrKeyNotExist))
+
+	// wrong key size
+	_, err = GetEBPFMapValueByKey(id, []byte{1})
+	assert.Error(t, err)
+}
+
+func TestDumpEBPFMap(t *testing.T) {
+	m, id := newTestHashMap(t)
+
+	entries, err := DumpEBPFMap(id)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	want := map[uint32]uint64{1: 10, 2: 20, 3: 30}
+	for k, v := range want {
+		require.NoError(t, m.Put(k, v))
+	}
+
+	entries, err = DumpEBPFMap(id)
+	require.NoError(t, err)
+	got := make(map[uint32]uint64)
+	for _, entry := range entries {
+		got[binary.NativeEndian.Uint32(entry["key"])] = binary.NativeEndian.Uint64(entry["value"])
+	}
+	assert.Equal(t, want, got)
+}
+
+// useTestInterfaceAnnotationsMap pins the interface annotations map in a bpffs of the test
+func useTestInterfaceAnnotationsMap(t *testing.T) string {
+	resetInterfaceAnnotationsMap()
+	interfaceAnnotationsPinPath = filepath.Join(mountTestBpffs(t), "kmesh", "iface_annotations")
+	t.Cleanup(func() {
+		resetInterfaceAnnotationsMap()
+		interfaceAnnotationsPinPath = InterfaceAnnotationsPinPath
+	})
+	return interfaceAnnotationsPinPath
+}
+
+func resetInterfaceAnnotationsMap() {
+	interfaceAnnotations.mu.Lock()
+	defer interfaceAnnotations.mu.Unlock()
+	if interfaceAnnotations.m != nil {
+		interfaceAnnotations.m.Close()
+		interfaceAnnotations.m = nil
+	}
+}
+
+func TestInterfaceAnnotations(t *testing.T) {
+	pinPath := useTestInterfaceAnnotationsMap(t)
+
+	link1 := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth1", Index: 11}}
+	link2 := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth2", Index: 12}}
+
+	// reading does not create the map
+	annotations, err := ReadInterfaceAnnotations(link1)
+	require.NoError(t, err)
+	assert.Empty(t, annotations)
+	assert.NoFileExists(t, pinPath)
+	require.NoError(t, ClearInterfaceAnnotations(link1))
+	assert.NoFileExists(t, pinPath)
+
+	require.NoError(t, AnnotateInterface(link1, map[string]string{"pod-uid": "uid-1", "namespace": "default"}))
+	require.NoError(t, AnnotateInterface(link2, map[string]string{"pod-uid": "uid-2"}))
+
+	annotations, err = ReadInterfaceAnnotations(link1)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"pod-uid": "uid-1", "namespace": "default"}, annotations)
+
+	// merge and remove
+	require.NoError(t, AnnotateInterface(link1, map[string]string{"namespace": "", "enrolled-at": "now"}))
+	annotations, err = ReadInterfaceAnnotations(link1)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"pod-uid": "uid-1", "enrolled-at": "now"}, annotations)
+
+	annotations, err = ReadInterfaceAnnotations(link2)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"pod-uid": "uid-2"}, annotations)
+
+	require.NoError(t, AnnotateInterface(link2, map[string]string{"pod-uid": ""}))
+	annotations, err = ReadInterfaceAnnotations(link2)
+	require.NoError(t, err)
+	assert.Empty(t, annotations)
+
+	err = AnnotateInterface(link1, map[string]string{"large": strings.Repeat("x", interfaceAnnotationsValueSize)})
+	assert.Error(t, err)
+
+	// the index of link1 is reused by another interface
+	reused := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth3", Index: 11}}
+	annotations, err = ReadInterfaceAnnotations(reused)
+	require.NoError(t, err)
+	assert.Empty(t, annotations)
+	require.NoError(t, ClearInterfaceAnnotations(reused))
+	annotations, err = ReadInterfaceAnnotations(link1)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"pod-uid": "uid-1", "enrolled-at": "now"}, annotations)
+
+	require.NoError(t, AnnotateInterface(reused, map[string]string{"pod-uid": "uid-3"}))
+	annotations, err = ReadInterfaceAnnotations(reused)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"pod-uid": "uid-3"}, annotations)
+	annotations, err = ReadInterfaceAnnotations(link1)
+	require.NoError(t, err)
+	assert.Empty(t, annotations)
+
+	require.NoError(t, ClearInterfaceAnnotations(reused))
+	annotations, err = ReadInterfaceAnnotations(reused)
+	require.NoError(t, err)
+	assert.Empty(t, annotations)
+}
+
+func TestClearInterfaceAnnotationsOnDelete(t *testing.T) {
+	useTestInterfaceAnnotationsMap(t)
+
+	link1 := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth1", Index: 11}}
+	link2 := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth2", Index: 12}}
+	require.NoError(t, AnnotateInterface(link1, map[string]string{"pod-uid": "uid-1"}))
+	require.NoError(t, AnnotateInterface(link2, map[string]string{"pod-uid": "uid-2"}))
+
+	fake := &FakeInterfaceEvents{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ClearInterfaceAnnotationsOnDelete(ctx, fake.Watch)
+	}()
+	require.Eventually(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.watchers) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// another interface of the index of link2 is deleted, its annotations are kept
+	fake.Send(InterfaceEvent{Name: "veth3", Index: 12, Deleted: true})
+	fake.Send(InterfaceEvent{Name: "veth2", Index: 12, OldFlags: net.FlagUp})
+	fake.Send(InterfaceEvent{Name: "veth1", Index: 11, Deleted: true})
+	require.Eventually(t, func() bool {
+		annotations, err := ReadInterfaceAnnotations(link1)
+		return err == nil && len(annotations) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	annotations, err := ReadInterfaceAnnotations(link2)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"pod-uid": "uid-2"}, annotations)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestDetachTCProgramsByPodUID(t *testing.T) {
+	useTestInterfaceAnnotationsMap(t)
+
+	env := NewTestTCEnvironment(t)
+	testNs, link := env.TestNs, env.Link1
+	prog := newTestSchedClsProg(t, "tc_ut")
+	err := testNs.Do(func(_ ns.NetNS) error {
+		// a second link in the netns of link
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth2"}, PeerName: "veth3"}))
+		peer, err := netlink.LinkByName("veth2")
+		require.NoError(t, err)
+		require.NoError(t, AnnotateInterface(link, map[string]string{InterfaceAnnotationPodUID: "uid-1"}))
+		require.NoError(t, AnnotateInterface(peer, map[string]string{InterfaceAnnotationPodUID: "uid-2"}))
+		require.NoError(t, ManageTCProgram(link, prog, constants.TC_ATTACH))
+		require.NoError(t, ManageTCProgram(peer, prog, constants.TC_ATTACH))
+
+		count, err := DetachTCProgramsByPodUID("uid-1")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+		filters, err := netlink.FilterList(link, netlink.HANDLE_MIN_INGRESS)
+		require.NoError(t, err)
+		assert.Empty(t, filters)
+		filters, err = netlink.FilterList(peer, netlink.HANDLE_MIN_INGRESS)
+		require.NoError(t, err)
+		assert.Len(t, filters, 1)
+		// the annotation of the detached link is cleared
+		annotations, err := ReadInterfaceAnnotations(link)
+		require.NoError(t, err)
+		assert.Empty(t, annotations)
+
+		// already detached
+		count, err = DetachTCProgramsByPodUID("uid-1")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+
+		count, err = DetachTCProgramsByPodUID("uid-3")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+
+		// the annotation left at the index of peer by a deleted interface is not peer's
+		deleted := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-deleted", Index: peer.Attrs().Index}}
+		require.NoError(t, AnnotateInterface(deleted, map[string]string{InterfaceAnnotationPodUID: "uid-4"}))
+		count, err = DetachTCProgramsByPodUID("uid-4")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+		filters, err = netlink.FilterList(peer, netlink.HANDLE_MIN_INGRESS)
+		require.NoError(t, err)
+		assert.Len(t, filters, 1)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestReadProgramVersion(t *testing.T) {
+	prog := newTestVersionedProg(t, "ut_tc_version", TCProgramVersion{Major: 1, Minor: 3})
+	v, err := ReadProgramVersion(prog.FD())
+	require.NoError(t, err)
+	assert.Equal(t, TCProgramVersion{Major: 1, Minor: 3}, v)
+	assert.Equal(t, "v1.3", v.String())
+
+	_, err = ReadProgramVersion(newTestSchedClsProg(t, "ut_tc_noversion").FD())
+	assert.ErrorIs(t, err, ErrNoProgramVersion)
+	_, err = ReadProgramVersion(-1)
+	assert.Error(t, err)
+}
+
+func TestIsCompatible(t *testing.T) {
+	tests := []struct {
+		installed TCProgramVersion
+		required  TCProgramVersion
+		want      bool
+	}{
+		{installed: TCProgramVersion{1, 0}, required: TCProgramVersion{1, 0}, want: true},
+		{installed: TCProgramVersion{1, 3}, required: TCProgramVersion{1, 2}, want: true},
+		{installed: TCProgramVersion{1, 1}, required: TCProgramVersion{1, 2}, want: false},
+		{installed: TCProgramVersion{2, 0}, required: TCProgramVersion{1, 2}, want: false},
+		{installed: TCProgramVersion{1, 9}, required: TCProgramVersion{2, 0}, want: false},
+		{installed: TCProgramVersion{0, 3}, required: TCProgramVersion{0, 3}, want: true},
+		{installed: TCProgramVersion{0, 4}, required: TCProgramVersion{0, 3}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.installed.String()+"/"+tt.required.String(), func(t *testing.T) {
+			assert.Equal(t, tt.want, IsCompatible(tt.installed, tt.required))
+		})
+	}
+}
+
+func TestCloneTCFilter(t *testing.T) {
+	chain := uint32(3)
+	newFilter := func() *netlink.BpfFilter {
+		return &netlink.BpfFilter{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: 7,
+				Parent:    netlink.HANDLE_MIN_INGRESS,
+				Handle:    1,
+				Protocol:  unix.ETH_P_ALL,
+				Priority:  1,
+				Chain:     &chain,
+			},
+			Fd:           42,
+			Name:         "tc_ingress-eth0",
+			DirectAction: true,
+		}
+	}
+	egress := TCDirection(constants.TC_EGRESS)
+	handle := uint32(5)
+	priority := uint16(30)
+
+	tests := []struct {
+		name      string
+		filter    func(f *netlink.BpfFilter)
+		overrides TCFilterOverrides
+		want      func(f *netlink.BpfFilter)
+		wantErr   string
+	}{
+		{
+			name: "no override",
+		},
+		{
+			name:      "direction",
+			overrides: TCFilterOverrides{Direction: &egress},
+			want: func(f *netlink.BpfFilter) {
+				f.Parent = netlink.HANDLE_MIN_EGRESS
+				f.Name = "tc_egress-eth0"
+			},
+		},
+		{
+			name:      "direction keeps a custom name",
+			filter:    func(f *netlink.BpfFilter) { f.Name = "kmesh_policy" },
+			overrides: TCFilterOverrides{Direction: &egress},
+			want:      func(f *netlink.BpfFilter) { f.Parent = netlink.HANDLE_MIN_EGRESS },
+		},
+		{
+			name:      "handle",
+			overrides: TCFilterOverrides{Handle: &handle},
+			want:      func(f *netlink.BpfFilter) { f.Handle = 5 },
+		},
+		{
+			name:      "priority",
+			overrides: TCFilterOverrides{Priority: &priority},
+			want:      func(f *netlink.BpfFilter) { f.Priority = 30 },
+		},
+		{
+			name:      "all",
+			overrides: TCFilterOverrides{Direction: &egress, Handle: &handle, Priority: &priority},
+			want: func(f *netlink.BpfFilter) {
+				f.Parent = netlink.HANDLE_MIN_EGRESS
+				f.Name = "tc_egress-eth0"
+				f.Handle = 5
+				f.Priority = 30
+			},
+		},
+		{
+			name:      "zero handle",
+			overrides: TCFilterOverrides{Handle: new(uint32)},
+			wantErr:   "handle must not be 0",
+		},
+		{
+			name:    "root parent",
+			filter:  func(f *netlink.BpfFilter) { f.Parent = netlink.HANDLE_ROOT },
+			wantErr: "neither the ingress nor the egress",
+		},
+		{
+			name:    "class of a direct action filter",
+			filter:  func(f *netlink.BpfFilter) { f.ClassId = netlink.MakeHandle(1, 1) },
+			wantErr: "ignored by a direct action filter",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := newFilter()
+			if tt.filter != nil {
+				tt.filter(filter)
+			}
+			want := *filter
+			if tt.want != nil {
+				tt.want(&want)
+			}
+			before := *filter
+
+			got, err := CloneTCFilter(filter, tt.overrides)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, &want, got)
+			// filter is unchanged and shares nothing with the clone
+			assert.Equal(t, before, *filter)
+			if filter.Chain != nil {
+				assert.NotSame(t, filter.Chain, got.Chain)
+			}
+		})
+	}
+
+	_, err := CloneTCFilter(nil, TCFilterOverrides{})
+	assert.Error(t, err)
+	invalid := TCDirection(5)
+	_, err = CloneTCFilter(newFilter(), TCFilterOverrides{Direction: &invalid})
+	assert.ErrorContains(t, err, "invalid tc direction 5")
+}
+
+func TestBPFMapID(t *testing.T) {
+	m, id := newTestHashMap(t)
+
+	got, err := GetBPFMapID(m.FD())
+	require.NoError(t, err)
+	assert.Equal(t, id, got)
+
+	fd, err := OpenBPFMapByID(id)
+	require.NoError(t, err)
+	defer unix.Close(fd)
+	assert.NotEqual(t, m.FD(), fd)
+	got, err = GetBPFMapID(fd)
+	require.NoError(t, err)
+	assert.Equal(t, id, got)
+
+	_, err = GetBPFMapID(-1)
+	assert.Error(t, err)
+	// not a map
+	_, err = GetBPFMapID(int(os.Stdin.Fd()))
+	assert.Error(t, err)
+	_, err = OpenBPFMapByID(math.MaxUint32)
+	assert.Error(t, err)
+}
+
+func TestBPFMapUpdaterPersistRestore(t *testing.T) {
+	m, id := newTestHashMap(t)
+	u := BPFMapUpdater{MapID: id}
+
+	state := &netnsapi.NetnsEnrollmentState{}
+	require.NoError(t, u.Persist(state))
+	// persisting twice does not duplicate the id
+	require.NoError(t, u.Persist(state))
+	assert.Equal(t, []uint32{id}, state.BpfMapIds)
+
+	var restored BPFMapUpdater
+	require.NoError(t, restored.Restore(state.BpfMapIds[0]))
+	assert.Equal(t, id, restored.MapID)
+	require.NoError(t, restored.UpdateEntry(binary.NativeEndian.AppendUint32(nil, 1), binary.NativeEndian.AppendUint64(nil, 10)))
+	var v uint64
+	require.NoError(t, m.Lookup(uint32(1), &v))
+	assert.Equal(t, uint64(10), v)
+
+	gone := BPFMapUpdater{MapID: math.MaxUint32}
+	assert.Error(t, gone.Persist(state))
+	assert.Equal(t, []uint32{id}, state.BpfMapIds)
+	assert.Error(t, restored.Restore(math.MaxUint32))
+	assert.Equal(t, id, restored.MapID)
+}
+
+func TestBPFMapUpdater(t *testing.T) {
+	m, id := newTestHashMap(t)
+	u := BPFMapUpdater{MapID: id}
+	key := func(k uint32) []byte {
+		return binary.NativeEndian.AppendUint32(nil, k)
+	}
+	value := func(v uint64) []byte {
+		return binary.NativeEndian.AppendUint64(nil, v)
+	}
+	lookup := func(k uint32) (uint64, error) {
+		var v uint64
+		err := m.Lookup(k, &v)
+		return v, err
+	}
+
+	require.NoError(t, u.UpdateEntry(key(1), value(10)))
+	v, err := lookup(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), v)
+
+	require.NoError(t, u.DeleteEntry(key(1)))
+	_, err = lookup(1)
+	assert.True(t, errors.Is(err, ebpf.ErrKeyNotExist))
+	assert.True(t, errors.Is(u.DeleteEntry(key(1)), ebpf.ErrKeyNotExist))
+
+	t.Run("batch", func(t *testing.T) {
+		err := u.BatchUpdate([]BPFMapEntry{{Key: key(2), Value: value(20)}, {Key: key(3), Value: value(30)}})
+		require.NoError(t, err)
+		v, err := lookup(3)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(30), v)
+	})
+
+	t.Run("batch not supported", func(t *testing.T) {
+		calls := 0
+		patches := gomonkey.ApplyMethodFunc(reflect.TypeOf(m), "BatchUpdate", func(_, _ interface{}, _ *ebpf.BatchOptions) (int, error) {
+			calls++
+			return 0, ebpf.ErrNotSupported
+		})
+		defer patches.Reset()
+
+		err := u.BatchUpdate([]BPFMapEntry{{Key: key(4), Value: value(40)}, {Key: key(5), Value: value(50)}})
+		require.NoError(t, err)
+		assert.Equal(t, 1, calls)
+		v, err := lookup(5)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(50), v)
+	})
+
+	assert.Error(t, u.BatchUpdate([]BPFMapEntry{{Key: []byte{1}, Value: value(1)}}))
+	assert.Error(t, u.BatchUpdate([]BPFMapEntry{{Key: key(6), Value: []byte{1}}}))
+}
+
+func TestGetProgramLoadTime(t *testing.T) {
+	before := time.Now()
+	prog := newTestSchedClsProg(t, "ut_load_time")
+
+	loadTime, err := GetProgramLoadTime(prog.FD())
+	require.NoError(t, err)
+	// the boot time clock and the wall clock are read at different times
+	assert.WithinDuration(t, before, loadTime, time.Second)
+	assert.WithinDuration(t, time.Now(), loadTime, time.Second)
+
+	// the fd is still usable
+	_, err = prog.Info()
+	assert.NoError(t, err)
+
+	_, err = GetProgramLoadTime(-1)
+	assert.Error(t, err)
+}
+
+type mockMTUProbeSocket struct {
+	sendErr error
+	pathMTU int
+	// replies are built from the sent request
+	replies []func(req []byte) []byte
+	sent    []byte
+}
+
+func (s *mockMTUProbeSocket) Send(b []byte) error {
+	s.sent = b
+	return s.sendErr
+}
+
+func (s *mockMTUProbeSocket) Recv(b []byte, _ time.Duration) (int, error) {
+	if len(s.replies) == 0 {
+		return 0, unix.EAGAIN
+	}
+	reply := s.replies[0](s.sent)
+	s.replies = s.replies[1:]
+	return copy(b, reply), nil
+}
+
+func (s *mockMTUProbeSocket) PathMTU() (int, error) {
+	return s.pathMTU, nil
+}
+
+func (s *mockMTUProbeSocket) Close() error {
+	return nil
+}
+
+func newTestIPv4Packet(payload []byte) []byte {
+	header := make([]byte, ipv4MinHeaderLen)
+	header[0] = 0x45
+	header[9] = unix.IPPROTO_ICMP
+	return append(header, payload...)
+}
+
+func TestMTUProbe(t *testing.T) {
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0", MTU: 1500}}
+	echoReply := func(req []byte) []byte {
+		reply := slices.Clone(req)
+		reply[0] = icmpEchoReply
+		return newTestIPv4Packet(reply)
+	}
+	fragNeeded := func(mtu uint16) func(req []byte) []byte {
+		return func(req []byte) []byte {
+			msg := make([]byte, icmpHeaderLen)
+			msg[0], msg[1] = icmpDstUnreach, icmpFragNeeded
+			binary.BigEndian.PutUint16(msg[6:8], mtu)
+			return newTestIPv4Packet(append(msg, newTestIPv4Packet(req[:icmpHeaderLen])...))
+		}
+	}
+	unrelated := func(req []byte) []byte {
+		return newTestIPv4Packet(newICMPEcho(1, 1, icmpHeaderLen))
+	}
+
+	tests := []struct {
+		name      string
+		targetMTU int
+		sock      *mockMTUProbeSocket
+		wantErr   bool
+		wantMTU   int
+	}{
+		{
+			name:      "delivered",
+			targetMTU: 1400,
+			sock:      &mockMTUProbeSocket{replies: []func([]byte) []byte{unrelated, echoReply}},
+		},
+		{
+			name:      "fragmentation needed",
+			targetMTU: 1400,
+			sock:      &mockMTUProbeSocket{replies: []func([]byte) []byte{fragNeeded(1300)}},
+			wantErr:   true,
+			wantMTU:   1300,
+		},
+		{
+			name:      "larger than known path mtu",
+			targetMTU: 1400,
+			sock:      &mockMTUProbeSocket{sendErr: unix.EMSGSIZE, pathMTU: 1280},
+			wantErr:   true,
+			wantMTU:   1280,
+		},
+		{
+			name:      "larger than link mtu",
+			targetMTU: 9000,
+			sock:      &mockMTUProbeSocket{},
+			wantErr:   true,
+			wantMTU:   1500,
+		},
+		{
+			name:      "no reply",
+			targetMTU: 1400,
+			sock:      &mockMTUProbeSocket{replies: []func([]byte) []byte{unrelated}},
+			wantErr:   true,
+		},
+		{
+			name:      "invalid target mtu",
+			targetMTU: 10,
+			sock:      &mockMTUProbeSocket{},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patches := gomonkey.NewPatches()
+			defer patches.Reset()
+			patches.ApplyFunc(newRawMTUProbeSocket, func(netlink.Link) (mtuProbeSocket, error) {
+				return tt.sock, nil
+			})
+
+			err := MTUProbe(link, tt.targetMTU)
+			if !tt.wantErr {
+				assert.NoError(t, err)
+				assert.Len(t, tt.sock.sent, tt.targetMTU-ipv4MinHeaderLen)
+				assert.Equal(t, uint16(0), icmpChecksum(tt.sock.sent))
+				return
+			}
+			assert.Error(t, err)
+			var mtuErr *ErrMTUTooSmall
+			if tt.wantMTU == 0 {
+				assert.False(t, errors.As(err, &mtuErr))
+				return
+			}
+			require.True(t, errors.As(err, &mtuErr))
+			assert.Equal(t, ErrMTUTooSmall{Actual: tt.wantMTU, Required: tt.targetMTU}, *mtuErr)
+		})
+	}
+}
+
+func TestInterfaceClassifier(t *testing.T) {
+	addrs := map[string][]netlink.Addr{
+		"eth0": {{IPNet: &net.IPNet{IP: net.ParseIP("10.244.1.5"), Mask: net.CIDRMask(24, 32)}}},
+		"net1": {{IPNet: &net.IPNet{IP: net.ParseIP("192.168.10.5"), Mask: net.CIDRMask(24, 32)}}},
+	}
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(netlink.AddrList, func(link netlink.Link, _ int) ([]netlink.Addr, error) {
+		return addrs[link.Attrs().Name], nil
+	})
+	newLink := func(name, mac string) netlink.Link {
+		hw, _ := net.ParseMAC(mac)
+		return &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name, HardwareAddr: hw}}
+	}
+
+	tests := []struct {
+		name    string
+		rules   []ClassificationRule
+		link    netlink.Link
+		want    PolicyClass
+		wantErr bool
+	}{
+		{
+			name:  "name pattern",
+			rules: []ClassificationRule{{Class: PolicyClassObservability, NamePattern: "net*"}, {Class: PolicyClassMesh, NamePattern: "eth*"}},
+			link:  newLink("eth0", "02:42:ac:11:00:02"),
+			want:  PolicyClassMesh,
+		},
+		{
+			name:  "mac prefix",
+			rules: []ClassificationRule{{Class: PolicyClassObservability, MACPrefix: "02:42"}},
+			link:  newLink("net1", "02:42:ac:11:00:02"),
+			want:  PolicyClassObservability,
+		},
+		{
+			name:    "mac prefix mismatch",
+			rules:   []ClassificationRule{{Class: PolicyClassObservability, MACPrefix: "02:43"}},
+			link:    newLink("net1", "02:42:ac:11:00:02"),
+			wantErr: true,
+		},
+		{
+			name:  "cidr",
+			rules: []ClassificationRule{{Class: PolicyClassObservability, CIDR: "192.168.0.0/16"}, {Class: PolicyClassMesh, CIDR: "10.244.0.0/16"}},
+			link:  newLink("eth0", "02:42:ac:11:00:02"),
+			want:  PolicyClassMesh,
+		},
+		{
+			name:  "all conditions match",
+			rules: []ClassificationRule{{Class: PolicyClassObservability, NamePattern: "eth*", CIDR: "192.168.0.0/16"}, {Class: PolicyClassMesh, NamePattern: "eth*"}},
+			link:  newLink("eth0", "02:42:ac:11:00:02"),
+			want:  PolicyClassMesh,
+		},
+		{
+			name:    "no rule",
+			link:    newLink("eth0", "02:42:ac:11:00:02"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewInterfaceClassifier(tt.rules...)
+			require.NoError(t, err)
+			class, err := c.Classify(tt.link)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrInterfaceNotClassified))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, class)
+		})
+	}
+
+	for _, rule := range []ClassificationRule{
+		{NamePattern: "eth*"},
+		{Class: PolicyClassMesh},
+		{Class: PolicyClassMesh, NamePattern: "[eth"},
+		{Class: PolicyClassMesh, MACPrefix: "0242"},
+		{Class: PolicyClassMesh, MACPrefix: "02:zz"},
+		{Class: PolicyClassMesh, CIDR: "10.0.0.0"},
+	} {
+		_, err := NewInterfaceClassifier(rule)
+		assert.Error(t, err, "%+v", rule)
+	}
+}
+
+func TestInterfaceClassifierLoadFromConfigMap(t *testing.T) {
+	c, err := NewInterfaceClassifier(ClassificationRule{Class: PolicyClassMesh, NamePattern: "*"})
+	require.NoError(t, err)
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "net1"}}
+
+	cm := &corev1.ConfigMap{Data: map[string]string{InterfaceClassesConfigMapKey: `
+- class: observability
+  namePattern: "net*"
+- class: mesh
+  namePattern: "*"
+`}}
+	require.NoError(t, c.LoadFromConfigMap(cm))
+	class, err := c.Classify(link)
+	require.NoError(t, err)
+	assert.Equal(t, PolicyClassObservability, class)
+
+	// invalid rules are not loaded
+	cm.Data[InterfaceClassesConfigMapKey] = `- class: mesh`
+	assert.Error(t, c.LoadFromConfigMap(cm))
+	cm.Data[InterfaceClassesConfigMapKey] = `{`
+	assert.Error(t, c.LoadFromConfigMap(cm))
+	assert.Error(t, c.LoadFromConfigMap(&corev1.ConfigMap{}))
+	class, err = c.Classify(link)
+	require.NoError(t, err)
+	assert.Equal(t, PolicyClassObservability, class)
+}
+
+func TestVerifyKernelBPFFeatures(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	resetCache := func() {
+		bpfFeaturesCache.probed, bpfFeaturesCache.supported = 0, 0
+	}
+	defer func() {
+		patches.Reset()
+		resetCache()
+	}()
+
+	probed, notSupported, inconclusive := 0, 0, 0
+	supported := func() error {
+		probed++
+		return nil
+	}
+	var ringBufErr error = errors.New("permission denied")
+	patches.ApplyFunc(probeBPFFeature, func(feature BPFFeatureSet) error {
+		switch feature {
+		case BPFFeatureMultiProg:
+			notSupported++
+			return fmt.Errorf("tcx: %w", ebpf.ErrNotSupported)
+		case BPFFeatureRingBuf:
+			inconclusive++
+			return ringBufErr
+		}
+		return supported()
+	})
+	resetCache()
+
+	// only the required features are probed
+	assert.NoError(t, requireBPFFeatures(BPFFeatureTC))
+	assert.Equal(t, 1, probed)
+	assert.EqualError(t, requireBPFFeatures(BPFFeatureTC|BPFFeatureMultiProg),
+		"bpf features multi-prog are not supported by the kernel")
+	assert.Equal(t, 1, probed)
+	assert.Equal(t, 1, notSupported)
+
+	// the inconclusive probe of ringbuf does not rule it out
+	set := VerifyKernelBPFFeatures()
+	assert.Equal(t, BPFFeatureTC|BPFFeatureMapInMap|BPFFeatureRingBuf|BPFFeaturePerCPUMap, set)
+	assert.Equal(t, "tc|map-in-map|ringbuf|percpu-map", set.String())
+	assert.True(t, set.Has(BPFFeatureTC|BPFFeatureMapInMap))
+	assert.False(t, set.Has(BPFFeatureTC|BPFFeatureMultiProg))
+
+	// every result is cached, the inconclusive ones too
+	ringBufErr = fmt.Errorf("ringbuf: %w", ebpf.ErrNotSupported)
+	assert.Equal(t, set, VerifyKernelBPFFeatures())
+	assert.NoError(t, requireBPFFeatures(BPFFeatureTC|BPFFeatureRingBuf))
+	assert.Equal(t, 3, probed)
+	assert.Equal(t, 1, notSupported)
+	assert.Equal(t, 1, inconclusive)
+
+	// attaching is refused without tc support
+	patches.ApplyFunc(probeBPFFeature, func(_ BPFFeatureSet) error {
+		return ebpf.ErrNotSupported
+	})
+	resetCache()
+	assert.Equal(t, "none", VerifyKernelBPFFeatures().String())
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth", Index: 1}}
+	assert.EqualError(t, ManageTCProgramByFd(link, 0, constants.TC_ATTACH, 0), "bpf features tc are not supported by the kernel")
+	_, err := NewTCManager().DryRun(TCPolicy{Link: link, ProgramName: "tc_ingress"})
+	assert.Error(t, err)
+}
+
+func TestGetNumPrograms(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+
+	bpfFilters := func(n int) []netlink.Filter {
+		filters := make([]netlink.Filter, n)
+		for i := range filters {
+			filters[i] = &netlink.BpfFilter{}
+		}
+		return filters
+	}
+
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth", Index: 1}}
+	tests := []struct {
+		name    string
+		filters []netlink.Filter
+		want    int
+	}{
+		{name: "no filters"},
+		{name: "one program", filters: bpfFilters(1), want: 1},
+		{name: "max programs", filters: bpfFilters(64), want: 64},
+		{
+			name: "filters without bpf are not counted",
+			filters: append(bpfFilters(2),
+				&netlink.MatchAll{Actions: []netlink.Action{netlink.NewPoliceAction()}},
+				&netlink.Flower{Actions: []netlink.Action{&netlink.GenericAction{}}},
+			),
+			want: 2,
+		},
+		{
+			name: "bpf actions are counted",
+			filters: []netlink.Filter{
+				&netlink.U32{Actions: []netlink.Action{&netlink.GenericAction{}, &netlink.BpfAction{Fd: 3}}},
+				&netlink.MatchAll{Actions: []netlink.Action{&netlink.BpfAction{Fd: 4}}},
+			},
+			want: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var parents []uint32
+			patches.ApplyFunc(netlink.FilterList, func(_ netlink.Link, parent uint32) ([]netlink.Filter, error) {
+				parents = append(parents, parent)
+				return tt.filters, nil
+			})
+			n, err := GetNumPrograms(link, constants.TC_EGRESS)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, n)
+			assert.Equal(t, []uint32{netlink.HANDLE_MIN_EGRESS}, parents)
+		})
+	}
+
+	patches.ApplyFunc(netlink.FilterList, func(_ netlink.Link, _ uint32) ([]netlink.Filter, error) {
+		return nil, errors.New("no such device")
+	})
+	_, err := GetNumPrograms(link, constants.TC_INGRESS)
+	assert.ErrorContains(t, err, "no such device")
+	_, err = GetNumPrograms(link, TCDirection(5))
+	assert.Error(t, err)
+
+	assert.Equal(t, 64, GetMaxSupportedPrograms(constants.TC_INGRESS))
+	assert.Equal(t, 64, GetMaxSupportedPrograms(constants.TC_EGRESS))
+	assert.Equal(t, 0, GetMaxSupportedPrograms(TCDirection(5)))
+}
+
+func TestSafeDetach(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth", Index: 1}}
+	clsact := []netlink.Qdisc{&netlink.GenericQdisc{QdiscType: "clsact"}}
+	filters := []netlink.Filter{&netlink.BpfFilter{}, &netlink.MatchAll{}, &netlink.BpfFilter{}}
+
+	tests := []struct {
+		name      string
+		qdiscs    []netlink.Qdisc
+		qdiscErr  error
+		filterErr error
+		delErr    error
+		wantDel   int
+		wantErr   error
+	}{
+		{name: "detach", qdiscs: clsact, wantDel: 2},
+		{name: "no clsact qdisc", qdiscs: []netlink.Qdisc{&netlink.GenericQdisc{QdiscType: "noqueue"}}},
+		{name: "link removed", qdiscErr: unix.ENODEV},
+		{name: "qdisc list denied", qdiscErr: unix.EPERM, wantErr: unix.EPERM},
+		{name: "qdisc removed", qdiscs: clsact, filterErr: unix.ENOENT},
+		{name: "filter list denied", qdiscs: clsact, filterErr: unix.EPERM, wantErr: unix.EPERM},
+		{name: "filter removed", qdiscs: clsact, delErr: unix.ENOENT, wantDel: 2},
+		{name: "filter delete denied", qdiscs: clsact, delErr: unix.EPERM, wantDel: 2, wantErr: unix.EPERM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deleted := 0
+			patches.ApplyFunc(netlink.QdiscList, func(_ netlink.Link) ([]netlink.Qdisc, error) {
+				return tt.qdiscs, tt.qdiscErr
+			})
+			patches.ApplyFunc(netlink.FilterList, func(_ netlink.Link, parent uint32) ([]netlink.Filter, error) {
+				assert.Equal(t, uint32(netlink.HANDLE_MIN_INGRESS), parent)
+				return filters, tt.filterErr
+			})
+			patches.ApplyFunc(netlink.FilterDel, func(_ netlink.Filter) error {
+				deleted++
+				return tt.delErr
+			})
+
+			err := SafeDetach(link, constants.TC_INGRESS)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.False(t, IsSafeDetachError(err))
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantDel, deleted)
+		})
+	}
+
+	assert.Error(t, SafeDetach(link, TCDirection(5)))
+	assert.True(t, IsSafeDetachError(fmt.Errorf("wrapped: %w", unix.ENOENT)))
+	assert.True(t, IsSafeDetachError(unix.ENODEV))
+	assert.False(t, IsSafeDetachError(unix.EPERM))
+	assert.False(t, IsSafeDetachError(nil))
+}
+
+func TestBPFProgramPinner(t *testing.T) {
+	baseDir := mountTestBpffs(t)
+	p := BPFProgramPinner{BaseDir: baseDir}
+	prog := newTestSchedClsProg(t, "ut_pin")
+
+	names, err := p.ListPinnedPrograms()
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	path, err := p.PinProgram("ut_pin", prog.FD())
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(baseDir, "kmesh", "schedcls", "ut_pin"), path)
+	assert.Equal(t, path, p.ProgramPath(ebpf.SchedCLS, "ut_pin"))
+
+	// pinning the same name again is refused by the bpffs
+	_, err = p.PinProgram("ut_pin", prog.FD())
+	assert.Error(t, err)
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		_, err = p.PinProgram(name, prog.FD())
+		assert.ErrorContains(t, err, "invalid pinned program name")
+	}
+
+	xdp, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.XDP,
+		Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, 2), asm.Return()},
+		License:      "GPL",
+	})
+	require.NoError(t, err)
+	defer xdp.Close()
+	path, err = p.PinProgram("ut_xdp", xdp.FD())
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(baseDir, "kmesh", "xdp", "ut_xdp"), path)
+	// names are unique across the program types
+	_, err = p.PinProgram("ut_pin", xdp.FD())
+	assert.ErrorContains(t, err, "already pinned")
+
+	names, err = p.ListPinnedPrograms()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ut_pin", "ut_xdp"}, names)
+
+	fd, err := p.OpenPinnedProgram("ut_pin")
+	require.NoError(t, err)
+	opened, err := ebpf.NewProgramFromFD(fd)
+	require.NoError(t, err)
+	assert.Equal(t, progID(t, prog), progID(t, opened))
+	opened.Close()
+
+	require.NoError(t, p.UnpinProgram("ut_pin"))
+	_, err = p.OpenPinnedProgram("ut_pin")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.ErrorIs(t, p.UnpinProgram("ut_pin"), os.ErrNotExist)
+	names, err = p.ListPinnedPrograms()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ut_xdp"}, names)
+}
+
+func TestRateLimitedTCAttach(t *testing.T) {
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth", Index: 1}}
+
+	// newAttach returns the fds of the operations run so far with the attach
+	newAttach := func(limit rate.Limit, burst int, strategy BackpressureStrategy) (*RateLimitedTCAttach, func() []int) {
+		a := NewRateLimitedTCAttach(limit, burst, strategy)
+		var mu sync.Mutex
+		var fds []int
+		a.manage = func(_ netlink.Link, tcFd int, _ int, _ uint16) error {
+			mu.Lock()
+			defer mu.Unlock()
+			fds = append(fds, tcFd)
+			return nil
+		}
+		return a, func() []int {
+			mu.Lock()
+			defer mu.Unlock()
+			return slices.Clone(fds)
+		}
+	}
+
+	t.Run("drop", func(t *testing.T) {
+		a, fds := newAttach(1, 2, BackpressureDrop)
+		var dropped int
+		for i := 0; i < 5; i++ {
+			if err := a.ManageTCProgramByFd(link, i, constants.TC_ATTACH, 0); err != nil {
+				assert.ErrorIs(t, err, ErrTCAttachRateLimited)
+				dropped++
+			}
+		}
+		assert.Equal(t, 3, dropped)
+		assert.Equal(t, []int{0, 1}, fds())
+	})
+
+	t.Run("block", func(t *testing.T) {
+		a, fds := newAttach(50, 1, BackpressureBlock)
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			require.NoError(t, a.ManageTCProgramByFd(link, i, constants.TC_ATTACH, 0))
+		}
+		// the first operation uses the burst, the others wait 20ms each
+		assert.GreaterOrEqual(t, time.Since(start), 70*time.Millisecond)
+		assert.Equal(t, []int{0, 1, 2, 3, 4}, fds())
+	})
+
+	// inodeAttach returns the inodes of the fds of the operations run so far with the attach,
+	// the deferred operations run on duplicates of the fds. release is called by the operations
+	// before they return.
+	inodeAttach := func(limit rate.Limit, burst int, release func()) (*RateLimitedTCAttach, func() []uint64) {
+		a := NewRateLimitedTCAttach(limit, burst, BackpressureDefer)
+		var mu sync.Mutex
+		var inodes []uint64
+		a.manage = func(_ netlink.Link, tcFd int, _ int, _ uint16) error {
+			var stat unix.Stat_t
+			require.NoError(t, unix.Fstat(tcFd, &stat))
+			mu.Lock()
+			inodes = append(inodes, stat.Ino)
+			mu.Unlock()
+			release()
+			return nil
+		}
+		return a, func() []uint64 {
+			mu.Lock()
+			defer mu.Unlock()
+			return slices.Clone(inodes)
+		}
+	}
+	// newPipeFd returns an fd closed once the test completes and its inode
+	newPipeFd := func(t *testing.T) (*os.File, uint64) {
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		w.Close()
+		t.Cleanup(func() {
+			r.Close()
+		})
+		var stat unix.Stat_t
+		require.NoError(t, unix.Fstat(int(r.Fd()), &stat))
+		return r, stat.Ino
+	}
+
+	t.Run("defer", func(t *testing.T) {
+		a, inodes := inodeAttach(50, 1, func() {})
+		var want []uint64
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			f, inode := newPipeFd(t)
+			want = append(want, inode)
+			require.NoError(t, a.ManageTCProgramByFd(link, int(f.Fd()), constants.TC_ATTACH, 0))
+			// the caller does not keep its fd for the deferred operation
+			f.Close()
+		}
+		assert.Less(t, time.Since(start), 20*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			return len(inodes()) == 5
+		}, time.Second, 10*time.Millisecond)
+		assert.GreaterOrEqual(t, time.Since(start), 70*time.Millisecond)
+		a.Close()
+		assert.Equal(t, want, inodes())
+	})
+
+	t.Run("defer order", func(t *testing.T) {
+		// the deferred operation is held until released
+		running, release := make(chan struct{}, 3), make(chan struct{})
+		a, inodes := inodeAttach(rate.Every(20*time.Millisecond), 1, func() {
+			running <- struct{}{}
+			<-release
+		})
+		defer a.Close()
+		f0, inode0 := newPipeFd(t)
+		f1, inode1 := newPipeFd(t)
+		f2, inode2 := newPipeFd(t)
+
+		go func() {
+			release <- struct{}{}
+		}()
+		require.NoError(t, a.ManageTCProgramByFd(link, int(f0.Fd()), constants.TC_ATTACH, 0))
+		<-running
+		require.NoError(t, a.ManageTCProgramByFd(link, int(f1.Fd()), constants.TC_ATTACH, 0))
+		<-running
+		// the limiter allows f2, which must not overtake the deferred f1 still running
+		time.Sleep(40 * time.Millisecond)
+		require.NoError(t, a.ManageTCProgramByFd(link, int(f2.Fd()), constants.TC_ATTACH, 0))
+		assert.Equal(t, []uint64{inode0, inode1}, inodes())
+		release <- struct{}{}
+		<-running
+		release <- struct{}{}
+		assert.Equal(t, []uint64{inode0, inode1, inode2}, inodes())
+	})
+
+	t.Run("defer queue full", func(t *testing.T) {
+		a, _ := newAttach(rate.Every(time.Hour), 1, BackpressureDefer)
+		defer a.Close()
+		require.NoError(t, a.ManageTCProgramByFd(link, 0, constants.TC_ATTACH, 0))
+		for i := 0; i < DefaultTCAttachQueueSize; i++ {
+			require.NoError(t, a.ManageTCProgramByFd(link, 1, constants.TC_ATTACH, 0))
+		}
+		// the worker may hold one operation out of the queue
+		err := a.ManageTCProgramByFd(link, 1, constants.TC_ATTACH, 0)
+		if err == nil {
+			err = a.ManageTCProgramByFd(link, 1, constants.TC_ATTACH, 0)
+		}
+		assert.ErrorIs(t, err, ErrTCAttachRateLimited)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		for _, strategy := range []BackpressureStrategy{BackpressureDrop, BackpressureBlock, BackpressureDefer} {
+			a, inodes := inodeAttach(rate.Every(time.Hour), 1, func() {})
+			a.strategy = strategy
+			a.Close()
+			f, _ := newPipeFd(t)
+			assert.ErrorIs(t, a.ManageTCProgramByFd(link, int(f.Fd()), constants.TC_ATTACH, 0), ErrTCAttachClosed)
+			// rate limited, nothing is queued either
+			assert.ErrorIs(t, a.ManageTCProgramByFd(link, int(f.Fd()), constants.TC_ATTACH, 0), ErrTCAttachClosed)
+			assert.Zero(t, a.pending)
+			assert.Empty(t, inodes())
+		}
+	})
+}
+
+func TestGetInterfaceRxStats(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	testNs, link := env.TestNs, env.Link1
+
+	err := testNs.Do(func(_ ns.NetNS) error {
+		before, err := GetInterfaceRxStats(link)
+		require.NoError(t, err)
+
+		// send a frame out of veth0
+		fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+		require.NoError(t, err)
+		defer unix.Close(fd)
+		frame := make([]byte, 64)
+		copy(frame, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+		binary.BigEndian.PutUint16(frame[12:], unix.ETH_P_IP)
+		require.NoError(t, unix.Sendto(fd, frame, 0, &unix.SockaddrLinklayer{Ifindex: link.Attrs().Index}))
+
+		// assert.Eventually polls from another thread, which is not in testNs
+		var delta InterfaceStats
+		for i := 0; i < 100 && delta.TxPackets == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+			after, err := GetInterfaceRxStats(link)
+			require.NoError(t, err)
+			delta = DiffStats(*before, *after)
+		}
+		// the kernel may send ipv6 neighbor discovery packets as well
+		assert.GreaterOrEqual(t, delta.TxPackets, uint64(1))
+		assert.GreaterOrEqual(t, delta.TxBytes, uint64(64))
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = GetInterfaceRxStats(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "not-exist", Index: 1 << 30}})
+	assert.Error(t, err)
+}
+
+func TestDiffStats(t *testing.T) {
+	before := InterfaceStats{RxPackets: 10, TxPackets: 20, RxBytes: 1000, TxBytes: 2000, RxDropped: 1, TxDropped: 2}
+	after := InterfaceStats{RxPackets: 15, TxPackets: 20, RxBytes: 1500, TxBytes: 2600, RxDropped: 1, TxDropped: 5}
+	assert.Equal(t, InterfaceStats{RxPackets: 5, RxBytes: 500, TxBytes: 600, TxDropped: 3}, DiffStats(before, after))
+	assert.Equal(t, InterfaceStats{}, DiffStats(after, after))
+
+	// the counters of a recreated interface start from 0 again
+	reset := InterfaceStats{RxPackets: 3, RxBytes: 300}
+	assert.Equal(t, reset, DiffStats(before, reset))
+}
+
+func TestGetLinkNamespace(t *testing.T) {
+	// a process in a netns of its own
+	cmd := exec.Command("unshare", "--net", "sleep", "60")
+	require.NoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	var peerNetns unix.Stat_t
+	require.Eventually(t, func() bool {
+		var self unix.Stat_t
+		_ = unix.Stat("/proc/self/ns/net", &self)
+		err := unix.Stat(fmt.Sprintf("/proc/%d/ns/net", cmd.Process.Pid), &peerNetns)
+		return err == nil && peerNetns.Ino != self.Ino
+	}, 5*time.Second, 10*time.Millisecond)
+
+	t.Setenv(HostProcRootEnv, "/proc")
+
+	env := NewTestTCEnvironment(t)
+	err := env.Do(func() error {
+		// no process is in the netns of the peer
+		_, err := GetLinkNamespace(env.Link1)
+		assert.ErrorContains(t, err, "not found")
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = env.PeerNs.Do(func(_ ns.NetNS) error {
+		return netlink.LinkSetNsPid(env.Link2, cmd.Process.Pid)
+	})
+	require.NoError(t, err)
+	err = env.Do(func() error {
+		link, err := netlink.LinkByName(env.Link1.Attrs().Name)
+		require.NoError(t, err)
+		nsPath, err := GetLinkNamespace(link)
+		require.NoError(t, err)
+		var stat unix.Stat_t
+		require.NoError(t, unix.Stat(nsPath, &stat))
+		assert.Equal(t, peerNetns.Ino, stat.Ino)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestGetVethPeerLink(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	// the path of PeerNs is the one of the thread it was created by
+	patches.ApplyFunc(GetLinkNamespace, func(link netlink.Link) (string, error) {
+		return fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), env.PeerNs.Fd()), nil
+	})
+
+	require.NoError(t, env.Do(func() error {
+		addLink := func(link netlink.Link, up bool) {
+			require.NoError(t, netlink.LinkAdd(link))
+			if up {
+				require.NoError(t, netlink.LinkSetUp(link))
+			}
+		}
+		interfaceByName := func(name string) net.Interface {
+			iface, err := net.InterfaceByName(name)
+			require.NoError(t, err)
+			return *iface
+		}
+		addLink(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth-a"}, PeerName: "ut-veth-b"}, true)
+		addLink(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "ut-master"}}, true)
+		addLink(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth-down"}, PeerName: "ut-veth-peer"}, false)
+
+		// the peer in another netns
+		peer, err := GetVethPeerLink(interfaceByName("veth0"))
+		require.NoError(t, err)
+		assert.Equal(t, "veth1", peer.Attrs().Name)
+		assert.Equal(t, env.Link2.Attrs().Index, peer.Attrs().Index)
+
+		// the peer in the same netns
+		peer, err = GetVethPeerLink(interfaceByName("ut-veth-a"))
+		require.NoError(t, err)
+		assert.Equal(t, "ut-veth-b", peer.Attrs().Name)
+
+		_, err = GetVethPeerLink(interfaceByName("ut-master"))
+		assert.ErrorIs(t, err, ErrNotLinkPair)
+		_, err = GetVethPeerLink(interfaceByName("lo"))
+		assert.ErrorIs(t, err, ErrNotLinkPair)
+		_, err = GetVethPeerLink(interfaceByName("ut-veth-down"))
+		assert.ErrorContains(t, err, "not up")
+
+		master, err := netlink.LinkByName("ut-master")
+		require.NoError(t, err)
+		ipvlan := &netlink.IPVlan{LinkAttrs: netlink.LinkAttrs{Name: "ut-ipvlan", ParentIndex: master.Attrs().Index}, Mode: netlink.IPVLAN_MODE_L2}
+		err = netlink.LinkAdd(ipvlan)
+		if errors.Is(err, unix.EOPNOTSUPP) {
+			t.Log("ipvlan is not supported by the kernel")
+			return nil
+		}
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetUp(ipvlan))
+		peer, err = GetVethPeerLink(interfaceByName("ut-ipvlan"))
+		require.NoError(t, err)
+		assert.Equal(t, "ut-master", peer.Attrs().Name)
+		return nil
+	}))
+}
+
+func TestGetAllVethPairs(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	peerNetns := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), env.PeerNs.Fd())
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(GetLinkNamespace, func(link netlink.Link) (string, error) {
+		return peerNetns, nil
+	})
+
+	require.NoError(t, env.Do(func() error {
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth-a"}, PeerName: "ut-veth-b"}))
+		require.NoError(t, netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "ut-br"}}))
+
+		names := func(pairs []VethPair) map[string]string {
+			res := make(map[string]string)
+			for _, p := range pairs {
+				res[p.Link.Attrs().Name] = p.Peer.Attrs().Name + "@" + p.PeerNetns
+			}
+			return res
+		}
+		pairs, err := GetAllVethPairs()
+		require.NoError(t, err)
+		// the pair in the netns is once, whichever end comes first
+		got := names(pairs)
+		assert.Len(t, got, 2)
+		assert.Equal(t, "veth1@"+peerNetns, got["veth0"])
+		if _, ok := got["ut-veth-a"]; ok {
+			assert.Equal(t, "ut-veth-b@", got["ut-veth-a"])
+		} else {
+			assert.Equal(t, "ut-veth-a@", got["ut-veth-b"])
+		}
+		for _, p := range pairs {
+			if p.Link.Attrs().Name == "veth0" {
+				assert.Equal(t, env.Link2.Attrs().Index, p.Peer.Attrs().Index)
+			}
+		}
+
+		// the veths of unknown peers are skipped
+		patches.ApplyFunc(netlink.VethPeerIndex, func(link *netlink.Veth) (index int, err error) {
+			if link.Name == "veth0" {
+				return -1, errors.New("no peer")
+			}
+			patches.Origin(func() {
+				index, err = netlink.VethPeerIndex(link)
+			})
+			return index, err
+		})
+		pairs, err = GetAllVethPairs()
+		require.NoError(t, err)
+		require.Len(t, pairs, 1)
+		assert.Contains(t, []string{"ut-veth-a", "ut-veth-b"}, pairs[0].Link.Attrs().Name)
+		return nil
+	}))
+}
+
+func newTestIPSet(t *testing.T) (IPSetBPFMap, *ebpf.Map) {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.LPMTrie,
+		KeySize:    ipSetKeySize,
+		ValueSize:  1,
+		MaxEntries: 64,
+		Flags:      unix.BPF_F_NO_PREALLOC,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		m.Close()
+	})
+	return IPSetBPFMap{MapFD: m.FD()}, m
+}
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	_, cidr, err := net.ParseCIDR(s)
+	require.NoError(t, err)
+	return cidr
+}
+
+// ipSetEntries returns the cidrs of m sorted
+func ipSetEntries(t *testing.T, m *ebpf.Map) []string {
+	var res []string
+	var key, value []byte
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		res = append(res, ipSetCIDR(key).String())
+	}
+	require.NoError(t, iter.Err())
+	slices.Sort(res)
+	return res
+}
+
+func TestAddrsContainIPs(t *testing.T) {
+	ipNet := func(cidr string) net.Addr {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ipNet.IP = ip
+		return ipNet
+	}
+	tests := []struct {
+		name  string
+		addrs []net.Addr
+		ips   []string
+		want  bool
+	}{
+		{name: "ipv4", addrs: []net.Addr{ipNet("10.244.1.5/24")}, ips: []string{"10.244.1.5"}, want: true},
+		{name: "ipv4 no match", addrs: []net.Addr{ipNet("10.244.1.5/24")}, ips: []string{"10.244.1.6"}},
+		{name: "ipv6 link-local", addrs: []net.Addr{ipNet("fe80::1/64")}, ips: []string{"fe80::1"}, want: true},
+		{name: "ipv6 link-local with zone", addrs: []net.Addr{ipNet("fe80::1/64")}, ips: []string{"fe80::1%eth0"}, want: true},
+		{name: "ipv6 link-local ipaddr with zone", addrs: []net.Addr{&net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}}, ips: []string{"fe80::1"}, want: true},
+		{name: "ipv6 link-local zones", addrs: []net.Addr{&net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}}, ips: []string{"fe80::1%eth0"}, want: true},
+		{name: "ipv6 link-local no match", addrs: []net.Addr{ipNet("fe80::1/64")}, ips: []string{"fe80::2%eth0"}},
+		{name: "ipv6 global", addrs: []net.Addr{ipNet("10.1.2.3/16"), ipNet("fd00:10:244::5/64")}, ips: []string{"fd00:10:244::5"}, want: true},
+		{name: "invalid ip", addrs: []net.Addr{ipNet("10.244.1.5/24")}, ips: []string{"%eth0", "not-an-ip"}},
+		{name: "no ips", addrs: []net.Addr{ipNet("10.244.1.5/24")}},
+		{name: "no addresses", ips: []string{"10.244.1.5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, addrsContainIPs(tt.addrs, tt.ips))
+		})
+	}
+}
+
+func TestNormalizeAddrs(t *testing.T) {
+	ipNet := func(cidr string) net.Addr {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ipNet.IP = ip
+		return ipNet
+	}
+	tests := []struct {
+		name  string
+		addrs []net.Addr
+		want  []net.IP
+	}{
+		{
+			name:  "ipnet and ipaddr",
+			addrs: []net.Addr{ipNet("10.244.1.5/24"), &net.IPAddr{IP: net.ParseIP("fd00:10:244::5")}},
+			want:  []net.IP{net.ParseIP("10.244.1.5").To4(), net.ParseIP("fd00:10:244::5")},
+		},
+		{
+			name:  "same address in both forms",
+			addrs: []net.Addr{ipNet("10.244.1.5/24"), &net.IPAddr{IP: net.IPv4(10, 244, 1, 5).To4()}},
+			want:  []net.IP{net.ParseIP("10.244.1.5").To4()},
+		},
+		{
+			name:  "ipv4-mapped",
+			addrs: []net.Addr{&net.IPAddr{IP: net.ParseIP("::ffff:10.244.1.5")}, ipNet("10.244.1.5/24")},
+			want:  []net.IP{net.ParseIP("10.244.1.5").To4()},
+		},
+		{
+			name:  "ipv4 before ipv6",
+			addrs: []net.Addr{ipNet("fe80::1/64"), ipNet("10.244.1.5/24"), ipNet("fd00::5/64"), ipNet("10.244.2.5/24")},
+			want:  []net.IP{net.ParseIP("10.244.1.5").To4(), net.ParseIP("10.244.2.5").To4(), net.ParseIP("fe80::1"), net.ParseIP("fd00::5")},
+		},
+		{
+			name:  "link-local zones",
+			addrs: []net.Addr{&net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}, ipNet("fe80::1/64")},
+			want:  []net.IP{net.ParseIP("fe80::1")},
+		},
+		{
+			name:  "invalid",
+			addrs: []net.Addr{&net.UnixAddr{Name: "/run/kmesh.sock"}, &net.IPAddr{IP: net.IP{1, 2, 3}}},
+		},
+		{name: "no addresses"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, normalizeAddrs(tt.addrs))
+		})
+	}
+}
+
+func TestGetInterfaceAddrs(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	require.NoError(t, err)
+	ips, err := GetInterfaceAddrs(*lo)
+	require.NoError(t, err)
+	assert.Contains(t, ips, net.IPv4(127, 0, 0, 1).To4())
+
+	// the addresses are looked up by index, none for a removed interface
+	ips, err = GetInterfaceAddrs(net.Interface{Index: math.MaxInt32, Name: "not-exist"})
+	assert.NoError(t, err)
+	assert.Empty(t, ips)
+}
+
+func TestAddrsInCIDRs(t *testing.T) {
+	addrs := func(cidrs ...string) []net.Addr {
+		var res []net.Addr
+		for _, cidr := range cidrs {
+			ip, ipNet, err := net.ParseCIDR(cidr)
+			require.NoError(t, err)
+			ipNet.IP = ip
+			res = append(res, ipNet)
+		}
+		return res
+	}
+	tests := []struct {
+		name  string
+		addrs []net.Addr
+		cidrs []string
+		want  bool
+	}{
+		{name: "ipv4 in cidr", addrs: addrs("10.244.1.5/24"), cidrs: []string{"10.0.0.0/8"}, want: true},
+		{name: "ipv4 not in cidr", addrs: addrs("192.168.1.5/24"), cidrs: []string{"10.0.0.0/8"}},
+		{name: "ipv4 host cidr", addrs: addrs("10.244.1.5/24"), cidrs: []string{"10.244.1.5/32"}, want: true},
+		{name: "ipv6 in cidr", addrs: addrs("fd00:10:244::5/64"), cidrs: []string{"fd00:10::/32"}, want: true},
+		{name: "ipv6 not in cidr", addrs: addrs("fe80::1/64"), cidrs: []string{"fd00::/8"}},
+		{name: "mixed, ipv6 address matches", addrs: addrs("192.168.1.5/24", "fd00:10:244::5/64"), cidrs: []string{"10.0.0.0/8", "fd00::/8"}, want: true},
+		{name: "mixed, ipv4 address matches", addrs: addrs("10.1.2.3/16", "fe80::1/64"), cidrs: []string{"fd00::/8", "10.0.0.0/8"}, want: true},
+		// an ipv4 address never matches an ipv6 cidr
+		{name: "mixed, no match", addrs: addrs("10.1.2.3/16"), cidrs: []string{"::/0"}},
+		{name: "no cidrs", addrs: addrs("10.1.2.3/16")},
+		{name: "no addresses", cidrs: []string{"0.0.0.0/0"}},
+		{name: "ipaddr", addrs: []net.Addr{&net.IPAddr{IP: net.IPv4(10, 1, 2, 3)}}, cidrs: []string{"10.0.0.0/8"}, want: true},
+		{name: "not an ip", addrs: []net.Addr{&net.UnixAddr{Name: "/run/kmesh.sock", Net: "unix"}}, cidrs: []string{"0.0.0.0/0", "::/0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := parseCIDRs(tt.cidrs)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, addrsInCIDRs(tt.addrs, nets))
+		})
+	}
+}
+
+func TestIfaceContainCIDRs(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	require.NoError(t, err)
+	got, err := IfaceContainCIDRs(*lo, []string{"10.0.0.0/8", "127.0.0.0/8"})
+	require.NoError(t, err)
+	assert.True(t, got)
+	got, err = IfaceContainCIDRs(*lo, []string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	assert.False(t, got)
+
+	_, err = IfaceContainCIDRs(*lo, []string{"127.0.0.0/8", "10.0.0.1"})
+	assert.ErrorContains(t, err, `invalid cidr "10.0.0.1"`)
+	_, err = IfaceContainCIDRs(*lo, []string{"fd00::/129"})
+	assert.ErrorContains(t, err, `invalid cidr "fd00::/129"`)
+}
+
+func TestIPSetKey(t *testing.T) {
+	tests := []struct {
+		cidr    string
+		wantLen uint32
+	}{
+		{cidr: "10.0.0.0/8", wantLen: 104},
+		{cidr: "192.168.1.1/32", wantLen: 128},
+		{cidr: "0.0.0.0/0", wantLen: 96},
+		{cidr: "fd00::/8", wantLen: 8},
+		{cidr: "2001:db8::1/128", wantLen: 128},
+		{cidr: "::/0", wantLen: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			cidr := mustParseCIDR(t, tt.cidr)
+			key, err := ipSetKey(cidr)
+			require.NoError(t, err)
+			require.Len(t, key, ipSetKeySize)
+			assert.Equal(t, tt.wantLen, binary.NativeEndian.Uint32(key))
+			assert.Equal(t, cidr.String(), ipSetCIDR(key).String())
+		})
+	}
+
+	// the host bits are cleared
+	key, err := ipSetKey(&net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(8, 32)})
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.0/8", ipSetCIDR(key).String())
+
+	_, err = ipSetKey(nil)
+	assert.Error(t, err)
+	_, err = ipSetKey(&net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(8, 32)})
+	assert.Error(t, err)
+	_, err = ipSetKey(&net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.IPMask{0xff, 0x00, 0xff}})
+	assert.Error(t, err)
+}
+
+func TestIPSetBPFMap(t *testing.T) {
+	s, m := newTestIPSet(t)
+
+	require.NoError(t, s.AddCIDR(mustParseCIDR(t, "10.0.0.0/8")))
+	require.NoError(t, s.AddCIDR(mustParseCIDR(t, "fd00::/16")))
+	// adding twice is fine
+	require.NoError(t, s.AddCIDR(mustParseCIDR(t, "10.0.0.0/8")))
+	assert.Equal(t, []string{"10.0.0.0/8", "fd00::/16"}, ipSetEntries(t, m))
+
+	tests := []struct {
+		cidr string
+		want bool
+	}{
+		{cidr: "10.0.0.0/8", want: true},
+		{cidr: "10.1.2.3/32", want: true},
+		{cidr: "10.0.0.0/7", want: false},
+		{cidr: "11.0.0.1/32", want: false},
+		{cidr: "fd00:1::/32", want: true},
+		{cidr: "fd01::1/128", want: false},
+		// the ipv4 mapped address of 10.0.0.1 is looked up as ipv4
+		{cidr: "::ffff:10.0.0.1/128", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			ok, err := s.ContainsCIDR(mustParseCIDR(t, tt.cidr))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, ok)
+		})
+	}
+
+	require.NoError(t, s.RemoveCIDR(mustParseCIDR(t, "10.0.0.0/8")))
+	ok, err := s.ContainsCIDR(mustParseCIDR(t, "10.1.2.3/32"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.ErrorIs(t, s.RemoveCIDR(mustParseCIDR(t, "10.0.0.0/8")), ebpf.ErrKeyNotExist)
+
+	// not an lpm trie
+	hash, _ := newTestHashMap(t)
+	assert.ErrorContains(t, IPSetBPFMap{MapFD: hash.FD()}.AddCIDR(mustParseCIDR(t, "10.0.0.0/8")), "is not an lpm trie")
+	assert.Error(t, IPSetBPFMap{MapFD: -1}.AddCIDR(mustParseCIDR(t, "10.0.0.0/8")))
+}
+
+func TestIPSetBPFMapSync(t *testing.T) {
+	s, m := newTestIPSet(t)
+	require.NoError(t, s.AddCIDR(mustParseCIDR(t, "10.0.0.0/8")))
+	require.NoError(t, s.AddCIDR(mustParseCIDR(t, "192.168.0.0/16")))
+	require.NoError(t, s.AddCIDR(mustParseCIDR(t, "fd00::/16")))
+
+	desired := []*net.IPNet{
+		mustParseCIDR(t, "10.0.0.0/8"),
+		mustParseCIDR(t, "172.16.0.0/12"),
+		mustParseCIDR(t, "2001:db8::/32"),
+	}
+	require.NoError(t, s.Sync(desired))
+	assert.Equal(t, []string{"10.0.0.0/8", "172.16.0.0/12", "2001:db8::/32"}, ipSetEntries(t, m))
+
+	// in sync already
+	require.NoError(t, s.Sync(desired))
+	assert.Equal(t, []string{"10.0.0.0/8", "172.16.0.0/12", "2001:db8::/32"}, ipSetEntries(t, m))
+
+	require.NoError(t, s.Sync(nil))
+	assert.Empty(t, ipSetEntries(t, m))
+
+	// nothing is changed if a desired cidr is invalid
+	require.NoError(t, s.AddCIDR(mustParseCIDR(t, "10.0.0.0/8")))
+	assert.Error(t, s.Sync([]*net.IPNet{nil}))
+	assert.Equal(t, []string{"10.0.0.0/8"}, ipSetEntries(t, m))
+}
+
+func TestTCLinkPair(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	prog := newTestSchedClsProg(t, "ut_tc_pair")
+	pair := TCLinkPair{
+		PodLink:  env.Link2,
+		HostLink: env.Link1,
+		PodNetns: fmt.Sprintf("/proc/self/fd/%d", env.PeerNs.Fd()),
+	}
+	numPrograms := func(netns ns.NetNS, link netlink.Link) [2]int {
+		var res [2]int
+		err := netns.Do(func(_ ns.NetNS) error {
+			for i, direction := range []TCDirection{constants.TC_INGRESS, constants.TC_EGRESS} {
+				n, err := GetNumPrograms(link, direction)
+				if err != nil {
+					return err
+				}
+				res[i] = n
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		return res
+	}
+
+	fd := prog.FD()
+	err := env.Do(func() error {
+		return pair.AttachProgramPair(fd, fd, fd, -1)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, [2]int{1, 1}, numPrograms(env.PeerNs, env.Link2))
+	assert.Equal(t, [2]int{1, 0}, numPrograms(env.TestNs, env.Link1))
+
+	require.NoError(t, env.Do(pair.DetachProgramPair))
+	assert.Equal(t, [2]int{0, 0}, numPrograms(env.PeerNs, env.Link2))
+	assert.Equal(t, [2]int{0, 0}, numPrograms(env.TestNs, env.Link1))
+	// nothing left to detach
+	require.NoError(t, env.Do(pair.DetachProgramPair))
+
+	// the pod programs are rolled back when the host attachment fails
+	err = env.Do(func() error {
+		return pair.AttachProgramPair(fd, fd, fd, 1<<20)
+	})
+	assert.ErrorContains(t, err, "failed to attach egress of pair veth1/veth0")
+	assert.Equal(t, [2]int{0, 0}, numPrograms(env.PeerNs, env.Link2))
+	assert.Equal(t, [2]int{0, 0}, numPrograms(env.TestNs, env.Link1))
+
+	assert.Error(t, TCLinkPair{HostLink: env.Link1}.AttachProgramPair(fd, fd, fd, fd))
+}
+
+func TestGetTCFilterBPFProgramInfo(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+
+	loadTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	summaries := map[int]BPFProgramSummary{
+		12: {ID: 12, Name: "tc_ingress", Tag: [8]byte{0xde, 0xad, 0xbe, 0xef}, LoadTime: loadTime, Type: "SchedCLS"},
+		15: {ID: 15, Name: "tc_policy", LoadTime: loadTime.Add(time.Minute), Type: "SchedCLS"},
+	}
+	patches.ApplyFunc(bpfProgramSummary, func(filter *netlink.BpfFilter) (BPFProgramSummary, error) {
+		summary, ok := summaries[filter.Id]
+		if !ok {
+			return BPFProgramSummary{}, unix.ENOENT
+		}
+		return summary, nil
+	})
+	var parents []uint32
+	filters := []netlink.Filter{
+		&netlink.BpfFilter{Id: 15},
+		&netlink.MatchAll{Actions: []netlink.Action{netlink.NewPoliceAction()}},
+		&netlink.BpfFilter{Id: 12},
+	}
+	patches.ApplyFunc(netlink.FilterList, func(_ netlink.Link, parent uint32) ([]netlink.Filter, error) {
+		parents = append(parents, parent)
+		return filters, nil
+	})
+
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth", Index: 1}}
+	got, err := GetTCFilterBPFProgramInfo(link, constants.TC_EGRESS)
+	require.NoError(t, err)
+	assert.Equal(t, []BPFProgramSummary{summaries[15], summaries[12]}, got)
+	assert.Equal(t, []uint32{netlink.HANDLE_MIN_EGRESS}, parents)
+
+	// the program of a filter is gone
+	filters = append(filters, &netlink.BpfFilter{Id: 20})
+	_, err = GetTCFilterBPFProgramInfo(link, constants.TC_EGRESS)
+	assert.ErrorIs(t, err, unix.ENOENT)
+
+	patches.ApplyFunc(netlink.FilterList, func(_ netlink.Link, _ uint32) ([]netlink.Filter, error) {
+		return nil, unix.ENODEV
+	})
+	_, err = GetTCFilterBPFProgramInfo(link, constants.TC_INGRESS)
+	assert.ErrorIs(t, err, unix.ENODEV)
+	_, err = GetTCFilterBPFProgramInfo(link, TCDirection(5))
+	assert.Error(t, err)
+}
+
+func TestGetTCFilterBPFProgramInfoAttached(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	prog := newTestSchedClsProg(t, "ut_tc_inspect")
+	info, err := prog.Info()
+	require.NoError(t, err)
+	id, _ := info.ID()
+
+	var summaries []BPFProgramSummary
+	err = env.Do(func() error {
+		if err := ManageTCProgramByFd(env.Link1, prog.FD(), constants.TC_ATTACH, 0); err != nil {
+			return err
+		}
+		var err error
+		summaries, err = GetTCFilterBPFProgramInfo(env.Link1, constants.TC_INGRESS)
+		return err
+	})
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	assert.Equal(t, uint32(id), summaries[0].ID)
+	assert.Equal(t, "ut_tc_inspect", summaries[0].Name)
+	assert.Equal(t, info.Tag, hex.EncodeToString(summaries[0].Tag[:]))
+	assert.Equal(t, "SchedCLS", summaries[0].Type)
+	assert.WithinDuration(t, time.Now(), summaries[0].LoadTime, time.Minute)
+}
+
+func TestListTCFilters(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	prog := newTestSchedClsProg(t, "ut_tc_list")
+	info, err := prog.Info()
+	require.NoError(t, err)
+	id, _ := info.ID()
+
+	require.NoError(t, env.Do(func() error {
+		// no clsact qdisc yet
+		filters, err := ListTCFilters(env.Link1, constants.TC_INGRESS)
+		require.NoError(t, err)
+		assert.Empty(t, filters)
+
+		require.NoError(t, ManageTCProgramByFd(env.Link1, prog.FD(), constants.TC_ATTACH, 0))
+		filters, err = ListTCFilters(env.Link1, constants.TC_INGRESS)
+		require.NoError(t, err)
+		require.Len(t, filters, 1)
+		filter, ok := filters[0].(*netlink.BpfFilter)
+		require.True(t, ok, "filter is %T", filters[0])
+		assert.Equal(t, int(id), filter.Id)
+		assert.Equal(t, uint16(1), filter.Priority)
+		assert.Equal(t, uint32(1), filter.Handle)
+		assert.Equal(t, uint32(netlink.HANDLE_MIN_INGRESS), filter.Parent)
+
+		filters, err = ListTCFilters(env.Link1, constants.TC_EGRESS)
+		require.NoError(t, err)
+		assert.Empty(t, filters)
+
+		require.NoError(t, ManageTCProgramByFd(env.Link1, prog.FD(), constants.TC_DETACH, 0))
+		filters, err = ListTCFilters(env.Link1, constants.TC_INGRESS)
+		require.NoError(t, err)
+		assert.Empty(t, filters)
+
+		_, err = ListTCFilters(env.Link1, TCDirection(5))
+		assert.ErrorContains(t, err, "invalid tc direction 5")
+		return nil
+	}))
+}
+
+func TestManageTCProgramByFdPriority(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	progID := func(prog *ebpf.Program) int {
+		info, err := prog.Info()
+		require.NoError(t, err)
+		id, _ := info.ID()
+		return int(id)
+	}
+	late := newTestSchedClsProg(t, "ut_tc_prio_late")
+	early := newTestSchedClsProg(t, "ut_tc_prio_early")
+
+	require.NoError(t, env.Do(func() error {
+		require.NoError(t, ManageTCProgramByFd(env.Link1, late.FD(), constants.TC_ATTACH, 10))
+		require.NoError(t, ManageTCProgramByFd(env.Link1, early.FD(), constants.TC_ATTACH, 5))
+
+		// the kernel lists the filters in the order they run
+		filters, err := ListTCFilters(env.Link1, constants.TC_INGRESS)
+		require.NoError(t, err)
+		require.Len(t, filters, 2)
+		assert.Equal(t, uint16(5), filters[0].Attrs().Priority)
+		assert.Equal(t, progID(early), filters[0].(*netlink.BpfFilter).Id)
+		assert.Equal(t, uint16(10), filters[1].Attrs().Priority)
+		assert.Equal(t, progID(late), filters[1].(*netlink.BpfFilter).Id)
+
+		// the detach removes the filter of its priority only
+		require.NoError(t, ManageTCProgramByFd(env.Link1, early.FD(), constants.TC_DETACH, 5))
+		filters, err = ListTCFilters(env.Link1, constants.TC_INGRESS)
+		require.NoError(t, err)
+		require.Len(t, filters, 1)
+		assert.Equal(t, uint16(10), filters[0].Attrs().Priority)
+
+		// 0 is the default priority
+		require.NoError(t, ManageTCProgramByFd(env.Link1, early.FD(), constants.TC_ATTACH, 0))
+		filters, err = ListTCFilters(env.Link1, constants.TC_INGRESS)
+		require.NoError(t, err)
+		require.Len(t, filters, 2)
+		assert.Equal(t, uint16(DefaultTCFilterPriority), filters[0].Attrs().Priority)
+		return nil
+	}))
+}
+
+func TestBTFMapSpecs(t *testing.T) {
+	u32 := &btf.Int{Name: "__u32", Size: 4}
+	value := &btf.Struct{Name: "ut_value", Size: 16, Members: []btf.Member{
+		{Name: "a", Type: &btf.Int{Name: "__u64", Size: 8}},
+		{Name: "b", Type: &btf.Int{Name: "__u64", Size: 8}, Offset: 64},
+	}}
+	uintArray := func(n uint32) *btf.Pointer {
+		return &btf.Pointer{Target: &btf.Array{Index: u32, Type: &btf.Int{Name: "int", Size: 4}, Nelems: n}}
+	}
+	typed := &btf.Var{Name: "ut_typed", Linkage: btf.GlobalVar, Type: &btf.Struct{Size: 24, Members: []btf.Member{
+		{Name: "type", Type: uintArray(1)},
+		{Name: "key", Type: &btf.Pointer{Target: u32}, Offset: 64},
+		{Name: "value", Type: &btf.Pointer{Target: value}, Offset: 128},
+	}}}
+	sized := &btf.Var{Name: "ut_sized", Linkage: btf.GlobalVar, Type: &btf.Struct{Size: 24, Members: []btf.Member{
+		{Name: "type", Type: uintArray(2)},
+		{Name: "key_size", Type: uintArray(8), Offset: 64},
+		{Name: "value_size", Type: uintArray(24), Offset: 128},
+	}}}
+	maps := &btf.Datasec{Name: ".maps", Size: 48, Vars: []btf.VarSecinfo{
+		{Type: typed, Size: 24},
+		{Type: sized, Offset: 24, Size: 24},
+	}}
+
+	loadSpec := func(types ...btf.Type) *btf.Spec {
+		b, err := btf.NewBuilder(types)
+		require.NoError(t, err)
+		raw, err := b.Marshal(nil, nil)
+		require.NoError(t, err)
+		spec, err := btf.LoadSpecFromReader(bytes.NewReader(raw))
+		require.NoError(t, err)
+		return spec
+	}
+
+	got, err := btfMapSpecs(loadSpec(maps))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]MapSpec{
+		"ut_typed": {Name: "ut_typed", KeySize: 4, ValueSize: 16},
+		"ut_sized": {Name: "ut_sized", KeySize: 8, ValueSize: 24},
+	}, got)
+
+	// no map defined
+	got, err = btfMapSpecs(loadSpec(value))
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	checker := TCProgramCompatChecker{RequiredMaps: []MapSpec{
+		{Name: "ut_typed", KeySize: 4, ValueSize: 16},
+		{Name: "ut_sized", KeySize: 4, ValueSize: 24},
+	}}
+	err = checker.checkMaps(map[string]MapSpec{
+		"ut_typed": {Name: "ut_typed", KeySize: 4, ValueSize: 16},
+		"ut_sized": {Name: "ut_sized", KeySize: 8, ValueSize: 24},
+	})
+	var incompatible *ErrIncompatibleBTF
+	require.ErrorAs(t, err, &incompatible)
+	assert.Equal(t, ErrIncompatibleBTF{
+		MapName:           "ut_sized",
+		ExpectedKeySize:   4,
+		ActualKeySize:     8,
+		ExpectedValueSize: 24,
+		ActualValueSize:   24,
+	}, *incompatible)
+	assert.EqualError(t, err, "map ut_sized of key size 8 and value size 24 is incompatible, expect key size 4 and value size 24")
+}
+
+func newTestCompatProg(t *testing.T, keySize, valueSize uint32) *ebpf.Program {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "ut_compat",
+		Type:       ebpf.Hash,
+		KeySize:    keySize,
+		ValueSize:  valueSize,
+		MaxEntries: 1,
+	})
+	require.NoError(t, err)
+	// the program holds a reference of the map
+	defer m.Close()
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type: ebpf.SchedCLS,
+		Name: "ut_compat",
+		Instructions: asm.Instructions{
+			asm.LoadMapPtr(asm.R1, m.FD()),
+			asm.Mov.Imm(asm.R0, 0),
+			asm.Return(),
+		},
+		License: "GPL",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		prog.Close()
+	})
+	return prog
+}
+
+func TestSwapTCProgram(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	link := env.Link1
+	old := newTestCompatProg(t, 4, 8)
+	compatible := newTestCompatProg(t, 4, 8)
+	incompatible := newTestCompatProg(t, 4, 16)
+	checker := &TCProgramCompatChecker{RequiredMaps: []MapSpec{{Name: "ut_compat", KeySize: 4, ValueSize: 8}}}
+
+	require.NoError(t, checker.Check(compatible.FD()))
+	err := checker.Check(incompatible.FD())
+	var incompatibleErr *ErrIncompatibleBTF
+	require.ErrorAs(t, err, &incompatibleErr)
+	assert.Equal(t, uint32(16), incompatibleErr.ActualValueSize)
+	err = TCProgramCompatChecker{RequiredMaps: []MapSpec{{Name: "ut_other", KeySize: 4, ValueSize: 8}}}.Check(compatible.FD())
+	assert.EqualError(t, err, "map ut_other is not defined")
+
+	attachedProgID := func() int {
+		var filters []netlink.Filter
+		err := env.Do(func() error {
+			var err error
+			filters, err = netlink.FilterList(link, netlink.HANDLE_MIN_EGRESS)
+			return err
+		})
+		require.NoError(t, err)
+		require.Len(t, filters, 1)
+		return filters[0].(*netlink.BpfFilter).Id
+	}
+	require.NoError(t, env.Do(func() error {
+		return manageTCProgramByFd(link, old.FD(), constants.TC_EGRESS, constants.TC_ATTACH, 0)
+	}))
+
+	// the attached program is kept
+	err = env.Do(func() error {
+		return SwapTCProgram(link, constants.TC_EGRESS, incompatible.FD(), checker)
+	})
+	assert.ErrorAs(t, err, &incompatibleErr)
+	assert.Equal(t, progID(t, old), attachedProgID())
+
+	require.NoError(t, env.Do(func() error {
+		return SwapTCProgram(link, constants.TC_EGRESS, compatible.FD(), checker)
+	}))
+	assert.Equal(t, progID(t, compatible), attachedProgID())
+	// without checker
+	require.NoError(t, env.Do(func() error {
+		return SwapTCProgram(link, constants.TC_EGRESS, incompatible.FD(), nil)
+	}))
+	assert.Equal(t, progID(t, incompatible), attachedProgID())
+}
+
+func newTestQdisc(qdiscType string, parent uint32, packets, bytes uint64, drops, overlimits uint32) netlink.Qdisc {
+	return &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			Parent: parent,
+			Statistics: &netlink.QdiscStatistics{
+				Basic: &netlink.GnetStatsBasic{Packets: uint32(packets), Bytes: bytes},
+				Queue: &netlink.GnetStatsQueue{Drops: drops, Overlimits: overlimits},
+			},
+		},
+		QdiscType: qdiscType,
+	}
+}
+
+func TestGetClsactStats(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth", Index: 1}}
+	var qdiscs []netlink.Qdisc
+	var qdiscErr error
+	patches.ApplyFunc(netlink.QdiscList, func(_ netlink.Link) ([]netlink.Qdisc, error) {
+		return qdiscs, qdiscErr
+	})
+
+	qdiscs = []netlink.Qdisc{
+		newTestQdisc("fq_codel", netlink.HANDLE_ROOT, 20, 2000, 1, 0),
+		newTestQdisc("clsact", netlink.HANDLE_CLSACT, 10, 1500, 2, 3),
+		// the statistics may be missing
+		&netlink.GenericQdisc{QdiscAttrs: netlink.QdiscAttrs{Parent: netlink.MakeHandle(1, 1)}, QdiscType: "fq"},
+	}
+	stats, err := GetClsactStats(link)
+	require.NoError(t, err)
+	assert.Equal(t, &ClsactStats{
+		Ingress: QdiscCounters{Packets: 10, Bytes: 1500, Drops: 2, Overlimits: 3},
+		Egress:  QdiscCounters{Packets: 20, Bytes: 2000, Drops: 1},
+	}, stats)
+
+	qdiscs = []netlink.Qdisc{&netlink.GenericQdisc{QdiscAttrs: netlink.QdiscAttrs{Parent: netlink.HANDLE_CLSACT}, QdiscType: "clsact"}}
+	stats, err = GetClsactStats(link)
+	require.NoError(t, err)
+	assert.Equal(t, &ClsactStats{}, stats)
+
+	qdiscs = qdiscs[:0]
+	_, err = GetClsactStats(link)
+	assert.ErrorIs(t, err, unix.ENOENT)
+
+	qdiscErr = unix.ENODEV
+	_, err = GetClsactStats(link)
+	assert.ErrorIs(t, err, unix.ENODEV)
+}
+
+// TestClsactStatsAttachNoDrop verifies that the packets of a link are not dropped by
+// attaching a passing program to both its directions
+func TestClsactStatsAttachNoDrop(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	prog := newTestSchedClsProg(t, "ut_tc_nodrop")
+	getStats := func() *ClsactStats {
+		var stats *ClsactStats
+		err := env.Do(func() error {
+			var err error
+			stats, err = GetClsactStats(env.Link1)
+			return err
+		})
+		require.NoError(t, err)
+		return stats
+	}
+	send := func(netns ns.NetNS, to net.IP, n int) {
+		err := netns.Do(func(_ ns.NetNS) error {
+			// not connected, so that the port unreachable replies do not fail the writes
+			conn, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			for range n {
+				if _, err := conn.WriteToUDP(make([]byte, 64), &net.UDPAddr{IP: to, Port: 9}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	err := env.Do(func() error {
+		for _, direction := range []TCDirection{constants.TC_INGRESS, constants.TC_EGRESS} {
+			if err := manageTCProgramByFd(env.Link1, prog.FD(), direction, constants.TC_ATTACH, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	before := getStats()
+	send(env.PeerNs, env.IP1.IP, 20)
+	send(env.TestNs, env.IP2.IP, 20)
+	after := getStats()
+	assert.GreaterOrEqual(t, after.Ingress.Packets-before.Ingress.Packets, uint64(40))
+	assert.Equal(t, before.Ingress.Drops, after.Ingress.Drops)
+	assert.Equal(t, before.Egress.Drops, after.Egress.Drops)
+}
+
+func TestWaitForQdiscReady(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth", Index: 1}}
+	clsact := func(handle uint32) netlink.Qdisc {
+		return &netlink.GenericQdisc{
+			QdiscAttrs: netlink.QdiscAttrs{Parent: netlink.HANDLE_CLSACT, Handle: handle},
+			QdiscType:  "clsact",
+		}
+	}
+
+	// the clsact qdisc appears, then gets its handle
+	lists := 0
+	patches.ApplyFunc(netlink.QdiscList, func(_ netlink.Link) ([]netlink.Qdisc, error) {
+		lists++
+		switch {
+		case lists < 3:
+			return []netlink.Qdisc{newTestQdisc("noqueue", netlink.HANDLE_ROOT, 0, 0, 0, 0)}, nil
+		case lists < 5:
+			return []netlink.Qdisc{clsact(0)}, nil
+		default:
+			return []netlink.Qdisc{clsact(netlink.HANDLE_CLSACT & 0xffff0000)}, nil
+		}
+	})
+	// a patch not applied fails fast instead of waiting for the test timeout
+	readyCtx, readyCancel := context.WithTimeout(context.TODO(), time.Second)
+	defer readyCancel()
+	require.NoError(t, WaitForQdiscReady(readyCtx, link))
+	assert.Equal(t, 5, lists)
+
+	// never ready
+	patches.ApplyFunc(netlink.QdiscList, func(_ netlink.Link) ([]netlink.Qdisc, error) {
+		return []netlink.Qdisc{clsact(0)}, nil
+	})
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	err := WaitForQdiscReady(ctx, link)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "clsact qdisc of interface ut-veth is not ready")
+
+	patches.ApplyFunc(netlink.QdiscList, func(_ netlink.Link) ([]netlink.Qdisc, error) {
+		return nil, unix.ENODEV
+	})
+	assert.ErrorIs(t, WaitForQdiscReady(readyCtx, link), unix.ENODEV)
+}
+
+func TestWaitForQdiscReadyAttached(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	prog := newTestSchedClsProg(t, "ut_qdisc_ready")
+	require.NoError(t, env.Do(func() error {
+		ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, WaitForQdiscReady(ctx, env.Link1), context.DeadlineExceeded)
+
+		// the attach waits for the qdisc it adds
+		require.NoError(t, ManageTCProgramByFd(env.Link1, prog.FD(), constants.TC_ATTACH, 0))
+		readyCtx, readyCancel := context.WithTimeout(context.TODO(), time.Second)
+		defer readyCancel()
+		return WaitForQdiscReady(readyCtx, env.Link1)
+	}))
+}
+
+func TestReplaceQdiscIfChanged(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	replaces := 0
+	patches.ApplyFunc(netlink.QdiscReplace, func(qdisc netlink.Qdisc) (err error) {
+		replaces++
+		patches.Origin(func() {
+			err = netlink.QdiscReplace(qdisc)
+		})
+		return err
+	})
+
+	env := NewTestTCEnvironment(t)
+	prog := newTestSchedClsProg(t, "ut_qdisc_changed")
+	require.NoError(t, env.Do(func() error {
+		changed, err := ReplaceQdiscIfChanged(env.Link1)
+		require.NoError(t, err)
+		assert.True(t, changed)
+		ok, err := hasClsactQdisc(env.Link1)
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		changed, err = ReplaceQdiscIfChanged(env.Link1)
+		require.NoError(t, err)
+		assert.False(t, changed)
+		assert.Equal(t, 1, replaces)
+
+		// the attach keeps the qdisc
+		require.NoError(t, ManageTCProgramByFd(env.Link1, prog.FD(), constants.TC_ATTACH, 0))
+		assert.Equal(t, 1, replaces)
+
+		// the qdisc is added again once removed
+		require.NoError(t, netlink.QdiscDel(&netlink.GenericQdisc{
+			QdiscAttrs: netlink.QdiscAttrs{LinkIndex: env.Link1.Attrs().Index, Parent: netlink.HANDLE_CLSACT},
+			QdiscType:  "clsact",
+		}))
+		changed, err = ReplaceQdiscIfChanged(env.Link1)
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Equal(t, 2, replaces)
+		return nil
+	}))
+
+	patches.ApplyFunc(netlink.QdiscReplace, func(_ netlink.Qdisc) error {
+		return unix.EPERM
+	})
+	env = NewTestTCEnvironment(t)
+	require.NoError(t, env.Do(func() error {
+		changed, err := ReplaceQdiscIfChanged(env.Link1)
+		assert.ErrorIs(t, err, unix.EPERM)
+		assert.False(t, changed)
+		return nil
+	}))
+}
+
+func TestDeleteQdisc(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	prog := newTestSchedClsProg(t, "ut_qdisc_delete")
+	require.NoError(t, env.Do(func() error {
+		assert.ErrorIs(t, DeleteQdisc(env.Link1), ErrQdiscNotFound)
+
+		require.NoError(t, ManageTCProgramByFd(env.Link1, prog.FD(), constants.TC_ATTACH, 0))
+		require.NoError(t, DeleteQdisc(env.Link1))
+		ok, err := hasClsactQdisc(env.Link1)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		// the filters are gone with the qdisc
+		filters, err := ListTCFilters(env.Link1, constants.TC_INGRESS)
+		require.NoError(t, err)
+		assert.Empty(t, filters)
+
+		// deleted again
+		assert.ErrorIs(t, DeleteQdisc(env.Link1), ErrQdiscNotFound)
+		return nil
+	}))
+
+	// the qdisc is deleted between the list and the delete
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(netlink.QdiscList, func(_ netlink.Link) ([]netlink.Qdisc, error) {
+		return []netlink.Qdisc{newTestQdisc("clsact", netlink.HANDLE_CLSACT, 0, 0, 0, 0)}, nil
+	})
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth", Index: 1}}
+	patches.ApplyFunc(netlink.QdiscDel, func(_ netlink.Qdisc) error {
+		return unix.ENOENT
+	})
+	assert.ErrorIs(t, DeleteQdisc(link), ErrQdiscNotFound)
+	patches.ApplyFunc(netlink.QdiscDel, func(_ netlink.Qdisc) error {
+		return unix.EPERM
+	})
+	err := DeleteQdisc(link)
+	assert.ErrorIs(t, err, unix.EPERM)
+	assert.NotErrorIs(t, err, ErrQdiscNotFound)
+}
+
+func TestManageTCProgramByFdLinkTypes(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(netlink.QdiscList, func(_ netlink.Link) ([]netlink.Qdisc, error) {
+		return []netlink.Qdisc{&netlink.GenericQdisc{
+			QdiscAttrs: netlink.QdiscAttrs{Parent: netlink.HANDLE_CLSACT, Handle: netlink.MakeHandle(0xffff, 0)},
+			QdiscType:  "clsact",
+		}}, nil
+	})
+	patches.ApplyFunc(netlink.QdiscReplace, func(_ netlink.Qdisc) error {
+		return nil
+	})
+	var replaced, deleted []netlink.Filter
+	patches.ApplyFunc(netlink.FilterReplace, func(filter netlink.Filter) error {
+		replaced = append(replaced, filter)
+		return nil
+	})
+	patches.ApplyFunc(netlink.FilterDel, func(filter netlink.Filter) error {
+		deleted = append(deleted, filter)
+		return nil
+	})
+
+	prog := newTestSchedClsProg(t, "ut_tc_link_types")
+	tests := []struct {
+		name    string
+		link    netlink.Link
+		wantErr bool
+	}{
+		{name: "veth", link: &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth", Index: 2}}},
+		{name: "bond", link: &netlink.Bond{LinkAttrs: netlink.LinkAttrs{Name: "ut-bond", Index: 3}}},
+		{name: "ipvlan", link: &netlink.IPVlan{LinkAttrs: netlink.LinkAttrs{Name: "ut-ipvlan", Index: 4, ParentIndex: 3}}},
+		{name: "bridge", link: &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "ut-bridge", Index: 5}}},
+		{name: "device", link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "ut-eth", Index: 6, EncapType: "ether"}}},
+		{name: "loopback", link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "lo", Index: 1, Flags: net.FlagLoopback, EncapType: "loopback"}}, wantErr: true},
+		{name: "tun", link: &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: "ut-tun", Index: 7}, Mode: netlink.TUNTAP_MODE_TUN}, wantErr: true},
+		{name: "tap", link: &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: "ut-tap", Index: 8}, Mode: netlink.TUNTAP_MODE_TAP}},
+		{name: "wireguard", link: &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: "ut-wg", Index: 9}}},
+		{name: "dummy", link: &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "ut-dummy", Index: 10}}},
+		{name: "geneve", link: &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: "ut-geneve", Index: 11}}},
+		{name: "gre", link: &netlink.Gretun{LinkAttrs: netlink.LinkAttrs{Name: "ut-gre", Index: 12}}},
+		{name: "vrf", link: &netlink.Vrf{LinkAttrs: netlink.LinkAttrs{Name: "ut-vrf", Index: 13}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replaced, deleted = nil, nil
+			err := manageTCProgramByFd(tt.link, prog.FD(), constants.TC_EGRESS, constants.TC_ATTACH, 0)
+			detachErr := manageTCProgramByFd(tt.link, prog.FD(), constants.TC_EGRESS, constants.TC_DETACH, 0)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrUnsupportedLinkType)
+				assert.ErrorIs(t, detachErr, ErrUnsupportedLinkType)
+				assert.Empty(t, replaced)
+				assert.Empty(t, deleted)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, detachErr)
+			require.Len(t, replaced, 1)
+			filter := replaced[0].(*netlink.BpfFilter)
+			assert.Equal(t, tt.link.Attrs().Index, filter.LinkIndex)
+			assert.Equal(t, uint32(netlink.HANDLE_MIN_EGRESS), filter.Parent)
+			assert.Equal(t, prog.FD(), filter.Fd)
+			assert.Equal(t, "tc_egress-"+tt.link.Attrs().Name, filter.Name)
+			assert.Equal(t, replaced, deleted)
+		})
+	}
+}
+
+func TestManageTCProgramByFdBridge(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	prog := newTestSchedClsProg(t, "ut_tc_bridge")
+	require.NoError(t, env.Do(func() error {
+		require.NoError(t, netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "ut-br"}}))
+		bridge, err := netlink.LinkByName("ut-br")
+		require.NoError(t, err)
+		require.NoError(t, ManageTCProgramByFd(bridge, prog.FD(), constants.TC_ATTACH, 0))
+		n, err := GetNumPrograms(bridge, constants.TC_INGRESS)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		require.NoError(t, ManageTCProgramByFd(bridge, prog.FD(), constants.TC_DETACH, 0))
+
+		require.NoError(t, netlink.LinkAdd(&netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: "ut-tun"}, Mode: netlink.TUNTAP_MODE_TUN}))
+		tun, err := netlink.LinkByName("ut-tun")
+		require.NoError(t, err)
+		assert.ErrorIs(t, ManageTCProgramByFd(tun, prog.FD(), constants.TC_ATTACH, 0), ErrUnsupportedLinkType)
+		lo, err := netlink.LinkByName("lo")
+		require.NoError(t, err)
+		assert.ErrorIs(t, ManageTCProgramByFd(lo, prog.FD(), constants.TC_ATTACH, 0), ErrUnsupportedLinkType)
+		return nil
+	}))
+}
+
+func TestBatchManageTCPrograms(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+
+	var mu sync.Mutex
+	var running, maxRunning int
+	patches.ApplyFunc(manageTCProgramByFd, func(link netlink.Link, tcFd int, _ TCDirection, _ int, _ uint16) error {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if tcFd%2 == 1 {
+			return fmt.Errorf("attach fd %d to %s failed", tcFd, link.Attrs().Name)
+		}
+		return nil
+	})
+
+	var ops []TCOp
+	for i := 0; i < 8; i++ {
+		ops = append(ops, TCOp{
+			Link:      &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: fmt.Sprintf("ut-veth%d", i), Index: i + 1}},
+			Fd:        i,
+			Direction: constants.TC_INGRESS,
+			Mode:      constants.TC_ATTACH,
+		})
+	}
+
+	tests := []struct {
+		name           string
+		opts           []BatchTCOption
+		wantMaxRunning int
+	}{
+		{name: "sequential", wantMaxRunning: 1},
+		{name: "parallel", opts: []BatchTCOption{WithBatchParallelism(4)}, wantMaxRunning: 4},
+		{name: "parallelism above the ops", opts: []BatchTCOption{WithBatchParallelism(100)}, wantMaxRunning: len(ops)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxRunning = 0
+			results := BatchManageTCPrograms(ops, tt.opts...)
+			require.Len(t, results, len(ops))
+			for i, r := range results {
+				assert.Equal(t, ops[i], r.Op)
+				if i%2 == 1 {
+					assert.ErrorContains(t, r.Err, fmt.Sprintf("attach fd %d", i))
+				} else {
+					assert.NoError(t, r.Err)
+				}
+			}
+			assert.Equal(t, []TCOp{ops[1], ops[3], ops[5], ops[7]}, FailedTCOps(results))
+			if tt.wantMaxRunning == 1 {
+				assert.Equal(t, 1, maxRunning)
+			} else {
+				assert.Greater(t, maxRunning, 1)
+				assert.LessOrEqual(t, maxRunning, tt.wantMaxRunning)
+			}
+		})
+	}
+
+	assert.Empty(t, BatchManageTCPrograms(nil, WithBatchParallelism(4)))
+	assert.Empty(t, FailedTCOps(nil))
+}
+
+func TestGetNetnsInode(t *testing.T) {
+	self, err := GetNetnsInode("/proc/self/ns/net")
+	require.NoError(t, err)
+	var stat unix.Stat_t
+	require.NoError(t, unix.Stat("/proc/self/ns/net", &stat))
+	assert.Equal(t, stat.Ino, self)
+
+	if init, err := GetNetnsInode("/proc/1/ns/net"); err != nil {
+		t.Logf("netns of pid 1 not accessible: %v", err)
+	} else {
+		assert.NotZero(t, init)
+	}
+
+	env := NewTestTCEnvironment(t)
+	other, err := GetNetnsInode(fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), env.TestNs.Fd()))
+	require.NoError(t, err)
+	assert.NotEqual(t, self, other)
+
+	_, err = GetNetnsInode(filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorContains(t, err, "failed to stat netns")
+}
+
+// nilAttrsLink is a link without attributes
+type nilAttrsLink struct{ typ string }
+
+func (l nilAttrsLink) Attrs() *netlink.LinkAttrs { return nil }
+func (l nilAttrsLink) Type() string              { return l.typ }
+
+func TestLinkTypePredicates(t *testing.T) {
+	attrs := netlink.LinkAttrs{Name: "ut-link", Index: 2}
+	tests := []struct {
+		name   string
+		link   netlink.Link
+		veth   bool
+		bridge bool
+		ipvlan bool
+		bond   bool
+	}{
+		{name: "veth", link: &netlink.Veth{LinkAttrs: attrs}, veth: true},
+		{name: "bridge", link: &netlink.Bridge{LinkAttrs: attrs}, bridge: true},
+		{name: "ipvlan", link: &netlink.IPVlan{LinkAttrs: attrs}, ipvlan: true},
+		{name: "bond", link: &netlink.Bond{LinkAttrs: attrs}, bond: true},
+		{name: "macvlan", link: &netlink.Macvlan{LinkAttrs: attrs}},
+		{name: "generic veth", link: &netlink.GenericLink{LinkAttrs: attrs, LinkType: "veth"}, veth: true},
+		{name: "nil attrs", link: nilAttrsLink{typ: "veth"}},
+		{name: "nil", link: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.veth, IsVethInterface(tt.link))
+			assert.Equal(t, tt.bridge, IsBridgeInterface(tt.link))
+			assert.Equal(t, tt.ipvlan, IsIPVLANInterface(tt.link))
+			assert.Equal(t, tt.bond, IsBondInterface(tt.link))
+		})
+	}
+}
+
+func TestEnsureTCProgram(t *testing.T) {
+	errReplace := errors.New("replace failed")
+
+	prog := newTestSchedClsProg(t, "ut_ensure_tc")
+	t.Run("attach", func(t *testing.T) {
+		env := NewTestTCEnvironment(t)
+		require.NoError(t, env.Do(func() error {
+			require.NoError(t, EnsureTCProgram(env.Link1, prog.FD(), constants.TC_EGRESS, 0))
+			// idempotent
+			require.NoError(t, EnsureTCProgram(env.Link1, prog.FD(), constants.TC_EGRESS, 0))
+			n, err := GetNumPrograms(env.Link1, constants.TC_EGRESS)
+			require.NoError(t, err)
+			assert.Equal(t, 1, n)
+			return nil
+		}))
+	})
+
+	t.Run("rollback of the qdisc created", func(t *testing.T) {
+		env := NewTestTCEnvironment(t)
+		patches := gomonkey.NewPatches()
+		defer patches.Reset()
+		patches.ApplyFunc(netlink.FilterReplace, func(_ netlink.Filter) error {
+			return errReplace
+		})
+		require.NoError(t, env.Do(func() error {
+			err := EnsureTCProgram(env.Link1, prog.FD(), constants.TC_INGRESS, 0)
+			assert.ErrorIs(t, err, errReplace)
+			ok, err := hasClsactQdisc(env.Link1)
+			require.NoError(t, err)
+			assert.False(t, ok)
+
+			// an invalid direction fails after the qdisc is created
+			err = EnsureTCProgram(env.Link1, prog.FD(), TCDirection(7), 0)
+			assert.Error(t, err)
+			ok, err = hasClsactQdisc(env.Link1)
+			require.NoError(t, err)
+			assert.False(t, ok)
+			return nil
+		}))
+	})
+
+	t.Run("existing qdisc kept", func(t *testing.T) {
+		env := NewTestTCEnvironment(t)
+		require.NoError(t, env.Do(func() error {
+			require.NoError(t, EnsureTCProgram(env.Link1, prog.FD(), constants.TC_INGRESS, 0))
+			patches := gomonkey.NewPatches()
+			defer patches.Reset()
+			patches.ApplyFunc(netlink.FilterReplace, func(_ netlink.Filter) error {
+				return errReplace
+			})
+			err := EnsureTCProgram(env.Link1, prog.FD(), constants.TC_EGRESS, 0)
+			assert.ErrorIs(t, err, errReplace)
+			ok, err := hasClsactQdisc(env.Link1)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			n, err := GetNumPrograms(env.Link1, constants.TC_INGRESS)
+			require.NoError(t, err)
+			assert.Equal(t, 1, n)
+			return nil
+		}))
+	})
+
+	t.Run("unsupported link", func(t *testing.T) {
+		lo := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "lo", Index: 1, Flags: net.FlagLoopback}}
+		assert.ErrorIs(t, EnsureTCProgram(lo, prog.FD(), constants.TC_INGRESS, 0), ErrUnsupportedLinkType)
+	})
+}
+
+func TestIsMultiQueueLink(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(linkDriverName, func(name string) (string, error) {
+		switch name {
+		case "ut-mlx":
+			return "mlx5_core", nil
+		case "ut-e1000":
+			return "e1000", nil
+		}
+		return "", errors.New("no such device")
+	})
+
+	tests := []struct {
+		name string
+		link netlink.Link
+		want bool
+	}{
+		{name: "tx queues", link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "ut-e1000", NumTxQueues: 8}}, want: true},
+		{name: "single tx queue", link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "ut-mlx", NumTxQueues: 1}}},
+		{name: "multi-queue driver", link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "ut-mlx"}}, want: true},
+		{name: "single queue driver", link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "ut-e1000"}}},
+		{name: "unknown driver", link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "ut-missing"}}},
+		// the length of the queue is not their number
+		{name: "tx queue length", link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "ut-e1000", TxQLen: 1000}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsMultiQueueLink(tt.link))
+		})
+	}
+}
+
+func TestReplaceQdiscMQ(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	require.NoError(t, env.Do(func() error {
+		require.NoError(t, netlink.LinkAdd(&netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "ut-mq", NumTxQueues: 4, NumRxQueues: 4},
+			PeerName:  "ut-mq-peer",
+		}))
+		link, err := netlink.LinkByName("ut-mq")
+		require.NoError(t, err)
+		require.True(t, IsMultiQueueLink(link))
+		require.NoError(t, netlink.QdiscAdd(&netlink.GenericQdisc{
+			QdiscAttrs: netlink.QdiscAttrs{LinkIndex: link.Attrs().Index, Handle: netlink.MakeHandle(1, 0), Parent: netlink.HANDLE_ROOT},
+			QdiscType:  "mq",
+		}))
+		qdiscTypes := func() map[string]int {
+			qdiscs, err := netlink.QdiscList(link)
+			require.NoError(t, err)
+			res := make(map[string]int)
+			for _, qdisc := range qdiscs {
+				res[qdisc.Type()]++
+			}
+			return res
+		}
+		before := qdiscTypes()
+		require.Equal(t, 1, before["mq"])
+
+		require.NoError(t, ReplaceQdiscMQ(link))
+		// clsact is added and the mq root is kept with its children
+		after := qdiscTypes()
+		assert.Equal(t, 1, after["clsact"])
+		delete(after, "clsact")
+		assert.Equal(t, before, after)
+		// a second call keeps the qdisc
+		require.NoError(t, ReplaceQdiscMQ(link))
+		assert.Equal(t, 1, qdiscTypes()["clsact"])
+
+		prog := newTestSchedClsProg(t, "ut_tc_mq")
+		require.NoError(t, ManageTCProgramByFd(link, prog.FD(), constants.TC_ATTACH, 0))
+		n, err := GetNumPrograms(link, constants.TC_INGRESS)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		// a single queue link is the same
+		require.NoError(t, ReplaceQdiscMQ(env.Link1))
+		ok, err := hasClsactQdisc(env.Link1)
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		lo, err := netlink.LinkByName("lo")
+		require.NoError(t, err)
+		assert.ErrorIs(t, ReplaceQdiscMQ(lo), ErrUnsupportedLinkType)
+		return nil
+	}))
+}
+
+func TestDetachAllTCPrograms(t *testing.T) {
+	useTestInterfaceAnnotationsMap(t)
+	env := NewTestTCEnvironment(t)
+	prog := newTestSchedClsProg(t, "ut_detach_all")
+	numBpfFilters := func(direction TCDirection) int {
+		n, err := GetNumPrograms(env.Link1, direction)
+		require.NoError(t, err)
+		return n
+	}
+
+	require.NoError(t, env.Do(func() error {
+		// nothing to detach without clsact qdisc
+		require.NoError(t, DetachAllTCPrograms(env.Link1))
+
+		for _, priority := range []uint16{1, 2, 3} {
+			require.NoError(t, manageTCProgramByFd(env.Link1, prog.FD(), constants.TC_INGRESS, constants.TC_ATTACH, priority))
+		}
+		require.NoError(t, manageTCProgramByFd(env.Link1, prog.FD(), constants.TC_EGRESS, constants.TC_ATTACH, 0))
+		// a filter without bpf program is kept
+		require.NoError(t, netlink.FilterReplace(&netlink.U32{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: env.Link1.Attrs().Index,
+				Parent:    netlink.HANDLE_MIN_EGRESS,
+				Priority:  10,
+				Protocol:  unix.ETH_P_ALL,
+			},
+			ClassId: netlink.MakeHandle(1, 1),
+		}))
+		require.Equal(t, 3, numBpfFilters(constants.TC_INGRESS))
+		require.Equal(t, 1, numBpfFilters(constants.TC_EGRESS))
+
+		n, err := detachAllTCPrograms(env.Link1)
+		require.NoError(t, err)
+		assert.Equal(t, 4, n)
+		assert.Zero(t, numBpfFilters(constants.TC_INGRESS))
+		assert.Zero(t, numBpfFilters(constants.TC_EGRESS))
+		filters, err := ListTCFilters(env.Link1, constants.TC_EGRESS)
+		require.NoError(t, err)
+		assert.Len(t, filters, 1)
+
+		// idempotent
+		require.NoError(t, DetachAllTCPrograms(env.Link1))
+
+		// the annotations of the link are cleared
+		require.NoError(t, AnnotateInterface(env.Link1, map[string]string{InterfaceAnnotationPodUID: "uid-1"}))
+		require.NoError(t, DetachAllTCPrograms(env.Link1))
+		annotations, err := ReadInterfaceAnnotations(env.Link1)
+		require.NoError(t, err)
+		assert.Empty(t, annotations)
+		return nil
+	}))
+}
+
+func TestDetachAllTCProgramsErrors(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth", Index: 2}}
+	patches.ApplyFunc(netlink.QdiscList, func(_ netlink.Link) ([]netlink.Qdisc, error) {
+		return []netlink.Qdisc{&netlink.GenericQdisc{QdiscAttrs: netlink.QdiscAttrs{Parent: netlink.HANDLE_CLSACT}, QdiscType: "clsact"}}, nil
+	})
+	errList, errDel := errors.New("list failed"), errors.New("delete failed")
+	patches.ApplyFunc(netlink.FilterList, func(_ netlink.Link, parent uint32) ([]netlink.Filter, error) {
+		if parent == netlink.HANDLE_MIN_INGRESS {
+			return nil, errList
+		}
+		return []netlink.Filter{
+			&netlink.BpfFilter{FilterAttrs: netlink.FilterAttrs{Handle: 1, Priority: 1}},
+			&netlink.BpfFilter{FilterAttrs: netlink.FilterAttrs{Handle: 1, Priority: 2}},
+		}, nil
+	})
+	var deleted []uint16
+	patches.ApplyFunc(netlink.FilterDel, func(filter netlink.Filter) error {
+		if filter.Attrs().Priority == 1 {
+			return errDel
+		}
+		deleted = append(deleted, filter.Attrs().Priority)
+		return nil
+	})
+
+	// all the filters are tried, the errors are joined
+	n, err := detachAllTCPrograms(link)
+	assert.Equal(t, 1, n)
+	assert.ErrorIs(t, err, errList)
+	assert.ErrorIs(t, err, errDel)
+	assert.Equal(t, []uint16{2}, deleted)
+}
+
+func TestGetInterfaceByIndex(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	require.NoError(t, env.Do(func() error {
+		iface, err := GetInterfaceByIndex(env.Link1.Attrs().Index)
+		require.NoError(t, err)
+		assert.Equal(t, "veth0", iface.Name)
+
+		_, err = GetInterfaceByIndex(99999)
+		assert.ErrorIs(t, err, ErrInterfaceNotFound)
+		assert.ErrorContains(t, err, "index 99999")
+
+		_, err = GetInterfaceByIndex(0)
+		assert.ErrorIs(t, err, ErrInterfaceNotFound)
+		return nil
+	}))
+
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(net.InterfaceByIndex, func(_ int) (*net.Interface, error) {
+		return nil, &net.OpError{Op: "route", Net: "ip+net", Err: os.NewSyscallError("netlinkrib", unix.EPERM)}
+	})
+	_, err := GetInterfaceByIndex(3)
+	assert.ErrorIs(t, err, unix.EPERM)
+	assert.NotErrorIs(t, err, ErrInterfaceNotFound)
+	assert.ErrorContains(t, err, "index 3")
+}
+
+func TestValidateTCProgType(t *testing.T) {
+	cls := newTestSchedClsProg(t, "ut_tc_prog_type")
+	assert.NoError(t, ValidateTCProgType(cls.FD()))
+
+	xdp, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.XDP,
+		Name:         "ut_xdp_prog_type",
+		Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, 2), asm.Return()},
+		License:      "GPL",
+	})
+	require.NoError(t, err)
+	defer xdp.Close()
+	err = ValidateTCProgType(xdp.FD())
+	assert.ErrorIs(t, err, ErrWrongBPFProgType)
+	assert.ErrorContains(t, err, "XDP")
+
+	// not a program
+	m, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Array, KeySize: 4, ValueSize: 4, MaxEntries: 1})
+	require.NoError(t, err)
+	defer m.Close()
+	assert.Error(t, ValidateTCProgType(m.FD()))
+	err = ValidateTCProgType(-1)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrWrongBPFProgType)
+
+	// the attach fails before the qdisc is added
+	env := NewTestTCEnvironment(t)
+	require.NoError(t, env.Do(func() error {
+		assert.ErrorIs(t, ManageTCProgramByFd(env.Link1, xdp.FD(), constants.TC_ATTACH, 0), ErrWrongBPFProgType)
+		ok, err := hasClsactQdisc(env.Link1)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		return nil
+	}))
+}
+
+func TestSameNetns(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	testNs := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), env.TestNs.Fd())
+	peerNs := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), env.PeerNs.Fd())
+
+	same, err := SameNetns("/proc/self/ns/net", "/proc/thread-self/ns/net")
+	require.NoError(t, err)
+	assert.True(t, same)
+	same, err = SameNetns(testNs, testNs)
+	require.NoError(t, err)
+	assert.True(t, same)
+	same, err = SameNetns(testNs, peerNs)
+	require.NoError(t, err)
+	assert.False(t, same)
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	_, err = SameNetns(testNs, missing)
+	assert.Error(t, err)
+	_, err = SameNetns(missing, testNs)
+	assert.Error(t, err)
+
+	inode, err := GetNetnsInode(testNs)
+	require.NoError(t, err)
+	changed, err := NetnsChangedSince(testNs, inode)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	changed, err = NetnsChangedSince(peerNs, inode)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	_, err = NetnsChangedSince(missing, inode)
+	assert.Error(t, err)
+}
+
+func TestAllocateTCHandle(t *testing.T) {
+	resetReservations := func() {
+		tcHandleReservations.mu.Lock()
+		defer tcHandleReservations.mu.Unlock()
+		tcHandleReservations.reserved = make(map[tcKey]*tcHandleBitmap)
+	}
+	resetReservations()
+	t.Cleanup(resetReservations)
+
+	env := NewTestTCEnvironment(t)
+	prog := newTestSchedClsProg(t, "ut_tc_handle")
+	addFilter := func(direction TCDirection, handle uint32) error {
+		parent, err := direction.parent()
+		require.NoError(t, err)
+		return netlink.FilterAdd(&netlink.BpfFilter{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: env.Link1.Attrs().Index,
+				Parent:    parent,
+				Handle:    handle,
+				Protocol:  unix.ETH_P_ALL,
+				Priority:  1,
+			},
+			Fd:           prog.FD(),
+			Name:         "ut_tc_handle",
+			DirectAction: true,
+		})
+	}
+
+	require.NoError(t, env.Do(func() error {
+		// no clsact qdisc yet
+		handle, err := AllocateTCHandle(env.Link1, constants.TC_INGRESS)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1), handle)
+
+		require.NoError(t, replaceQdisc(env.Link1))
+		// handle 2 is attached by another component
+		require.NoError(t, addFilter(constants.TC_INGRESS, 2))
+		// handle 4 is reserved for a filter not attached yet
+		require.NoError(t, ReserveTCHandle(env.Link1, constants.TC_INGRESS, 4))
+
+		allocated := []uint32{handle}
+		require.NoError(t, addFilter(constants.TC_INGRESS, handle))
+		for i := 0; i < 5; i++ {
+			handle, err := AllocateTCHandle(env.Link1, constants.TC_INGRESS)
+			require.NoError(t, err)
+			require.NotContains(t, allocated, handle)
+			allocated = append(allocated, handle)
+			// the handles allocated never collide
+			require.NoError(t, addFilter(constants.TC_INGRESS, handle))
+		}
+		assert.Equal(t, []uint32{1, 3, 5, 6, 7, 8}, allocated)
+
+		// an allocated handle not attached yet is not returned again
+		handle, err = AllocateTCHandle(env.Link1, constants.TC_INGRESS)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(9), handle)
+		handle, err = AllocateTCHandle(env.Link1, constants.TC_INGRESS)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(10), handle)
+
+		// the directions are independent
+		handle, err = AllocateTCHandle(env.Link1, constants.TC_EGRESS)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1), handle)
+		return nil
+	}))
+
+	assert.ErrorContains(t, ReserveTCHandle(env.Link1, constants.TC_INGRESS, 4), "reserved already")
+	assert.ErrorContains(t, ReserveTCHandle(env.Link1, constants.TC_INGRESS, 0), "invalid tc handle")
+	assert.ErrorContains(t, ReserveTCHandle(env.Link1, constants.TC_INGRESS, 0x10000), "invalid tc handle")
+
+	// all the handles are used
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	patches.ApplyFunc(netlink.QdiscList, func(_ netlink.Link) ([]netlink.Qdisc, error) {
+		return nil, nil
+	})
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-veth", Index: 9999}}
+	for handle := uint32(minTCHandle); handle < maxTCHandle; handle++ {
+		require.NoError(t, ReserveTCHandle(link, constants.TC_EGRESS, handle))
+	}
+	handle, err := AllocateTCHandle(link, constants.TC_EGRESS)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(maxTCHandle), handle)
+	_, err = AllocateTCHandle(link, constants.TC_EGRESS)
+	assert.ErrorIs(t, err, ErrNoTCHandle)
+}
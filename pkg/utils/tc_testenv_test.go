@@ -0,0 +1,136 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+// TestTCEnvironment is a veth pair for the tests of tc programs, isolated from the host.
+// Link1 is in TestNs and its peer Link2 in PeerNs, both are up with the addresses
+// IP1 and IP2 of the same subnet.
+type TestTCEnvironment struct {
+	TestNs ns.NetNS
+	PeerNs ns.NetNS
+	Link1  netlink.Link
+	Link2  netlink.Link
+	IP1    *net.IPNet
+	IP2    *net.IPNet
+}
+
+// NewTestTCEnvironment creates the netns and the veth pair of the environment, they are
+// removed when t completes. It needs CAP_NET_ADMIN.
+func NewTestTCEnvironment(t testing.TB) *TestTCEnvironment {
+	t.Helper()
+	env := &TestTCEnvironment{
+		IP1: &net.IPNet{IP: net.IPv4(10, 10, 0, 1), Mask: net.CIDRMask(24, 32)},
+		IP2: &net.IPNet{IP: net.IPv4(10, 10, 0, 2), Mask: net.CIDRMask(24, 32)},
+	}
+	var err error
+	env.TestNs, err = ns.TempNetNS()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		env.TestNs.Close()
+	})
+	env.PeerNs, err = ns.TempNetNS()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		env.PeerNs.Close()
+	})
+
+	env.Link1 = setupTestLink(t, env.TestNs, env.IP1, func() error {
+		return netlink.LinkAdd(&netlink.Veth{
+			LinkAttrs:     netlink.LinkAttrs{Name: "veth0"},
+			PeerName:      "veth1",
+			PeerNamespace: netlink.NsFd(int(env.PeerNs.Fd())),
+		})
+	}, "veth0")
+	env.Link2 = setupTestLink(t, env.PeerNs, env.IP2, nil, "veth1")
+	return env
+}
+
+// setupTestLink runs create in netns and brings up the link name created with ip
+func setupTestLink(t testing.TB, netns ns.NetNS, ip *net.IPNet, create func() error, name string) netlink.Link {
+	var link netlink.Link
+	err := netns.Do(func(_ ns.NetNS) error {
+		if create != nil {
+			if err := create(); err != nil {
+				return err
+			}
+		}
+		var err error
+		if link, err = netlink.LinkByName(name); err != nil {
+			return err
+		}
+		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: ip}); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return err
+		}
+		// refresh the state of the link
+		link, err = netlink.LinkByName(name)
+		return err
+	})
+	require.NoError(t, err)
+	return link
+}
+
+// Do runs fn in TestNs, the netns of Link1
+func (e *TestTCEnvironment) Do(fn func() error) error {
+	return e.TestNs.Do(func(_ ns.NetNS) error {
+		return fn()
+	})
+}
+
+func TestNewTestTCEnvironment(t *testing.T) {
+	var env *TestTCEnvironment
+	t.Run("setup", func(t *testing.T) {
+		env = NewTestTCEnvironment(t)
+		assertLink := func(netns ns.NetNS, link netlink.Link, ip string) {
+			err := netns.Do(func(_ ns.NetNS) error {
+				got, err := netlink.LinkByIndex(link.Attrs().Index)
+				require.NoError(t, err)
+				assert.Equal(t, link.Attrs().Name, got.Attrs().Name)
+				assert.NotZero(t, got.Attrs().Flags&net.FlagUp)
+				addrs, err := netlink.AddrList(got, netlink.FAMILY_V4)
+				require.NoError(t, err)
+				require.Len(t, addrs, 1)
+				assert.Equal(t, ip, addrs[0].IPNet.String())
+				return nil
+			})
+			require.NoError(t, err)
+		}
+		assertLink(env.TestNs, env.Link1, "10.10.0.1/24")
+		assertLink(env.PeerNs, env.Link2, "10.10.0.2/24")
+		// the peer is not in the netns of the test
+		err := env.Do(func() error {
+			_, err := netlink.LinkByName(env.Link2.Attrs().Name)
+			return err
+		})
+		assert.Error(t, err)
+	})
+
+	// the netns are removed with the test
+	assert.Error(t, env.Do(func() error { return nil }))
+}
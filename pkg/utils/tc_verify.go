@@ -0,0 +1,175 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+)
+
+// tcVerificationWorkers is the number of attachments verified concurrently
+const tcVerificationWorkers = 8
+
+// TCVerificationDuration observes the duration of the verifications of all the attachments
+var TCVerificationDuration = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "kmesh_tc_verification_duration_seconds",
+		Help:    "Duration of the verification of the tc programs attached by kmesh in seconds.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	},
+)
+
+// VerificationResult is the state of an attachment checked by VerifyAllAttachments. Expected
+// is the id of the program recorded and Actual the id of the program found at its filter,
+// Actual is 0 if the filter is missing.
+type VerificationResult struct {
+	Link      netlink.Link
+	Direction TCDirection
+	Expected  uint32
+	Actual    uint32
+	OK        bool
+}
+
+// VerifyAllAttachments checks that the programs of the registry are still attached, the links
+// are verified concurrently. The paused attachments are skipped, their filter holds the
+// passthrough program. The results are ordered by link index and direction, the errors of
+// the links that could not be verified are joined.
+func (m *TCManager) VerifyAllAttachments() ([]VerificationResult, error) {
+	start := time.Now()
+	defer func() {
+		TCVerificationDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	type job struct {
+		link netlink.Link
+		info TCAttachment
+	}
+	var jobs []job
+	err := m.ForEachLink(func(link netlink.Link, _ TCDirection, info TCAttachment) error {
+		if !info.Paused {
+			jobs = append(jobs, job{link: link, info: info})
+		}
+		return nil
+	}, ContinueOnError())
+
+	results := make([]VerificationResult, len(jobs))
+	errs := make([]error, len(jobs), len(jobs)+1)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(tcVerificationWorkers, len(jobs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i], errs[i] = verifyAttachment(jobs[i].link, jobs[i].info)
+			}
+		}()
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results, errors.Join(append(errs, err)...)
+}
+
+func verifyAttachment(link netlink.Link, info TCAttachment) (VerificationResult, error) {
+	res := VerificationResult{Link: link, Direction: info.Direction, Expected: info.ProgramID}
+	parent, err := info.Direction.parent()
+	if err != nil {
+		return res, err
+	}
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return res, fmt.Errorf("failed to list filter for interface %v: %w", link.Attrs().Name, err)
+	}
+
+	for _, filter := range filters {
+		bpfFilter, ok := filter.(*netlink.BpfFilter)
+		if ok && bpfFilter.Handle == info.Handle && bpfFilter.Priority == info.Priority {
+			res.Actual = uint32(bpfFilter.Id)
+			break
+		}
+	}
+	res.OK = res.Actual != 0 && res.Actual == res.Expected
+	return res, nil
+}
+
+// StartPeriodicVerification verifies the attachments every interval in the background until
+// ctx is done, the programs found missing or replaced are attached again.
+func (m *TCManager) StartPeriodicVerification(ctx context.Context, interval time.Duration) {
+	go m.runPeriodicVerification(ctx, interval)
+}
+
+func (m *TCManager) runPeriodicVerification(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.verifyAndReattach()
+		}
+	}
+}
+
+func (m *TCManager) verifyAndReattach() {
+	results, err := m.VerifyAllAttachments()
+	if err != nil {
+		log.Warnf("failed to verify tc attachments: %v", err)
+	}
+	for _, res := range results {
+		if res.OK {
+			continue
+		}
+		log.Warnf("program %d of interface %v/%s is not attached, found %d, attach it again",
+			res.Expected, res.Link.Attrs().Name, res.Direction, res.Actual)
+		if err := m.reattach(res.Link, res.Direction); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+}
+
+// reattach attaches the program recorded for the link direction again
+func (m *TCManager) reattach(link netlink.Link, direction TCDirection) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.attachments[tcKey{ifIndex: link.Attrs().Index, direction: direction}]
+	if !ok || a.Paused {
+		// detached or paused since verified
+		return nil
+	}
+	parent, err := direction.parent()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = m.filterReplace(link, direction, m.newPolicyProgFilter(link, parent, a.ProgFd, a.ProgramName))
+	m.stats.recordAttach(start, err)
+	if err != nil {
+		return fmt.Errorf("failed to attach %s of interface %v again: %v", a.ProgramName, link.Attrs().Name, err)
+	}
+	return nil
+}
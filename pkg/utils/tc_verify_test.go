@@ -0,0 +1,159 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+func histogramSampleCount(t *testing.T, h prometheus.Histogram) uint64 {
+	var m dto.Metric
+	require.NoError(t, h.Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+// useTestNsNetlink makes the netlink calls used by the verification run in the netns of
+// env, as the workers do not run on the thread of env.Do
+func useTestNsNetlink(t *testing.T, env *TestTCEnvironment) (*netlink.Handle, *gomonkey.Patches) {
+	h, err := netlink.NewHandleAt(netns.NsHandle(env.TestNs.Fd()))
+	require.NoError(t, err)
+	patches := gomonkey.NewPatches()
+	patches.ApplyFunc(netlink.FilterList, h.FilterList)
+	patches.ApplyFunc(netlink.FilterReplace, h.FilterReplace)
+	t.Cleanup(func() {
+		patches.Reset()
+		h.Close()
+	})
+	return h, patches
+}
+
+func TestVerifyAllAttachments(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	link := env.Link1
+	newTestSchedClsProg(t, "ut_tc_verify")
+	other := newTestSchedClsProg(t, "ut_tc_other")
+	h, patches := useTestNsNetlink(t, env)
+
+	m := NewTCManager()
+	for _, direction := range []TCDirection{constants.TC_INGRESS, constants.TC_EGRESS} {
+		policy := TCPolicy{Link: link, Direction: direction, ProgramName: "ut_tc_verify"}
+		require.NoError(t, env.Do(func() error { return m.ApplyPolicy(policy) }))
+	}
+	// the program of an earlier run may be found by name until it is freed
+	id := m.Attachments()[0].ProgramID
+	require.NotZero(t, id)
+	ingress, _ := TCDirection(constants.TC_INGRESS).parent()
+	egress, _ := TCDirection(constants.TC_EGRESS).parent()
+
+	samples := histogramSampleCount(t, TCVerificationDuration)
+	results, err := m.VerifyAllAttachments()
+	require.NoError(t, err)
+	assert.Equal(t, []VerificationResult{
+		{Link: link, Direction: constants.TC_INGRESS, Expected: id, Actual: id, OK: true},
+		{Link: link, Direction: constants.TC_EGRESS, Expected: id, Actual: id, OK: true},
+	}, results)
+	assert.Equal(t, samples+1, histogramSampleCount(t, TCVerificationDuration))
+
+	// the ingress program is removed and the egress one replaced behind the manager
+	require.NoError(t, h.FilterDel(m.newPolicyProgFilter(link, ingress, 0, "ut_tc_verify")))
+	require.NoError(t, h.FilterReplace(m.newPolicyProgFilter(link, egress, other.FD(), "ut_tc_other")))
+	results, err = m.VerifyAllAttachments()
+	require.NoError(t, err)
+	assert.Equal(t, []VerificationResult{
+		{Link: link, Direction: constants.TC_INGRESS, Expected: id},
+		{Link: link, Direction: constants.TC_EGRESS, Expected: id, Actual: uint32(progID(t, other))},
+	}, results)
+
+	attachments := m.GetTCStats().TotalAttachments
+	var buf bytes.Buffer
+	m.WithLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	m.verifyAndReattach()
+	m.WithLogger(nil)
+	// the reattaches are logged as the other netlink operations
+	assert.Equal(t, 2, strings.Count(buf.String(), `"op":"filter replace"`))
+	results, err = m.VerifyAllAttachments()
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.True(t, results[0].OK)
+	assert.True(t, results[1].OK)
+	assert.Equal(t, attachments+2, m.GetTCStats().TotalAttachments)
+
+	// a paused attachment is skipped
+	m.attachments[tcKey{ifIndex: link.Attrs().Index, direction: constants.TC_EGRESS}].Paused = true
+	results, err = m.VerifyAllAttachments()
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, TCDirection(constants.TC_INGRESS), results[0].Direction)
+
+	patches.ApplyFunc(netlink.FilterList, func(_ netlink.Link, _ uint32) ([]netlink.Filter, error) {
+		return nil, unix.ENODEV
+	})
+	results, err = m.VerifyAllAttachments()
+	assert.ErrorIs(t, err, unix.ENODEV)
+	require.Len(t, results, 1)
+	assert.False(t, results[0].OK)
+
+	// nothing to verify
+	results, err = NewTCManager().VerifyAllAttachments()
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func TestStartPeriodicVerification(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	link := env.Link1
+	newTestSchedClsProg(t, "ut_tc_periodic")
+	h, _ := useTestNsNetlink(t, env)
+
+	m := NewTCManager()
+	policy := TCPolicy{Link: link, Direction: constants.TC_INGRESS, ProgramName: "ut_tc_periodic"}
+	require.NoError(t, env.Do(func() error { return m.ApplyPolicy(policy) }))
+	ingress, _ := TCDirection(constants.TC_INGRESS).parent()
+	require.NoError(t, h.FilterDel(m.newPolicyProgFilter(link, ingress, 0, "ut_tc_periodic")))
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan struct{})
+	go func() {
+		m.runPeriodicVerification(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// the program is attached again
+	require.Eventually(t, func() bool {
+		n, err := GetNumPrograms(link, constants.TC_INGRESS)
+		return err == nil && n == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+// xdpFlags are the flags ManageXDPProgramByFd accepts, XDP_FLAGS_REPLACE is not one of them as
+// netlink sends no expected fd, XDP_REPLACE replaces whatever program is attached
+const xdpFlags = unix.XDP_FLAGS_UPDATE_IF_NOEXIST | unix.XDP_FLAGS_MODES
+
+// ManageXDPProgramByFd attaches, replaces or detaches the xdp program of fd on link, with mode
+// XDP_ATTACH, XDP_REPLACE or XDP_DETACH. flags are XDP_FLAGS_SKB_MODE, XDP_FLAGS_DRV_MODE or
+// XDP_FLAGS_HW_MODE, the kernel picks the mode given none, a detach must use the mode of the
+// attach. XDP_ATTACH fails if a program is attached already, XDP_REPLACE does not.
+func ManageXDPProgramByFd(link netlink.Link, fd int, mode int, flags uint32) error {
+	xdp, err := newXDPRequest(fd, mode, flags)
+	if err != nil {
+		return fmt.Errorf("interface %v: %v", link.Attrs().Name, err)
+	}
+	if err := netlink.LinkSetXdpFdWithFlags(link, xdp.Fd, int(xdp.Flags)); err != nil {
+		return fmt.Errorf("failed to set xdp program of interface %v: %w", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// newXDPRequest returns the program fd and the flags of IFLA_XDP for mode, the fd of a
+// detach is -1
+func newXDPRequest(fd int, mode int, flags uint32) (*netlink.LinkXdp, error) {
+	if flags&^xdpFlags != 0 {
+		return nil, fmt.Errorf("invalid xdp flags %#x", flags)
+	}
+	if modes := flags & unix.XDP_FLAGS_MODES; modes&(modes-1) != 0 {
+		return nil, fmt.Errorf("more than one xdp mode in flags %#x", flags)
+	}
+
+	switch mode {
+	case constants.XDP_ATTACH:
+		flags |= unix.XDP_FLAGS_UPDATE_IF_NOEXIST
+	case constants.XDP_REPLACE:
+		if flags&unix.XDP_FLAGS_UPDATE_IF_NOEXIST != 0 {
+			return nil, fmt.Errorf("xdp flags %#x of a replace must not have XDP_FLAGS_UPDATE_IF_NOEXIST", flags)
+		}
+	case constants.XDP_DETACH:
+		return &netlink.LinkXdp{Fd: -1, Flags: flags &^ unix.XDP_FLAGS_UPDATE_IF_NOEXIST}, nil
+	default:
+		return nil, fmt.Errorf("invalid mode in ManageXDPProgramByFd")
+	}
+	if fd < 0 {
+		return nil, fmt.Errorf("invalid xdp program fd %d", fd)
+	}
+	return &netlink.LinkXdp{Fd: fd, Flags: flags}, nil
+}
+
+// xdpModeFlags are the flags of the attach modes reported by the kernel
+var xdpModeFlags = map[uint32]uint32{
+	nl.XDP_ATTACHED_SKB: unix.XDP_FLAGS_SKB_MODE,
+	nl.XDP_ATTACHED_DRV: unix.XDP_FLAGS_DRV_MODE,
+	nl.XDP_ATTACHED_HW:  unix.XDP_FLAGS_HW_MODE,
+}
+
+// detachXDPProgram detaches the xdp program of link in the mode it is attached with and returns
+// the number of detached programs
+func detachXDPProgram(link netlink.Link) (int, error) {
+	// the xdp attributes of link may be those of before the attach
+	current, err := netlink.LinkByIndex(link.Attrs().Index)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get interface %v: %v", link.Attrs().Name, err)
+	}
+	xdp := current.Attrs().Xdp
+	if xdp == nil || !xdp.Attached {
+		return 0, nil
+	}
+	flags, ok := xdpModeFlags[xdp.AttachMode]
+	if !ok {
+		return 0, fmt.Errorf("interface %v has xdp programs of several modes, attach mode %d", link.Attrs().Name, xdp.AttachMode)
+	}
+	if err := ManageXDPProgramByFd(current, -1, constants.XDP_DETACH, flags); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
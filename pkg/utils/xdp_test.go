@@ -0,0 +1,208 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"kmesh.net/kmesh/pkg/constants"
+)
+
+func newTestXDPProg(t *testing.T, name string) *ebpf.Program {
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type: ebpf.XDP,
+		Name: name,
+		Instructions: asm.Instructions{
+			// XDP_PASS
+			asm.Mov.Imm(asm.R0, 2),
+			asm.Return(),
+		},
+		License: "GPL",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		prog.Close()
+	})
+	return prog
+}
+
+func TestNewXDPRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		fd      int
+		mode    int
+		flags   uint32
+		want    *netlink.LinkXdp
+		wantErr string
+	}{
+		{name: "attach", fd: 7, mode: constants.XDP_ATTACH, want: &netlink.LinkXdp{Fd: 7, Flags: unix.XDP_FLAGS_UPDATE_IF_NOEXIST}},
+		{
+			name:  "attach driver mode",
+			fd:    7,
+			mode:  constants.XDP_ATTACH,
+			flags: unix.XDP_FLAGS_DRV_MODE,
+			want:  &netlink.LinkXdp{Fd: 7, Flags: unix.XDP_FLAGS_UPDATE_IF_NOEXIST | unix.XDP_FLAGS_DRV_MODE},
+		},
+		{
+			name:  "attach with update if no exist",
+			fd:    7,
+			mode:  constants.XDP_ATTACH,
+			flags: unix.XDP_FLAGS_UPDATE_IF_NOEXIST | unix.XDP_FLAGS_SKB_MODE,
+			want:  &netlink.LinkXdp{Fd: 7, Flags: unix.XDP_FLAGS_UPDATE_IF_NOEXIST | unix.XDP_FLAGS_SKB_MODE},
+		},
+		{name: "replace", fd: 7, mode: constants.XDP_REPLACE, flags: unix.XDP_FLAGS_SKB_MODE, want: &netlink.LinkXdp{Fd: 7, Flags: unix.XDP_FLAGS_SKB_MODE}},
+		{name: "detach", fd: 7, mode: constants.XDP_DETACH, flags: unix.XDP_FLAGS_HW_MODE, want: &netlink.LinkXdp{Fd: -1, Flags: unix.XDP_FLAGS_HW_MODE}},
+		{
+			name:  "detach drops update if no exist",
+			fd:    -1,
+			mode:  constants.XDP_DETACH,
+			flags: unix.XDP_FLAGS_UPDATE_IF_NOEXIST | unix.XDP_FLAGS_SKB_MODE,
+			want:  &netlink.LinkXdp{Fd: -1, Flags: unix.XDP_FLAGS_SKB_MODE},
+		},
+		{name: "several modes", fd: 7, mode: constants.XDP_ATTACH, flags: unix.XDP_FLAGS_SKB_MODE | unix.XDP_FLAGS_DRV_MODE, wantErr: "more than one xdp mode"},
+		{name: "all modes", fd: 7, mode: constants.XDP_DETACH, flags: unix.XDP_FLAGS_MODES, wantErr: "more than one xdp mode"},
+		{name: "replace flag", fd: 7, mode: constants.XDP_REPLACE, flags: unix.XDP_FLAGS_REPLACE, wantErr: "invalid xdp flags"},
+		{name: "unknown flag", fd: 7, mode: constants.XDP_ATTACH, flags: 1 << 8, wantErr: "invalid xdp flags"},
+		{name: "replace if no exist", fd: 7, mode: constants.XDP_REPLACE, flags: unix.XDP_FLAGS_UPDATE_IF_NOEXIST, wantErr: "must not have"},
+		{name: "attach without fd", fd: -1, mode: constants.XDP_ATTACH, wantErr: "invalid xdp program fd"},
+		{name: "replace without fd", fd: -1, mode: constants.XDP_REPLACE, wantErr: "invalid xdp program fd"},
+		{name: "invalid mode", fd: 7, mode: 3, wantErr: "invalid mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newXDPRequest(tt.fd, tt.mode, tt.flags)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestManageXDPProgramByFdRequest(t *testing.T) {
+	patches := gomonkey.NewPatches()
+	defer patches.Reset()
+	var gotFd, gotFlags int
+	var setErr error
+	patches.ApplyFunc(netlink.LinkSetXdpFdWithFlags, func(_ netlink.Link, fd int, flags int) error {
+		gotFd, gotFlags = fd, flags
+		return setErr
+	})
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ut-xdp", Index: 10}}
+
+	require.NoError(t, ManageXDPProgramByFd(link, 7, constants.XDP_REPLACE, unix.XDP_FLAGS_DRV_MODE))
+	assert.Equal(t, 7, gotFd)
+	assert.Equal(t, unix.XDP_FLAGS_DRV_MODE, gotFlags)
+
+	setErr = unix.EBUSY
+	err := ManageXDPProgramByFd(link, 7, constants.XDP_ATTACH, 0)
+	assert.ErrorIs(t, err, unix.EBUSY)
+	assert.ErrorContains(t, err, "ut-xdp")
+
+	// the invalid requests are not sent
+	gotFd = 0
+	assert.Error(t, ManageXDPProgramByFd(link, 7, constants.XDP_ATTACH, unix.XDP_FLAGS_MODES))
+	assert.Zero(t, gotFd)
+}
+
+func TestManageXDPProgramByFd(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	prog := newTestXDPProg(t, "ut_xdp")
+	other := newTestXDPProg(t, "ut_xdp_other")
+	progID := func(prog *ebpf.Program) uint32 {
+		info, err := prog.Info()
+		require.NoError(t, err)
+		id, _ := info.ID()
+		return uint32(id)
+	}
+	attachedXDP := func() *netlink.LinkXdp {
+		link, err := netlink.LinkByIndex(env.Link1.Attrs().Index)
+		require.NoError(t, err)
+		return link.Attrs().Xdp
+	}
+
+	require.NoError(t, env.Do(func() error {
+		require.NoError(t, ManageXDPProgramByFd(env.Link1, prog.FD(), constants.XDP_ATTACH, unix.XDP_FLAGS_SKB_MODE))
+		assert.Equal(t, progID(prog), attachedXDP().ProgId)
+		// a program is attached already
+		assert.ErrorIs(t, ManageXDPProgramByFd(env.Link1, other.FD(), constants.XDP_ATTACH, unix.XDP_FLAGS_SKB_MODE), unix.EBUSY)
+		require.NoError(t, ManageXDPProgramByFd(env.Link1, other.FD(), constants.XDP_REPLACE, unix.XDP_FLAGS_SKB_MODE))
+		assert.Equal(t, progID(other), attachedXDP().ProgId)
+		require.NoError(t, ManageXDPProgramByFd(env.Link1, -1, constants.XDP_DETACH, unix.XDP_FLAGS_SKB_MODE))
+		assert.False(t, attachedXDP().Attached)
+		return nil
+	}))
+}
+
+func TestDetachAllTCProgramsXDP(t *testing.T) {
+	env := NewTestTCEnvironment(t)
+	tcProg := newTestSchedClsProg(t, "ut_tc_detach_xdp")
+	xdpProg := newTestXDPProg(t, "ut_xdp_detach")
+	xdpAttached := func() bool {
+		link, err := netlink.LinkByIndex(env.Link1.Attrs().Index)
+		require.NoError(t, err)
+		return link.Attrs().Xdp != nil && link.Attrs().Xdp.Attached
+	}
+
+	require.NoError(t, env.Do(func() error {
+		// the xdp program is kept by default
+		require.NoError(t, ManageXDPProgramByFd(env.Link1, xdpProg.FD(), constants.XDP_ATTACH, unix.XDP_FLAGS_DRV_MODE))
+		require.NoError(t, ManageTCProgramByFd(env.Link1, tcProg.FD(), constants.TC_ATTACH, 0))
+		require.NoError(t, DetachAllTCPrograms(env.Link1))
+		assert.True(t, xdpAttached())
+		n, err := GetNumPrograms(env.Link1, constants.TC_INGRESS)
+		require.NoError(t, err)
+		assert.Zero(t, n)
+
+		require.NoError(t, ManageTCProgramByFd(env.Link1, tcProg.FD(), constants.TC_ATTACH, 0))
+		require.NoError(t, DetachAllTCPrograms(env.Link1, DetachXDP))
+		assert.False(t, xdpAttached())
+		n, err = GetNumPrograms(env.Link1, constants.TC_INGRESS)
+		require.NoError(t, err)
+		assert.Zero(t, n)
+
+		// nothing to detach, in the mode of the attach
+		require.NoError(t, DetachAllTCPrograms(env.Link1, DetachXDP))
+		require.NoError(t, ManageXDPProgramByFd(env.Link1, xdpProg.FD(), constants.XDP_ATTACH, unix.XDP_FLAGS_SKB_MODE))
+		require.NoError(t, DetachAllTCPrograms(env.Link1, DetachXDP))
+		assert.False(t, xdpAttached())
+		return nil
+	}))
+
+	// a failed detach of the xdp program is reported
+	require.NoError(t, env.Do(func() error {
+		require.NoError(t, netlink.LinkSetXdpFdWithFlags(env.Link1, xdpProg.FD(), unix.XDP_FLAGS_SKB_MODE))
+		patches := gomonkey.NewPatches()
+		defer patches.Reset()
+		patches.ApplyFunc(netlink.LinkSetXdpFdWithFlags, func(_ netlink.Link, _ int, _ int) error {
+			return errors.New("detach failed")
+		})
+		assert.ErrorContains(t, DetachAllTCPrograms(env.Link1, DetachXDP), "detach failed")
+		return nil
+	}))
+}